@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// errBadSpec is returned by batch for a size spec that doesn't parse.
+var errBadSpec = errors.New("Bad size, expected WIDTHxHEIGHT[,token...] such as 300x200,crop")
+
+// batchUsage describes the batch subcommand's arguments.
+const batchUsage = "Usage: fotomat [flags] batch WIDTHxHEIGHT[,token...] input_directory output_directory"
+
+// batch thumbnails every file in directory in to directory out, using the
+// image flags and a spec of the form 300x200,crop,q80, which accepts the
+// same tokens as the friendly URL grammar.  Files are processed by up to
+// threads workers at once.  Files that aren't images or can't be
+// processed are logged and skipped, and their names are returned.
+func batch(spec, in, out string, threads int) ([]string, error) {
+	c := currentConfig()
+	r, ok := parseFriendlyPath("/" + spec + "/batch")
+	if !ok || r.width > c.maxOutputDimension || r.height > c.maxOutputDimension {
+		return nil, errBadSpec
+	}
+	options := r.options(c)
+
+	files, err := ioutil.ReadDir(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if threads <= 0 {
+		threads = numCPUCores()
+	}
+	pool := thumbnail.NewPool(threads, 1)
+	defer pool.Close()
+
+	// Only hold the originals we're about to process in RAM.
+	active := make(chan bool, threads)
+	failedCh := make(chan string, len(files))
+	wg := sync.WaitGroup{}
+
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		active <- true
+		wg.Add(1)
+		go func(name string) {
+			defer func() { <-active; wg.Done() }()
+
+			outName, err := batchFile(pool, options, in, out, name)
+			if err != nil {
+				log.Printf("Batch: %s: %v", name, err)
+				failedCh <- name
+				return
+			}
+			log.Printf("Batch: %s -> %s", name, outName)
+		}(fi.Name())
+	}
+
+	wg.Wait()
+	close(failedCh)
+
+	failed := []string{}
+	for name := range failedCh {
+		failed = append(failed, name)
+	}
+	sort.Strings(failed)
+
+	return failed, nil
+}
+
+// batchFile thumbnails file name in directory in to directory out, and
+// returns the name it was saved as.  The name is kept if its extension
+// matches the format saved, and otherwise has that format's extension
+// appended.
+func batchFile(pool *thumbnail.Pool, options thumbnail.Options, in, out, name string) (string, error) {
+	// Map the original rather than reading it, to save memory.
+	r, err := pool.ProcessFile(filepath.Join(in, name), options, nil)
+	if err != nil {
+		return "", err
+	}
+	thumb := r.Blob
+
+	if f := format.DetectFormat(thumb); format.ExtensionFormat(name) != f {
+		name += f.Extension()
+	}
+
+	return name, ioutil.WriteFile(filepath.Join(out, name), thumb, 0644)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/die-net/fotomat/format"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	out, err := ioutil.TempDir("", "batch")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(out)
+
+	in, err := ioutil.ReadDir(*localImageDirectory)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	failed, err := batch("100x100,crop", *localImageDirectory, out, 2)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Text, truncated, too small, too big, corrupt header, and
+	// unloadable TIFF files are skipped.  A JPEG with an inconsistent
+	// EXIF size is repaired, and a PNG named .jpg is processed as one.
+	assert.Equal(t, []string{"1px.png", "2page.tif", "2px.tif", "34000px.png", "bad.jpg", "badheader.png", "notimage.txt"}, failed)
+
+	saved, err := ioutil.ReadDir(out)
+	if assert.Nil(t, err) {
+		assert.Equal(t, len(in)-len(failed), len(saved))
+	}
+
+	// Names are kept if the format is unchanged, or get its extension.
+	thumb, err := ioutil.ReadFile(filepath.Join(out, "watermelon.jpg"))
+	if assert.Nil(t, err) {
+		m, err := format.MetadataBytes(thumb)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []int{100, 100}, []int{m.Width, m.Height})
+		}
+	}
+	gifs, err := filepath.Glob(filepath.Join(out, "2px.gif*"))
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(gifs)) {
+		assert.NotEqual(t, format.Gif, format.ExtensionFormat(gifs[0]))
+	}
+	_, err = os.Stat(filepath.Join(out, "mislabeled.jpg.png"))
+	assert.Nil(t, err)
+
+	_, err = batch("100by100", *localImageDirectory, out, 2)
+	assert.Equal(t, errBadSpec, err)
+}
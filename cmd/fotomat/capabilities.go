@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"net/http"
+	"strconv"
+)
+
+// capabilitiesHandler reports which image formats this build can load and
+// save, so clients know what they can request.
+func capabilitiesHandler(w http.ResponseWriter, req *http.Request) {
+	j, err := json.Marshal(format.DetectCapabilities())
+	if err != nil {
+		thumbnail.WriteError(w, http.StatusInternalServerError, thumbnail.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(j)))
+	_, _ = w.Write(j)
+}
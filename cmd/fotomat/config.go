@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/die-net/fotomat/format"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	configFile = flag.String("config_file", "", "File of reloadable flags, one name=value per line, read at startup and again on SIGHUP (\"\"=disable).")
+	quality    = flag.Int("quality", format.DefaultQuality, "Default JPEG or WebP quality (1-100).")
+)
+
+// reloadableFlags are the flags that a config file may set, since they
+// are only read through a config.
+var reloadableFlags = map[string]bool{
+	"cmyk_profile":            true,
+	"exif_gps":                true,
+	"fast_resize":             true,
+	"immutable_path":          true,
+	"keep_copyright":          true,
+	"linear_processing":       true,
+	"lossless":                true,
+	"lossless_webp":           true,
+	"lossy_if_photo":          true,
+	"max_age":                 true,
+	"max_aspect_ratio":        true,
+	"max_buffer_pixels":       true,
+	"max_megapixels":          true,
+	"max_memory":              true,
+	"max_output_dimension":    true,
+	"max_processing_duration": true,
+	"max_queue_duration":      true,
+	"min_input_dimension":     true,
+	"pass_through":            true,
+	"quality":                 true,
+	"repair_headers":          true,
+	"rgb_profile":             true,
+	"sharpen":                 true,
+	"sharpen_before_resize":   true,
+	"stale_while_revalidate":  true,
+}
+
+// config is an immutable snapshot of the reloadable flags.  Each request
+// uses the config that was active when it arrived, even if a reload swaps
+// in another before it finishes.
+type config struct {
+	exifGPS               bool
+	fastResize            bool
+	keepCopyright         bool
+	linearProcessing      bool
+	lossless              bool
+	losslessWebp          bool
+	lossyIfPhoto          bool
+	passThrough           bool
+	repairHeaders         bool
+	sharpen               bool
+	sharpenBeforeResize   bool
+	maxAspectRatio        float64
+	maxMegapixels         float64
+	maxBufferPixels       int
+	maxMemory             int64
+	maxOutputDimension    int
+	minInputDimension     int
+	quality               int
+	maxAge                time.Duration
+	maxProcessingDuration time.Duration
+	maxQueueDuration      time.Duration
+	staleWhileRevalidate  time.Duration
+	cmykProfile           string
+	rgbProfile            string
+	matchImmutable        *regexp.Regexp
+}
+
+var (
+	activeConfig atomic.Value // *config
+	configMu     sync.Mutex   // Serializes loading and reloading.
+)
+
+// currentConfig returns the active config, creating it from the flags if
+// none has been loaded yet.
+func currentConfig() *config {
+	if c, ok := activeConfig.Load().(*config); ok {
+		return c
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	if c, ok := activeConfig.Load().(*config); ok {
+		return c
+	}
+	c, err := newConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	activeConfig.Store(c)
+	return c
+}
+
+// newConfig snapshots the reloadable flags.
+func newConfig() (*config, error) {
+	if *quality < 1 || *quality > 100 {
+		return nil, fmt.Errorf("Bad quality: %d", *quality)
+	}
+	if *maxMegapixels < 0 {
+		return nil, fmt.Errorf("Bad max_megapixels: %g", *maxMegapixels)
+	}
+
+	c := &config{
+		exifGPS:               *exifGPS,
+		fastResize:            *fastResize,
+		keepCopyright:         *keepCopyright,
+		linearProcessing:      *linearProcessing,
+		lossless:              *lossless,
+		losslessWebp:          *losslessWebp,
+		lossyIfPhoto:          *lossyIfPhoto,
+		passThrough:           *passThrough,
+		repairHeaders:         *repairHeaders,
+		sharpen:               *sharpen,
+		sharpenBeforeResize:   *sharpenBeforeResize,
+		maxAspectRatio:        *maxAspectRatio,
+		maxMegapixels:         *maxMegapixels,
+		maxBufferPixels:       *maxBufferPixels,
+		maxMemory:             *maxMemory,
+		maxOutputDimension:    *maxOutputDimension,
+		minInputDimension:     *minInputDimension,
+		quality:               *quality,
+		maxAge:                *maxAge,
+		maxProcessingDuration: *maxProcessingDuration,
+		maxQueueDuration:      *maxQueueDuration,
+		staleWhileRevalidate:  *staleWhileRevalidate,
+		cmykProfile:           *cmykProfile,
+		rgbProfile:            *rgbProfile,
+	}
+
+	for name, filename := range map[string]string{"cmyk_profile": c.cmykProfile, "rgb_profile": c.rgbProfile} {
+		if filename != "" {
+			if _, err := os.Stat(filename); err != nil {
+				return nil, fmt.Errorf("Bad %s: %v", name, err)
+			}
+		}
+	}
+
+	if *immutablePath != "" {
+		var err error
+		if c.matchImmutable, err = regexp.Compile(*immutablePath); err != nil {
+			return nil, fmt.Errorf("Bad immutable_path: %v", err)
+		}
+	}
+
+	return c, nil
+}
+
+// loadConfig sets the flags in configFile, if any, and makes a snapshot
+// of them the active config.  On error, the active config is unchanged,
+// though flags set before the error keep their new values until the next
+// successful load.
+func loadConfig() error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	if *configFile != "" {
+		if err := setFlagsFromFile(*configFile); err != nil {
+			return err
+		}
+	}
+
+	c, err := newConfig()
+	if err != nil {
+		return err
+	}
+	activeConfig.Store(c)
+
+	return nil
+}
+
+// setFlagsFromFile sets reloadable flags from a file of name=value lines.
+// Blank lines and lines starting with # are ignored, and the name may
+// have leading dashes, as on the command line.
+func setFlagsFromFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(strings.TrimLeft(line, "-"), "=", 2)
+		if len(kv) != 2 || !reloadableFlags[kv[0]] {
+			return fmt.Errorf("%s:%d: not a reloadable name=value flag", filename, n)
+		}
+		if err := flag.Set(kv[0], kv[1]); err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, n, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// reloadOnHangup reloads the config each time the process receives
+// SIGHUP, logging rather than exiting on errors.
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := loadConfig(); err != nil {
+			log.Println("Config reload failed:", err)
+		} else {
+			log.Println("Config reloaded")
+		}
+	}
+}
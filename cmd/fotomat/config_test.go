@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"github.com/die-net/fotomat/format"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestConfigReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "fotomat-config")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.Remove(f.Name())
+
+	defer func() {
+		*configFile = ""
+		assert.Nil(t, flag.Set("quality", strconv.Itoa(format.DefaultQuality)))
+		assert.Nil(t, loadConfig())
+	}()
+
+	old := currentConfig()
+	assert.Equal(t, format.DefaultQuality, old.quality)
+
+	_, err = f.WriteString("# Lower quality to save bandwidth.\n\n-quality=50\n")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	// A simulated reload changes the quality of new requests, but not of
+	// a config already in use.
+	*configFile = f.Name()
+	assert.Nil(t, loadConfig())
+	o, status := direct("/200x300/watermelon.jpg")
+	if assert.Equal(t, 0, status) {
+		assert.Equal(t, 50, o.Save.Quality)
+	}
+	assert.Equal(t, format.DefaultQuality, old.quality)
+
+	// A request's own quality still wins.
+	o, status = direct("/200x300,q80/watermelon.jpg")
+	if assert.Equal(t, 0, status) {
+		assert.Equal(t, 80, o.Save.Quality)
+	}
+
+	// Flags that aren't reloadable, unknown flags, bad values, and
+	// invalid configs are refused, leaving the active config alone.
+	for _, line := range []string{"listen=:1", "zoom=2", "quality", "quality=high", "quality=0", "immutable_path=("} {
+		assert.Nil(t, ioutil.WriteFile(f.Name(), []byte(line+"\n"), 0600))
+		assert.Error(t, loadConfig(), line)
+		assert.Equal(t, 50, currentConfig().quality, line)
+		assert.Nil(t, flag.Set("quality", "50"))
+		assert.Nil(t, flag.Set("immutable_path", ""))
+	}
+}
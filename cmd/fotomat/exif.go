@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	exifGPS    = flag.Bool("exif_gps", false, "Include the GPS location, which may be sensitive, in EXIF JSON responses.")
+	exifPrefix = flag.String("exif_prefix", "", "Path prefix to serve source images' EXIF as JSON under, such as /exif (\"\"=disable).")
+)
+
+// exifHandler serves the EXIF of the source image whose path follows
+// exifPrefix as JSON, without the image itself.  Original images are held
+// in RAM under the same limit as proxy's.
+func exifHandler(proxy *thumbnail.Proxy, up upstream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			thumbnail.WriteError(w, http.StatusMethodNotAllowed, thumbnail.ErrorResponse{})
+			return
+		}
+
+		path := strings.TrimPrefix(req.URL.Path, *exifPrefix)
+		if path == "" || path == "/" {
+			thumbnail.WriteError(w, http.StatusBadRequest, thumbnail.ErrorResponse{})
+			return
+		}
+
+		source := *req.URL
+		setSource(&source, req.Host, path)
+		source.RawQuery = ""
+		blob, ok := up.getOriginal(w, proxy, source.String())
+		if !ok {
+			return
+		}
+
+		e, err := format.ExifBytes(blob)
+		blob = nil      // Free up image memory ASAP.
+		proxy.Release() // Release semaphore ASAP.
+		if err != nil {
+			thumbnail.WriteError(w, http.StatusUnsupportedMediaType, thumbnail.ErrorResponse{Code: "unknown_format", Message: err.Error()})
+			return
+		}
+		if !currentConfig().exifGPS {
+			e.GPS = nil
+		}
+
+		j, err := json.Marshal(e)
+		if err != nil {
+			thumbnail.WriteError(w, http.StatusInternalServerError, thumbnail.ErrorResponse{Message: err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(j)))
+		_, _ = w.Write(j)
+	})
+}
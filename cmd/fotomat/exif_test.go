@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/die-net/fotomat/format"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestExif(t *testing.T) {
+	body, code := fetch("exif/orient6.jpg")
+	if assert.Equal(t, http.StatusOK, code) {
+		e := format.Exif{}
+		if assert.Nil(t, json.Unmarshal(body, &e)) {
+			assert.Equal(t, format.Exif{Orientation: int(format.RightTop)}, e)
+		}
+	}
+
+	assert.Equal(t, http.StatusNotFound, status("exif/notfound.jpg"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, status("exif/notimage.txt"))
+}
@@ -4,31 +4,97 @@ import (
 	"flag"
 	"github.com/die-net/fotomat/format"
 	"github.com/die-net/fotomat/thumbnail"
+	"github.com/die-net/fotomat/vips"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var (
-	fastResize            = flag.Bool("fast_resize", false, "Allow faster resizing, at lower image quality in some cases.")
-	fetchTimeout          = flag.Duration("fetch_timeout", 30*time.Second, "How long to wait to receive original image from source (0=disable).")
-	localImageDirectory   = flag.String("local_image_directory", "", "Enable local image serving from this path (\"\"=proxy instead).")
-	lossless              = flag.Bool("lossless", true, "Allow saving as PNG even without transparency.")
-	lossyIfPhoto          = flag.Bool("lossy_if_photo", true, "Save as lossy if image is detected as a photo.")
-	losslessWebp          = flag.Bool("lossless_webp", false, "When saving in WebP, allow lossless encoding.")
-	maxBufferPixels       = flag.Int("max_buffer_pixels", 6500000, "Maximum number of pixels to allocate for an intermediate image buffer.")
-	maxImageThreads       = flag.Int("max_image_threads", numCPUCores(), "Maximum number of threads simultaneously processing images (0=all CPUs).")
-	maxOutputDimension    = flag.Int("max_output_dimension", 2048, "Maximum width or height of an image response.")
-	maxPrefetch           = flag.Int("max_prefetch", numCPUCores(), "Maximum number of images to prefetch before thread is available.")
-	maxProcessingDuration = flag.Duration("max_processing_duration", time.Minute, "Maximum duration we can be processing an image before assuming we crashed (0=disable).")
-	maxQueueDuration      = flag.Duration("max_queue_duration", 10*time.Second, "Maximum delay of pre-image-fetch queue before returning error (0=disable).")
-	sharpen               = flag.Bool("sharpen", false, "Sharpen after resize.")
-
-	matchPath = regexp.MustCompile(`^(/.*)=(p?)(w?)([sc])(\d{1,5})x(\d{1,5})$`)
+	cmykProfile            = flag.String("cmyk_profile", "", "ICC profile file that CMYK images without one are assumed to be in (\"\"=U.S. Web Coated (SWOP) v2).")
+	digest                 = flag.String("digest", "", "When to send a Digest header with the SHA-256 of each image: \"want\" if the request's Want-Digest asks, or \"always\" (\"\"=never).")
+	fastResize             = flag.Bool("fast_resize", false, "Allow faster resizing, at lower image quality in some cases.")
+	fetchTimeout           = flag.Duration("fetch_timeout", 30*time.Second, "How long to wait to receive original image from source (0=disable).")
+	forwardHeaders         = flag.String("forward_headers", "", "Comma-separated request headers, such as Cookie, to pass on to the upstream image server (\"\"=disable).")
+	immutablePath          = flag.String("immutable_path", "", "Regexp of source paths that never change, such as hashed URLs, to be cached for a year (\"\"=disable).")
+	keepCopyright          = flag.Bool("keep_copyright", false, "Keep the EXIF, XMP, and IPTC metadata of images marked as copyrighted, rather than stripping it.")
+	linearProcessing       = flag.Bool("linear_processing", false, "Resize in linear light, which is slower but more accurate for fine detail.")
+	localImageDirectory    = flag.String("local_image_directory", "", "Enable local image serving from this path (\"\"=proxy instead).")
+	lossless               = flag.Bool("lossless", true, "Allow saving as PNG even without transparency.")
+	lossyIfPhoto           = flag.Bool("lossy_if_photo", true, "Save as lossy if image is detected as a photo.")
+	losslessWebp           = flag.Bool("lossless_webp", false, "When saving in WebP, allow lossless encoding.")
+	maxAge                 = flag.Duration("max_age", 0, "Cache-Control max-age to send with responses (0=use upstream's).")
+	maxAspectRatio         = flag.Float64("max_aspect_ratio", 0, "Maximum ratio of an image's longer side to its shorter side (0=disable).")
+	maxBufferPixels        = flag.Int("max_buffer_pixels", 6500000, "Maximum number of pixels to allocate for an intermediate image buffer.")
+	maxImageThreads        = flag.Int("max_image_threads", numCPUCores(), "Maximum number of threads simultaneously processing images (0=all CPUs).")
+	maxMegapixels          = flag.Float64("max_megapixels", 0, "Maximum area of an image response, in millions of pixels, scaling it down to fit (0=disable).")
+	maxMemory              = flag.Int64("max_memory", 0, "Maximum bytes VIPS may allocate, beyond what it had when an image started processing, before that image fails with a 413 (0=disable).")
+	maxOutputDimension     = flag.Int("max_output_dimension", 2048, "Maximum width or height of an image response.")
+	maxPrefetch            = flag.Int("max_prefetch", numCPUCores(), "Maximum number of images to prefetch before thread is available.")
+	maxProcessingDuration  = flag.Duration("max_processing_duration", time.Minute, "Maximum duration we can be processing an image before assuming we crashed (0=disable).")
+	maxQueueDuration       = flag.Duration("max_queue_duration", 10*time.Second, "Maximum delay of pre-image-fetch queue before returning error (0=disable).")
+	maxSourceBytes         = flag.Int64("max_source_bytes", 0, "Maximum bytes of an original image, beyond which its download is aborted (0=disable).")
+	minInputDimension      = flag.Int("min_input_dimension", 2, "Minimum width or height of an original image, below which it's rejected.")
+	passThrough            = flag.Bool("pass_through", false, "Return the original image unchanged when no resizing or conversion is needed.  Since originals have their metadata, other images keep theirs too.")
+	passThroughUnsupported = flag.Bool("pass_through_unsupported", false, "Return original images in a known format that can't be processed, such as TIFF, unchanged rather than with a 415 error.")
+	placeholderImage       = flag.String("placeholder_image", "", "Image to scale and return when the original can't be fetched or decoded (\"\"=return an error instead).")
+	repairHeaders          = flag.Bool("repair_headers", true, "Process images whose headers are inconsistent but still decodable, such as a JPEG whose EXIF size disagrees with its frame, rather than rejecting them.")
+	rgbProfile             = flag.String("rgb_profile", "", "ICC profile file to convert CMYK images without one to (\"\"=sRGB).")
+	sharpen                = flag.Bool("sharpen", false, "Sharpen after resize.")
+	sharpenBeforeResize    = flag.Bool("sharpen_before_resize", false, "With -sharpen, sharpen the original before resizing it instead, which is slower.")
+	signingKeyFile         = flag.String("signing_key_file", "", "File of the secret key that signs ?nocache=1 and /purge requests (\"\"=reject them).")
+	sourceCacheSize        = flag.Int64("source_cache_size", 0, "Maximum bytes of original images to cache in memory, to avoid refetching them for other sizes (0=disable).")
+	sourceCacheTTL         = flag.Duration("source_cache_ttl", 10*time.Minute, "Maximum time to cache each original image (0=until evicted).")
+	staleWhileRevalidate   = flag.Duration("stale_while_revalidate", 0, "Cache-Control stale-while-revalidate to send with responses (0=disable).")
+	tempDir                = flag.String("temp_dir", "", "Directory for large intermediate images VIPS spills to disk, not used by ffmpeg (\"\"=use $TMPDIR).")
+	tempThreshold          = flag.Int64("temp_threshold", -1, "Size in bytes above which intermediate images are spilled to temp_dir (-1=VIPS default of 100MB, 0=never).")
+	upstreamHeadersFile    = flag.String("upstream_headers_file", "", "File of \"Name: value\" headers, such as Authorization, to send to the upstream image server (\"\"=disable).")
+	userAgent              = flag.String("user_agent", thumbnail.DefaultUserAgent, "User-Agent header to send to the upstream image server.")
+
+	matchPath         = regexp.MustCompile(`^(/.*)=(p?)(w?)([sc])(\d{1,5})x(\d{1,5})$`)
+	matchFriendlyPath = regexp.MustCompile(`^/(\d{1,5})x(\d{1,5})((?:,[^,/]+)*)(/.+)$`)
+	matchQuality      = regexp.MustCompile(`^q(\d{1,3})$`)
 )
 
+// digestPolicies maps the values of the digest flag to DigestPolicy.
+var digestPolicies = map[string]thumbnail.DigestPolicy{
+	"":       thumbnail.NoDigest,
+	"want":   thumbnail.WantDigest,
+	"always": thumbnail.AlwaysDigest,
+}
+
+// outputExtensions maps the extensions that can select an output format
+// to the Format saved.
+var outputExtensions = map[string]format.Format{
+	".jpg":  format.Jpeg,
+	".jpeg": format.Jpeg,
+	".png":  format.Png,
+	".webp": format.Webp,
+}
+
 func handleInit() http.Handler {
+	if *tempDir != "" {
+		if err := vips.SetTempDir(*tempDir); err != nil {
+			log.Fatalln("Bad temp_dir:", err)
+		}
+	}
+	if *tempThreshold >= 0 {
+		if err := vips.SetDiscThreshold(*tempThreshold); err != nil {
+			log.Fatalln("Bad temp_threshold:", err)
+		}
+	}
+
+	if err := thumbnail.Warmup(); err != nil {
+		log.Println("Warmup failed:", err)
+	}
+
 	pool := thumbnail.NewPool(*maxImageThreads, 1)
 
 	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
@@ -38,66 +104,372 @@ func handleInit() http.Handler {
 
 	client := &http.Client{Transport: http.RoundTripper(transport), Timeout: *fetchTimeout}
 
-	return thumbnail.NewProxy(director, pool, *maxPrefetch+*maxImageThreads, client)
+	var signingKey []byte
+	if *signingKeyFile != "" {
+		var err error
+		if signingKey, err = readSigningKey(*signingKeyFile); err != nil || len(signingKey) == 0 {
+			log.Fatalln("Bad signing_key_file:", err)
+		}
+	}
+
+	up := upstream{client: client, userAgent: *userAgent, maxBytes: *maxSourceBytes}
+	if *upstreamHeadersFile != "" {
+		var err error
+		if up.header, err = readHeaderFile(*upstreamHeadersFile); err != nil {
+			log.Fatalln("Bad upstream_headers_file:", err)
+		}
+	}
+
+	if err := loadConfig(); err != nil {
+		log.Fatalln(err)
+	}
+	if *configFile != "" {
+		go reloadOnHangup()
+	}
+
+	proxy := thumbnail.NewProxy(signedDirector(signingKey), pool, *maxPrefetch+*maxImageThreads, client)
+	proxy.CachePolicy = cachePolicy
+	proxy.UserAgent = *userAgent
+	proxy.Header = up.header
+	proxy.ForwardHeaders = headerNames(*forwardHeaders)
+	proxy.Timings = observeTimings
+	proxy.MaxSourceBytes = *maxSourceBytes
+	proxy.PassThroughUnsupported = *passThroughUnsupported
+	var ok bool
+	if proxy.Digest, ok = digestPolicies[*digest]; !ok {
+		log.Fatalln("Bad digest:", *digest)
+	}
+	if *requestLog != "" {
+		var err error
+		if proxy.Log, err = newRequestLogger(*requestLog, os.Stderr); err != nil {
+			log.Fatalln("Bad request_log:", err)
+		}
+	}
+	if *sourceCacheSize > 0 {
+		if len(proxy.ForwardHeaders) > 0 {
+			log.Fatalln("Can't use source_cache_size with forward_headers, which may make originals differ per user.")
+		}
+		if proxy.SourceCache = thumbnail.NewSourceCache(*sourceCacheSize, *sourceCacheTTL); proxy.SourceCache == nil {
+			log.Fatalln("Bad source_cache_ttl:", *sourceCacheTTL)
+		}
+	}
+
+	if *placeholderImage != "" {
+		var err error
+		if proxy.Placeholder, err = ioutil.ReadFile(*placeholderImage); err != nil {
+			log.Fatalln("Can't read placeholder_image:", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/capabilities", capabilitiesHandler)
+	mux.Handle("/purge", purgeHandler(proxy.SourceCache, signingKey))
+	if *iiifPrefix != "" {
+		mux.Handle(*iiifPrefix+"/", iiifHandler(proxy, up))
+	}
+	if *exifPrefix != "" {
+		mux.Handle(*exifPrefix+"/", exifHandler(proxy, up))
+	}
+	if *srcsetPrefix != "" {
+		mux.Handle(*srcsetPrefix+"/", srcsetHandler(proxy, up))
+	}
+	if *validatePath != "" {
+		mux.Handle(*validatePath, validateHandler(proxy, *maxSourceBytes))
+	}
+	if *uploadPath != "" {
+		mux.Handle(*uploadPath, uploadHandler(proxy, pool, *maxSourceBytes))
+	}
+
+	handler := endpoints(mux, proxy)
+	if *rateLimit > 0 {
+		var keys map[string]bool
+		if *rateLimitKeys != "" {
+			var err error
+			if keys, err = readRateLimitKeys(*rateLimitKeys); err != nil {
+				log.Fatalln("Bad rate_limit_keys_file:", err)
+			}
+		}
+		handler = newRateLimiter(handler, *rateLimit, *rateLimitBurst, *rateLimitHeader, keys)
+	}
+
+	return handler
+}
+
+// endpoints serves requests for the paths registered with mux, and passes
+// all other requests on to fallback.
+func endpoints(mux *http.ServeMux, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if h, pattern := mux.Handler(req); pattern != "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		fallback.ServeHTTP(w, req)
+	})
+}
+
+// request is a parsed thumbnail request path.
+type request struct {
+	path       string
+	width      int
+	height     int
+	crop       bool
+	preview    bool
+	webp       bool
+	quality    int
+	region     thumbnail.Rect
+	format     format.Format
+	pad        bool
+	outside    bool
+	bg         thumbnail.Color
+	keepFormat bool
+	video      thumbnail.VideoFormat
+	preset     thumbnail.Preset
 }
 
 func director(req *http.Request) (thumbnail.Options, int) {
-	g := matchPath.FindStringSubmatch(req.URL.Path)
-	if len(g) != 7 {
+	c := currentConfig()
+
+	r, ok := parsePath(req.URL.Path)
+	if !ok {
+		r, ok = parseFriendlyPath(req.URL.Path)
+	}
+	if !ok {
+		r, ok = parseIIIFPath(req.URL.EscapedPath(), c.maxOutputDimension)
+	}
+	if !ok {
 		return thumbnail.Options{}, http.StatusBadRequest
 	}
 
-	if *localImageDirectory != "" {
-		req.URL.Scheme = "file"
-		req.URL.Host = "localhost"
-	} else {
-		req.URL.Scheme = "http"
-		req.URL.Host = req.Host
+	if r.format == format.Unknown {
+		r.path, r.format = outputFormat(r.path)
 	}
 
-	req.URL.Path = g[1]
-	preview := g[2] == "p"
-	webp := g[3] == "w"
-	crop := g[4] == "c"
-	width, _ := strconv.Atoi(g[5])
-	height, _ := strconv.Atoi(g[6])
+	setSource(req.URL, req.Host, r.path)
 
 	// Disallow repeated scaling parameters.
-	if matchPath.MatchString(req.URL.Path) {
+	if matchPath.MatchString(req.URL.Path) || matchFriendlyPath.MatchString(req.URL.Path) {
 		return thumbnail.Options{}, http.StatusBadRequest
 	}
 
-	if width <= 0 || height <= 0 || width > *maxOutputDimension || height > *maxOutputDimension {
+	if r.width <= 0 || r.height <= 0 || r.width > c.maxOutputDimension || r.height > c.maxOutputDimension {
 		return thumbnail.Options{}, http.StatusBadRequest
 	}
 
+	return r.options(c), 0
+}
+
+// options returns the thumbnail.Options for a parsed request, combined with
+// the image flags in config c.
+func (r request) options(c *config) thumbnail.Options {
 	o := thumbnail.Options{
-		Width:                 width,
-		Height:                height,
-		MaxBufferPixels:       *maxBufferPixels,
-		Sharpen:               *sharpen,
-		Crop:                  crop,
-		FastResize:            *fastResize,
-		MaxQueueDuration:      *maxQueueDuration,
-		MaxProcessingDuration: *maxProcessingDuration,
+		Width:                 r.width,
+		Height:                r.height,
+		MinDimension:          c.minInputDimension,
+		MaxAspectRatio:        c.maxAspectRatio,
+		MaxMegapixels:         c.maxMegapixels,
+		MaxBufferPixels:       c.maxBufferPixels,
+		MaxMemory:             c.maxMemory,
+		Sharpen:               toggle(c.sharpen),
+		SharpenBeforeResize:   c.sharpenBeforeResize,
+		Crop:                  r.crop,
+		Pad:                   r.pad,
+		Outside:               r.outside,
+		Background:            r.bg,
+		Region:                r.region,
+		KeepFormat:            r.keepFormat,
+		Video:                 r.video,
+		FastResize:            toggle(c.fastResize),
+		Preset:                r.preset,
+		LinearProcessing:      c.linearProcessing,
+		CmykProfile:           c.cmykProfile,
+		RgbProfile:            c.rgbProfile,
+		PassThrough:           c.passThrough,
+		RepairHeader:          c.repairHeaders,
+		MaxQueueDuration:      c.maxQueueDuration,
+		MaxProcessingDuration: c.maxProcessingDuration,
 		Save: format.SaveOptions{
-			Lossless:     *lossless,
-			LossyIfPhoto: *lossyIfPhoto,
+			Format:       r.format,
+			Quality:      c.quality,
+			Lossless:     c.lossless,
+			LossyIfPhoto: c.lossyIfPhoto,
 		},
 	}
 
-	if webp {
+	if c.keepCopyright {
+		o.Save.Metadata = format.StripUnlessCopyrighted
+	}
+
+	// PassThrough only returns originals if metadata is kept.
+	if c.passThrough {
+		o.Save.KeepMetadata = true
+	}
+
+	if r.webp {
 		o.Save.AllowWebp = true
-		o.Save.Lossless = *losslessWebp
+		o.Save.Lossless = c.losslessWebp
+	}
+
+	// Lossless only chooses between formats, so doesn't apply to JPEG.
+	if r.format == format.Jpeg {
+		o.Save.Lossless = false
 	}
 
 	// Preview images are tiny, blurry JPEGs/lossy WebPs.
-	if preview {
-		o.Sharpen = false
+	if r.preview {
+		o.Sharpen = thumbnail.ToggleOff
 		o.BlurSigma = 0.4
 		o.Save.Lossless = false
 		o.Save.Quality = 40
 	}
 
-	return o, 0
+	if r.quality > 0 {
+		o.Save.Quality = r.quality
+	}
+
+	return o
+}
+
+// toggle turns on a thumbnail option if its flag is set, and otherwise
+// leaves it to any preset.
+func toggle(on bool) thumbnail.Toggle {
+	if on {
+		return thumbnail.ToggleOn
+	}
+	return thumbnail.ToggleDefault
+}
+
+// outputFormat splits an output format extension following the source's
+// own image extension, as in /path/to/image.jpg.webp, off of source path
+// p.  It returns p unchanged and Unknown if there isn't one, such as for
+// /path/to/my.photo.jpg, leaving the format to be negotiated.
+func outputFormat(p string) (string, format.Format) {
+	ext := path.Ext(p)
+	f, ok := outputExtensions[strings.ToLower(ext)]
+	source := strings.TrimSuffix(p, ext)
+	if !ok || format.ExtensionFormat(source) == format.Unknown {
+		return p, format.Unknown
+	}
+
+	return source, f
+}
+
+// setSource points u at the original image at path, either on the local
+// filesystem or on host.
+func setSource(u *url.URL, host, path string) {
+	if *localImageDirectory != "" {
+		u.Scheme = "file"
+		u.Host = "localhost"
+	} else {
+		u.Scheme = "http"
+		u.Host = host
+	}
+
+	u.Path = path
+	u.RawPath = ""
+}
+
+// cachePolicy returns the CachePolicy for a request that signedDirector has
+// accepted, which includes checking the signature of any nocache
+// parameter.
+func cachePolicy(req *http.Request) thumbnail.CachePolicy {
+	if req.URL.Query().Get("nocache") != "" {
+		return thumbnail.CachePolicy{NoStore: true}
+	}
+
+	cfg := currentConfig()
+	c := thumbnail.CachePolicy{
+		MaxAge:               cfg.maxAge,
+		StaleWhileRevalidate: cfg.staleWhileRevalidate,
+	}
+
+	if cfg.matchImmutable != nil && cfg.matchImmutable.MatchString(req.URL.Path) {
+		c.Immutable = true
+	}
+
+	return c
+}
+
+// parsePath parses a path of the form /path/to/image.jpg=pwc300x200, where
+// the optional p means preview, the optional w means allow WebP, and s or c
+// means scale or crop to the given width and height.
+func parsePath(path string) (request, bool) {
+	g := matchPath.FindStringSubmatch(path)
+	if len(g) != 7 {
+		return request{}, false
+	}
+
+	r := request{
+		path:    g[1],
+		preview: g[2] == "p",
+		webp:    g[3] == "w",
+		crop:    g[4] == "c",
+	}
+	r.width, _ = strconv.Atoi(g[5])
+	r.height, _ = strconv.Atoi(g[6])
+
+	return r, true
+}
+
+// parseFriendlyPath parses a path of the form /300x200,crop,q80/path/to/image.jpg,
+// where the width and height may be followed by comma-separated tokens.
+// Unknown tokens fail to parse.
+func parseFriendlyPath(path string) (request, bool) {
+	g := matchFriendlyPath.FindStringSubmatch(path)
+	if len(g) != 5 {
+		return request{}, false
+	}
+
+	r := request{path: g[4]}
+	r.width, _ = strconv.Atoi(g[1])
+	r.height, _ = strconv.Atoi(g[2])
+
+	// Skip the empty string before the first comma.
+	for _, token := range strings.Split(g[3], ",")[1:] {
+		switch token {
+		case "crop", "fit=cover":
+			r.crop, r.pad, r.outside = true, false, false
+		case "fit=contain":
+			r.crop, r.pad, r.outside = false, false, false
+		case "pad", "fit=pad":
+			r.crop, r.pad, r.outside = false, true, false
+		case "fit=outside":
+			r.crop, r.pad, r.outside = false, false, true
+		case "preview":
+			r.preview = true
+		case "webp":
+			r.webp = true
+		case "format=original":
+			r.keepFormat = true
+		case "mp4":
+			r.video = thumbnail.MP4
+		case "webm":
+			r.video = thumbnail.WebM
+		case "preset=fast":
+			r.preset = thumbnail.PresetFast
+		case "preset=balanced":
+			r.preset = thumbnail.PresetBalanced
+		case "preset=best":
+			r.preset = thumbnail.PresetBest
+		default:
+			if strings.HasPrefix(token, "bg=") {
+				var err error
+				if r.bg, err = thumbnail.ParseColor(token[3:]); err != nil {
+					return request{}, false
+				}
+				continue
+			}
+
+			q := matchQuality.FindStringSubmatch(token)
+			if len(q) != 2 {
+				return request{}, false
+			}
+			r.quality, _ = strconv.Atoi(q[1])
+			if r.quality < 1 || r.quality > 100 {
+				return request{}, false
+			}
+		}
+	}
+
+	return r, true
 }
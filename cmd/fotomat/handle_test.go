@@ -1,15 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
 	"github.com/die-net/fotomat/vips"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"runtime"
 	"testing"
@@ -30,6 +33,11 @@ func init() {
 	// Initialize flags with default values, enable local serving.
 	flag.Parse()
 	*localImageDirectory = "../../testdata/"
+	*iiifPrefix = "/iiif"
+	*exifPrefix = "/exif"
+	*srcsetPrefix = "/srcset"
+	*uploadPath = "/upload"
+	*validatePath = "/validate"
 	runtime.GOMAXPROCS(2)
 
 	// Listen on an ephemeral localhost port.
@@ -56,6 +64,165 @@ func TestSuccess(t *testing.T) {
 
 	// Crop 3000x2000 PNG to a small preview JPEG.
 	assert.Nil(t, isSize("3000px.png=pc16x16", format.Jpeg, 16, 16))
+
+	// A PNG named .jpg is processed as the PNG it is.
+	assert.Nil(t, isSize("mislabeled.jpg=s2048x2048", format.Png, 2, 3))
+}
+
+func TestFriendlyPath(t *testing.T) {
+	o, status := direct("/200x300/watermelon.jpg")
+	if assert.Equal(t, 0, status) {
+		assert.Equal(t, 200, o.Width)
+		assert.Equal(t, 300, o.Height)
+		assert.False(t, o.Crop)
+	}
+
+	o, status = direct("/200x300,fit=cover/watermelon.jpg")
+	if assert.Equal(t, 0, status) {
+		assert.Equal(t, 200, o.Width)
+		assert.Equal(t, 300, o.Height)
+		assert.True(t, o.Crop)
+	}
+
+	o, status = direct("/200x300,crop,fit=outside/watermelon.jpg")
+	if assert.Equal(t, 0, status) {
+		assert.True(t, o.Outside)
+		assert.False(t, o.Crop)
+	}
+
+	o, status = direct("/200x300,format=original,webp/animation.gif")
+	if assert.Equal(t, 0, status) {
+		assert.True(t, o.KeepFormat)
+		assert.Equal(t, format.Unknown, o.Save.Format)
+	}
+
+	o, status = direct("/200x300,crop,webm/animation.gif")
+	if assert.Equal(t, 0, status) {
+		assert.Equal(t, thumbnail.WebM, o.Video)
+		assert.True(t, o.Crop)
+	}
+
+	o, status = direct("/200x300,pad,mp4/animation.gif")
+	if assert.Equal(t, 0, status) {
+		assert.IsType(t, thumbnail.ConflictError{}, o.Validate())
+	}
+
+	o, status = direct("/300x200,crop,webp,q80/path/to/image.jpg")
+	if assert.Equal(t, 0, status) {
+		assert.True(t, o.Crop)
+		assert.True(t, o.Save.AllowWebp)
+		assert.Equal(t, 80, o.Save.Quality)
+	}
+
+	o, status = direct("/300x200,preset=best/path/to/image.jpg")
+	if assert.Equal(t, 0, status) {
+		assert.Equal(t, thumbnail.PresetBest, o.Preset)
+	}
+
+	// Unknown or invalid tokens are refused.
+	for _, path := range []string{
+		"/200x300,zoom/watermelon.jpg",
+		"/200x300,q0/watermelon.jpg",
+		"/200x300,q101/watermelon.jpg",
+		"/200x300,preset=slow/watermelon.jpg",
+		"/200x300,/watermelon.jpg",
+		"/200x300",
+		"/200x300/200x300/watermelon.jpg",
+	} {
+		_, status = direct(path)
+		assert.Equal(t, http.StatusBadRequest, status, path)
+	}
+
+	// Crop JPEG to 200x100 and convert to WebP.
+	assert.Nil(t, isSize("200x100,crop,webp/watermelon.jpg", format.Webp, 200, 100))
+	// Scale JPEG to fit.
+	assert.Nil(t, isSize("100x100/watermelon.jpg", format.Jpeg, 75, 100))
+	// Scale JPEG to cover.
+	assert.Nil(t, isSize("200x300,fit=outside/watermelon.jpg", format.Jpeg, 223, 300))
+}
+
+func TestOutputExtension(t *testing.T) {
+	o, status := direct("/200x300/watermelon.jpg.png")
+	if assert.Equal(t, 0, status) {
+		assert.Equal(t, format.Png, o.Save.Format)
+	}
+
+	// A single extension is the source's own.
+	o, status = direct("/200x300,webp/watermelon.png")
+	if assert.Equal(t, 0, status) {
+		assert.Equal(t, format.Unknown, o.Save.Format)
+		assert.True(t, o.Save.AllowWebp)
+	}
+
+	for _, test := range []struct {
+		path   string
+		source string
+		f      format.Format
+	}{
+		{"/a/image.jpg.webp", "/a/image.jpg", format.Webp},
+		{"/a/image.png.JPEG", "/a/image.png", format.Jpeg},
+		{"/a/image.jpg", "/a/image.jpg", format.Unknown},
+		{"/a.b/image.png", "/a.b/image.png", format.Unknown},
+		{"/a/image.jpg.gif", "/a/image.jpg.gif", format.Unknown},
+		// Dots elsewhere in the name aren't the source's extension.
+		{"/a/my.photo.jpg", "/a/my.photo.jpg", format.Unknown},
+		{"/a/my.photo.png", "/a/my.photo.png", format.Unknown},
+		{"/a/my.photo.jpg.webp", "/a/my.photo.jpg", format.Webp},
+		{"/a/image.v2.webp", "/a/image.v2.webp", format.Unknown},
+	} {
+		source, f := outputFormat(test.path)
+		assert.Equal(t, test.source, source, test.path)
+		assert.Equal(t, test.f, f, test.path)
+	}
+
+	// Scale a JPEG and save it as PNG, in either grammar.
+	assert.Nil(t, isSize("100x100/watermelon.jpg.png", format.Png, 75, 100))
+	assert.Nil(t, isSize("watermelon.jpg.png=s100x100", format.Png, 75, 100))
+
+	// Requesting image.png of a JPEG source responds with a PNG, even
+	// to a client that accepts WebP.
+	req, err := http.NewRequest("GET", "http://"+localhost+"/100x100,webp/watermelon.jpg.png", nil)
+	if assert.Nil(t, err) {
+		req.Header.Set("Accept", "image/webp,image/*")
+		resp, err := http.DefaultClient.Do(req)
+		if assert.Nil(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestFriendlyPathPad(t *testing.T) {
+	o, status := direct("/200x300,pad,bg=%23ff0000/watermelon.jpg")
+	if assert.Equal(t, 0, status) {
+		assert.True(t, o.Pad)
+		assert.False(t, o.Crop)
+		assert.Equal(t, thumbnail.Color{R: 255}, o.Background)
+	}
+
+	o, status = direct("/200x300,crop,fit=pad,bg=fff/watermelon.jpg")
+	if assert.Equal(t, 0, status) {
+		assert.True(t, o.Pad)
+		assert.False(t, o.Crop)
+		assert.Equal(t, thumbnail.Color{R: 255, G: 255, B: 255}, o.Background)
+	}
+
+	_, status = direct("/200x300,pad,bg=%23zzz/watermelon.jpg")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	assert.Nil(t, isSize("200x100,pad,bg=white/watermelon.jpg", format.Jpeg, 200, 100))
+}
+
+func TestCapabilities(t *testing.T) {
+	body, code := fetch("capabilities")
+	assert.Equal(t, http.StatusOK, code)
+
+	c := format.Capabilities{}
+	if assert.Nil(t, json.Unmarshal(body, &c)) {
+		assert.Contains(t, c.Load, "image/jpeg")
+		assert.Contains(t, c.Load, "image/png")
+	}
 }
 
 func TestResponseErrors(t *testing.T) {
@@ -68,13 +235,38 @@ func TestResponseErrors(t *testing.T) {
 	// Return StatusUnsupportedMediaType on a truncated image.
 	assert.Equal(t, status("bad.jpg=s16x16"), http.StatusUnsupportedMediaType)
 
-	// Return StatusUnsupportedMediaType on a 1x1 pixel image.
-	assert.Equal(t, status("1px.png=s16x16"), http.StatusUnsupportedMediaType)
+	// Return StatusUnprocessableEntity on a 1x1 pixel image.
+	assert.Equal(t, status("1px.png=s16x16"), http.StatusUnprocessableEntity)
 
 	// Return StatusRequestEntityTooLarge on a 34000px image.
 	assert.Equal(t, status("34000px.png=s16x16"), http.StatusRequestEntityTooLarge)
 }
 
+func TestJSONErrors(t *testing.T) {
+	resp, err := http.Get("http://" + localhost + "/34000px.png=s16x16")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var e thumbnail.ErrorResponse
+	if assert.Nil(t, json.NewDecoder(resp.Body).Decode(&e)) {
+		assert.Equal(t, "too_big", e.Code)
+		assert.Equal(t, thumbnail.ErrTooBig.Error(), e.Message)
+		assert.Equal(t, *maxBufferPixels, e.MaxPixels)
+	}
+
+	// Errors without a more specific code are named after their status.
+	body, code := fetch("notfound.txt=s16x16")
+	assert.Equal(t, http.StatusNotFound, code)
+	if assert.Nil(t, json.Unmarshal(body, &e)) {
+		assert.Equal(t, thumbnail.ErrorResponse{Code: "not_found", Message: "Not Found"}, e)
+	}
+}
+
 func TestParameterValidation(t *testing.T) {
 	// Test missing parameters.
 	assert.Equal(t, status("watermelon.jpg"), http.StatusBadRequest)
@@ -101,6 +293,10 @@ func TestParameterValidation(t *testing.T) {
 	assert.Equal(t, status("watermelon.jpg=s16x16=s16x16"), http.StatusBadRequest)
 }
 
+func direct(path string) (thumbnail.Options, int) {
+	return director(httptest.NewRequest("GET", path, nil))
+}
+
 func isSize(filename string, f format.Format, width, height int) error {
 	image, code := fetch(filename)
 	if code != 200 {
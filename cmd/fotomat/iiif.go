@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	iiifPrefix = flag.String("iiif_prefix", "", "Path prefix to serve the IIIF Image API 2.1 under, such as /iiif (\"\"=disable).")
+
+	matchIIIFRegion = regexp.MustCompile(`^(\d{1,5}),(\d{1,5}),(\d{1,5}),(\d{1,5})$`)
+	matchIIIFSize   = regexp.MustCompile(`^(!?)(\d{0,5}),(\d{0,5})$`)
+)
+
+// iiifFormats maps IIIF output format extensions to the Format saved.
+var iiifFormats = map[string]format.Format{
+	"jpg":  format.Jpeg,
+	"png":  format.Png,
+	"webp": format.Webp,
+}
+
+// iiifInfo is the subset of an IIIF Image API 2.1 info.json response that
+// we can provide.
+type iiifInfo struct {
+	Context  string        `json:"@context"`
+	ID       string        `json:"@id"`
+	Protocol string        `json:"protocol"`
+	Width    int           `json:"width"`
+	Height   int           `json:"height"`
+	Profile  []interface{} `json:"profile"`
+}
+
+type iiifProfile struct {
+	Formats   []string `json:"formats"`
+	Qualities []string `json:"qualities"`
+	Supports  []string `json:"supports"`
+}
+
+// iiifHandler serves info.json for IIIF requests under iiifPrefix, and
+// passes image requests on to proxy.  Original images fetched for
+// info.json are held in RAM under the same limit as proxy's.
+func iiifHandler(proxy *thumbnail.Proxy, up upstream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasSuffix(req.URL.Path, "/info.json") {
+			proxy.ServeHTTP(w, req)
+			return
+		}
+
+		escaped := strings.TrimSuffix(strings.TrimPrefix(req.URL.EscapedPath(), *iiifPrefix+"/"), "/info.json")
+		path, ok := iiifIdentifier(escaped)
+		if !ok {
+			thumbnail.WriteError(w, http.StatusBadRequest, thumbnail.ErrorResponse{})
+			return
+		}
+
+		source := *req.URL
+		setSource(&source, req.Host, path)
+		blob, ok := up.getOriginal(w, proxy, source.String())
+		if !ok {
+			return
+		}
+
+		m, err := format.MetadataBytes(blob)
+		blob = nil      // Free up image memory ASAP.
+		proxy.Release() // Release semaphore ASAP.
+		if err != nil {
+			thumbnail.WriteError(w, http.StatusUnsupportedMediaType, thumbnail.ErrorResponse{Code: "unknown_format", Message: err.Error()})
+			return
+		}
+
+		j, err := json.Marshal(iiifInfo{
+			Context:  "http://iiif.io/api/image/2/context.json",
+			ID:       "http://" + req.Host + *iiifPrefix + "/" + escaped,
+			Protocol: "http://iiif.io/api/image",
+			Width:    m.Width,
+			Height:   m.Height,
+			Profile: []interface{}{
+				"http://iiif.io/api/image/2/level0.json",
+				iiifProfile{
+					Formats:   []string{"jpg", "png", "webp"},
+					Qualities: []string{"default", "color"},
+					Supports:  []string{"regionByPx", "sizeByW", "sizeByH", "sizeByWh", "sizeByConfinedWh"},
+				},
+			},
+		})
+		if err != nil {
+			thumbnail.WriteError(w, http.StatusInternalServerError, thumbnail.ErrorResponse{Message: err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(j)))
+		_, _ = w.Write(j)
+	})
+}
+
+// parseIIIFPath parses an escaped IIIF Image API 2.1 path of the form
+// /prefix/{identifier}/{region}/{size}/{rotation}/{quality}.{format}, where
+// identifier is the URL-escaped source path.  Only full and pixel regions,
+// no rotation, and the default or color quality are supported.  An exact
+// w,h size crops to fill rather than distorting the image.
+func parseIIIFPath(escaped string, maxDimension int) (request, bool) {
+	if *iiifPrefix == "" || !strings.HasPrefix(escaped, *iiifPrefix+"/") {
+		return request{}, false
+	}
+
+	p := strings.Split(strings.TrimPrefix(escaped, *iiifPrefix+"/"), "/")
+	if len(p) != 5 {
+		return request{}, false
+	}
+
+	path, ok := iiifIdentifier(p[0])
+	if !ok {
+		return request{}, false
+	}
+	r := request{path: path}
+
+	if p[1] != "full" {
+		g := matchIIIFRegion.FindStringSubmatch(p[1])
+		if len(g) != 5 {
+			return request{}, false
+		}
+		r.region.X, _ = strconv.Atoi(g[1])
+		r.region.Y, _ = strconv.Atoi(g[2])
+		r.region.Width, _ = strconv.Atoi(g[3])
+		r.region.Height, _ = strconv.Atoi(g[4])
+		if r.region.Width == 0 || r.region.Height == 0 {
+			return request{}, false
+		}
+	}
+
+	// Missing dimensions are limited only by maxDimension, since we
+	// never scale up.
+	r.width, r.height = maxDimension, maxDimension
+	if p[2] != "full" && p[2] != "max" {
+		g := matchIIIFSize.FindStringSubmatch(p[2])
+		if len(g) != 4 || (g[2] == "" && g[3] == "") || (g[1] == "!" && (g[2] == "" || g[3] == "")) {
+			return request{}, false
+		}
+		if g[2] != "" {
+			r.width, _ = strconv.Atoi(g[2])
+		}
+		if g[3] != "" {
+			r.height, _ = strconv.Atoi(g[3])
+		}
+		r.crop = g[1] == "" && g[2] != "" && g[3] != ""
+	}
+
+	if p[3] != "0" {
+		return request{}, false
+	}
+
+	dot := strings.LastIndex(p[4], ".")
+	if dot < 0 {
+		return request{}, false
+	}
+	if quality := p[4][:dot]; quality != "default" && quality != "color" {
+		return request{}, false
+	}
+	if r.format, ok = iiifFormats[p[4][dot+1:]]; !ok {
+		return request{}, false
+	}
+
+	return r, true
+}
+
+// iiifIdentifier unescapes an IIIF identifier into a source path.
+func iiifIdentifier(escaped string) (string, bool) {
+	id, err := url.PathUnescape(escaped)
+	if err != nil || id == "" {
+		return "", false
+	}
+
+	return "/" + strings.TrimPrefix(id, "/"), true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestIIIF(t *testing.T) {
+	// A 200x300 region scaled to 100 wide.
+	assert.Nil(t, isSize("iiif/watermelon.jpg/100,100,200,300/100,/0/default.jpg", format.Jpeg, 100, 150))
+
+	// The full image confined to 100x100, converted to PNG.
+	assert.Nil(t, isSize("iiif/watermelon.jpg/full/!100,100/0/default.png", format.Png, 75, 100))
+
+	// An exact size is cropped to fill.
+	assert.Nil(t, isSize("iiif/watermelon.jpg/full/50,50/0/color.webp", format.Webp, 50, 50))
+
+	// Full size is never scaled up.
+	assert.Nil(t, isSize("iiif/watermelon.jpg/full/full/0/default.jpg", format.Jpeg, 398, 536))
+
+	// Unsupported rotation, quality, format, and region.
+	assert.Equal(t, http.StatusBadRequest, status("iiif/watermelon.jpg/full/full/90/default.jpg"))
+	assert.Equal(t, http.StatusBadRequest, status("iiif/watermelon.jpg/full/full/0/gray.jpg"))
+	assert.Equal(t, http.StatusBadRequest, status("iiif/watermelon.jpg/full/full/0/default.gif"))
+	assert.Equal(t, http.StatusBadRequest, status("iiif/watermelon.jpg/square/full/0/default.jpg"))
+}
+
+func TestIIIFInfo(t *testing.T) {
+	body, code := fetch("iiif/watermelon.jpg/info.json")
+	if !assert.Equal(t, http.StatusOK, code) {
+		return
+	}
+
+	info := iiifInfo{}
+	if assert.Nil(t, json.Unmarshal(body, &info)) {
+		assert.Equal(t, "http://iiif.io/api/image", info.Protocol)
+		assert.Equal(t, 398, info.Width)
+		assert.Equal(t, 536, info.Height)
+	}
+
+	assert.Equal(t, http.StatusNotFound, status("iiif/notfound.jpg/info.json"))
+}
+
+func TestIIIFIdentifier(t *testing.T) {
+	o, status := direct("/iiif/path%2Fto%2Fimage.jpg/10,20,30,40/full/0/default.jpg")
+	if assert.Equal(t, 0, status) {
+		assert.Equal(t, thumbnail.Rect{X: 10, Y: 20, Width: 30, Height: 40}, o.Region)
+		assert.Equal(t, format.Jpeg, o.Save.Format)
+	}
+}
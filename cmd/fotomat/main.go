@@ -33,6 +33,20 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flag.Arg(0) == "batch" {
+		if flag.NArg() != 4 {
+			log.Fatalln(batchUsage)
+		}
+		failed, err := batch(flag.Arg(1), flag.Arg(2), flag.Arg(3), *maxImageThreads)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(failed) > 0 {
+			log.Fatalf("Batch: %d files failed", len(failed))
+		}
+		os.Exit(0)
+	}
+
 	if *debugListen != "" {
 		http.Handle("/metrics", promhttp.Handler())
 		go func() { log.Fatal(http.ListenAndServe(*debugListen, nil)) }()
@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 
+	"github.com/die-net/fotomat/thumbnail"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -40,10 +41,26 @@ var (
 		},
 		[]string{},
 	)
+
+	stageDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "thumbnail_stage_duration_seconds",
+			Help:    "A histogram of latencies for each stage of thumbnailing an image.",
+			Buckets: prometheus.ExponentialBuckets(.001, 2, 14),
+		},
+		[]string{"stage"},
+	)
 )
 
 func prometheusInit() {
-	prometheus.MustRegister(inFlightGauge, counter, duration, responseSize)
+	prometheus.MustRegister(inFlightGauge, counter, duration, responseSize, stageDuration)
+}
+
+// observeTimings records thumbnail stage Timings in stageDuration.
+func observeTimings(t thumbnail.Timings) {
+	stageDuration.WithLabelValues("load").Observe(t.Load.Seconds())
+	stageDuration.WithLabelValues("transform").Observe(t.Transform.Seconds())
+	stageDuration.WithLabelValues("encode").Observe(t.Encode.Seconds())
 }
 
 func prometheusWrapHandler(handler http.Handler) http.Handler {
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/die-net/fotomat/thumbnail"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// purgeHandler removes the original image fetched from the source URL in
+// the url parameter of a POST from cache, so the next request for any
+// size of it fetches it again, such as after it's updated upstream.  The
+// sig parameter must be purgeMessage of that URL and the Unix time in the
+// expires parameter, signed with key, and is refused after that time.
+// Responses aren't cached here, so derived images must be purged from any
+// downstream HTTP caches separately.
+func purgeHandler(cache *thumbnail.SourceCache, key []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			thumbnail.WriteError(w, http.StatusMethodNotAllowed, thumbnail.ErrorResponse{})
+			return
+		}
+
+		q := req.URL.Query()
+		source := q.Get("url")
+		if source == "" {
+			thumbnail.WriteError(w, http.StatusBadRequest, thumbnail.ErrorResponse{})
+			return
+		}
+
+		expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+		if err != nil || time.Now().Unix() > expires || !isSigned(key, purgeMessage(source, expires), q.Get("sig")) {
+			thumbnail.WriteError(w, http.StatusForbidden, thumbnail.ErrorResponse{})
+			return
+		}
+
+		// Purging what isn't cached succeeds too, so retries are harmless.
+		if cache != nil {
+			cache.Remove(source)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// purgeMessage returns what's signed to purge source until the Unix time
+// expires.  Its prefix keeps signatures for other uses, such as
+// noCacheMessage, from being accepted.
+func purgeMessage(source string, expires int64) string {
+	return "purge\n" + strconv.FormatInt(expires, 10) + "\n" + source
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/die-net/fotomat/thumbnail"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPurge(t *testing.T) {
+	// An origin that counts how many times it's fetched from.
+	fetches := int32(0)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		http.ServeFile(w, r, *localImageDirectory+"watermelon.jpg")
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	director := func(req *http.Request) (thumbnail.Options, int) {
+		req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+		return thumbnail.Options{Width: 50, Height: 50}, 0
+	}
+	proxy := thumbnail.NewProxy(director, thumbnail.NewPool(0, 1), 2, &http.Client{Timeout: time.Minute})
+	proxy.SourceCache = thumbnail.NewSourceCache(1<<20, time.Minute)
+
+	// A server per signing key, sharing the proxy and its cache.
+	newServer := func(key []byte) *httptest.Server {
+		mux := http.NewServeMux()
+		mux.Handle("/purge", purgeHandler(proxy.SourceCache, key))
+		return httptest.NewServer(endpoints(mux, proxy))
+	}
+	unsigned := newServer(nil)
+	defer unsigned.Close()
+	key := []byte("secret")
+	server := newServer(key)
+	defer server.Close()
+
+	get := func() {
+		resp, err := http.Get(server.URL + "/watermelon.jpg")
+		if assert.Nil(t, err) {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			resp.Body.Close()
+		}
+	}
+	purge := func(server *httptest.Server, source string, expires int64, sig string) int {
+		q := url.Values{"url": {source}, "expires": {strconv.FormatInt(expires, 10)}, "sig": {sig}}
+		resp, err := http.Post(server.URL+"/purge?"+q.Encode(), "", nil)
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	get()
+	get()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	source := origin.URL + "/watermelon.jpg"
+	expires := time.Now().Add(time.Hour).Unix()
+	signed := func(source string, expires int64) string {
+		return sign(key, purgeMessage(source, expires))
+	}
+
+	// Without a signing key, or a valid signature, purges are refused.
+	assert.Equal(t, http.StatusForbidden, purge(unsigned, source, expires, ""))
+	assert.Equal(t, http.StatusForbidden, purge(unsigned, source, expires, signed(source, expires)))
+	assert.Equal(t, http.StatusForbidden, purge(server, source, expires, ""))
+	assert.Equal(t, http.StatusForbidden, purge(server, source, expires, signed(origin.URL+"/2px.png", expires)))
+
+	// As are signatures for another purpose, or another expiry, or that
+	// have expired.
+	assert.Equal(t, http.StatusForbidden, purge(server, source, expires, sign(key, noCacheMessage(source, expires))))
+	assert.Equal(t, http.StatusForbidden, purge(server, source, expires+1, signed(source, expires)))
+	past := time.Now().Add(-time.Minute).Unix()
+	assert.Equal(t, http.StatusForbidden, purge(server, source, past, signed(source, past)))
+	get()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// A signed purge makes the next request refetch the original, and
+	// repeating it still succeeds.
+	assert.Equal(t, http.StatusNoContent, purge(server, source, expires, signed(source, expires)))
+	assert.Equal(t, http.StatusNoContent, purge(server, source, expires, signed(source, expires)))
+	get()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	// Only signed POSTs with a url are accepted.
+	assert.Equal(t, http.StatusBadRequest, purge(server, "", expires, signed("", expires)))
+	q := url.Values{"url": {source}, "expires": {strconv.FormatInt(expires, 10)}, "sig": {signed(source, expires)}}
+	resp, err := http.Get(server.URL + "/purge?" + q.Encode())
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
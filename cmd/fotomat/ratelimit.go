@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"github.com/die-net/fotomat/thumbnail"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimit       = flag.Float64("rate_limit", 0, "Maximum sustained requests per second from each client (0=disable).")
+	rateLimitBurst  = flag.Int("rate_limit_burst", 20, "Maximum burst of requests from each client before rate limiting.")
+	rateLimitHeader = flag.String("rate_limit_header", "", "Request header containing an API key listed in -rate_limit_keys_file to rate limit by (\"\"=use client IP).")
+	rateLimitKeys   = flag.String("rate_limit_keys_file", "", "File of API keys, one per line, that -rate_limit_header may give (\"\"=use client IP).")
+)
+
+// rateLimiter is an http.Handler that limits the rate of requests from
+// each client with a token bucket, keyed by an API key header or the
+// client's IP.  This provides fairness between clients, as opposed to the
+// Proxy's concurrency limit, which protects the machine.  Only known API
+// keys are trusted, so clients can't escape their IP's limit by making
+// up new ones.
+type rateLimiter struct {
+	handler http.Handler
+	rate    float64 // Tokens added per second.
+	burst   float64 // Maximum tokens in a bucket.
+	header  string
+	keys    map[string]bool
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(handler http.Handler, rate float64, burst int, header string, keys map[string]bool) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		handler: handler,
+		rate:    rate,
+		burst:   float64(burst),
+		header:  header,
+		keys:    keys,
+		buckets: make(map[string]*tokenBucket),
+		pruned:  time.Now(),
+	}
+}
+
+func (rl *rateLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if wait := rl.take(rl.key(req), time.Now()); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		thumbnail.WriteError(w, http.StatusTooManyRequests, thumbnail.ErrorResponse{})
+		return
+	}
+
+	rl.handler.ServeHTTP(w, req)
+}
+
+func (rl *rateLimiter) key(req *http.Request) string {
+	if rl.header != "" {
+		if key := req.Header.Get(rl.header); rl.keys[key] {
+			return "key:" + key
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// readRateLimitKeys reads a file of API keys, one per line, ignoring
+// blank lines and surrounding whitespace.
+func readRateLimitKeys(filename string) (map[string]bool, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		if key := strings.TrimSpace(line); key != "" {
+			keys[key] = true
+		}
+	}
+	return keys, nil
+}
+
+// take removes a token from key's bucket, returning 0 on success or how
+// long until a token will be available.
+func (rl *rateLimiter) take(key string, now time.Time) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.pruned) > time.Minute {
+		rl.prune(now)
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+}
+
+// prune forgets buckets that would have refilled completely, since they
+// are equivalent to new ones.
+func (rl *rateLimiter) prune(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.pruned = now
+}
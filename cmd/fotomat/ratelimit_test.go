@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	rl := newRateLimiter(ok, 1, 3, "X-Api-Key", map[string]bool{"secret": true})
+
+	get := func(remoteAddr, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/watermelon.jpg=s16x16", nil)
+		req.RemoteAddr = remoteAddr
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, req)
+		return w
+	}
+
+	// A burst of 3 is allowed from one IP, then the 4th is refused.
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, get("192.0.2.1:1234", "").Code)
+	}
+	w := get("192.0.2.1:5678", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// Other IPs and API keys have their own buckets.
+	assert.Equal(t, http.StatusOK, get("192.0.2.2:1234", "").Code)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, get("192.0.2.1:1234", "secret").Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, get("192.0.2.3:1234", "secret").Code)
+
+	// Unknown API keys are limited by IP, so can't be used to escape it.
+	assert.Equal(t, http.StatusTooManyRequests, get("192.0.2.1:1234", "made-up").Code)
+
+	// Tokens are refilled over time.
+	now := time.Now()
+	assert.True(t, rl.take("ip:192.0.2.1", now.Add(1100*time.Millisecond)) == 0)
+	assert.True(t, rl.take("ip:192.0.2.1", now.Add(1100*time.Millisecond)) > 0)
+
+	// Full buckets are forgotten.
+	rl.prune(now.Add(time.Hour))
+	assert.Equal(t, 0, len(rl.buckets))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var requestLog = flag.String("request_log", "", "Log one line per image request to stderr, formatted as \"text\" or \"json\" (\"\"=disable).")
+
+// logField is a named value in a request log line.
+type logField struct {
+	name  string
+	value interface{}
+}
+
+// newRequestLogger returns a function that writes each thumbnail.LogEntry
+// to w as a line of logfmt-style "text" or of "json", as named by style.
+func newRequestLogger(style string, w io.Writer) (func(thumbnail.LogEntry), error) {
+	var encode func(*bytes.Buffer, []logField)
+	switch style {
+	case "text":
+		encode = encodeText
+	case "json":
+		encode = encodeJSON
+	default:
+		return nil, fmt.Errorf("unknown request log format %q", style)
+	}
+
+	var mu sync.Mutex
+	return func(e thumbnail.LogEntry) {
+		b := &bytes.Buffer{}
+		encode(b, logFields(time.Now(), e))
+		b.WriteByte('\n')
+
+		mu.Lock()
+		_, _ = w.Write(b.Bytes())
+		mu.Unlock()
+	}, nil
+}
+
+// logFields returns the fields of a thumbnail.LogEntry logged at time now,
+// leaving out those that don't apply.
+func logFields(now time.Time, e thumbnail.LogEntry) []logField {
+	fields := []logField{
+		{"time", now.UTC().Format(time.RFC3339Nano)},
+		{"source", e.Source},
+		{"status", e.Status},
+		{"duration_ms", float64(e.Duration) / float64(time.Millisecond)},
+	}
+	if e.Error != "" {
+		fields = append(fields, logField{"error", e.Error})
+	}
+	if e.InputBytes > 0 {
+		fields = append(fields, logField{"input_format", formatName(e.InputFormat)}, logField{"input_bytes", e.InputBytes})
+	}
+	if e.OutputBytes > 0 {
+		fields = append(fields, logField{"output_format", formatName(e.OutputFormat)}, logField{"output_bytes", e.OutputBytes})
+	}
+	if e.Width > 0 && e.Height > 0 {
+		fields = append(fields, logField{"width", e.Width}, logField{"height", e.Height})
+	}
+	return fields
+}
+
+// formatName returns the mime type of f, or "unknown".
+func formatName(f format.Format) string {
+	if f == format.Unknown {
+		return "unknown"
+	}
+	return f.String()
+}
+
+// encodeText writes fields as space-separated name=value pairs, quoting
+// strings that are empty or contain spaces, quotes, or equals signs.
+func encodeText(b *bytes.Buffer, fields []logField) {
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f.name)
+		b.WriteByte('=')
+
+		switch v := f.value.(type) {
+		case string:
+			if v == "" || bytes.ContainsAny([]byte(v), " \t\r\n\"=") {
+				v = strconv.Quote(v)
+			}
+			b.WriteString(v)
+		case float64:
+			b.WriteString(strconv.FormatFloat(v, 'f', 3, 64))
+		default:
+			fmt.Fprint(b, v)
+		}
+	}
+}
+
+// encodeJSON writes fields as a JSON object, in order.
+func encodeJSON(b *bytes.Buffer, fields []logField) {
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(f.name)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			value = []byte("null")
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+}
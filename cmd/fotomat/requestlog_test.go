@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestLog(t *testing.T) {
+	e := thumbnail.LogEntry{
+		Source:       "http://example.com/watermelon.jpg",
+		InputFormat:  format.Jpeg,
+		InputBytes:   1234,
+		OutputFormat: format.Webp,
+		OutputBytes:  567,
+		Width:        200,
+		Height:       100,
+		Duration:     1500 * time.Microsecond,
+		Status:       200,
+	}
+
+	b := &bytes.Buffer{}
+	logger, err := newRequestLogger("text", b)
+	if assert.Nil(t, err) {
+		logger(e)
+		line := b.String()
+		assert.True(t, strings.HasPrefix(line, "time="))
+		assert.True(t, strings.HasSuffix(line, "\n"))
+		for _, field := range []string{"source=http://example.com/watermelon.jpg", "status=200", "duration_ms=1.500", "input_format=image/jpeg", "input_bytes=1234", "output_format=image/webp", "output_bytes=567", "width=200", "height=100"} {
+			assert.Contains(t, line, " "+field, field)
+		}
+		assert.NotContains(t, line, "error=")
+	}
+
+	e = thumbnail.LogEntry{Source: "http://example.com/a b.txt", InputFormat: format.Unknown, InputBytes: 10, Status: 415, Error: "unknown_format"}
+
+	b.Reset()
+	logger, err = newRequestLogger("text", b)
+	if assert.Nil(t, err) {
+		logger(e)
+		line := b.String()
+		assert.Contains(t, line, ` source="http://example.com/a b.txt"`)
+		assert.Contains(t, line, " error=unknown_format")
+		assert.Contains(t, line, " input_format=unknown")
+		assert.NotContains(t, line, "output_format=")
+	}
+
+	b.Reset()
+	logger, err = newRequestLogger("json", b)
+	if assert.Nil(t, err) {
+		logger(e)
+		var fields map[string]interface{}
+		if assert.Nil(t, json.Unmarshal(b.Bytes(), &fields)) {
+			assert.Equal(t, "http://example.com/a b.txt", fields["source"])
+			assert.Equal(t, 415.0, fields["status"])
+			assert.Equal(t, "unknown_format", fields["error"])
+			assert.Equal(t, "unknown", fields["input_format"])
+			assert.Equal(t, 10.0, fields["input_bytes"])
+			assert.Contains(t, fields, "time")
+			assert.Contains(t, fields, "duration_ms")
+			assert.NotContains(t, fields, "width")
+		}
+	}
+
+	_, err = newRequestLogger("xml", b)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/die-net/fotomat/thumbnail"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readSigningKey reads a secret key from a file, ignoring surrounding
+// whitespace such as a trailing newline.
+func readSigningKey(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSpace(string(b))), nil
+}
+
+// sign returns the hex HMAC-SHA256 of s, such as an escaped request path,
+// with key.
+func sign(key []byte, s string) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedDirector returns director, but refusing requests that aren't
+// allowed by isNoCacheAllowed with key.
+func signedDirector(key []byte) func(*http.Request) (thumbnail.Options, int) {
+	return func(req *http.Request) (thumbnail.Options, int) {
+		if !isNoCacheAllowed(key, req) {
+			return thumbnail.Options{}, http.StatusForbidden
+		}
+
+		return director(req)
+	}
+}
+
+// isNoCacheAllowed returns false if req asks to bypass caches with a
+// nocache parameter, but lacks a sig parameter that's noCacheMessage of its
+// path and the Unix time in its expires parameter signed with key, or is
+// past that time, so the public can't use it to make us refetch and
+// reprocess images.
+func isNoCacheAllowed(key []byte, req *http.Request) bool {
+	q := req.URL.Query()
+	if q.Get("nocache") == "" {
+		return true
+	}
+
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return isSigned(key, noCacheMessage(req.URL.EscapedPath(), expires), q.Get("sig"))
+}
+
+// noCacheMessage returns what's signed to bypass caches for the escaped
+// request path until the Unix time expires.  Its prefix keeps it distinct
+// from purgeMessage.
+func noCacheMessage(path string, expires int64) string {
+	return "nocache\n" + strconv.FormatInt(expires, 10) + "\n" + path
+}
+
+// isSigned returns true if sig is the signature of s with key, and false
+// if it isn't or key is empty because signed requests are disabled.
+func isSigned(key []byte, s, sig string) bool {
+	if len(key) == 0 {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(sign(key, s)))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/die-net/fotomat/thumbnail"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNoCache(t *testing.T) {
+	const path = "/watermelon.jpg=s100x100"
+	get := func(host, query string) *http.Response {
+		resp, err := http.Get("http://" + host + path + query)
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Without a signing key, nocache is always refused.
+	assert.Equal(t, http.StatusForbidden, get(localhost, "?nocache=1").StatusCode)
+
+	key := []byte("secret")
+	transport := &http.Transport{}
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir(*localImageDirectory)))
+	proxy := thumbnail.NewProxy(signedDirector(key), thumbnail.NewPool(0, 1), 2, &http.Client{Transport: transport, Timeout: time.Minute})
+	proxy.CachePolicy = cachePolicy
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	host := server.Listener.Addr().String()
+	expires := time.Now().Add(time.Hour).Unix()
+	signed := func(path string, expires int64) string {
+		return "?nocache=1&expires=" + strconv.FormatInt(expires, 10) + "&sig=" + sign(key, noCacheMessage(path, expires))
+	}
+
+	// A missing, wrong, or other path's signature is refused.
+	assert.Equal(t, http.StatusForbidden, get(host, "?nocache=1").StatusCode)
+	assert.Equal(t, http.StatusForbidden, get(host, "?nocache=1&expires="+strconv.FormatInt(expires, 10)+"&sig=0123").StatusCode)
+	assert.Equal(t, http.StatusForbidden, get(host, signed("/2px.png=s100x100", expires)).StatusCode)
+
+	// As are signatures without an expiry, for another purpose, or that
+	// have expired.
+	assert.Equal(t, http.StatusForbidden, get(host, "?nocache=1&sig="+sign(key, path)).StatusCode)
+	assert.Equal(t, http.StatusForbidden, get(host, "?nocache=1&expires="+strconv.FormatInt(expires, 10)+"&sig="+sign(key, purgeMessage(path, expires))).StatusCode)
+	past := time.Now().Add(-time.Minute).Unix()
+	assert.Equal(t, http.StatusForbidden, get(host, signed(path, past)).StatusCode)
+
+	// A valid signature is honored.
+	resp := get(host, signed(path, expires))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	// Ordinary requests are unaffected.
+	resp = get(host, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, "no-store", resp.Header.Get("Cache-Control"))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxSrcsetWidths is the most widths a srcset request may ask for.
+const maxSrcsetWidths = 32
+
+var srcsetPrefix = flag.String("srcset_prefix", "", "Path prefix to serve JSON for building an HTML srcset of source images under, such as /srcset (\"\"=disable).")
+
+// srcsetImage is one size of a source image in a srcset response.
+type srcsetImage struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// srcsetResponse lists the sizes a source image can be served at, and
+// the srcset attribute value that offers them.
+type srcsetResponse struct {
+	Images []srcsetImage `json:"images"`
+	Srcset string        `json:"srcset"`
+}
+
+// srcsetHandler serves JSON describing the source image whose path
+// follows srcsetPrefix scaled to each of the comma-separated widths in the
+// widths parameter.  Since images aren't enlarged, widths beyond the
+// source's, or beyond what -max_output_dimension or -max_megapixels
+// allow, are clamped to the largest it can be served at.  Original images
+// are held in RAM under the same limit as proxy's.
+func srcsetHandler(proxy *thumbnail.Proxy, up upstream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			thumbnail.WriteError(w, http.StatusMethodNotAllowed, thumbnail.ErrorResponse{})
+			return
+		}
+
+		path := strings.TrimPrefix(req.URL.Path, *srcsetPrefix)
+		widths, ok := parseSrcsetWidths(req.URL.Query().Get("widths"))
+		if path == "" || path == "/" || !ok {
+			thumbnail.WriteError(w, http.StatusBadRequest, thumbnail.ErrorResponse{})
+			return
+		}
+
+		source := *req.URL
+		setSource(&source, req.Host, path)
+		source.RawQuery = ""
+		blob, ok := up.getOriginal(w, proxy, source.String())
+		if !ok {
+			return
+		}
+
+		m, err := format.MetadataBytes(blob)
+		blob = nil      // Free up image memory ASAP.
+		proxy.Release() // Release semaphore ASAP.
+		if err != nil {
+			thumbnail.WriteError(w, http.StatusUnsupportedMediaType, thumbnail.ErrorResponse{Code: "unknown_format", Message: err.Error()})
+			return
+		}
+
+		c := currentConfig()
+		escaped := strings.TrimPrefix(req.URL.EscapedPath(), *srcsetPrefix)
+		j, err := json.Marshal(srcset(m, widths, c.maxOutputDimension, c.maxMegapixels, escaped))
+		if err != nil {
+			thumbnail.WriteError(w, http.StatusInternalServerError, thumbnail.ErrorResponse{Message: err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(j)))
+		_, _ = w.Write(j)
+	})
+}
+
+// parseSrcsetWidths parses comma-separated positive widths, returning
+// them in increasing order.
+func parseSrcsetWidths(s string) ([]int, bool) {
+	tokens := strings.Split(s, ",")
+	if s == "" || len(tokens) > maxSrcsetWidths {
+		return nil, false
+	}
+
+	widths := make([]int, len(tokens))
+	for i, token := range tokens {
+		width, err := strconv.Atoi(strings.TrimSpace(token))
+		if err != nil || width < 1 {
+			return nil, false
+		}
+		widths[i] = width
+	}
+
+	sort.Ints(widths)
+	return widths, true
+}
+
+// srcset returns the sizes that an image with Metadata m is served at for
+// each of widths, in increasing order, with friendly URLs for the escaped
+// source path.  Widths are clamped to the largest the image can be served
+// at within maxDimension and maxMegapixels (if positive) without enlarging
+// it, and duplicates removed.  Heights are rounded up, as thumbnail.RoundUp
+// does, so that each URL's box fits the scaled image exactly.
+func srcset(m format.Metadata, widths []int, maxDimension int, maxMegapixels float64, escaped string) srcsetResponse {
+	largest := m.Width
+	if largest > maxDimension {
+		largest = maxDimension
+	}
+	if tallest := maxDimension * m.Width / m.Height; largest > tallest {
+		largest = tallest
+	}
+	if maxMegapixels > 0 {
+		maxPixels := maxMegapixels * 1e6
+		if widest := int(math.Sqrt(maxPixels * float64(m.Width) / float64(m.Height))); largest > widest {
+			largest = widest
+		}
+		for largest > 1 && float64(largest)*float64(srcsetHeight(m, largest)) > maxPixels {
+			largest--
+		}
+	}
+	if largest < 1 {
+		largest = 1
+	}
+
+	r := srcsetResponse{Images: []srcsetImage{}}
+	var candidates []string
+	for _, width := range widths {
+		if width > largest {
+			width = largest
+		}
+		if n := len(r.Images); n > 0 && r.Images[n-1].Width == width {
+			continue
+		}
+
+		height := srcsetHeight(m, width)
+		url := "/" + strconv.Itoa(width) + "x" + strconv.Itoa(height) + escaped
+		r.Images = append(r.Images, srcsetImage{URL: url, Width: width, Height: height})
+		candidates = append(candidates, url+" "+strconv.Itoa(width)+"w")
+	}
+	r.Srcset = strings.Join(candidates, ", ")
+
+	return r
+}
+
+// srcsetHeight returns the height of an image with Metadata m scaled to
+// width, rounded up.
+func srcsetHeight(m format.Metadata, width int) int {
+	return (m.Height*width + m.Width - 1) / m.Width
+}
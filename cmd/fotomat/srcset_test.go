@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestSrcset(t *testing.T) {
+	body, code := fetch("srcset/watermelon.jpg?widths=800,100,200")
+	if assert.Equal(t, http.StatusOK, code) {
+		r := srcsetResponse{}
+		if assert.Nil(t, json.Unmarshal(body, &r)) {
+			// 800 is clamped to the source's 398.
+			assert.Equal(t, []srcsetImage{
+				{URL: "/100x135/watermelon.jpg", Width: 100, Height: 135},
+				{URL: "/200x270/watermelon.jpg", Width: 200, Height: 270},
+				{URL: "/398x536/watermelon.jpg", Width: 398, Height: 536},
+			}, r.Images)
+			assert.Equal(t, "/100x135/watermelon.jpg 100w, /200x270/watermelon.jpg 200w, /398x536/watermelon.jpg 398w", r.Srcset)
+
+			// Each URL serves an image of exactly that size.
+			for _, image := range r.Images {
+				assert.Nil(t, isSize(image.URL[1:], format.Jpeg, image.Width, image.Height), image.URL)
+			}
+		}
+	}
+
+	assert.Equal(t, http.StatusBadRequest, status("srcset/watermelon.jpg"))
+	assert.Equal(t, http.StatusBadRequest, status("srcset/watermelon.jpg?widths=100,0"))
+	assert.Equal(t, http.StatusNotFound, status("srcset/notfound.jpg?widths=100"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, status("srcset/notimage.txt?widths=100"))
+}
+
+func TestSrcsetClamp(t *testing.T) {
+	// A tall image is clamped by its height, and duplicates are dropped.
+	m := format.Metadata{Format: format.Jpeg, Width: 1000, Height: 4000}
+	r := srcset(m, []int{100, 600, 800}, 2048, 0, "/tall.jpg")
+	assert.Equal(t, []srcsetImage{
+		{URL: "/100x400/tall.jpg", Width: 100, Height: 400},
+		{URL: "/512x2048/tall.jpg", Width: 512, Height: 2048},
+	}, r.Images)
+
+	// Sizes are clamped to fit within MaxMegapixels, as they're served.
+	r = srcset(m, []int{100, 600}, 2048, 0.1, "/tall.jpg")
+	assert.Equal(t, []srcsetImage{
+		{URL: "/100x400/tall.jpg", Width: 100, Height: 400},
+		{URL: "/158x632/tall.jpg", Width: 158, Height: 632},
+	}, r.Images)
+	for _, image := range r.Images {
+		o, err := thumbnail.Options{Width: image.Width, Height: image.Height, MaxMegapixels: 0.1}.Check(m)
+		if assert.Nil(t, err) {
+			assert.Equal(t, image.Width, o.Width)
+			assert.Equal(t, image.Height, o.Height)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+)
+
+var uploadPath = flag.String("upload_path", "", "Path to thumbnail images POSTed as multipart/form-data at, such as /upload (\"\"=disable).")
+
+const (
+	// maxUploadFieldBytes is the largest form field value uploadHandler
+	// reads.
+	maxUploadFieldBytes = 1024
+
+	// maxUploadParts is the most parts, files or not, that uploadHandler
+	// will read from one form.
+	maxUploadParts = 10
+)
+
+// uploadFields are the names of the form fields uploadHandler uses.
+var uploadFields = map[string]bool{"width": true, "height": true, "options": true}
+
+var (
+	// errNoUpload is returned by uploadHandler for a form without an
+	// image.
+	errNoUpload = errors.New("No image file in form")
+
+	// errExtraUpload is returned by uploadHandler for a form with more
+	// than one file.
+	errExtraUpload = errors.New("More than one file in form")
+)
+
+// uploadHandler thumbnails the image uploaded as the first file in a
+// multipart/form-data POST, and responds with the result.  The width and
+// height fields give its size, and an optional options field takes the
+// same comma-separated tokens as the friendly URL grammar, such as
+// "crop,q80".  Images of more than maxBytes (0=maxValidateBytes) are
+// rejected without being processed.  Uploads are held in RAM under the
+// same limit as proxy's originals.
+func uploadHandler(proxy *thumbnail.Proxy, pool *thumbnail.Pool, maxBytes int64) http.Handler {
+	if maxBytes <= 0 {
+		maxBytes = maxValidateBytes
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			thumbnail.WriteError(w, http.StatusMethodNotAllowed, thumbnail.ErrorResponse{})
+			return
+		}
+
+		aborted := w.(http.CloseNotifier).CloseNotify()
+		if !proxy.Acquire(aborted) {
+			thumbnail.WriteError(w, 499, thumbnail.ErrorResponse{Code: "aborted", Message: thumbnail.ErrAborted.Error()})
+			return
+		}
+		result, ok := processUpload(w, req, pool, maxBytes, aborted)
+		proxy.Release() // Release semaphore ASAP.
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", format.DetectFormat(result.Blob).String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(result.Blob)))
+		_, _ = w.Write(result.Blob)
+	})
+}
+
+// processUpload reads and thumbnails the image uploaded in req.  If that
+// fails, it responds to w and returns false.
+func processUpload(w http.ResponseWriter, req *http.Request, pool *thumbnail.Pool, maxBytes int64, aborted <-chan bool) (thumbnail.Result, bool) {
+	blob, fields, err := readUpload(req, maxBytes)
+	if err == thumbnail.ErrSourceTooBig {
+		thumbnail.WriteProcessError(w, err)
+		return thumbnail.Result{}, false
+	}
+	if err != nil {
+		thumbnail.WriteError(w, http.StatusBadRequest, thumbnail.ErrorResponse{Message: err.Error()})
+		return thumbnail.Result{}, false
+	}
+
+	c := currentConfig()
+	spec := fields["width"] + "x" + fields["height"]
+	if fields["options"] != "" {
+		spec += "," + fields["options"]
+	}
+	r, ok := parseFriendlyPath("/" + spec + "/upload")
+	if !ok || r.width <= 0 || r.height <= 0 || r.width > c.maxOutputDimension || r.height > c.maxOutputDimension {
+		thumbnail.WriteError(w, http.StatusBadRequest, thumbnail.ErrorResponse{Message: errBadSpec.Error()})
+		return thumbnail.Result{}, false
+	}
+
+	options := r.options(c)
+	if err := options.Validate(); err != nil {
+		thumbnail.WriteError(w, http.StatusBadRequest, thumbnail.ErrorResponse{Code: "conflicting_options", Message: err.Error()})
+		return thumbnail.Result{}, false
+	}
+
+	result, err := pool.Process(blob, options, aborted)
+	if err != nil {
+		thumbnail.WriteProcessError(w, err)
+		return thumbnail.Result{}, false
+	}
+
+	return result, true
+}
+
+// readUpload returns the only file in a multipart/form-data request, and
+// the values of its uploadFields by name.  It returns
+// thumbnail.ErrSourceTooBig as soon as the file passes maxBytes, and
+// errTooManyParts past maxUploadParts.
+func readUpload(req *http.Request, maxBytes int64) ([]byte, map[string]string, error) {
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var blob []byte
+	fields := map[string]string{}
+	for parts := 0; ; parts++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && parts >= maxUploadParts {
+			err = errTooManyParts
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if part.FileName() == "" {
+			if !uploadFields[part.FormName()] {
+				continue
+			}
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxUploadFieldBytes))
+			if err != nil {
+				return nil, nil, err
+			}
+			fields[part.FormName()] = string(value)
+			continue
+		}
+
+		if blob != nil {
+			return nil, nil, errExtraUpload
+		}
+		if blob, err = ioutil.ReadAll(io.LimitReader(part, maxBytes+1)); err != nil {
+			return nil, nil, err
+		}
+		if int64(len(blob)) > maxBytes {
+			return nil, nil, thumbnail.ErrSourceTooBig
+		}
+		logMislabeled(blob, part)
+	}
+
+	if blob == nil {
+		return nil, nil, errNoUpload
+	}
+
+	return blob, fields, nil
+}
+
+// logMislabeled logs if the Format of an uploaded file, which is sniffed
+// from blob, isn't what its Content-Type or filename declared.
+func logMislabeled(blob []byte, part *multipart.Part) {
+	if f, mismatch := format.DetectFormatDeclared(blob, part.Header.Get("Content-Type"), part.FileName()); mismatch && f != format.Unknown {
+		log.Printf("Upload: %s is actually %s, not as declared", part.FileName(), f)
+	}
+}
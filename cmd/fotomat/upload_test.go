@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/thumbnail"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpload(t *testing.T) {
+	blob, err := ioutil.ReadFile(*localImageDirectory + "flowers.png")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	thumb, code := upload(t, blob, map[string]string{"width": "64", "height": "64"})
+	if assert.Equal(t, http.StatusOK, code) {
+		m, err := format.MetadataBytes(thumb)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []int{64, 42}, []int{m.Width, m.Height})
+		}
+	}
+
+	// Options take friendly URL grammar tokens.
+	thumb, code = upload(t, blob, map[string]string{"width": "64", "height": "64", "options": "crop"})
+	if assert.Equal(t, http.StatusOK, code) {
+		m, err := format.MetadataBytes(thumb)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []int{64, 64}, []int{m.Width, m.Height})
+		}
+	}
+
+	// Bad sizes and options, and missing or bad images, are rejected.
+	_, code = upload(t, blob, map[string]string{"width": "64"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, code = upload(t, blob, map[string]string{"width": "64", "height": "64", "options": "bogus"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, code = upload(t, nil, map[string]string{"width": "64", "height": "64"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, code = upload(t, []byte("not an image"), map[string]string{"width": "64", "height": "64"})
+	assert.Equal(t, http.StatusUnsupportedMediaType, code)
+
+	// Conflicting options are rejected, as the proxy does.
+	_, code = upload(t, blob, map[string]string{"width": "64", "height": "64", "options": "pad,mp4"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Only POSTs are accepted.
+	_, code = fetch("upload")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestReadUpload(t *testing.T) {
+	read := func(body []byte, contentType string, maxBytes int64) ([]byte, map[string]string, error) {
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		return readUpload(req, maxBytes)
+	}
+
+	// Fields that aren't used are skipped.
+	body, contentType := uploadForm(t, []byte("0123456789"), map[string]string{"width": "64", "other": "1"})
+	blob, fields, err := read(body, contentType, 10)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("0123456789"), blob)
+		assert.Equal(t, map[string]string{"width": "64"}, fields)
+	}
+
+	_, _, err = read(body, contentType, 9)
+	assert.Equal(t, thumbnail.ErrSourceTooBig, err)
+
+	// As are forms with more than one file, or too many parts.
+	buf := bytes.Buffer{}
+	mw := multipart.NewWriter(&buf)
+	for i := 0; i < 2; i++ {
+		part, err := mw.CreateFormFile("image", "image")
+		if assert.Nil(t, err) {
+			_, err = part.Write([]byte("0123456789"))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, mw.Close())
+	_, _, err = read(buf.Bytes(), mw.FormDataContentType(), 10)
+	assert.Equal(t, errExtraUpload, err)
+
+	buf.Reset()
+	mw = multipart.NewWriter(&buf)
+	for i := 0; i <= maxUploadParts; i++ {
+		assert.Nil(t, mw.WriteField("other", "1"))
+	}
+	assert.Nil(t, mw.Close())
+	_, _, err = read(buf.Bytes(), mw.FormDataContentType(), 10)
+	assert.Equal(t, errTooManyParts, err)
+}
+
+// upload POSTs blob, if set, and fields to /upload, and returns the
+// response body and status.
+func upload(t *testing.T, blob []byte, fields map[string]string) ([]byte, int) {
+	body, contentType := uploadForm(t, blob, fields)
+
+	resp, err := http.Post("http://"+localhost+"/upload", contentType, bytes.NewReader(body))
+	if !assert.Nil(t, err) {
+		return nil, 0
+	}
+	defer resp.Body.Close()
+
+	thumb, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	return thumb, resp.StatusCode
+}
+
+// uploadForm returns a multipart/form-data body of fields and, if set, an
+// image file blob, and its Content-Type.
+func uploadForm(t *testing.T, blob []byte, fields map[string]string) ([]byte, string) {
+	body := bytes.Buffer{}
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		assert.Nil(t, mw.WriteField(name, value))
+	}
+	if blob != nil {
+		part, err := mw.CreateFormFile("image", "image")
+		if assert.Nil(t, err) {
+			_, err = part.Write(blob)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, mw.Close())
+
+	return body.Bytes(), mw.FormDataContentType()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/die-net/fotomat/thumbnail"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// readHeaderFile reads headers to send on upstream requests from a file
+// of "Name: value" lines, so that secrets such as Authorization needn't
+// be passed on the command line.  Blank lines and lines starting with #
+// are ignored, and a name may be repeated to send several values.
+func readHeaderFile(filename string) (http.Header, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := http.Header{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%s:%d: not a Name: value header", filename, n)
+		}
+		header.Add(name, strings.TrimSpace(kv[1]))
+	}
+
+	return header, scanner.Err()
+}
+
+// headerNames splits a comma-separated list of header names into their
+// canonical forms.
+func headerNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// upstream fetches original images for handlers other than the proxy,
+// with the same User-Agent, additional headers, and size limit.
+type upstream struct {
+	client    *http.Client
+	userAgent string
+	header    http.Header
+	maxBytes  int64
+}
+
+// get returns the body and status of source, or an error if it couldn't
+// be fetched.  A body of more than maxBytes (if positive) is abandoned
+// with thumbnail.ErrSourceTooBig.
+func (u upstream) get(source string) ([]byte, int, error) {
+	r, err := http.NewRequest("GET", source, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.Header.Set("User-Agent", u.userAgent)
+	for key, value := range u.header {
+		r.Header[key] = value
+	}
+
+	resp, err := u.client.Do(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var blob []byte
+	if u.maxBytes > 0 && resp.ContentLength > u.maxBytes {
+		err = thumbnail.ErrSourceTooBig
+	} else if u.maxBytes > 0 {
+		blob, err = ioutil.ReadAll(io.LimitReader(resp.Body, u.maxBytes+1))
+		if err == nil && int64(len(blob)) > u.maxBytes {
+			blob, err = nil, thumbnail.ErrSourceTooBig
+		}
+	} else {
+		blob, err = ioutil.ReadAll(resp.Body)
+	}
+	_ = resp.Body.Close()
+
+	return blob, resp.StatusCode, err
+}
+
+// getOriginal waits for a turn under proxy's limit on images held in RAM,
+// and then gets the original image at source.  If that fails, it responds
+// to w and returns false.  Otherwise the caller must call proxy.Release
+// once done with the image.
+func (u upstream) getOriginal(w http.ResponseWriter, proxy *thumbnail.Proxy, source string) ([]byte, bool) {
+	if !proxy.Acquire(w.(http.CloseNotifier).CloseNotify()) {
+		thumbnail.WriteError(w, 499, thumbnail.ErrorResponse{Code: "aborted", Message: thumbnail.ErrAborted.Error()})
+		return nil, false
+	}
+
+	blob, status, err := u.get(source)
+	switch {
+	case err == thumbnail.ErrSourceTooBig:
+		thumbnail.WriteError(w, http.StatusRequestEntityTooLarge, thumbnail.ErrorResponse{Code: "source_too_big", Message: err.Error()})
+	case err != nil:
+		thumbnail.WriteError(w, http.StatusBadGateway, thumbnail.ErrorResponse{Message: err.Error()})
+	case status == http.StatusNotFound:
+		thumbnail.WriteError(w, status, thumbnail.ErrorResponse{})
+	case status != http.StatusOK:
+		thumbnail.WriteError(w, http.StatusBadGateway, thumbnail.ErrorResponse{})
+	default:
+		return blob, true
+	}
+
+	proxy.Release()
+	return nil, false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/die-net/fotomat/thumbnail"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadHeaderFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "fotomat-headers")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("# Origin credentials.\n\nauthorization: Bearer secret\nX-Tag: a\nX-Tag: b:c\n")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	header, err := readHeaderFile(f.Name())
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.Header{"Authorization": {"Bearer secret"}, "X-Tag": {"a", "b:c"}}, header)
+	}
+
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("not a header\n"), 0600))
+	_, err = readHeaderFile(f.Name())
+	assert.NotNil(t, err)
+
+	_, err = readHeaderFile(f.Name() + ".missing")
+	assert.NotNil(t, err)
+}
+
+func TestHeaderNames(t *testing.T) {
+	assert.Nil(t, headerNames(""))
+	assert.Equal(t, []string{"Cookie", "X-Forwarded-For"}, headerNames("cookie, x-forwarded-for,"))
+}
+
+func TestUpstreamMaxBytes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			w.(http.Flusher).Flush() // Omit Content-Length.
+		}
+		_, _ = w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer ts.Close()
+
+	up := upstream{client: http.DefaultClient, maxBytes: 1000}
+	blob, status, err := up.get(ts.URL + "/chunked")
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, 1000, len(blob))
+	}
+
+	up.maxBytes = 999
+	for _, path := range []string{"/chunked", "/"} {
+		blob, _, err = up.get(ts.URL + path)
+		assert.Equal(t, thumbnail.ErrSourceTooBig, err, path)
+		assert.Nil(t, blob)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/die-net/fotomat/thumbnail"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+var validatePath = flag.String("validate_path", "", "Path to check images POSTed as multipart/form-data at, without thumbnailing them, such as /validate (\"\"=disable).")
+
+const (
+	// maxValidateBytes is the largest image validateHandler or
+	// uploadHandler will read if -max_source_bytes is unset.
+	maxValidateBytes = 64 << 20
+
+	// maxValidateParts is the most parts, files or not, that
+	// validateHandler will read from one form.
+	maxValidateParts = 100
+)
+
+// errTooManyParts is returned by validateHandler or uploadHandler for a
+// form with more than maxValidateParts or maxUploadParts parts.
+var errTooManyParts = errors.New("Too many parts in form")
+
+// validateResult is the outcome of validating one uploaded image.  Status
+// is "ok", or an error code such as "too_big" or "unknown_format".
+type validateResult struct {
+	Filename string `json:"filename"`
+	Status   string `json:"status"`
+	Format   string `json:"format,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+}
+
+// validateHandler checks each image uploaded in a multipart/form-data POST
+// as thumbnail.Validate does, without thumbnailing any, and responds with
+// the results as JSON.  Images are held in RAM under the same limit as
+// proxy's originals, and those of more than maxBytes (0=maxValidateBytes)
+// are rejected without being checked.
+func validateHandler(proxy *thumbnail.Proxy, maxBytes int64) http.Handler {
+	if maxBytes <= 0 {
+		maxBytes = maxValidateBytes
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			thumbnail.WriteError(w, http.StatusMethodNotAllowed, thumbnail.ErrorResponse{})
+			return
+		}
+
+		mr, err := req.MultipartReader()
+		if err != nil {
+			thumbnail.WriteError(w, http.StatusBadRequest, thumbnail.ErrorResponse{Message: err.Error()})
+			return
+		}
+
+		c := currentConfig()
+		aborted := w.(http.CloseNotifier).CloseNotify()
+		results := []validateResult{}
+		for parts := 0; ; parts++ {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err == nil && parts >= maxValidateParts {
+				err = errTooManyParts
+			}
+			if err != nil {
+				thumbnail.WriteError(w, http.StatusBadRequest, thumbnail.ErrorResponse{Message: err.Error()})
+				return
+			}
+			if part.FileName() == "" {
+				continue
+			}
+
+			if !proxy.Acquire(aborted) {
+				thumbnail.WriteError(w, 499, thumbnail.ErrorResponse{Code: "aborted", Message: thumbnail.ErrAborted.Error()})
+				return
+			}
+			r := validateResult{Filename: part.FileName()}
+			blob, err := ioutil.ReadAll(io.LimitReader(part, maxBytes+1))
+			if err != nil {
+				proxy.Release()
+				thumbnail.WriteError(w, http.StatusBadRequest, thumbnail.ErrorResponse{Message: err.Error()})
+				return
+			}
+
+			if int64(len(blob)) > maxBytes {
+				r.Status = thumbnail.ErrorCode(thumbnail.ErrSourceTooBig)
+			} else {
+				logMislabeled(blob, part)
+				m, err := thumbnail.Validate(blob, c.maxBufferPixels)
+				r.Status = "ok"
+				if err != nil {
+					r.Status = thumbnail.ErrorCode(err)
+				}
+				if m.Width > 0 {
+					r.Format, r.Width, r.Height = m.Format.String(), m.Width, m.Height
+				}
+			}
+			blob = nil      // Free up image memory ASAP.
+			proxy.Release() // Release semaphore ASAP.
+			results = append(results, r)
+		}
+
+		j, err := json.Marshal(struct {
+			Results []validateResult `json:"results"`
+		}{results})
+		if err != nil {
+			thumbnail.WriteError(w, http.StatusInternalServerError, thumbnail.ErrorResponse{Message: err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(j)))
+		_, _ = w.Write(j)
+	})
+}
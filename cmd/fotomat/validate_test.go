@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	body := bytes.Buffer{}
+	mw := multipart.NewWriter(&body)
+	for _, filename := range []string{"watermelon.jpg", "bad.jpg", "34000px.png"} {
+		blob, err := ioutil.ReadFile(*localImageDirectory + filename)
+		if !assert.Nil(t, err) {
+			return
+		}
+		part, err := mw.CreateFormFile("image", filename)
+		if !assert.Nil(t, err) {
+			return
+		}
+		_, err = part.Write(blob)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, mw.Close())
+
+	resp, err := http.Post("http://"+localhost+"/validate", mw.FormDataContentType(), &body)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	r := struct {
+		Results []validateResult `json:"results"`
+	}{}
+	if assert.Nil(t, json.NewDecoder(resp.Body).Decode(&r)) {
+		assert.Equal(t, []validateResult{
+			{Filename: "watermelon.jpg", Status: "ok", Format: "image/jpeg", Width: 398, Height: 536},
+			{Filename: "bad.jpg", Status: "unknown_format"},
+			{Filename: "34000px.png", Status: "too_big", Format: "image/png", Width: 34000, Height: 16},
+		}, r.Results)
+	}
+
+	// Only POSTs are accepted.
+	_, code := fetch("validate")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// As are only a limited number of parts.
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	for i := 0; i <= maxValidateParts; i++ {
+		assert.Nil(t, mw.WriteField("field", "value"))
+	}
+	assert.Nil(t, mw.Close())
+	resp, err = http.Post("http://"+localhost+"/validate", mw.FormDataContentType(), &body)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -0,0 +1,40 @@
+package format
+
+import (
+	"github.com/die-net/fotomat/vips"
+)
+
+// Capabilities describes what the VIPS library in use, as it was built,
+// is able to do with each Format.
+type Capabilities struct {
+	// VipsVersion is the version of the VIPS library.
+	VipsVersion string `json:"vips_version"`
+	// Load lists the mime types of Formats that can be loaded.
+	Load []string `json:"load"`
+	// Save lists the mime types of Formats that can be saved.
+	Save []string `json:"save"`
+	// JpegEncoder is the JpegEncoder VIPS is linked against.
+	JpegEncoder string `json:"jpeg_encoder"`
+}
+
+// DetectCapabilities returns the Capabilities of the VIPS library in use.
+func DetectCapabilities() Capabilities {
+	c := Capabilities{VipsVersion: vips.Version(), Load: []string{}, Save: []string{}, JpegEncoder: JpegEncoder()}
+
+	for format, info := range formatInfo {
+		if info.loadOp != "" && Format(format).loaderAvailable() {
+			c.Load = append(c.Load, Format(format).String())
+		}
+		if info.saveOp != "" && vips.OperationExists(info.saveOp) {
+			c.Save = append(c.Save, Format(format).String())
+		}
+	}
+
+	return c
+}
+
+// SupportedFormats returns the mime types of Formats that the VIPS library
+// in use is able to load.
+func SupportedFormats() []string {
+	return DetectCapabilities().Load
+}
@@ -0,0 +1,168 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	// Photoshop image resource IDs.
+	resourcePathFirst    = 2000
+	resourcePathLast     = 2997
+	resourceClippingPath = 2999
+
+	// Photoshop path record selectors.
+	pathClosedLength      = 0
+	pathClosedLinked      = 1
+	pathClosedUnlinked    = 2
+	pathRecordLength      = 26
+	bezierSegmentsPerKnot = 16
+)
+
+// Point is a position within an image, as a fraction of its width and
+// height.
+type Point struct {
+	X float64
+	Y float64
+}
+
+// ClippingPath returns the closed subpaths of the clipping path a JPEG
+// blob selects from its Photoshop image resources, such as to remove the
+// background of a product photo.  Curves are flattened into polygons, and
+// points are relative to the image as stored, before any Orientation is
+// applied.  Returns false if there is no clipping path.
+func ClippingPath(blob []byte) ([][]Point, bool) {
+	resources := photoshopResources(blob)
+
+	// The clipping path resource holds the name of the path to use.
+	name := ""
+	for _, r := range resources {
+		if r.id == resourceClippingPath && len(r.data) > 0 && int(r.data[0])+1 <= len(r.data) {
+			name = string(r.data[1 : 1+int(r.data[0])])
+		}
+	}
+	if name == "" {
+		return nil, false
+	}
+
+	for _, r := range resources {
+		if r.id >= resourcePathFirst && r.id <= resourcePathLast && r.name == name {
+			paths := parsePath(r.data)
+			return paths, len(paths) > 0
+		}
+	}
+
+	return nil, false
+}
+
+type photoshopResource struct {
+	id   uint16
+	name string
+	data []byte
+}
+
+// photoshopResources returns the Photoshop image resources from the APP13
+// segments of a JPEG.
+func photoshopResources(blob []byte) []photoshopResource {
+	prefix := []byte("Photoshop 3.0\x00")
+	irb := []byte{}
+	for i := 2; i+4 <= len(blob) && blob[i] == 0xff; {
+		marker := blob[i+1]
+		end := i + 2 + int(binary.BigEndian.Uint16(blob[i+2:i+4]))
+		if marker == 0xda || end > len(blob) { // Start of scan.
+			break
+		}
+		if marker == 0xed && bytes.HasPrefix(blob[i+4:end], prefix) {
+			irb = append(irb, blob[i+4+len(prefix):end]...)
+		}
+		i = end
+	}
+
+	// Each resource is a signature, ID, even-padded Pascal string name,
+	// and even-padded length-prefixed data.
+	resources := []photoshopResource{}
+	for i := 0; i+8 <= len(irb) && string(irb[i:i+4]) == "8BIM"; {
+		id := binary.BigEndian.Uint16(irb[i+4 : i+6])
+		n := int(irb[i+6])
+		start := i + 6 + (n+2)&^1
+		if start+4 > len(irb) {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(irb[start : start+4]))
+		if size < 0 || start+4+size > len(irb) {
+			break
+		}
+
+		resources = append(resources, photoshopResource{
+			id:   id,
+			name: string(irb[i+7 : i+7+n]),
+			data: irb[start+4 : start+4+size],
+		})
+		i = start + 4 + (size+1)&^1
+	}
+
+	return resources
+}
+
+// parsePath flattens the closed subpaths in Photoshop path resource data.
+// Open subpaths can't clip anything, so are skipped.
+func parsePath(data []byte) [][]Point {
+	paths := [][]Point{}
+	var knots [][3]Point
+	closed := false
+
+	finish := func() {
+		if closed && len(knots) > 1 {
+			paths = append(paths, flattenBezier(knots))
+		}
+		knots = nil
+	}
+
+	for i := 0; i+pathRecordLength <= len(data); i += pathRecordLength {
+		r := data[i : i+pathRecordLength]
+		switch binary.BigEndian.Uint16(r) {
+		case pathClosedLength:
+			finish()
+			closed = true
+		case pathClosedLinked, pathClosedUnlinked:
+			// Control point before, anchor point, control point after.
+			var k [3]Point
+			for j := range k {
+				k[j] = Point{Y: pathFixed(r[2+8*j:]), X: pathFixed(r[6+8*j:])}
+			}
+			knots = append(knots, k)
+		default:
+			// Open subpaths, fill rules, and the clipboard.
+			finish()
+			closed = false
+		}
+	}
+	finish()
+
+	return paths
+}
+
+// pathFixed converts a signed 8.24 fixed point number.
+func pathFixed(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / (1 << 24)
+}
+
+// flattenBezier approximates a closed path of cubic Bezier knots with a
+// polygon.
+func flattenBezier(knots [][3]Point) []Point {
+	polygon := make([]Point, 0, len(knots)*bezierSegmentsPerKnot)
+	for i, k := range knots {
+		next := knots[(i+1)%len(knots)]
+		p0, p1, p2, p3 := k[1], k[2], next[0], next[1]
+		for s := 0; s < bezierSegmentsPerKnot; s++ {
+			t := float64(s) / bezierSegmentsPerKnot
+			u := 1 - t
+			a, b, c, d := u*u*u, 3*u*u*t, 3*u*t*t, t*t*t
+			polygon = append(polygon, Point{
+				X: a*p0.X + b*p1.X + c*p2.X + d*p3.X,
+				Y: a*p0.Y + b*p1.Y + c*p2.Y + d*p3.Y,
+			})
+		}
+	}
+	return polygon
+}
@@ -0,0 +1,285 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/die-net/fotomat/vips"
+	"strings"
+	"time"
+)
+
+// Exif is the commonly useful subset of an image's EXIF metadata, such as
+// for a photo management UI.  Fields that aren't present are left zero.
+type Exif struct {
+	Make        string `json:"make,omitempty"`
+	Model       string `json:"model,omitempty"`
+	LensModel   string `json:"lens_model,omitempty"`
+	Software    string `json:"software,omitempty"`
+	Copyright   string `json:"copyright,omitempty"`
+	Orientation int    `json:"orientation,omitempty"`
+	// CaptureTime is when the photo was taken, as local time without a
+	// zone, in the form 2006-01-02T15:04:05.
+	CaptureTime string `json:"capture_time,omitempty"`
+	// ExposureTime is in seconds.
+	ExposureTime float64 `json:"exposure_time,omitempty"`
+	FNumber      float64 `json:"f_number,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	// FocalLength is in millimetres.
+	FocalLength float64 `json:"focal_length,omitempty"`
+	// GPS is where the photo was taken, if recorded.  Since this may be
+	// sensitive, callers may want to remove it before sharing Exif.
+	GPS *GPS `json:"gps,omitempty"`
+}
+
+// GPS is a location from EXIF.
+type GPS struct {
+	// Latitude and Longitude are in decimal degrees, negative for
+	// south and west.
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Altitude is in metres above sea level.
+	Altitude float64 `json:"altitude,omitempty"`
+}
+
+// EXIF tags, from IFD0, the EXIF sub-IFD, and the GPS IFD.
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagSoftware         = 0x0131
+	tagDateTime         = 0x0132
+	tagCopyright        = 0x8298
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+	tagPixelXDimension  = 0xA002
+	tagPixelYDimension  = 0xA003
+	tagLensModel        = 0xA434
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+	tagGPSAltitudeRef   = 0x0005
+	tagGPSAltitude      = 0x0006
+)
+
+// ExifBytes parses an image byte slice and returns its Exif, which is
+// zero if it has none, or an error.
+func ExifBytes(blob []byte) (Exif, error) {
+	format := DetectFormat(blob)
+	if format == Unknown {
+		return Exif{}, ErrUnknownFormat
+	}
+
+	image, err := format.LoadBytes(blob)
+	if err != nil {
+		return Exif{}, loadError(err)
+	}
+
+	defer image.Close()
+
+	return ExifImage(image), nil
+}
+
+// ExifImage returns the Exif of an Image, which is zero if it has none.
+func ExifImage(image *vips.Image) Exif {
+	if exif, ok := image.ImageGetBlob(vips.MetaExifName); ok {
+		return parseExif(exif)
+	}
+	return Exif{}
+}
+
+// parseExif returns the Exif in raw EXIF data, which may start with an
+// "Exif\0\0" prefix.
+func parseExif(exif []byte) Exif {
+	t, ok := newTiff(exif)
+	if !ok {
+		return Exif{}
+	}
+
+	ifd0 := t.ifd(t.first())
+	e := Exif{
+		Make:        t.string(ifd0[tagMake]),
+		Model:       t.string(ifd0[tagModel]),
+		Software:    t.string(ifd0[tagSoftware]),
+		Copyright:   t.string(ifd0[tagCopyright]),
+		Orientation: int(validOrientation(int(t.uint(ifd0[tagOrientation])), true)),
+		CaptureTime: exifTime(t.string(ifd0[tagDateTime])),
+	}
+
+	if sub, ok := ifd0[tagExifIFD]; ok {
+		ifd := t.ifd(int(t.uint(sub)))
+		e.LensModel = t.string(ifd[tagLensModel])
+		e.ExposureTime = t.rational(ifd[tagExposureTime], 0)
+		e.FNumber = t.rational(ifd[tagFNumber], 0)
+		e.ISO = int(t.uint(ifd[tagISO]))
+		e.FocalLength = t.rational(ifd[tagFocalLength], 0)
+		if original := exifTime(t.string(ifd[tagDateTimeOriginal])); original != "" {
+			e.CaptureTime = original
+		}
+	}
+
+	if gps, ok := ifd0[tagGPSIFD]; ok {
+		ifd := t.ifd(int(t.uint(gps)))
+		lat, latOk := t.degrees(ifd[tagGPSLatitude])
+		lon, lonOk := t.degrees(ifd[tagGPSLongitude])
+		if latOk && lonOk {
+			e.GPS = &GPS{Latitude: lat, Longitude: lon, Altitude: t.rational(ifd[tagGPSAltitude], 0)}
+			if t.string(ifd[tagGPSLatitudeRef]) == "S" {
+				e.GPS.Latitude = -lat
+			}
+			if t.string(ifd[tagGPSLongitudeRef]) == "W" {
+				e.GPS.Longitude = -lon
+			}
+			if t.uint(ifd[tagGPSAltitudeRef]) == 1 {
+				e.GPS.Altitude = -e.GPS.Altitude
+			}
+		}
+	}
+
+	return e
+}
+
+// exifTime converts an EXIF "2006:01:02 15:04:05" time to the form
+// 2006-01-02T15:04:05, or returns "" if it isn't valid.
+func exifTime(s string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", s)
+	if err != nil {
+		return ""
+	}
+	return t.Format("2006-01-02T15:04:05")
+}
+
+// tiff is the TIFF structure of raw EXIF data.
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry is an IFD entry's type, count, and value, which is at most
+// 4 bytes, or else the offset of the value.
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// tiffTypeSizes are the sizes of the TIFF types that EXIF uses.
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// newTiff validates the TIFF header of raw EXIF data, which may start with
+// an "Exif\0\0" prefix.
+func newTiff(exif []byte) (tiff, bool) {
+	if bytes.HasPrefix(exif, []byte("Exif\x00\x00")) {
+		exif = exif[6:]
+	}
+	if len(exif) < 8 {
+		return tiff{}, false
+	}
+
+	switch string(exif[:4]) {
+	case "II*\x00":
+		return tiff{exif, binary.LittleEndian}, true
+	case "MM\x00*":
+		return tiff{exif, binary.BigEndian}, true
+	default:
+		return tiff{}, false
+	}
+}
+
+// first returns the offset of IFD0.
+func (t tiff) first() int {
+	return int(t.order.Uint32(t.b[4:8]))
+}
+
+// ifd returns the entries of the IFD at offset, by tag.
+func (t tiff) ifd(offset int) map[uint16]tiffEntry {
+	entries := map[uint16]tiffEntry{}
+	if offset < 8 || offset+2 > len(t.b) {
+		return entries
+	}
+
+	// Each IFD entry is a tag, type, count, and value.
+	n := int(t.order.Uint16(t.b[offset : offset+2]))
+	for i := offset + 2; i+12 <= len(t.b) && n > 0; i, n = i+12, n-1 {
+		entries[t.order.Uint16(t.b[i:i+2])] = tiffEntry{
+			typ:   t.order.Uint16(t.b[i+2 : i+4]),
+			count: t.order.Uint32(t.b[i+4 : i+8]),
+			value: t.b[i+8 : i+12],
+		}
+	}
+
+	return entries
+}
+
+// data returns the bytes of an entry's value, or nil if it's out of range.
+func (t tiff) data(e tiffEntry) []byte {
+	size, ok := tiffTypeSizes[e.typ]
+	if !ok || e.count == 0 || e.count > uint32(len(t.b)) {
+		return nil
+	}
+
+	n := size * int(e.count)
+	if n <= 4 {
+		return e.value[:n]
+	}
+
+	offset := int(t.order.Uint32(e.value))
+	if offset < 8 || offset+n > len(t.b) {
+		return nil
+	}
+	return t.b[offset : offset+n]
+}
+
+// string returns an ASCII entry, without trailing NULs or spaces.
+func (t tiff) string(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimRight(string(t.data(e)), "\x00 ")
+}
+
+// uint returns the first value of a BYTE, SHORT, or LONG entry, or 0.
+func (t tiff) uint(e tiffEntry) uint32 {
+	b := t.data(e)
+	switch {
+	case e.typ == 1 && len(b) >= 1:
+		return uint32(b[0])
+	case e.typ == 3 && len(b) >= 2:
+		return uint32(t.order.Uint16(b))
+	case e.typ == 4 && len(b) >= 4:
+		return t.order.Uint32(b)
+	}
+	return 0
+}
+
+// rational returns value i of a RATIONAL or SRATIONAL entry, or 0.
+func (t tiff) rational(e tiffEntry, i int) float64 {
+	b := t.data(e)
+	if (e.typ != 5 && e.typ != 10) || len(b) < 8*(i+1) {
+		return 0
+	}
+
+	b = b[8*i:]
+	num, den := t.order.Uint32(b), t.order.Uint32(b[4:])
+	if den == 0 {
+		return 0
+	}
+	if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den))
+	}
+	return float64(num) / float64(den)
+}
+
+// degrees returns the decimal degrees of a GPS degrees, minutes, and
+// seconds entry.
+func (t tiff) degrees(e tiffEntry) (float64, bool) {
+	if e.typ != 5 || e.count != 3 {
+		return 0, false
+	}
+	return t.rational(e, 0) + t.rational(e, 1)/60 + t.rational(e, 2)/3600, true
+}
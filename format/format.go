@@ -1,9 +1,13 @@
 package format
 
 import (
+	"encoding/binary"
 	"errors"
 	"github.com/die-net/fotomat/vips"
+	"mime"
 	"net/http"
+	"path"
+	"strings"
 )
 
 var (
@@ -11,6 +15,18 @@ var (
 	ErrInvalidOperation = errors.New("Invalid operation")
 	// ErrUnknownFormat is returned when the given image is in an unknown format.
 	ErrUnknownFormat = errors.New("Unknown image format")
+	// ErrLoaderUnavailable is returned when the given image is in a known
+	// format, but the VIPS library in use can't load it, such as if it
+	// was built without the library for that format, or Fotomat has no
+	// loader for it, as for TIFF.
+	ErrLoaderUnavailable = errors.New("Image format can't be loaded by this build of VIPS")
+	// ErrCorruptHeader is returned when the given image's header is
+	// internally inconsistent, such as a JPEG whose EXIF dimensions
+	// disagree with its frame header.
+	ErrCorruptHeader = errors.New("Image header is inconsistent")
+	// ErrTooManyPixels is returned by Reset if an image has more pixels
+	// than allowed.
+	ErrTooManyPixels = errors.New("Image has too many pixels")
 )
 
 // Format of compressed image.
@@ -23,22 +39,45 @@ const (
 	Png
 	Gif
 	Webp
+	Avif
+	Tiff
 )
 
 var formatInfo = []struct {
 	mime      string
+	ext       string
+	loadOp    string
+	saveOp    string
 	loadFile  func(filename string) (*vips.Image, error)
 	loadBytes func([]byte) (*vips.Image, error)
+	loadPage  func([]byte, int) (*vips.Image, error)
 }{
-	{mime: "application/octet-stream", loadFile: nil, loadBytes: nil},
-	{mime: "image/jpeg", loadFile: vips.Jpegload, loadBytes: vips.JpegloadBuffer},
-	{mime: "image/png", loadFile: vips.Pngload, loadBytes: vips.PngloadBuffer},
-	{mime: "image/gif", loadFile: vips.Gifload, loadBytes: vips.GifloadBuffer},
-	{mime: "image/webp", loadFile: vips.Webpload, loadBytes: vips.WebploadBuffer},
+	{mime: "application/octet-stream", ext: "", loadOp: "", saveOp: "", loadFile: nil, loadBytes: nil, loadPage: nil},
+	{mime: "image/jpeg", ext: ".jpg", loadOp: "jpegload_buffer", saveOp: "jpegsave_buffer", loadFile: vips.Jpegload, loadBytes: vips.JpegloadBuffer, loadPage: nil},
+	{mime: "image/png", ext: ".png", loadOp: "pngload_buffer", saveOp: "pngsave_buffer", loadFile: vips.Pngload, loadBytes: vips.PngloadBuffer, loadPage: nil},
+	{mime: "image/gif", ext: ".gif", loadOp: "gifload_buffer", saveOp: "gifsave_buffer", loadFile: vips.Gifload, loadBytes: vips.GifloadBuffer, loadPage: vips.GifloadBufferPage},
+	{mime: "image/webp", ext: ".webp", loadOp: "webpload_buffer", saveOp: "webpsave_buffer", loadFile: vips.Webpload, loadBytes: vips.WebploadBuffer, loadPage: vips.WebploadBufferPage},
+	{mime: "image/avif", ext: ".avif", loadOp: "heifload_buffer", saveOp: "", loadFile: vips.Heifload, loadBytes: vips.HeifloadBuffer, loadPage: vips.HeifloadBufferPage},
+	{mime: "image/tiff", ext: ".tif", loadOp: "tiffload_buffer", saveOp: "tiffsave_buffer", loadFile: vips.Tiffload, loadBytes: vips.TiffloadBuffer, loadPage: vips.TiffloadBufferPage},
 }
 
-// DetectFormat detects the Format of the supplied byte slice.
+// Less common names for formats, seen in the wild.
+var (
+	mimeAliases = map[string]Format{"image/jpg": Jpeg, "image/pjpeg": Jpeg}
+	extAliases  = map[string]Format{".jpeg": Jpeg, ".jpe": Jpeg, ".tiff": Tiff}
+)
+
+// DetectFormat detects the Format of the supplied byte slice.  This is the
+// authoritative Format of an image, and is what's used to pick a loader.
 func DetectFormat(blob []byte) Format {
+	// http.DetectContentType doesn't know about AVIF or TIFF.
+	if isAvif(blob) {
+		return Avif
+	}
+	if isTiff(blob) {
+		return Tiff
+	}
+
 	mime := http.DetectContentType(blob)
 
 	for format, info := range formatInfo {
@@ -50,11 +89,118 @@ func DetectFormat(blob []byte) Format {
 	return Unknown
 }
 
+// isAvif returns true if blob starts with an ISO-BMFF "ftyp" box whose
+// major or compatible brands include AVIF.
+func isAvif(blob []byte) bool {
+	if len(blob) < 16 || string(blob[4:8]) != "ftyp" {
+		return false
+	}
+
+	size := int(binary.BigEndian.Uint32(blob[0:4]))
+	if size > len(blob) {
+		size = len(blob)
+	}
+
+	// Major brand is at 8, minor version at 12, and compatible brands
+	// from 16 to the end of the box.
+	for i := 8; i+4 <= size; i += 4 {
+		if i == 12 {
+			continue
+		}
+		switch string(blob[i : i+4]) {
+		case "avif", "avis":
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsLossless returns true if the compressed image blob is in a lossless
+// encoding: PNG, GIF, or WebP with a VP8L bitstream.
+func IsLossless(blob []byte) bool {
+	switch DetectFormat(blob) {
+	case Png, Gif:
+		return true
+	case Webp:
+		// RIFF chunks follow the 12 byte header, each an ID, a
+		// little-endian size, and data padded to an even length.
+		for i := 12; i+8 <= len(blob); {
+			switch string(blob[i : i+4]) {
+			case "VP8L":
+				return true
+			case "VP8 ":
+				return false
+			}
+			i += 8 + (int(binary.LittleEndian.Uint32(blob[i+4:i+8]))+1)&^1
+		}
+	}
+
+	return false
+}
+
+// DetectFormatDeclared detects the authoritative Format of the supplied
+// byte slice, as DetectFormat does, and returns true if that disagrees with
+// the Format declared by a Content-Type header or, if that is unset, by a
+// filename's extension.  Declarations are never trusted to pick a loader.
+func DetectFormatDeclared(blob []byte, contentType, filename string) (Format, bool) {
+	format := DetectFormat(blob)
+
+	declared := Unknown
+	if contentType != "" {
+		declared = MimeFormat(contentType)
+	} else if filename != "" {
+		declared = ExtensionFormat(filename)
+	}
+
+	return format, declared != Unknown && declared != format
+}
+
+// MimeFormat returns the Format matching a mime type or Content-Type
+// header, or Unknown.
+func MimeFormat(contentType string) Format {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return Unknown
+	}
+
+	for format, info := range formatInfo {
+		if format != int(Unknown) && info.mime == mediaType {
+			return Format(format)
+		}
+	}
+
+	return mimeAliases[mediaType]
+}
+
+// ExtensionFormat returns the Format matching a filename's extension, or
+// Unknown.
+func ExtensionFormat(filename string) Format {
+	ext := strings.ToLower(path.Ext(filename))
+	if ext == "" {
+		return Unknown
+	}
+
+	for format, info := range formatInfo {
+		if info.ext == ext {
+			return Format(format)
+		}
+	}
+
+	return extAliases[ext]
+}
+
 // String returns the mime type of given image format.
 func (format Format) String() string {
 	return formatInfo[format].mime
 }
 
+// Extension returns the usual filename extension, including the leading
+// dot, of given image format.
+func (format Format) Extension() string {
+	return formatInfo[format].ext
+}
+
 // CanLoadFile returns true if we know how to load this format from a file.
 func (format Format) CanLoadFile() bool {
 	return formatInfo[format].loadFile != nil
@@ -65,12 +211,32 @@ func (format Format) CanLoadBytes() bool {
 	return formatInfo[format].loadBytes != nil
 }
 
+// CanSave returns true if the VIPS library in use can save this format.
+func (format Format) CanSave() bool {
+	saveOp := formatInfo[format].saveOp
+	return saveOp != "" && vips.OperationExists(saveOp)
+}
+
+// loaderAvailable returns true if the VIPS library in use provides the
+// loader for this format, and it's enabled.  A build of VIPS may have the
+// loader's function but not the library it needs, so calling it would fail
+// opaquely.
+func (format Format) loaderAvailable() bool {
+	if format == Tiff && !LoadTiff {
+		return false
+	}
+	return vips.OperationExists(formatInfo[format].loadOp)
+}
+
 // LoadFile loads a file in a given Format and returns an Image.
 func (format Format) LoadFile(filename string) (*vips.Image, error) {
 	loadFile := formatInfo[format].loadFile
 	if loadFile == nil {
 		return nil, ErrInvalidOperation
 	}
+	if !format.loaderAvailable() {
+		return nil, ErrLoaderUnavailable
+	}
 
 	return loadFile(filename)
 }
@@ -81,6 +247,53 @@ func (format Format) LoadBytes(blob []byte) (*vips.Image, error) {
 	if loadBytes == nil {
 		return nil, ErrInvalidOperation
 	}
+	if !format.loaderAvailable() {
+		return nil, ErrLoaderUnavailable
+	}
 
 	return loadBytes(blob)
 }
+
+// LoadBytesPage loads page number page, counting from 0, of a multi-page
+// or animated byte slice in a given format and returns an Image.
+func (format Format) LoadBytesPage(blob []byte, page int) (*vips.Image, error) {
+	if page == 0 {
+		return format.LoadBytes(blob)
+	}
+
+	loadPage := formatInfo[format].loadPage
+	if loadPage == nil {
+		return nil, ErrInvalidOperation
+	}
+	if !format.loaderAvailable() {
+		return nil, ErrLoaderUnavailable
+	}
+
+	return loadPage(blob, page)
+}
+
+// Reset loads a byte slice in whichever Format DetectFormat finds into
+// image, freeing the image it previously held, to avoid finalizing a new
+// Image for each of many images in a row.  Images with more than
+// maxPixels pixels (0=unlimited) are rejected with ErrTooManyPixels before
+// they are decoded.  On error, image is closed.
+func Reset(image *vips.Image, blob []byte, maxPixels int) error {
+	format := DetectFormat(blob)
+	if format == Unknown {
+		image.Close()
+		return ErrUnknownFormat
+	}
+
+	loaded, err := format.LoadBytes(blob)
+	if err == nil && maxPixels > 0 && loaded.Xsize()*loaded.Ysize() > maxPixels {
+		loaded.Close()
+		err = ErrTooManyPixels
+	}
+	if err != nil {
+		image.Close()
+		return err
+	}
+
+	image.Replace(loaded)
+	return nil
+}
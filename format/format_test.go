@@ -1,11 +1,19 @@
 package format
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/die-net/fotomat/vips"
 	"github.com/stretchr/testify/assert"
+	goimage "image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"strconv"
 	"testing"
 )
@@ -65,6 +73,164 @@ func isSize(blob []byte, f Format, width, height int) error {
 	return nil
 }
 
+func TestProbeDimensions(t *testing.T) {
+	for _, p := range []struct {
+		filename string
+		format   Format
+		width    int
+		height   int
+	}{
+		{"watermelon.jpg", Jpeg, 398, 536},
+		{"flowers.png", Png, 256, 169},
+		{"2px.gif", Gif, 2, 3},
+		{"2px.webp", Webp, 2, 3},
+		{"3000px.png", Png, 3000, 2000},
+		{"34000px.png", Png, 34000, 16},
+	} {
+		f, w, h, err := ProbeDimensions(image(p.filename))
+		if assert.Nil(t, err, "file: %s", p.filename) {
+			assert.Equal(t, []interface{}{p.format, p.width, p.height}, []interface{}{f, w, h}, "file: %s", p.filename)
+		}
+	}
+
+	// Dimensions are as stored, before orientation.
+	_, w, h, err := ProbeDimensions(image("orient6.jpg"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int{80, 48}, []int{w, h})
+	}
+
+	for _, filename := range []string{"bad.jpg", "notimage.txt"} {
+		_, _, _, err := ProbeDimensions(image(filename))
+		assert.Equal(t, ErrUnknownFormat, err, "file: %s", filename)
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	for _, filename := range []string{"watermelon.jpg", "orient6.jpg", "flowers.png", "2px.gif", "bad.jpg", "notimage.txt"} {
+		assert.Nil(t, CheckHeader(image(filename), false), "file: %s", filename)
+	}
+
+	// EXIF says 100x100, but the frame is 2x3, which can be repaired.
+	assert.Equal(t, ErrCorruptHeader, CheckHeader(image("badexif.jpg"), false))
+	assert.Nil(t, CheckHeader(image("badexif.jpg"), true))
+
+	// An RGB PNG with a bit depth of 4 can't be.
+	assert.Equal(t, ErrCorruptHeader, CheckHeader(image("badheader.png"), false))
+	assert.Equal(t, ErrCorruptHeader, CheckHeader(image("badheader.png"), true))
+
+	// Truncated headers are left for the loader.
+	assert.Nil(t, CheckHeader(image("badheader.png")[:20], false))
+}
+
+func TestPages(t *testing.T) {
+	// A three frame animated GIF.
+	anim := gif.GIF{}
+	for _, c := range []color.Color{color.White, color.Black, color.White} {
+		anim.Image = append(anim.Image, goimage.NewPaletted(goimage.Rect(0, 0, 4, 4), color.Palette{c}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, gif.EncodeAll(&buf, &anim)) {
+		return
+	}
+
+	for _, p := range []struct {
+		name  string
+		blob  []byte
+		pages int
+	}{
+		{"animated.gif", buf.Bytes(), 3},
+		{"2px.gif", image("2px.gif"), 1},
+		{"flowers.png", image("flowers.png"), 1},
+		{"watermelon.jpg", image("watermelon.jpg"), 1},
+		{"2px.webp", image("2px.webp"), 1},
+	} {
+		pages, err := ProbePages(p.blob)
+		if assert.Nil(t, err, "file: %s", p.name) {
+			assert.Equal(t, p.pages, pages, "file: %s", p.name)
+		}
+
+		m, err := MetadataBytes(p.blob)
+		if assert.Nil(t, err, "file: %s", p.name) {
+			assert.Equal(t, p.pages, m.Pages, "file: %s", p.name)
+		}
+	}
+
+	for _, blob := range [][]byte{image("notimage.txt"), []byte("GIF89a\x01\x00\x01\x00")} {
+		_, err := ProbePages(blob)
+		assert.Equal(t, ErrUnknownFormat, err)
+	}
+}
+
+func TestLoaderUnavailable(t *testing.T) {
+	// Simulate a build of VIPS without a JPEG loader.
+	loadOp := formatInfo[Jpeg].loadOp
+	formatInfo[Jpeg].loadOp = "nosuchload_buffer"
+	defer func() { formatInfo[Jpeg].loadOp = loadOp }()
+
+	blob := image("watermelon.jpg")
+	_, err := Jpeg.LoadBytes(blob)
+	assert.Equal(t, ErrLoaderUnavailable, err)
+	_, err = Jpeg.LoadBytesPage(blob, 1)
+	assert.Equal(t, ErrLoaderUnavailable, err)
+	_, err = Jpeg.LoadFile(TestdataPath + "watermelon.jpg")
+	assert.Equal(t, ErrLoaderUnavailable, err)
+	_, err = MetadataBytes(blob)
+	assert.Equal(t, ErrLoaderUnavailable, err)
+	_, err = ExifBytes(blob)
+	assert.Equal(t, ErrLoaderUnavailable, err)
+
+	// Other formats still load, and undecodable images are still unknown.
+	_, err = MetadataBytes(image("2px.png"))
+	assert.Nil(t, err)
+	_, err = MetadataBytes(image("notimage.txt"))
+	assert.Equal(t, ErrUnknownFormat, err)
+
+	// TIFF is known, but there's no loader for it.
+	blob = image("2px.tif")
+	assert.Equal(t, Tiff, DetectFormat(blob))
+	_, err = MetadataBytes(blob)
+	assert.Equal(t, ErrLoaderUnavailable, err)
+}
+
+func TestReset(t *testing.T) {
+	img := &vips.Image{}
+	if assert.Nil(t, Reset(img, image("watermelon.jpg"), 0)) {
+		assert.Equal(t, 398, img.Xsize())
+		assert.Nil(t, img.Write())
+	}
+
+	// The JPEG is freed, and the PNG loaded in its place.
+	if assert.Nil(t, Reset(img, image("2px.png"), 6)) {
+		assert.Equal(t, 2, img.Xsize())
+	}
+
+	// Too many pixels, a bad image, or one whose loader is off closes it.
+	assert.Equal(t, ErrTooManyPixels, Reset(img, image("watermelon.jpg"), 398*536-1))
+	assert.Equal(t, ErrUnknownFormat, Reset(img, image("notimage.txt"), 0))
+	assert.Equal(t, ErrLoaderUnavailable, Reset(img, image("2px.tif"), 0))
+
+	// A closed Image can be reused.
+	if assert.Nil(t, Reset(img, image("2px.png"), 0)) {
+		assert.Equal(t, 3, img.Ysize())
+	}
+	img.Close()
+}
+
+func TestDetectAvif(t *testing.T) {
+	// Major brand.
+	assert.Equal(t, Avif, DetectFormat([]byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf")))
+	// Compatible brand.
+	assert.Equal(t, Avif, DetectFormat([]byte("\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1avis")))
+	// Other ISO-BMFF brands, such as HEIC, aren't AVIF.
+	assert.NotEqual(t, Avif, DetectFormat([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")))
+	// Brands after the end of the ftyp box don't count.
+	assert.NotEqual(t, Avif, DetectFormat([]byte("\x00\x00\x00\x14ftypmif1\x00\x00\x00\x00mif1avif")))
+
+	assert.Equal(t, "image/avif", Avif.String())
+	assert.Equal(t, Avif, ExtensionFormat("photo.avif"))
+}
+
 func TestFormatCanLoad(t *testing.T) {
 	assert.Equal(t, "image/jpeg", Jpeg.String())
 	assert.True(t, Jpeg.CanLoadBytes())
@@ -81,6 +247,47 @@ func TestFormatCanLoad(t *testing.T) {
 	assert.Equal(t, ErrInvalidOperation, err)
 }
 
+func TestFormatDeclared(t *testing.T) {
+	jpeg := image("watermelon.jpg")
+
+	// A JPEG named .png is still detected as a JPEG, with a mismatch.
+	f, mismatch := DetectFormatDeclared(jpeg, "", "watermelon.png")
+	assert.Equal(t, Jpeg, f)
+	assert.True(t, mismatch)
+
+	// Content-Type takes precedence over the filename.
+	f, mismatch = DetectFormatDeclared(jpeg, "image/png; charset=binary", "watermelon.jpg")
+	assert.Equal(t, Jpeg, f)
+	assert.True(t, mismatch)
+
+	// Matching or missing declarations aren't a mismatch.
+	_, mismatch = DetectFormatDeclared(jpeg, "image/jpg", "")
+	assert.False(t, mismatch)
+	_, mismatch = DetectFormatDeclared(jpeg, "", "WATERMELON.JPEG")
+	assert.False(t, mismatch)
+	_, mismatch = DetectFormatDeclared(jpeg, "application/octet-stream", "watermelon.png")
+	assert.False(t, mismatch)
+	_, mismatch = DetectFormatDeclared(jpeg, "", "")
+	assert.False(t, mismatch)
+
+	assert.Equal(t, ".webp", Webp.Extension())
+	assert.Equal(t, Gif, ExtensionFormat("/a/b.gif"))
+	assert.Equal(t, Unknown, MimeFormat("text/plain"))
+}
+
+func TestCapabilities(t *testing.T) {
+	c := DetectCapabilities()
+	assert.NotEqual(t, "", c.VipsVersion)
+	assert.Contains(t, c.Load, "image/jpeg")
+	assert.Contains(t, c.Load, "image/png")
+	assert.Contains(t, c.Save, "image/jpeg")
+	assert.Contains(t, c.Save, "image/png")
+	assert.NotContains(t, c.Load, Unknown.String())
+
+	assert.Equal(t, c.Load, SupportedFormats())
+	assert.Contains(t, []string{Mozjpeg, Libjpeg}, c.JpegEncoder)
+}
+
 func TestFormatOrientation(t *testing.T) {
 	for i := 0; i <= 8; i++ {
 		filename := "orient" + strconv.Itoa(i) + ".jpg"
@@ -89,11 +296,221 @@ func TestFormatOrientation(t *testing.T) {
 		if assert.Nil(t, err) {
 			assert.Equal(t, m.Width, 48)
 			assert.Equal(t, m.Height, 80)
+			assert.Equal(t, Portrait, m.Shape(), filename)
+			assert.Equal(t, 0.6, m.AspectRatio(), filename)
 		}
 
 		thumb := convert(image(filename), SaveOptions{})
 		assert.Nil(t, isSize(thumb, Jpeg, 48, 80))
 	}
+
+	assert.Equal(t, Square, Metadata{Width: 64, Height: 64}.Shape())
+	assert.Equal(t, 0.0, Metadata{}.AspectRatio())
+	assert.Equal(t, 0.0, Metadata{Width: 64}.AspectRatio())
+}
+
+func TestFormatOrientationPngWebp(t *testing.T) {
+	// An 80x48 PNG with an eXIf chunk for RightTop.
+	m, err := MetadataBytes(image("orient6.png"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, RightTop, m.Orientation)
+		assert.Equal(t, []int{48, 80}, []int{m.Width, m.Height})
+	}
+	thumb := convert(image("orient6.png"), SaveOptions{Format: Png})
+	assert.Nil(t, isSize(thumb, Png, 48, 80))
+
+	// A 2x3 WebP with an EXIF chunk for RightTop.
+	m, err = MetadataBytes(image("orient6.webp"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, RightTop, m.Orientation)
+		assert.Equal(t, []int{3, 2}, []int{m.Width, m.Height})
+		assert.Equal(t, Landscape, m.Shape())
+	}
+	thumb = convert(image("orient6.webp"), SaveOptions{Format: Webp})
+	assert.Nil(t, isSize(thumb, Webp, 3, 2))
+}
+
+func TestStripUnlessCopyrighted(t *testing.T) {
+	so := SaveOptions{Format: Jpeg, Metadata: StripUnlessCopyrighted}
+
+	// An image with an EXIF copyright keeps it.
+	thumb := convert(image("copyright.jpg"), so)
+	e, err := ExifBytes(thumb)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Copyright 2018 Fotomat Test", e.Copyright)
+	}
+	assert.Equal(t, []string{vips.MetaExifName}, metadataFields(thumb))
+
+	// One without is fully stripped.
+	assert.NotEmpty(t, metadataFields(image("orient6.jpg")))
+	thumb = convert(image("orient6.jpg"), so)
+	assert.Empty(t, metadataFields(thumb))
+
+	// As is a copyrighted one by default.
+	thumb = convert(image("copyright.jpg"), SaveOptions{Format: Jpeg})
+	assert.Empty(t, metadataFields(thumb))
+
+	// The caller's image keeps its color profile.
+	img, err := Jpeg.LoadBytes(image("copyright.jpg"))
+	if assert.Nil(t, err) {
+		icc := img.ImageFieldExists(vips.MetaIccName)
+		_, err = Save(img, so)
+		assert.Nil(t, err)
+		assert.Equal(t, icc, img.ImageFieldExists(vips.MetaIccName))
+		img.Close()
+	}
+
+	img, err = Jpeg.LoadBytes(image("2px.jpg"))
+	if assert.Nil(t, err) {
+		_, err = Save(img, SaveOptions{Metadata: StripUnlessCopyrighted + 1})
+		assert.Equal(t, ErrInvalidMetadataPolicy, err)
+		img.Close()
+	}
+
+	assert.True(t, iptcCopyrighted([]byte("8BIM\x04\x04\x00\x00\x00\x00\x00\x0c\x1c\x02\x74\x00\x07(c) Foo")))
+	assert.False(t, iptcCopyrighted([]byte("8BIM\x04\x04\x00\x00\x00\x00\x00\x0c\x1c\x02\x74\x00\x00")))
+}
+
+// metadataFields returns which of EXIF, XMP, IPTC, and ICC profile
+// metadata the image in blob has.
+func metadataFields(blob []byte) []string {
+	img, err := DetectFormat(blob).LoadBytes(blob)
+	if err != nil {
+		panic(err)
+	}
+	defer img.Close()
+
+	var fields []string
+	for _, field := range []string{vips.MetaExifName, vips.MetaXmpName, vips.MetaIptcName, vips.MetaIccName} {
+		if img.ImageFieldExists(field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func TestExifOrientation(t *testing.T) {
+	// Big and little-endian IFD0 with a single Orientation entry.
+	assert.Equal(t, RightTop, exifOrientation([]byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")))
+	assert.Equal(t, BottomRight, exifOrientation([]byte("Exif\x00\x00II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x03\x00\x00\x00\x00\x00\x00\x00")))
+
+	// Out of range, truncated, or not EXIF.
+	assert.Equal(t, Undefined, exifOrientation([]byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x09\x00\x00\x00\x00\x00\x00")))
+	assert.Equal(t, Undefined, exifOrientation([]byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12")))
+	assert.Equal(t, Undefined, exifOrientation([]byte("not exif")))
+}
+
+func TestExif(t *testing.T) {
+	ascii := func(s string) exifTag { return exifTag{typ: 2, count: uint32(len(s) + 1), data: []byte(s + "\x00")} }
+	rationals := func(v ...uint32) exifTag {
+		data := make([]byte, 4*len(v))
+		for i := range v {
+			binary.BigEndian.PutUint32(data[4*i:], v[i])
+		}
+		return exifTag{typ: 5, count: uint32(len(v) / 2), data: data}
+	}
+	tag := func(id uint16, e exifTag) exifTag { e.tag = id; return e }
+
+	exif := exifBlob(
+		[]exifTag{
+			tag(0x010F, ascii("Canon")),
+			tag(0x0110, ascii("Canon EOS 5D Mark IV")),
+			tag(0x0112, exifTag{typ: 3, count: 1, data: []byte{0, 6}}),
+			tag(0x0132, ascii("2020:01:02 03:04:05")),
+			tag(0x8298, ascii("Copyright 2020 Example")),
+		},
+		[]exifTag{
+			tag(0x829A, rationals(1, 250)),
+			tag(0x829D, rationals(28, 10)),
+			tag(0x8827, exifTag{typ: 3, count: 1, data: []byte{0, 200}}),
+			tag(0x9003, ascii("2019:12:31 23:59:58")),
+			tag(0x920A, rationals(50, 1)),
+			tag(0xA434, ascii("EF50mm f/1.8 STM")),
+		},
+		[]exifTag{
+			tag(0x0001, ascii("N")),
+			tag(0x0002, rationals(37, 1, 30, 1, 0, 1)),
+			tag(0x0003, ascii("W")),
+			tag(0x0004, rationals(122, 1, 15, 1, 0, 1)),
+			tag(0x0005, exifTag{typ: 1, count: 1, data: []byte{0}}),
+			tag(0x0006, rationals(12, 1)),
+		},
+	)
+
+	want := Exif{
+		Make:         "Canon",
+		Model:        "Canon EOS 5D Mark IV",
+		LensModel:    "EF50mm f/1.8 STM",
+		Copyright:    "Copyright 2020 Example",
+		Orientation:  int(RightTop),
+		CaptureTime:  "2019-12-31T23:59:58",
+		ExposureTime: 0.004,
+		FNumber:      2.8,
+		ISO:          200,
+		FocalLength:  50,
+		GPS:          &GPS{Latitude: 37.5, Longitude: -122.25, Altitude: 12},
+	}
+	assert.Equal(t, want, parseExif(exif))
+	assert.Equal(t, want, parseExif(append([]byte("Exif\x00\x00"), exif...)))
+
+	// The EXIF survives being embedded in a JPEG and read back by VIPS.
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, jpeg.Encode(&buf, goimage.NewGray(goimage.Rect(0, 0, 40, 20)), nil)) {
+		return
+	}
+	payload := append([]byte("Exif\x00\x00"), exif...)
+	app1 := append([]byte{0xff, 0xe1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+	blob := append(append(append([]byte{}, buf.Bytes()[:2]...), app1...), buf.Bytes()[2:]...)
+
+	e, err := ExifBytes(blob)
+	if assert.Nil(t, err) {
+		assert.Equal(t, want, e)
+	}
+
+	// Images without EXIF, and truncated or bogus EXIF, have none.
+	e, err = ExifBytes(image("2px.png"))
+	assert.Nil(t, err)
+	assert.Equal(t, Exif{}, e)
+	assert.Equal(t, Exif{}, parseExif(exif[:6]))
+	assert.Equal(t, Exif{Orientation: int(RightTop)}, parseExif(exif[:90]))
+	assert.Equal(t, Exif{}, parseExif([]byte("not exif")))
+
+	_, err = ExifBytes([]byte("not an image"))
+	assert.Equal(t, ErrUnknownFormat, err)
+}
+
+func TestXmpOrientation(t *testing.T) {
+	assert.Equal(t, RightTop, xmpOrientation([]byte(`<rdf:Description tiff:Orientation="6" tiff:Make="x"/>`)))
+	assert.Equal(t, BottomLeft, xmpOrientation([]byte(`<tiff:Make>x</tiff:Make><tiff:Orientation>4</tiff:Orientation>`)))
+	assert.Equal(t, Undefined, xmpOrientation([]byte(`<rdf:Description tiff:Orientation="9"/>`)))
+	assert.Equal(t, Undefined, xmpOrientation([]byte(`<rdf:Description tiff:Orientation="16"/>`)))
+	assert.Equal(t, Undefined, xmpOrientation([]byte(`<rdf:Description tiff:Make="x"/>`)))
+
+	// A 40x20 JPEG with only XMP, stored for RightTop.
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, jpeg.Encode(&buf, goimage.NewGray(goimage.Rect(0, 0, 40, 20)), nil)) {
+		return
+	}
+	xmp := []byte("http://ns.adobe.com/xap/1.0/\x00" +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:tiff="http://ns.adobe.com/tiff/1.0/" tiff:Orientation="6"/></rdf:RDF></x:xmpmeta>`)
+	app1 := append([]byte{0xff, 0xe1, byte((len(xmp) + 2) >> 8), byte(len(xmp) + 2)}, xmp...)
+	blob := append(append(append([]byte{}, buf.Bytes()[:2]...), app1...), buf.Bytes()[2:]...)
+
+	m, err := MetadataBytes(blob)
+	if assert.Nil(t, err) {
+		assert.Equal(t, RightTop, m.Orientation)
+		assert.Equal(t, []int{20, 40}, []int{m.Width, m.Height})
+	}
+	assert.Nil(t, isSize(convert(blob, SaveOptions{Format: Jpeg}), Jpeg, 20, 40))
+
+	// Once applied, the XMP is rewritten as upright.
+	thumb := convert(blob, SaveOptions{Format: Jpeg, KeepMetadata: true})
+	m, err = MetadataBytes(thumb)
+	if assert.Nil(t, err) {
+		assert.Equal(t, TopLeft, m.Orientation)
+		assert.Equal(t, []int{20, 40}, []int{m.Width, m.Height})
+	}
 }
 
 func TestFormatCrop(t *testing.T) {
@@ -148,6 +565,452 @@ func TestSwitchToLossy(t *testing.T) {
 	}
 }
 
+func TestQuantTable(t *testing.T) {
+	img, err := Png.LoadBytes(image("flowers.png"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer img.Close()
+
+	for _, qt := range []int{-1, MaxQuantTable + 1} {
+		_, err = Save(img, SaveOptions{Format: Jpeg, QuantTable: qt})
+		assert.Equal(t, err, ErrInvalidQuantTable)
+	}
+
+	// At quality 50, tables are used unscaled.  Table 0 is from Annex K.
+	blob, err := Save(img, SaveOptions{Format: Jpeg, Quality: 50})
+	if assert.Nil(t, err) {
+		assert.Equal(t, [][]byte{annexKLuma, annexKChroma}, jpegQuantTables(blob))
+	}
+
+	// Table 1 is flat, but only if libjpeg is mozjpeg.
+	blob, err = Save(img, SaveOptions{Format: Jpeg, Quality: 50, QuantTable: 1})
+	if assert.Nil(t, err) {
+		tables := jpegQuantTables(blob)
+		if len(tables) > 0 && bytes.Equal(tables[0], annexKLuma) {
+			t.Skip("libjpeg doesn't support quantization table presets")
+		}
+		flat := bytes.Repeat([]byte{16}, 64)
+		assert.Equal(t, [][]byte{flat, flat}, tables)
+	}
+}
+
+func TestCustomQuantTables(t *testing.T) {
+	img, err := Png.LoadBytes(image("flowers.png"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer img.Close()
+
+	// A luma table rising along rows and columns, and a flat chroma table.
+	var luma, chroma [64]int
+	for i := range luma {
+		luma[i], chroma[i] = 1+i/8+i%8, 40
+	}
+
+	var zero [64]int
+	for _, tables := range [][][64]int{{zero}, {luma, chroma, chroma}} {
+		_, err = Save(img, SaveOptions{Format: Jpeg, CustomQuantTables: tables})
+		assert.Equal(t, ErrInvalidQuantTable, err)
+	}
+	_, err = Save(img, SaveOptions{Format: Jpeg, CustomQuantTables: [][64]int{luma}, KeepMetadata: true})
+	assert.Equal(t, ErrInvalidQuantTable, err)
+
+	if _, err := exec.LookPath(Cjpeg); err != nil {
+		t.Skip("No cjpeg:", err)
+	}
+
+	// The DQT segments hold the tables in zigzag order.
+	blob, err := Save(img, SaveOptions{Format: Jpeg, CustomQuantTables: [][64]int{luma, chroma}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(blob, Jpeg, 256, 169))
+		assert.Equal(t, [][]byte{zigzag(luma), zigzag(chroma)}, jpegQuantTables(blob))
+	}
+
+	// Without a chroma table, the luma table is used for both.
+	blob, err = Save(img, SaveOptions{Format: Jpeg, CustomQuantTables: [][64]int{luma}})
+	if assert.Nil(t, err) {
+		assert.Equal(t, [][]byte{zigzag(luma)}, jpegQuantTables(blob))
+	}
+}
+
+// zigzag returns a quantization table in natural order as the zigzag
+// ordered bytes of a DQT segment.
+func zigzag(table [64]int) []byte {
+	b := make([]byte, 0, 64)
+	for s := 0; s < 15; s++ {
+		for i := 0; i <= s; i++ {
+			row, col := i, s-i
+			if s%2 == 0 {
+				row, col = s-i, i
+			}
+			if row < 8 && col < 8 {
+				b = append(b, byte(table[row*8+col]))
+			}
+		}
+	}
+	return b
+}
+
+func TestSmallJpeg(t *testing.T) {
+	img, err := Png.LoadBytes(image("flowers.png"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer img.Close()
+
+	fast, err := Save(img, SaveOptions{Format: Jpeg})
+	if !assert.Nil(t, err) {
+		return
+	}
+	small, err := Save(img, SaveOptions{Format: Jpeg, SmallJpeg: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	if JpegEncoder() == Mozjpeg {
+		assert.True(t, len(small) < len(fast), "small %d, fast %d", len(small), len(fast))
+	} else {
+		assert.Equal(t, fast, small)
+	}
+}
+
+func TestTargetSSIM(t *testing.T) {
+	detailed, err := Png.LoadBytes(image("flowers.png"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer detailed.Close()
+
+	// A smooth diagonal gradient the same size.
+	w, h := detailed.Xsize(), detailed.Ysize()
+	gradient := goimage.NewRGBA(goimage.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gradient.Set(x, y, color.RGBA{uint8(x * 255 / w), uint8(y * 255 / h), 128, 255})
+		}
+	}
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, png.Encode(&buf, gradient)) {
+		return
+	}
+	flat, err := Png.LoadBytes(buf.Bytes())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer flat.Close()
+
+	for _, f := range []Format{Jpeg, Webp} {
+		so := SaveOptions{Format: f, Quality: 95, TargetSSIM: 0.98}
+		_, flatQuality, err := saveTargetSSIM(flat, so)
+		assert.Nil(t, err)
+		_, detailedQuality, err := saveTargetSSIM(detailed, so)
+		assert.Nil(t, err)
+		assert.True(t, flatQuality < detailedQuality, "%s: flat %d, detailed %d", f, flatQuality, detailedQuality)
+
+		fixed, err := Save(flat, SaveOptions{Format: f, Quality: 95})
+		assert.Nil(t, err)
+		targeted, err := Save(flat, so)
+		assert.Nil(t, err)
+		assert.True(t, len(targeted) < len(fixed), "%s: targeted %d, fixed %d", f, len(targeted), len(fixed))
+	}
+
+	for _, target := range []float64{-0.1, 1.1} {
+		_, err = Save(flat, SaveOptions{Format: Jpeg, TargetSSIM: target})
+		assert.Equal(t, ErrInvalidTargetSSIM, err)
+	}
+}
+
+func TestScanScript(t *testing.T) {
+	// Invalid scripts are rejected clearly.
+	for _, script := range []string{"", "0: 5-2, 0, 0;", "4;", "0,1: 1-63, 0, 0;", "0: 0-10, 0, 0;", "0: 0-0, 0, 0"} {
+		_, err := ParseScanScript(script)
+		assert.IsType(t, ScanScriptError{}, err, "script: %q", script)
+	}
+
+	img, err := Jpeg.LoadBytes(image("watermelon.jpg"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer img.Close()
+
+	// Even before saving.
+	_, err = Save(img, SaveOptions{Format: Jpeg, ScanScript: "0: 0-10, 0, 0;"})
+	assert.Equal(t, ScanScriptError{Scan: 1, Reason: "DC scans can't include AC coefficients"}, err)
+
+	// A segment too short to hold its own length ends the scans.
+	assert.Equal(t, []Scan{}, JpegScans([]byte{0xff, 0xd8, 0xff, 0xda, 0, 0}))
+	assert.Equal(t, []Scan{}, JpegScans([]byte{0xff, 0xd8, 0xff, 0xda, 0, 1, 0}))
+
+	if _, err := exec.LookPath(Jpegtran); err != nil {
+		t.Skip("No jpegtran:", err)
+	}
+
+	// Send all of the luma, then the color.
+	script := "0: 0-0, 0, 0;\n1,2: 0-0, 0, 0;\n0: 1-63, 0, 0; # Luma done.\n1: 1-63, 0, 0;\n2: 1-63, 0, 0;\n"
+	want, err := ParseScanScript(script)
+	if !assert.Nil(t, err) || !assert.Len(t, want, 5) {
+		return
+	}
+
+	blob, err := Save(img, SaveOptions{Format: Jpeg, ScanScript: script})
+	if assert.Nil(t, err) {
+		assert.Equal(t, want, JpegScans(blob))
+
+		m, err := MetadataBytes(blob)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []int{398, 536}, []int{m.Width, m.Height})
+		}
+	}
+
+	// The JPEG that fits within MaxBytes is the one rewritten, which can
+	// grow it slightly past the limit.
+	blob, err = Save(img, SaveOptions{Format: Jpeg, ScanScript: script, MaxBytes: 30000})
+	if err != ErrMaxBytes && assert.Nil(t, err) {
+		assert.True(t, len(blob) <= 30000)
+		assert.Equal(t, want, JpegScans(blob))
+	}
+}
+
+func TestTiff(t *testing.T) {
+	if !Tiff.CanSave() {
+		t.Skip("VIPS can't save TIFF")
+	}
+
+	img, err := Png.LoadBytes(image("3000px.png"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer img.Close()
+
+	blob, err := Save(img, SaveOptions{Format: Tiff, TileSize: 512})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, Tiff, DetectFormat(blob))
+
+	// 3000x2000 halves until it fits in a 512 pixel tile: 3000, 1500,
+	// 750, and 375 pixels wide.
+	tf, ok := newTiff(blob)
+	if assert.True(t, ok) {
+		levels := 0
+		for offset := tf.first(); offset != 0 && levels < 100; levels++ {
+			entries := tf.ifd(offset)
+			assert.Equal(t, uint32(512), tf.uint(entries[0x0142]), "TileWidth")
+			next := offset + 2 + 12*int(tf.order.Uint16(blob[offset:offset+2]))
+			offset = int(tf.order.Uint32(blob[next : next+4]))
+		}
+		assert.Equal(t, 4, levels)
+	}
+
+	LoadTiff = true
+	defer func() { LoadTiff = false }()
+	decoded, err := Tiff.LoadBytes(blob)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int{3000, 2000}, []int{decoded.Xsize(), decoded.Ysize()})
+		decoded.Close()
+	}
+
+	lossless, err := Save(img, SaveOptions{Format: Tiff, TiffCompression: TiffDeflate})
+	if assert.Nil(t, err) {
+		assert.Equal(t, Tiff, DetectFormat(lossless))
+		assert.NotEqual(t, blob, lossless)
+	}
+
+	for _, size := range []int{-16, 100, MaxTileSize + 16} {
+		_, err = Save(img, SaveOptions{Format: Tiff, TileSize: size})
+		assert.Equal(t, ErrInvalidTileSize, err)
+	}
+	_, err = Save(img, SaveOptions{Format: Tiff, TiffCompression: TiffNone + 1})
+	assert.Equal(t, ErrInvalidTiffCompression, err)
+
+	assert.Equal(t, "image/tiff", Tiff.String())
+	assert.Equal(t, Tiff, ExtensionFormat("map.tiff"))
+}
+
+func TestDither(t *testing.T) {
+	// A smooth horizontal gray gradient.
+	gradient := goimage.NewGray(goimage.Rect(0, 0, 256, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 256; x++ {
+			gradient.SetGray(x, y, color.Gray{Y: uint8(x)})
+		}
+	}
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, png.Encode(&buf, gradient)) {
+		return
+	}
+	img, err := Png.LoadBytes(buf.Bytes())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer img.Close()
+
+	for _, colors := range []int{-1, 1, MaxColors + 1} {
+		_, err = Save(img, SaveOptions{Format: Png, Colors: colors})
+		assert.Equal(t, ErrInvalidColors, err)
+	}
+
+	flat, err := Save(img, SaveOptions{Format: Png, Colors: 4})
+	if err != nil {
+		t.Skip("VIPS doesn't support palette PNGs:", err)
+	}
+	dithered, err := Save(img, SaveOptions{Format: Png, Colors: 4, Dither: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Dithering breaks up the bands, so neighboring pixels vary more.
+	assert.True(t, localVariance(t, dithered) > localVariance(t, flat))
+}
+
+// localVariance returns the mean squared difference between horizontally
+// adjacent pixels of a grayscale PNG.
+func localVariance(t *testing.T, blob []byte) float64 {
+	img, err := png.Decode(bytes.NewReader(blob))
+	if !assert.Nil(t, err) {
+		return 0
+	}
+
+	b := img.Bounds()
+	sum, n := 0.0, 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X + 1; x < b.Max.X; x++ {
+			l := float64(color.GrayModel.Convert(img.At(x-1, y)).(color.Gray).Y)
+			r := float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			sum += (r - l) * (r - l)
+			n++
+		}
+	}
+
+	return sum / float64(n)
+}
+
+func TestRestartInterval(t *testing.T) {
+	img, err := Png.LoadBytes(image("flowers.png"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer img.Close()
+
+	for _, ri := range []int{-1, MaxRestartInterval + 1} {
+		_, err = Save(img, SaveOptions{Format: Jpeg, RestartInterval: ri})
+		assert.Equal(t, err, ErrInvalidRestartInterval)
+	}
+
+	// Off by default.
+	blob, err := Save(img, SaveOptions{Format: Jpeg})
+	if assert.Nil(t, err) {
+		interval, markers := jpegRestarts(blob)
+		assert.Equal(t, interval, 0)
+		assert.Empty(t, markers)
+	}
+
+	blob, err = Save(img, SaveOptions{Format: Jpeg, RestartInterval: 4})
+	var major, minor int
+	if _, _ = fmt.Sscanf(vips.Version(), "%d.%d", &major, &minor); major == 8 && minor < 15 {
+		assert.NotNil(t, err)
+		t.Skip("VIPS doesn't support JPEG restart markers")
+	}
+	if assert.Nil(t, err) {
+		interval, markers := jpegRestarts(blob)
+		assert.Equal(t, interval, 4)
+		if assert.NotEmpty(t, markers) {
+			// RSTn count up modulo 8, starting over with each scan.
+			for i := 1; i < len(markers); i++ {
+				assert.Contains(t, []int{0, (markers[i-1] + 1) % 8}, markers[i])
+			}
+		}
+	}
+}
+
+func TestSubsampling(t *testing.T) {
+	img, err := Png.LoadBytes(image("flowers.png"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer img.Close()
+
+	// Luma has twice the sampling factors of chroma when subsampled.
+	for subsampling, want := range map[Subsampling]byte{
+		DefaultSubsampling: 0x22,
+		Subsample420:       0x22,
+		Subsample444:       0x11,
+	} {
+		blob, err := Save(img, SaveOptions{Format: Jpeg, Subsampling: subsampling})
+		if assert.Nil(t, err) {
+			assert.Equal(t, want, jpegLumaSampling(blob), "%d", subsampling)
+		}
+	}
+
+	_, err = Save(img, SaveOptions{Format: Jpeg, Subsampling: Subsample444 + 1})
+	assert.Equal(t, ErrInvalidSubsampling, err)
+}
+
+// jpegLumaSampling returns the horizontal and vertical sampling factors
+// of the first component in the SOF segment of a JPEG, as a nibble each.
+func jpegLumaSampling(blob []byte) byte {
+	for i := 2; i+4 <= len(blob) && blob[i] == 0xff; {
+		marker := blob[i+1]
+		end := i + 2 + int(blob[i+2])<<8 + int(blob[i+3])
+		if marker == 0xda || end > len(blob) { // Start of scan.
+			break
+		}
+		if (marker == 0xc0 || marker == 0xc1 || marker == 0xc2) && end-i >= 12 {
+			return blob[i+11]
+		}
+		i = end
+	}
+	return 0
+}
+
+// jpegRestarts returns the restart interval from the DRI segment of a
+// JPEG, and the numbers of the RSTn markers in its entropy-coded data.
+func jpegRestarts(blob []byte) (int, []int) {
+	interval, markers := 0, []int{}
+	for i := 2; i+4 <= len(blob) && blob[i] == 0xff; {
+		marker := blob[i+1]
+		end := i + 2 + int(blob[i+2])<<8 + int(blob[i+3])
+		if end > len(blob) {
+			break
+		}
+		if marker == 0xdd && end-i >= 6 { // Define restart interval.
+			interval = int(blob[i+4])<<8 + int(blob[i+5])
+		}
+		i = end
+		if marker != 0xda { // Start of scan.
+			continue
+		}
+
+		// Skip entropy-coded data up to the next marker other than
+		// a stuffed 0 byte or an RSTn.
+		for ; i+1 < len(blob); i++ {
+			if blob[i] != 0xff || blob[i+1] == 0 {
+				continue
+			}
+			if blob[i+1] < 0xd0 || blob[i+1] > 0xd7 {
+				break
+			}
+			markers = append(markers, int(blob[i+1]-0xd0))
+			i++
+		}
+	}
+	return interval, markers
+}
+
+// Annex K quantization tables, in zigzag order.
+var (
+	annexKLuma = []byte{
+		16, 11, 12, 14, 12, 10, 16, 14, 13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37, 29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68, 87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113, 121, 112, 100, 120, 92, 101, 103, 99,
+	}
+	annexKChroma = append([]byte{
+		17, 18, 18, 24, 21, 24, 47, 26, 26, 47, 99, 66, 56, 66,
+	}, bytes.Repeat([]byte{99}, 50)...)
+)
+
 func convert(blob []byte, so SaveOptions) []byte {
 	format := DetectFormat(blob)
 	img, err := format.LoadBytes(blob)
@@ -165,6 +1028,38 @@ func convert(blob []byte, so SaveOptions) []byte {
 	return blob
 }
 
+func BenchmarkLoadBytes(b *testing.B) {
+	blob := image("2px.png")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		img, err := Png.LoadBytes(blob)
+		if !assert.Nil(b, err) {
+			return
+		}
+		img.Close()
+	}
+}
+
+// BenchmarkReset reuses one Image, so unlike BenchmarkLoadBytes, no
+// finalizer is set for each image loaded.
+func BenchmarkReset(b *testing.B) {
+	blob := image("2px.png")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	img := &vips.Image{}
+	for i := 0; i < b.N; i++ {
+		if !assert.Nil(b, Reset(img, blob, 0)) {
+			return
+		}
+	}
+	img.Close()
+}
+
 func BenchmarkMetadataJpeg_2(b *testing.B) {
 	benchMetadata(b, "2px.jpg", Jpeg)
 }
@@ -454,3 +1349,68 @@ func benchConvert(b *testing.B, filename string, so SaveOptions) {
 		}
 	})
 }
+
+func TestClippingPath(t *testing.T) {
+	paths, ok := ClippingPath(image("clippath.jpg"))
+	if assert.True(t, ok) && assert.Equal(t, 1, len(paths)) {
+		// A diamond, with each straight side flattened into segments.
+		assert.Equal(t, 4*bezierSegmentsPerKnot, len(paths[0]))
+		for i, p := range []Point{{0.5, 0.1}, {0.9, 0.5}, {0.5, 0.9}, {0.1, 0.5}} {
+			q := paths[0][i*bezierSegmentsPerKnot]
+			assert.InDelta(t, p.X, q.X, 0.0001)
+			assert.InDelta(t, p.Y, q.Y, 0.0001)
+		}
+	}
+
+	_, ok = ClippingPath(image("watermelon.jpg"))
+	assert.False(t, ok)
+	_, ok = ClippingPath(image("notimage.txt"))
+	assert.False(t, ok)
+}
+
+// exifTag is an IFD entry for exifBlob, with its value's data.
+type exifTag struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+// exifBlob returns big-endian TIFF-structured EXIF data with IFD0, followed
+// by an EXIF sub-IFD and a GPS IFD that IFD0 points to, and then the data
+// too large to fit in their entries.
+func exifBlob(ifd0, sub, gps []exifTag) []byte {
+	size := func(tags []exifTag) int { return 2 + 12*len(tags) + 4 }
+	pointer := func(offset int) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(offset))
+		return b
+	}
+
+	subOffset := 8 + size(ifd0) + 2*12
+	gpsOffset := subOffset + size(sub)
+	ifd0 = append(ifd0, exifTag{0x8769, 4, 1, pointer(subOffset)}, exifTag{0x8825, 4, 1, pointer(gpsOffset)})
+	dataOffset := gpsOffset + size(gps)
+
+	out := []byte("MM\x00*\x00\x00\x00\x08")
+	var data []byte
+	for _, tags := range [][]exifTag{ifd0, sub, gps} {
+		out = append(out, byte(len(tags)>>8), byte(len(tags)))
+		for _, tag := range tags {
+			entry := make([]byte, 12)
+			binary.BigEndian.PutUint16(entry, tag.tag)
+			binary.BigEndian.PutUint16(entry[2:], tag.typ)
+			binary.BigEndian.PutUint32(entry[4:], tag.count)
+			if len(tag.data) <= 4 {
+				copy(entry[8:], tag.data)
+			} else {
+				copy(entry[8:], pointer(dataOffset+len(data)))
+				data = append(data, tag.data...)
+			}
+			out = append(out, entry...)
+		}
+		out = append(out, 0, 0, 0, 0)
+	}
+
+	return append(out, data...)
+}
@@ -0,0 +1,95 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// pngBitDepths are the bit depths allowed for each PNG color type.
+var pngBitDepths = map[byte][]byte{
+	0: {1, 2, 4, 8, 16}, // Grayscale.
+	2: {8, 16},          // RGB.
+	3: {1, 2, 4, 8},     // Palette.
+	4: {8, 16},          // Grayscale and alpha.
+	6: {8, 16},          // RGB and alpha.
+}
+
+// CheckHeader parses the header of a JPEG or PNG image in Go, without
+// calling VIPS, and returns ErrCorruptHeader if it's inconsistent.  A PNG
+// with an impossible combination of bit depth and color type can't be
+// decoded, so is always rejected.  A JPEG whose EXIF dimensions disagree
+// with its frame header can still be decoded at the frame's size, so it's
+// allowed if repair is set.  Other formats and truncated headers are left
+// for the loader to reject.
+func CheckHeader(blob []byte, repair bool) error {
+	switch DetectFormat(blob) {
+	case Jpeg:
+		if !repair && !jpegExifMatches(blob) {
+			return ErrCorruptHeader
+		}
+	case Png:
+		if !pngHeaderValid(blob) {
+			return ErrCorruptHeader
+		}
+	}
+
+	return nil
+}
+
+// pngHeaderValid returns false if a PNG's IHDR chunk is the wrong length,
+// or has an impossible color type and bit depth or an unknown compression,
+// filter, or interlace method.
+func pngHeaderValid(blob []byte) bool {
+	// Length, "IHDR", width, height, then one byte each of bit depth,
+	// color type, compression, filter, and interlace.
+	if len(blob) < 29 || string(blob[12:16]) != "IHDR" {
+		return true
+	}
+	if binary.BigEndian.Uint32(blob[8:12]) != 13 || blob[26] != 0 || blob[27] != 0 || blob[28] > 1 {
+		return false
+	}
+
+	depth, color := blob[24], blob[25]
+	for _, d := range pngBitDepths[color] {
+		if d == depth {
+			return true
+		}
+	}
+	return false
+}
+
+// jpegExifMatches returns false if a JPEG's EXIF PixelXDimension and
+// PixelYDimension are set and disagree with its start of frame.
+func jpegExifMatches(blob []byte) bool {
+	w, h := probeJpeg(blob)
+	t, ok := newTiff(jpegExif(blob))
+	if w <= 0 || h <= 0 || !ok {
+		return true
+	}
+
+	sub, ok := t.ifd(t.first())[tagExifIFD]
+	if !ok {
+		return true
+	}
+	ifd := t.ifd(int(t.uint(sub)))
+	x, y := int(t.uint(ifd[tagPixelXDimension])), int(t.uint(ifd[tagPixelYDimension]))
+
+	return x == 0 || y == 0 || (x == w && y == h)
+}
+
+// jpegExif returns the raw EXIF data in the first APP1 segment of a JPEG
+// that has it, or nil.
+func jpegExif(blob []byte) []byte {
+	for i := 2; i+4 <= len(blob) && blob[i] == 0xff; {
+		marker := blob[i+1]
+		end := i + 2 + int(blob[i+2])<<8 + int(blob[i+3])
+		if marker == 0xda || end < i+4 || end > len(blob) { // Start of scan.
+			break
+		}
+		if marker == 0xe1 && bytes.HasPrefix(blob[i+4:end], []byte("Exif\x00\x00")) {
+			return blob[i+4 : end]
+		}
+		i = end
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package format
+
+import (
+	"bytes"
+	"github.com/die-net/fotomat/vips"
+	"sync"
+)
+
+// JPEG encoders that JpegEncoder can report.
+const (
+	// Mozjpeg supports SaveOptions.QuantTable and SmallJpeg.
+	Mozjpeg = "mozjpeg"
+	// Libjpeg is libjpeg-turbo, or another libjpeg without mozjpeg's
+	// extensions.
+	Libjpeg = "libjpeg"
+)
+
+// Subsampling is whether a JPEG's chroma is saved at lower resolution
+// than its luma.
+type Subsampling int
+
+// Subsampling values.
+const (
+	// DefaultSubsampling halves chroma resolution, except at Quality 90
+	// and above with VIPS 8.10 or later.
+	DefaultSubsampling Subsampling = iota
+	// Subsample420 always halves chroma resolution both ways.
+	Subsample420
+	// Subsample444 keeps full chroma resolution.
+	Subsample444
+)
+
+var subsamples = []vips.Subsample{
+	DefaultSubsampling: vips.SubsampleAuto,
+	Subsample420:       vips.SubsampleOn,
+	Subsample444:       vips.SubsampleOff,
+}
+
+var (
+	jpegEncoderOnce sync.Once
+	jpegEncoder     string
+)
+
+// JpegEncoder returns which JPEG encoder VIPS is linked against, Mozjpeg or
+// Libjpeg.  VIPS can't switch between them, so this is detected once, by
+// whether a quantization table preset is honored.
+func JpegEncoder() string {
+	jpegEncoderOnce.Do(func() {
+		jpegEncoder = detectJpegEncoder()
+	})
+	return jpegEncoder
+}
+
+func detectJpegEncoder() string {
+	image, err := vips.NewImageFromMemory(make([]byte, 8*8), 8, 8, 1, vips.BandFormatUchar)
+	if err != nil {
+		return Libjpeg
+	}
+	defer image.Close()
+
+	// At quality 50, table 1 is used unscaled, and is flat.
+	blob, err := image.JpegsaveBuffer(true, 50, false, false, 1, 0, false, vips.SubsampleAuto)
+	if err != nil {
+		return Libjpeg
+	}
+
+	if tables := jpegQuantTables(blob); len(tables) > 0 && bytes.Equal(tables[0], bytes.Repeat([]byte{16}, 64)) {
+		return Mozjpeg
+	}
+
+	return Libjpeg
+}
+
+// jpegQuantTables returns the 8-bit quantization tables in the DQT
+// segments of a JPEG, in the order they are defined.
+func jpegQuantTables(blob []byte) [][]byte {
+	tables := [][]byte{}
+	for i := 2; i+4 <= len(blob) && blob[i] == 0xff; {
+		marker := blob[i+1]
+		end := i + 2 + int(blob[i+2])<<8 + int(blob[i+3])
+		if marker == 0xda || end > len(blob) { // Start of scan.
+			break
+		}
+		if marker == 0xdb {
+			for j := i + 4; j+65 <= end && blob[j]>>4 == 0; j += 65 {
+				tables = append(tables, blob[j+1:j+65])
+			}
+		}
+		i = end
+	}
+	return tables
+}
@@ -4,6 +4,10 @@ import (
 	"github.com/die-net/fotomat/vips"
 )
 
+// MillimetresPerInch converts VIPS resolutions, in pixels per millimetre,
+// to and from dots per inch.
+const MillimetresPerInch = 25.4
+
 // Metadata is the currently-known metadata about an Image.
 type Metadata struct {
 	Width       int
@@ -11,6 +15,44 @@ type Metadata struct {
 	Format      Format
 	Orientation Orientation
 	HasAlpha    bool
+	// Pages is the number of pages or frames in the image, 1 unless it
+	// is multi-page or animated.
+	Pages int
+	// XDPI and YDPI are the horizontal and vertical pixel density, in
+	// dots per inch, as stored in the image or defaulted by VIPS.
+	XDPI float64
+	YDPI float64
+}
+
+// Shape classifies an image by whether it's wider or taller.
+type Shape int
+
+// Shapes, as returned by Metadata.Shape.
+const (
+	Square Shape = iota
+	Landscape
+	Portrait
+)
+
+// AspectRatio returns the width of the image divided by its height, after
+// Orientation is applied, or 0 if it has no height.
+func (m Metadata) AspectRatio() float64 {
+	if m.Height == 0 {
+		return 0
+	}
+	return float64(m.Width) / float64(m.Height)
+}
+
+// Shape returns whether the image is Landscape, Portrait, or Square,
+// after Orientation is applied.
+func (m Metadata) Shape() Shape {
+	switch {
+	case m.Width > m.Height:
+		return Landscape
+	case m.Width < m.Height:
+		return Portrait
+	}
+	return Square
 }
 
 // MetadataBytes parses an image byte slice and returns Metadata or an error.
@@ -27,7 +69,20 @@ func MetadataBytes(blob []byte) (Metadata, error) {
 func (format Format) MetadataBytes(blob []byte) (Metadata, error) {
 	image, err := format.LoadBytes(blob)
 	if err != nil {
-		return Metadata{}, ErrUnknownFormat
+		return Metadata{}, loadError(err)
+	}
+
+	defer image.Close()
+
+	return metadataImageFormat(image, format), nil
+}
+
+// MetadataBytesPage parses page number page, counting from 0, of an image
+// byte slice in known format and returns Metadata or an error.
+func (format Format) MetadataBytesPage(blob []byte, page int) (Metadata, error) {
+	image, err := format.LoadBytesPage(blob, page)
+	if err != nil {
+		return Metadata{}, loadError(err)
 	}
 
 	defer image.Close()
@@ -47,6 +102,16 @@ func (format Format) MetadataFile(filename string) (Metadata, error) {
 	return metadataImageFormat(image, format), nil
 }
 
+// loadError returns ErrUnknownFormat for an image that failed to load,
+// unless that's because its format has no loader, or its loader is
+// unavailable, which are ErrLoaderUnavailable.
+func loadError(err error) error {
+	if err == ErrLoaderUnavailable || err == ErrInvalidOperation {
+		return ErrLoaderUnavailable
+	}
+	return ErrUnknownFormat
+}
+
 func metadataImageFormat(image *vips.Image, format Format) Metadata {
 	m := MetadataImage(image)
 	m.Format = format
@@ -60,5 +125,13 @@ func MetadataImage(image *vips.Image) Metadata {
 	if w <= 0 || h <= 0 {
 		panic("Invalid image dimensions.")
 	}
-	return Metadata{Width: w, Height: h, Orientation: o, HasAlpha: image.HasAlpha()}
+	pages, ok := image.ImageGetInt(vips.MetaNPages)
+	if !ok || pages < 1 {
+		pages = 1
+	}
+	xdpi, ydpi := image.ImageGetXres()*MillimetresPerInch, image.ImageGetYres()*MillimetresPerInch
+	if orientationInfo[o].swapXY {
+		xdpi, ydpi = ydpi, xdpi
+	}
+	return Metadata{Width: w, Height: h, Orientation: o, HasAlpha: image.HasAlpha(), Pages: pages, XDPI: xdpi, YDPI: ydpi}
 }
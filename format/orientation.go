@@ -1,8 +1,10 @@
 package format
 
 import (
+	"bytes"
 	"github.com/die-net/fotomat/vips"
 	"strconv"
+	"strings"
 )
 
 // Orientation is the current Image orientation, as stored by a camera.
@@ -38,19 +40,88 @@ var orientationInfo = []struct {
 	{swapXY: true, flipX: true, flipY: false, apply: rot270},
 }
 
-// DetectOrientation detects the current Image Orientation from the EXIF header.
+// DetectOrientation detects the current Image Orientation from the EXIF
+// header.  This works for any format VIPS reads EXIF from, such as JPEG,
+// and PNG and WebP with an EXIF chunk.  Without EXIF, it falls back to
+// XMP's tiff:Orientation.
 func DetectOrientation(image *vips.Image) Orientation {
-	o, ok := image.ImageGetAsString(vips.ExifOrientation)
-	if !ok || o == "" {
+	if o, ok := image.ImageGetAsString(vips.ExifOrientation); ok && o != "" {
+		orientation, err := strconv.Atoi(o[:1])
+		return validOrientation(orientation, err == nil)
+	}
+
+	// Some loaders only set VIPS's own orientation field, or attach the
+	// raw EXIF without parsing it.
+	if o, ok := image.ImageGetInt(vips.MetaOrientation); ok {
+		return validOrientation(o, true)
+	}
+	if exif, ok := image.ImageGetBlob(vips.MetaExifName); ok {
+		return exifOrientation(exif)
+	}
+	if xmp, ok := image.ImageGetBlob(vips.MetaXmpName); ok {
+		return xmpOrientation(xmp)
+	}
+
+	return Undefined
+}
+
+func validOrientation(orientation int, ok bool) Orientation {
+	if !ok || orientation <= 0 || orientation >= len(orientationInfo) {
 		return Undefined
 	}
+	return Orientation(orientation)
+}
 
-	orientation, err := strconv.Atoi(o[:1])
-	if err != nil || orientation <= 0 || orientation >= len(orientationInfo) {
+// exifOrientation returns the Orientation tag from IFD0 of raw EXIF data,
+// which may start with an "Exif\0\0" prefix.
+func exifOrientation(exif []byte) Orientation {
+	t, ok := newTiff(exif)
+	if !ok {
 		return Undefined
 	}
 
-	return Orientation(orientation)
+	e, ok := t.ifd(t.first())[tagOrientation]
+	if !ok || e.typ != 3 {
+		return Undefined
+	}
+
+	return validOrientation(int(t.uint(e)), true)
+}
+
+// xmpOrientation returns the tiff:Orientation property of XMP data.
+func xmpOrientation(xmp []byte) Orientation {
+	i := xmpOrientationIndex(xmp)
+	if i < 0 {
+		return Undefined
+	}
+	return validOrientation(int(xmp[i]-'0'), true)
+}
+
+// xmpOrientationIndex returns the index of the single digit value of the
+// tiff:Orientation property of XMP data, which may be written as either an
+// attribute or an element, or -1 if there isn't one.
+func xmpOrientationIndex(xmp []byte) int {
+	tag := []byte("tiff:Orientation")
+	for start := 0; ; {
+		i := bytes.Index(xmp[start:], tag)
+		if i < 0 {
+			return -1
+		}
+		start += i + len(tag)
+
+		// Skip the =" or > that starts the value.
+		j := start
+		for j < len(xmp) && strings.IndexByte("=\"'> \t\r\n", xmp[j]) >= 0 {
+			j++
+		}
+		if j > start && j < len(xmp) && isDigit(xmp[j]) && (j+1 == len(xmp) || !isDigit(xmp[j+1])) {
+			return j
+		}
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
 
 // Dimensions translates a virtual width and height to match the current physical Orientation.
@@ -98,11 +169,28 @@ func (orientation Orientation) Apply(image *vips.Image) error {
 		return err
 	}
 
-	_ = image.ImageRemove(vips.ExifOrientation)
+	RemoveOrientation(image)
 
 	return nil
 }
 
+// RemoveOrientation resets the metadata an Orientation is detected from to
+// TopLeft, so the Image's pixels are treated as already being upright.  The
+// rest of the EXIF is kept, and if saved with SaveOptions.KeepMetadata, its
+// orientation tag is written as TopLeft.  So is XMP's, where VIPS supports
+// changing it.
+func RemoveOrientation(image *vips.Image) {
+	_ = image.ImageRemove(vips.ExifOrientation)
+	image.ImageSetInt(vips.MetaOrientation, int(TopLeft))
+
+	if xmp, ok := image.ImageGetBlob(vips.MetaXmpName); ok {
+		if i := xmpOrientationIndex(xmp); i >= 0 && xmp[i] != '1' {
+			xmp[i] = '1'
+			_ = image.ImageSetBlob(vips.MetaXmpName, xmp)
+		}
+	}
+}
+
 func flip(image *vips.Image) error {
 	return image.Flip(vips.DirectionVertical)
 }
@@ -0,0 +1,198 @@
+package format
+
+import (
+	"encoding/binary"
+)
+
+// ProbeDimensions returns the Format, width, and height of a JPEG, PNG,
+// GIF, or WebP image by parsing its header in Go, without calling VIPS.
+// This is cheap and safe to use for rejecting untrusted input early.  The
+// dimensions are as stored, before any EXIF Orientation is applied.
+// Returns ErrUnknownFormat for other formats or truncated headers.
+func ProbeDimensions(blob []byte) (Format, int, int, error) {
+	f := DetectFormat(blob)
+
+	var w, h int
+	switch f {
+	case Jpeg:
+		w, h = probeJpeg(blob)
+	case Png:
+		// IHDR must be the first chunk.
+		if len(blob) >= 24 && string(blob[12:16]) == "IHDR" {
+			w = int(binary.BigEndian.Uint32(blob[16:20]))
+			h = int(binary.BigEndian.Uint32(blob[20:24]))
+		}
+	case Gif:
+		// Logical screen descriptor, which is 13 bytes with the header.
+		if len(blob) >= 13 {
+			w = int(binary.LittleEndian.Uint16(blob[6:8]))
+			h = int(binary.LittleEndian.Uint16(blob[8:10]))
+		}
+	case Webp:
+		w, h = probeWebp(blob)
+	}
+
+	if w <= 0 || h <= 0 {
+		return Unknown, 0, 0, ErrUnknownFormat
+	}
+
+	return f, w, h, nil
+}
+
+// probeJpeg returns the dimensions from the first start of frame marker.
+func probeJpeg(blob []byte) (int, int) {
+	for i := 2; i+4 <= len(blob); {
+		if blob[i] != 0xff {
+			return 0, 0
+		}
+		marker := blob[i+1]
+		switch {
+		case marker == 0xff: // Fill byte.
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7): // No length.
+			i += 2
+			continue
+		case marker == 0xd9 || marker == 0xda: // End of image or start of scan.
+			return 0, 0
+		}
+
+		length := int(binary.BigEndian.Uint16(blob[i+2 : i+4]))
+		if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+			// Length, precision, height, width.
+			if i+9 > len(blob) {
+				return 0, 0
+			}
+			return int(binary.BigEndian.Uint16(blob[i+7 : i+9])), int(binary.BigEndian.Uint16(blob[i+5 : i+7]))
+		}
+		i += 2 + length
+	}
+
+	return 0, 0
+}
+
+// probeWebp returns the dimensions from the first chunk of a WebP.
+func probeWebp(blob []byte) (int, int) {
+	if len(blob) < 30 {
+		return 0, 0
+	}
+
+	switch string(blob[12:16]) {
+	case "VP8 ":
+		// Lossy: frame tag, start code, then 14-bit width and height.
+		if blob[23] != 0x9d || blob[24] != 0x01 || blob[25] != 0x2a {
+			return 0, 0
+		}
+		return int(binary.LittleEndian.Uint16(blob[26:28]) & 0x3fff), int(binary.LittleEndian.Uint16(blob[28:30]) & 0x3fff)
+	case "VP8L":
+		// Lossless: signature, then 14-bit width-1 and height-1.
+		if blob[20] != 0x2f {
+			return 0, 0
+		}
+		bits := binary.LittleEndian.Uint32(blob[21:25])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1
+	case "VP8X":
+		// Extended: flags, then 24-bit canvas width-1 and height-1.
+		return int(uint32(blob[24])|uint32(blob[25])<<8|uint32(blob[26])<<16) + 1,
+			int(uint32(blob[27])|uint32(blob[28])<<8|uint32(blob[29])<<16) + 1
+	}
+
+	return 0, 0
+}
+
+// ProbePages returns the number of pages or frames in an image by parsing
+// its container in Go, without calling VIPS or decoding any pixels.  This
+// is 1 for still images, and the frame count of an animated GIF or WebP.
+// Returns ErrUnknownFormat for other formats or truncated headers.
+func ProbePages(blob []byte) (int, error) {
+	f, _, _, err := ProbeDimensions(blob)
+	if err != nil {
+		return 0, err
+	}
+
+	pages := 1
+	switch f {
+	case Gif:
+		pages = probeGifFrames(blob)
+	case Webp:
+		pages = probeWebpFrames(blob)
+	}
+
+	if pages <= 0 {
+		return 0, ErrUnknownFormat
+	}
+
+	return pages, nil
+}
+
+// probeGifFrames counts the image descriptors in a GIF.
+func probeGifFrames(blob []byte) int {
+	// Header and logical screen descriptor, then global color table.
+	i := 13
+	if blob[10]&0x80 != 0 {
+		i += 3 << (blob[10]&0x07 + 1)
+	}
+
+	frames := 0
+	for i < len(blob) {
+		switch blob[i] {
+		case 0x2c: // Image descriptor, then local color table.
+			if i+10 > len(blob) {
+				return 0
+			}
+			frames++
+			flags := blob[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			i++ // LZW minimum code size.
+		case 0x21: // Extension introducer and label.
+			i += 2
+		case 0x3b: // Trailer.
+			return frames
+		default:
+			return 0
+		}
+
+		// Skip data sub-blocks until the zero-length terminator.
+		for {
+			if i >= len(blob) {
+				return 0
+			}
+			n := int(blob[i])
+			i += 1 + n
+			if n == 0 {
+				break
+			}
+		}
+	}
+
+	// Tolerate a missing trailer, as decoders do.
+	return frames
+}
+
+// probeWebpFrames counts the animation frame chunks in a WebP.
+func probeWebpFrames(blob []byte) int {
+	// Animations are only allowed in the extended format.
+	if string(blob[12:16]) != "VP8X" {
+		return 1
+	}
+
+	frames := 0
+	for i := 12; i+8 <= len(blob); {
+		if string(blob[i:i+4]) == "ANMF" {
+			frames++
+		}
+		size := int(binary.LittleEndian.Uint32(blob[i+4 : i+8]))
+		if size < 0 {
+			return 0
+		}
+		i += 8 + (size+1)&^1
+	}
+
+	if frames == 0 {
+		return 1
+	}
+	return frames
+}
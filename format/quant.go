@@ -0,0 +1,167 @@
+package format
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/die-net/fotomat/vips"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoCjpeg is returned when SaveOptions.CustomQuantTables is set, but
+// Cjpeg can't be found.
+var ErrNoCjpeg = errors.New("cjpeg not available")
+
+// Cjpeg is the cjpeg binary, from libjpeg-turbo or mozjpeg, used to save
+// JPEGs with SaveOptions.CustomQuantTables, looked up in $PATH if it has
+// no directory.
+var Cjpeg = "cjpeg"
+
+// ToolTimeout limits how long Cjpeg or Jpegtran may run for one image.
+var ToolTimeout = time.Minute
+
+// MaxCustomQuantTables is how many SaveOptions.CustomQuantTables a JPEG
+// can use: one for luma, and one for chroma.
+const MaxCustomQuantTables = 2
+
+// checkCustomQuantTables returns ErrInvalidQuantTable if options has
+// CustomQuantTables that can't be used.
+func checkCustomQuantTables(options SaveOptions) error {
+	if len(options.CustomQuantTables) == 0 {
+		return nil
+	}
+
+	if len(options.CustomQuantTables) > MaxCustomQuantTables || options.QuantTable != 0 || options.KeepMetadata || options.Metadata != StripMetadata {
+		return ErrInvalidQuantTable
+	}
+
+	for _, table := range options.CustomQuantTables {
+		for _, q := range table {
+			// Baseline JPEGs have 8-bit tables.
+			if q < 1 || q > 255 {
+				return ErrInvalidQuantTable
+			}
+		}
+	}
+
+	return nil
+}
+
+// customQuantSave saves image as a JPEG with options.CustomQuantTables,
+// which VIPS can't do, by passing its pixels and tables to Cjpeg.
+func customQuantSave(image *vips.Image, options SaveOptions, interlace bool) ([]byte, error) {
+	cjpeg, err := exec.LookPath(Cjpeg)
+	if err != nil {
+		return nil, ErrNoCjpeg
+	}
+
+	pnm, err := pnmBytes(image)
+	if err != nil {
+		return nil, err
+	}
+
+	// cjpeg only reads quantization tables from a file.
+	f, err := ioutil.TempFile("", "fotomat-qtables-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(quantTablesText(options.CustomQuantTables))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// At quality 50, cjpeg uses the tables unscaled.  With only one,
+	// chroma uses the luma table.
+	slots := "0"
+	if len(options.CustomQuantTables) > 1 {
+		slots = "0,1"
+	}
+	args := []string{"-qtables", f.Name(), "-qslots", slots, "-quality", "50", "-baseline", "-optimize"}
+	if interlace {
+		args = append(args, "-progressive")
+	}
+	if options.RestartInterval > 0 {
+		args = append(args, "-restart", strconv.Itoa(options.RestartInterval)+"B")
+	}
+	if options.Subsampling == Subsample444 {
+		args = append(args, "-sample", "1x1")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ToolTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, cjpeg, args...)
+	cmd.Stdin = bytes.NewReader(pnm)
+	out, stderr := bytes.Buffer{}, bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", Cjpeg, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out.Bytes(), nil
+}
+
+// pnmBytes returns the pixels of image as an 8-bit binary PPM, or a PGM if
+// it's grayscale, without any alpha, as Cjpeg reads.
+func pnmBytes(image *vips.Image) ([]byte, error) {
+	// Convert a copy, so image is left as it was.
+	c, err := image.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	magic, space, bands := "P6", vips.InterpretationSRGB, 3
+	if c.ImageGetBands() < 3 {
+		magic, space, bands = "P5", vips.InterpretationBW, 1
+	}
+	if err := c.Colourspace(space); err != nil {
+		return nil, err
+	}
+	if c.ImageGetBands() > bands {
+		if err := c.ExtractBand(0, bands); err != nil {
+			return nil, err
+		}
+	}
+	if c.ImageGetBandFormat() != vips.BandFormatUchar {
+		if err := c.Cast(vips.BandFormatUchar); err != nil {
+			return nil, err
+		}
+	}
+
+	pixels, err := c.WriteToMemory()
+	if err != nil {
+		return nil, err
+	}
+
+	header := fmt.Sprintf("%s\n%d %d\n255\n", magic, c.Xsize(), c.Ysize())
+	return append([]byte(header), pixels...), nil
+}
+
+// quantTablesText formats quantization tables as Cjpeg's -qtables reads
+// them: 64 numbers each, in natural (row by row) order.
+func quantTablesText(tables [][64]int) string {
+	s := bytes.Buffer{}
+	for _, table := range tables {
+		for i, q := range table {
+			s.WriteString(strconv.Itoa(q))
+			if i%8 == 7 {
+				s.WriteByte('\n')
+			} else {
+				s.WriteByte(' ')
+			}
+		}
+		s.WriteByte('\n')
+	}
+	return s.String()
+}
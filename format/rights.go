@@ -0,0 +1,55 @@
+package format
+
+import (
+	"bytes"
+	"github.com/die-net/fotomat/vips"
+)
+
+// MetadataPolicy is which metadata Save keeps when SaveOptions.KeepMetadata
+// isn't set.
+type MetadataPolicy int
+
+// Metadata policies.
+const (
+	// StripMetadata strips all metadata.
+	StripMetadata MetadataPolicy = iota
+	// StripUnlessCopyrighted strips all metadata from images that
+	// aren't marked as copyrighted, as by Copyrighted.  Those that are
+	// keep their EXIF, XMP, and IPTC, since VIPS can't keep just the
+	// rights fields, but not their ICC profile, which should have
+	// already been converted to sRGB.
+	StripUnlessCopyrighted
+)
+
+// Copyrighted returns true if an Image's metadata marks it as
+// copyrighted, with an EXIF copyright, an XMP rights marking, or an IPTC
+// copyright notice.
+func Copyrighted(image *vips.Image) bool {
+	if ExifImage(image).Copyright != "" {
+		return true
+	}
+
+	if xmp, ok := image.ImageGetBlob(vips.MetaXmpName); ok {
+		if bytes.Contains(xmp, []byte(`xmpRights:Marked="True"`)) || bytes.Contains(xmp, []byte("<xmpRights:Marked>True<")) {
+			return true
+		}
+	}
+
+	if iptc, ok := image.ImageGetBlob(vips.MetaIptcName); ok {
+		return iptcCopyrighted(iptc)
+	}
+
+	return false
+}
+
+// iptcCopyrighted returns true if IPTC data, which VIPS keeps wrapped in
+// Photoshop image resources, contains a non-empty copyright notice,
+// dataset 2:116.
+func iptcCopyrighted(iptc []byte) bool {
+	for i := 0; i+5 <= len(iptc); i++ {
+		if iptc[i] == 0x1c && iptc[i+1] == 2 && iptc[i+2] == 116 && (iptc[i+3] != 0 || iptc[i+4] != 0) {
+			return true
+		}
+	}
+	return false
+}
@@ -12,8 +12,40 @@ const (
 	DefaultCompression = 6
 )
 
-// ErrInvalidSaveFormat is returned if the specified Format can't be written to.
-var ErrInvalidSaveFormat = errors.New("Invalid save format")
+var (
+	// ErrInvalidSaveFormat is returned if the specified Format can't be written to.
+	ErrInvalidSaveFormat = errors.New("Invalid save format")
+	// ErrInvalidQuantTable is returned if SaveOptions.QuantTable is out
+	// of range, or CustomQuantTables are invalid or can't be used.
+	ErrInvalidQuantTable = errors.New("Invalid JPEG quantization table")
+	// ErrInvalidRestartInterval is returned if SaveOptions.RestartInterval is out of range.
+	ErrInvalidRestartInterval = errors.New("Invalid JPEG restart interval")
+	// ErrInvalidSubsampling is returned if SaveOptions.Subsampling is out of range.
+	ErrInvalidSubsampling = errors.New("Invalid JPEG chroma subsampling")
+	// ErrInvalidColors is returned if SaveOptions.Colors is out of range.
+	ErrInvalidColors = errors.New("Invalid number of palette colors")
+	// ErrInvalidMinQuality is returned if SaveOptions.MinQuality is out of range.
+	ErrInvalidMinQuality = errors.New("Invalid minimum quality")
+	// ErrInvalidTargetSSIM is returned if SaveOptions.TargetSSIM is out of range.
+	ErrInvalidTargetSSIM = errors.New("Invalid target SSIM")
+	// ErrInvalidTileSize is returned if SaveOptions.TileSize is out of range.
+	ErrInvalidTileSize = errors.New("Invalid TIFF tile size")
+	// ErrInvalidTiffCompression is returned if SaveOptions.TiffCompression is out of range.
+	ErrInvalidTiffCompression = errors.New("Invalid TIFF compression")
+	// ErrInvalidMetadataPolicy is returned if SaveOptions.Metadata is out of range.
+	ErrInvalidMetadataPolicy = errors.New("Invalid metadata policy")
+	// ErrMaxBytes is returned if an image can't be compressed to within SaveOptions.MaxBytes.
+	ErrMaxBytes = errors.New("Image can't be compressed small enough")
+)
+
+const (
+	// MaxQuantTable is the highest JPEG quantization table preset.
+	MaxQuantTable = 8
+	// MaxRestartInterval is the highest JPEG restart interval.
+	MaxRestartInterval = 65535
+	// MaxColors is the largest palette SaveOptions.Colors can select.
+	MaxColors = 256
+)
 
 // SaveOptions specifies how an image should be saved.
 type SaveOptions struct {
@@ -29,6 +61,73 @@ type SaveOptions struct {
 	Lossless bool
 	// LossyIfPhoto uses a lossy format if it detects that an image is a photo.
 	LossyIfPhoto bool
+	// QuantTable selects one of mozjpeg's preset JPEG quantization
+	// tables (0-MaxQuantTable), which are scaled by Quality.  0 is the
+	// standard table from Annex K of the JPEG spec, and 1 is flat.
+	// VIPS doesn't allow arbitrary tables to be supplied.  Values other
+	// than 0 require VIPS 8.8 or later, and are ignored unless libjpeg
+	// is mozjpeg.
+	QuantTable int
+	// CustomQuantTables optionally replaces the JPEG quantization tables
+	// derived from Quality with a luma table and optionally a chroma
+	// table, of 1-255 in natural (row by row) order, such as ones tuned
+	// for text.  VIPS can't do this, so the JPEG is encoded by Cjpeg
+	// instead, and metadata can't be kept.  Quality doesn't apply, so
+	// neither does TargetSSIM, and MaxBytes only fails if it's too big.
+	CustomQuantTables [][64]int
+	// SmallJpeg uses mozjpeg's slower trellis quantization, deringing,
+	// and scan optimization to save JPEGs several percent smaller at the
+	// same Quality.  It's ignored unless JpegEncoder is Mozjpeg.
+	SmallJpeg bool
+	// Subsampling is whether JPEG chroma is saved at half resolution,
+	// which is smaller, but blurs colored edges.
+	Subsampling Subsampling
+	// RestartInterval adds JPEG restart markers every this many MCUs
+	// (0-MaxRestartInterval), which lets decoders resynchronize after
+	// corrupted data, at a small cost in size.  0 disables them, and
+	// other values require VIPS 8.15 or later.
+	RestartInterval int
+	// ScanScript optionally sets the order that a progressive JPEG's
+	// scans are sent in, such as to send color last, as a jpegtran scan
+	// script parsed by ParseScanScript.  VIPS can't do this, so the
+	// saved JPEG is rewritten by Jpegtran, which takes some time.  That's
+	// done once, after MaxBytes and TargetSSIM choose a quality, and
+	// ErrMaxBytes is returned if the rewritten JPEG no longer fits.
+	ScanScript string
+	// MaxBytes optionally limits the size of the compressed image.  JPEG
+	// and lossy WebP images are saved at the highest quality up to
+	// Quality that fits, and ErrMaxBytes is returned if none does.
+	MaxBytes int
+	// MinQuality is the lowest quality (0-100) that MaxBytes may reduce
+	// Quality to, so that ErrMaxBytes is returned rather than an
+	// unacceptably degraded image.  0 allows any quality.
+	MinQuality int
+	// TargetSSIM optionally saves JPEG and lossy WebP images at the
+	// lowest quality from MinQuality up to Quality whose structural
+	// similarity (SSIM) to the uncompressed image is at least this
+	// (0-1), so flat images aren't saved at needlessly high quality.
+	// Each step of the search compresses and decodes the image, so this
+	// is much slower.  0 disables it.
+	TargetSSIM float64
+	// Colors optionally reduces PNG images to a palette of at most this
+	// many colors (2-MaxColors), which is much smaller for graphics.
+	// This requires VIPS 8.7 or later built with libimagequant.
+	Colors int
+	// Dither enables Floyd-Steinberg dithering when reducing Colors,
+	// which hides banding in gradients, but adds noise.
+	Dither bool
+	// TileSize is the width and height of the tiles that TIFFs are
+	// saved in, a multiple of 16 up to MaxTileSize, or DefaultTileSize
+	// if unset.  TIFFs are always saved tiled, with a pyramid of
+	// successively halved resolutions, for deep zoom viewers.
+	TileSize int
+	// TiffCompression is how TIFF tiles are compressed.
+	TiffCompression TiffCompression
+	// KeepMetadata keeps EXIF, XMP, and ICC profile metadata in the
+	// saved image, rather than stripping it to save space.
+	KeepMetadata bool
+	// Metadata is which metadata to keep when KeepMetadata isn't set.
+	Metadata MetadataPolicy
 }
 
 // Save returns an Image compressed using the given SaveOptions as a byte slice.
@@ -41,6 +140,67 @@ func Save(image *vips.Image, options SaveOptions) ([]byte, error) {
 		options.Compression = DefaultCompression
 	}
 
+	if options.MinQuality < 0 || options.MinQuality > 100 {
+		return nil, ErrInvalidMinQuality
+	}
+
+	if options.TargetSSIM < 0 || options.TargetSSIM > 1 {
+		return nil, ErrInvalidTargetSSIM
+	}
+
+	if options.QuantTable < 0 || options.QuantTable > MaxQuantTable {
+		return nil, ErrInvalidQuantTable
+	}
+
+	if err := checkCustomQuantTables(options); err != nil {
+		return nil, err
+	}
+
+	if options.RestartInterval < 0 || options.RestartInterval > MaxRestartInterval {
+		return nil, ErrInvalidRestartInterval
+	}
+
+	if options.Subsampling < 0 || int(options.Subsampling) >= len(subsamples) {
+		return nil, ErrInvalidSubsampling
+	}
+
+	if options.ScanScript != "" {
+		if _, err := ParseScanScript(options.ScanScript); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.TileSize < 0 || options.TileSize > MaxTileSize || options.TileSize%16 != 0 {
+		return nil, ErrInvalidTileSize
+	}
+
+	if options.TiffCompression < 0 || int(options.TiffCompression) >= len(tiffCompressions) {
+		return nil, ErrInvalidTiffCompression
+	}
+
+	if options.Colors < 0 || options.Colors == 1 || options.Colors > MaxColors {
+		return nil, ErrInvalidColors
+	}
+
+	switch options.Metadata {
+	case StripMetadata:
+	case StripUnlessCopyrighted:
+		if !options.KeepMetadata && Copyrighted(image) {
+			// Remove the profile from a copy, so the caller's image
+			// is left as it was.
+			c, err := image.Copy()
+			if err != nil {
+				return nil, err
+			}
+			defer c.Close()
+			_ = c.ImageRemove(vips.MetaIccName)
+			image = c
+			options.KeepMetadata = true
+		}
+	default:
+		return nil, ErrInvalidMetadataPolicy
+	}
+
 	// Make a decision on image format and whether we're using lossless.
 	if options.Format == Unknown {
 		if options.AllowWebp {
@@ -54,6 +214,164 @@ func Save(image *vips.Image, options SaveOptions) ([]byte, error) {
 		options.Lossless = false
 	}
 
+	blob, err := saveQuality(image, options)
+	if err != nil || options.Format != Jpeg || options.ScanScript == "" {
+		return blob, err
+	}
+
+	if blob, err = rewriteScans(blob, options.ScanScript); err != nil {
+		return nil, err
+	}
+	if options.MaxBytes > 0 && len(blob) > options.MaxBytes {
+		return nil, ErrMaxBytes
+	}
+
+	return blob, nil
+}
+
+// saveQuality saves image at the quality chosen by options.TargetSSIM and
+// options.MaxBytes, if they're set.
+func saveQuality(image *vips.Image, options SaveOptions) ([]byte, error) {
+	if options.TargetSSIM > 0 && isLossy(options) {
+		blob, quality, err := saveTargetSSIM(image, options)
+		if err != nil || options.MaxBytes <= 0 || len(blob) <= options.MaxBytes {
+			return blob, err
+		}
+
+		// Let MaxBytes reduce quality further from there.
+		options.Quality = quality
+	}
+
+	if options.MaxBytes > 0 {
+		return saveMaxBytes(image, options)
+	}
+
+	return save(image, options)
+}
+
+// maxSSIMIterations bounds how many times saveTargetSSIM compresses an
+// image.  A binary search over 100 quality levels needs at most 7.
+const maxSSIMIterations = 7
+
+// saveTargetSSIM saves image at the lowest quality from options.MinQuality
+// up to options.Quality whose SSIM to image is at least
+// options.TargetSSIM, or at options.Quality if none is.  It returns the
+// compressed image and the quality chosen.
+func saveTargetSSIM(image *vips.Image, options SaveOptions) ([]byte, int, error) {
+	// Sequentially loaded images can only be read once, so buffer the
+	// pixels in memory to allow compressing them repeatedly.
+	if err := image.Write(); err != nil {
+		return nil, 0, err
+	}
+
+	var best []byte
+	quality := options.Quality
+	low, high := options.MinQuality, options.Quality
+	if low < 1 {
+		low = 1
+	}
+	for i := 0; i < maxSSIMIterations && low <= high; i++ {
+		options.Quality = (low + high) / 2
+		blob, err := save(image, options)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		ssim, err := blobSSIM(blob, options.Format, image)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if ssim >= options.TargetSSIM {
+			best, quality = blob, options.Quality
+			high = options.Quality - 1
+		} else {
+			low = options.Quality + 1
+		}
+	}
+
+	if best == nil {
+		options.Quality = quality
+		blob, err := save(image, options)
+		return blob, quality, err
+	}
+
+	return best, quality, nil
+}
+
+// blobSSIM decodes a compressed image in Format f and returns its SSIM to
+// ref.  The blob is one we just saved, so its format's loader is used even
+// if LoadTiff, which only guards originals, is off.
+func blobSSIM(blob []byte, f Format, ref *vips.Image) (float64, error) {
+	loadBytes := formatInfo[f].loadBytes
+	if loadBytes == nil {
+		return 0, ErrInvalidOperation
+	}
+
+	decoded, err := loadBytes(blob)
+	if err != nil {
+		return 0, err
+	}
+	defer decoded.Close()
+
+	return decoded.Ssim(ref)
+}
+
+// isLossy returns true if quality affects the Format chosen in options.
+func isLossy(options SaveOptions) bool {
+	return (options.Format == Jpeg && len(options.CustomQuantTables) == 0) || (options.Format == Webp && !options.Lossless) || (options.Format == Tiff && options.TiffCompression == TiffJpeg)
+}
+
+// saveMaxBytes saves image at the highest quality from options.MinQuality
+// up to options.Quality that fits within options.MaxBytes, using a binary
+// search to limit how many times it is compressed.
+func saveMaxBytes(image *vips.Image, options SaveOptions) ([]byte, error) {
+	// Sequentially loaded images can only be read once, so buffer the
+	// pixels in memory to allow compressing them repeatedly.
+	if err := image.Write(); err != nil {
+		return nil, err
+	}
+
+	blob, err := save(image, options)
+	if err != nil || len(blob) <= options.MaxBytes {
+		return blob, err
+	}
+
+	// Quality doesn't affect lossless or palette formats.
+	if !isLossy(options) {
+		return nil, ErrMaxBytes
+	}
+
+	var best []byte
+	low, high := options.MinQuality, options.Quality-1
+	if low < 1 {
+		low = 1
+	}
+	for low <= high {
+		options.Quality = (low + high) / 2
+		blob, err = save(image, options)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(blob) <= options.MaxBytes {
+			best = blob
+			low = options.Quality + 1
+		} else {
+			high = options.Quality - 1
+		}
+	}
+
+	if best == nil {
+		return nil, ErrMaxBytes
+	}
+
+	return best, nil
+}
+
+// save compresses an image in the Format and with the other settings
+// already chosen in options.
+func save(image *vips.Image, options SaveOptions) ([]byte, error) {
 	switch options.Format {
 	case Jpeg:
 		return jpegSave(image, options)
@@ -61,6 +379,10 @@ func Save(image *vips.Image, options SaveOptions) ([]byte, error) {
 		return pngSave(image, options)
 	case Webp:
 		return webpSave(image, options)
+	case Gif:
+		return image.GifsaveBuffer(!options.KeepMetadata)
+	case Tiff:
+		return tiffSave(image, options)
 	default:
 		return nil, ErrInvalidSaveFormat
 	}
@@ -75,17 +397,30 @@ func jpegSave(image *vips.Image, options SaveOptions) ([]byte, error) {
 	pixels := image.Xsize() * image.Ysize()
 	interlace := pixels >= 200*200 && pixels <= 1024*1024
 
-	// Strip and optimize both save space, enable them.
-	return image.JpegsaveBuffer(true, options.Quality, true, interlace)
+	var blob []byte
+	var err error
+	if len(options.CustomQuantTables) > 0 {
+		blob, err = customQuantSave(image, options, interlace)
+	} else {
+		// Strip and optimize both save space, enable them.
+		blob, err = image.JpegsaveBuffer(!options.KeepMetadata, options.Quality, true, interlace, options.QuantTable, options.RestartInterval, options.SmallJpeg, subsamples[options.Subsampling])
+	}
+
+	return blob, err
 }
 
 func pngSave(image *vips.Image, options SaveOptions) ([]byte, error) {
+	dither := 0.0
+	if options.Dither {
+		dither = 1.0
+	}
+
 	// PNG interlace is larger; don't use it.
-	return image.PngsaveBuffer(true, options.Compression, false)
+	return image.PngsaveBuffer(!options.KeepMetadata, options.Compression, false, options.Colors, dither)
 }
 
 func webpSave(image *vips.Image, options SaveOptions) ([]byte, error) {
-	return image.WebpsaveBuffer(options.Quality, options.Lossless)
+	return image.WebpsaveBuffer(!options.KeepMetadata, options.Quality, options.Lossless)
 }
 
 func useLossless(image *vips.Image, options SaveOptions) bool {
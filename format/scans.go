@@ -0,0 +1,250 @@
+package format
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ErrNoJpegtran is returned when SaveOptions.ScanScript is set, but
+// Jpegtran can't be found.
+var ErrNoJpegtran = errors.New("jpegtran not available")
+
+// Jpegtran is the jpegtran binary, from libjpeg-turbo or mozjpeg, used to
+// rewrite JPEGs with SaveOptions.ScanScript, looked up in $PATH if it has
+// no directory.
+var Jpegtran = "jpegtran"
+
+// maxScanComponents is the most color components a JPEG scan can have.
+const maxScanComponents = 4
+
+// Scan is one scan of a JPEG, which holds a band of DCT coefficients, or
+// some bits of them, for some of its color components.
+type Scan struct {
+	// Components are the indexes of the color components in the scan,
+	// such as 0 for Y, and 1 and 2 for Cb and Cr.
+	Components []int
+	// Ss and Se are the first and last DCT coefficient in the scan, in
+	// zig-zag order (0-63), where 0 is DC.
+	Ss int
+	Se int
+	// Ah and Al are the successive approximation bit positions: the
+	// low bit of the previous scan of these coefficients, if any, and
+	// of this one.
+	Ah int
+	Al int
+}
+
+// ScanScriptError is returned when a SaveOptions.ScanScript doesn't parse
+// or describes a scan JPEG doesn't allow.
+type ScanScriptError struct {
+	// Scan is the number of the scan with the error, counting from 1.
+	Scan   int
+	Reason string
+}
+
+func (e ScanScriptError) Error() string {
+	return fmt.Sprintf("Invalid JPEG scan script: scan %d: %s", e.Scan, e.Reason)
+}
+
+// ParseScanScript parses a scan script in jpegtran's format, such as
+// "0: 0-0, 0, 0; 0: 1-63, 0, 0; 1,2: 0-0, 0, 0; 1: 1-63, 0, 0; 2: 1-63,
+// 0, 0;" to send the luma before the color.  Each scan is a list of
+// component indexes, optionally followed by a colon and Ss-Se, Ah, Al,
+// which default to 0-63, 0, 0, and ends with a semicolon.  Comments run
+// from # to the end of a line.  Whether the scans together are a valid
+// JPEG is left to jpegtran to check.
+func ParseScanScript(script string) ([]Scan, error) {
+	lines := strings.Split(script, "\n")
+	for i, line := range lines {
+		if c := strings.IndexByte(line, '#'); c >= 0 {
+			lines[i] = line[:c]
+		}
+	}
+
+	scans := []Scan{}
+	entries := strings.Split(strings.Join(lines, " "), ";")
+	for i, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			if i == len(entries)-1 {
+				break
+			}
+			return nil, ScanScriptError{len(scans) + 1, "empty scan"}
+		}
+		if i == len(entries)-1 {
+			return nil, ScanScriptError{len(scans) + 1, "missing semicolon"}
+		}
+
+		scan, reason := parseScan(entry)
+		if reason != "" {
+			return nil, ScanScriptError{len(scans) + 1, reason}
+		}
+		scans = append(scans, scan)
+	}
+
+	if len(scans) == 0 {
+		return nil, ScanScriptError{1, "no scans"}
+	}
+
+	return scans, nil
+}
+
+// parseScan parses and checks one entry of a scan script, or returns why
+// it's invalid.
+func parseScan(entry string) (Scan, string) {
+	s := Scan{Se: 63}
+	parts := strings.SplitN(entry, ":", 2)
+
+	for _, field := range strings.Split(parts[0], ",") {
+		c, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || c < 0 || c >= maxScanComponents {
+			return Scan{}, fmt.Sprintf("bad component %q", strings.TrimSpace(field))
+		}
+		for _, d := range s.Components {
+			if c == d {
+				return Scan{}, fmt.Sprintf("component %d repeated", c)
+			}
+		}
+		s.Components = append(s.Components, c)
+	}
+
+	if len(parts) == 2 {
+		params := strings.Join(strings.Fields(parts[1]), "")
+		var rest string
+		if n, _ := fmt.Sscanf(params+";", "%d-%d,%d,%d%s", &s.Ss, &s.Se, &s.Ah, &s.Al, &rest); n != 5 || rest != ";" {
+			return Scan{}, fmt.Sprintf("bad parameters %q, expected Ss-Se, Ah, Al", strings.TrimSpace(parts[1]))
+		}
+	}
+
+	switch {
+	case s.Ss < 0 || s.Se > 63 || s.Ss > s.Se:
+		return Scan{}, fmt.Sprintf("bad coefficient range %d-%d", s.Ss, s.Se)
+	case s.Ss > 0 && len(s.Components) != 1:
+		return Scan{}, "AC scans must have exactly one component"
+	case s.Ss == 0 && s.Se != 0 && (s.Se != 63 || s.Ah != 0 || s.Al != 0):
+		return Scan{}, "DC scans can't include AC coefficients"
+	case s.Al < 0 || s.Al > 13 || (s.Ah != 0 && s.Ah != s.Al+1):
+		return Scan{}, fmt.Sprintf("bad successive approximation %d, %d", s.Ah, s.Al)
+	}
+
+	return s, ""
+}
+
+// rewriteScans losslessly rewrites a JPEG blob with Jpegtran to have the
+// scans in script, which must already have been through ParseScanScript.
+func rewriteScans(blob []byte, script string) ([]byte, error) {
+	jpegtran, err := exec.LookPath(Jpegtran)
+	if err != nil {
+		return nil, ErrNoJpegtran
+	}
+
+	// jpegtran only reads scan scripts from a file.
+	f, err := ioutil.TempFile("", "fotomat-scans-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(script)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ToolTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, jpegtran, "-copy", "all", "-scans", f.Name())
+	cmd.Stdin = bytes.NewReader(blob)
+	out, stderr := bytes.Buffer{}, bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", Jpegtran, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out.Bytes(), nil
+}
+
+// JpegScans returns the Scans of a JPEG, from its start of scan headers,
+// with the components numbered in the order of its frame header.
+func JpegScans(blob []byte) []Scan {
+	scans := []Scan{}
+	var ids []byte
+	for i := 2; i+4 <= len(blob); {
+		if blob[i] != 0xff {
+			return scans
+		}
+		marker := blob[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if marker == 0xd9 { // End of image.
+			break
+		}
+		// The length includes its own two bytes, so less is malformed.
+		length := int(blob[i+2])<<8 + int(blob[i+3])
+		if length < 2 || i+2+length > len(blob) {
+			break
+		}
+		end := i + 2 + length
+		segment := blob[i+4 : end]
+
+		switch {
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// Precision, height, width, count, then an ID, sampling
+			// factors, and table for each component.
+			if len(segment) >= 6 {
+				for j := 6; j+3 <= len(segment); j += 3 {
+					ids = append(ids, segment[j])
+				}
+			}
+		case marker == 0xda:
+			scans = append(scans, parseSos(segment, ids))
+
+			// Skip the entropy-coded data, up to the next marker
+			// that isn't a stuffed 0xff or a restart.
+			for end < len(blob)-1 && (blob[end] != 0xff || blob[end+1] == 0 || (blob[end+1] >= 0xd0 && blob[end+1] <= 0xd7)) {
+				end++
+			}
+		}
+		i = end
+	}
+
+	return scans
+}
+
+// parseSos returns the Scan described by a start of scan segment, given
+// the component IDs from the frame header.
+func parseSos(segment []byte, ids []byte) Scan {
+	s := Scan{Components: []int{}}
+	if len(segment) < 1 {
+		return s
+	}
+	n := int(segment[0])
+	if len(segment) < 1+2*n+3 {
+		return s
+	}
+
+	for j := 0; j < n; j++ {
+		id := segment[1+2*j]
+		index := -1
+		for k, c := range ids {
+			if c == id {
+				index = k
+			}
+		}
+		s.Components = append(s.Components, index)
+	}
+	p := segment[1+2*n:]
+	s.Ss, s.Se, s.Ah, s.Al = int(p[0]), int(p[1]), int(p[2]>>4), int(p[2]&0x0f)
+
+	return s
+}
@@ -0,0 +1,57 @@
+package format
+
+import (
+	"github.com/die-net/fotomat/vips"
+)
+
+// LoadTiff enables loading TIFF images, such as to choose a Page of a
+// multi-page scan.  TIFF's many encodings are a large attack surface, so
+// it's off by default, and TIFFs fail with ErrLoaderUnavailable.
+var LoadTiff bool
+
+// TiffCompression is how the tiles of a TIFF are compressed.
+type TiffCompression int
+
+// TiffCompression values.  TiffJpeg is lossy at SaveOptions.Quality, and
+// the others are lossless.
+const (
+	TiffJpeg TiffCompression = iota
+	TiffDeflate
+	TiffLzw
+	TiffNone
+)
+
+const (
+	// DefaultTileSize is the width and height of TIFF tiles if
+	// SaveOptions.TileSize is unset.
+	DefaultTileSize = 256
+	// MaxTileSize is the largest SaveOptions.TileSize.
+	MaxTileSize = 4096
+)
+
+var tiffCompressions = []vips.TiffCompression{
+	TiffJpeg:    vips.TiffCompressionJpeg,
+	TiffDeflate: vips.TiffCompressionDeflate,
+	TiffLzw:     vips.TiffCompressionLzw,
+	TiffNone:    vips.TiffCompressionNone,
+}
+
+// isTiff returns true if blob starts with a little or big-endian TIFF
+// header, which http.DetectContentType doesn't know about.
+func isTiff(blob []byte) bool {
+	if len(blob) < 8 {
+		return false
+	}
+	header := string(blob[:4])
+	return header == "II*\x00" || header == "MM\x00*"
+}
+
+// tiffSave saves a tiled, pyramidal TIFF, as read by deep zoom viewers.
+func tiffSave(image *vips.Image, options SaveOptions) ([]byte, error) {
+	tileSize := options.TileSize
+	if tileSize == 0 {
+		tileSize = DefaultTileSize
+	}
+
+	return image.TiffsaveBuffer(!options.KeepMetadata, options.Quality, tileSize, tiffCompressions[options.TiffCompression])
+}
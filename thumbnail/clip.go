@@ -0,0 +1,66 @@
+package thumbnail
+
+import (
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/vips"
+	"math"
+	"sort"
+)
+
+// clip adds an alpha channel to image that makes everything outside the
+// polygons in paths transparent.
+func clip(image *vips.Image, paths [][]format.Point) error {
+	w, h := image.Xsize(), image.Ysize()
+	mask, err := vips.NewImageFromMemory(clipMask(paths, w, h), w, h, 1, vips.BandFormatUchar)
+	if err != nil {
+		return err
+	}
+	defer mask.Close()
+
+	return image.Bandjoin2(mask)
+}
+
+// clipMask returns a width by height 8-bit mask that is 255 for pixels
+// whose centers are inside the polygons in paths, using the even-odd rule,
+// and 0 elsewhere.
+func clipMask(paths [][]format.Point, width, height int) []byte {
+	mask := make([]byte, width*height)
+	xs := []float64{}
+
+	for y := 0; y < height; y++ {
+		// Find where each edge crosses the center of this row.
+		fy := (float64(y) + 0.5) / float64(height)
+		xs = xs[:0]
+		for _, p := range paths {
+			for i := range p {
+				a, b := p[i], p[(i+1)%len(p)]
+				if (a.Y <= fy) != (b.Y <= fy) {
+					xs = append(xs, a.X+(fy-a.Y)*(b.X-a.X)/(b.Y-a.Y))
+				}
+			}
+		}
+		sort.Float64s(xs)
+
+		row := mask[y*width : (y+1)*width]
+		for i := 0; i+1 < len(xs); i += 2 {
+			for x := clipColumn(xs[i], width); x < clipColumn(xs[i+1], width); x++ {
+				row[x] = 255
+			}
+		}
+	}
+
+	return mask
+}
+
+// clipColumn returns the first column of a row width pixels wide whose
+// center is at or right of fraction x of the width.
+func clipColumn(x float64, width int) int {
+	c := int(math.Ceil(x*float64(width) - 0.5))
+	if c < 0 {
+		return 0
+	}
+	if c > width {
+		return width
+	}
+	return c
+}
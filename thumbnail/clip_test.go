@@ -0,0 +1,50 @@
+package thumbnail
+
+import (
+	"bytes"
+	"github.com/die-net/fotomat/format"
+	"github.com/stretchr/testify/assert"
+	"image/png"
+	"testing"
+)
+
+func TestClippingPath(t *testing.T) {
+	// watermelon.jpg with a diamond-shaped Photoshop clipping path.
+	img := image("clippath.jpg")
+
+	thumb, err := Thumbnail(img, Options{Width: 200, Height: 200, ClippingPath: true})
+	if assert.Nil(t, err) && assert.Nil(t, isSize(thumb, format.Png, 149, 200, true)) {
+		out, err := png.Decode(bytes.NewReader(thumb))
+		if assert.Nil(t, err) {
+			for _, p := range [][2]int{{0, 0}, {148, 0}, {0, 199}, {148, 199}} {
+				_, _, _, a := out.At(p[0], p[1]).RGBA()
+				assert.Equal(t, uint32(0), a, "corner %v should be transparent", p)
+			}
+			_, _, _, a := out.At(74, 100).RGBA()
+			assert.Equal(t, uint32(0xffff), a, "center should be opaque")
+		}
+	}
+
+	// Unless it's requested, the path is ignored.
+	thumb, err = Thumbnail(img, Options{Width: 200, Height: 200})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 149, 200, false))
+	}
+
+	// Images without a clipping path are unaffected.
+	thumb, err = Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 200, ClippingPath: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 149, 200, false))
+	}
+}
+
+func TestClipMask(t *testing.T) {
+	square := [][]format.Point{{{X: 0.25, Y: 0.25}, {X: 0.75, Y: 0.25}, {X: 0.75, Y: 0.75}, {X: 0.25, Y: 0.75}}}
+	mask := clipMask(square, 4, 4)
+	assert.Equal(t, []byte{
+		0, 0, 0, 0,
+		0, 255, 255, 0,
+		0, 255, 255, 0,
+		0, 0, 0, 0,
+	}, mask)
+}
@@ -0,0 +1,58 @@
+package thumbnail
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrBadColor is returned when a color can't be parsed.
+var ErrBadColor = errors.New("Bad color specified")
+
+// Color is an opaque sRGB color.
+type Color struct {
+	R uint8
+	G uint8
+	B uint8
+}
+
+// namedColors are the CSS color names accepted by ParseColor.
+var namedColors = map[string]Color{
+	"black":  {0, 0, 0},
+	"blue":   {0, 0, 255},
+	"gray":   {128, 128, 128},
+	"green":  {0, 128, 0},
+	"grey":   {128, 128, 128},
+	"red":    {255, 0, 0},
+	"silver": {192, 192, 192},
+	"white":  {255, 255, 255},
+	"yellow": {255, 255, 0},
+}
+
+// ParseColor parses a CSS-style #RRGGBB or #RGB hex color, where the # is
+// optional, or one of a few basic CSS color names.
+func ParseColor(s string) (Color, error) {
+	if c, ok := namedColors[strings.ToLower(s)]; ok {
+		return c, nil
+	}
+
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return Color{}, ErrBadColor
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return Color{}, ErrBadColor
+	}
+
+	return Color{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v)}, nil
+}
+
+// String returns a Color in #rrggbb form.
+func (c Color) String() string {
+	return "#" + strconv.FormatUint(uint64(1)<<24|uint64(c.R)<<16|uint64(c.G)<<8|uint64(c.B), 16)[1:]
+}
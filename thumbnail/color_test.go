@@ -0,0 +1,26 @@
+package thumbnail
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseColor(t *testing.T) {
+	for _, s := range []string{"#ff0000", "#F00", "ff0000", "Red"} {
+		c, err := ParseColor(s)
+		if assert.Nil(t, err, "color: %s", s) {
+			assert.Equal(t, Color{R: 255}, c, "color: %s", s)
+		}
+	}
+
+	c, err := ParseColor("#0a1b2c")
+	if assert.Nil(t, err) {
+		assert.Equal(t, Color{R: 0x0a, G: 0x1b, B: 0x2c}, c)
+		assert.Equal(t, "#0a1b2c", c.String())
+	}
+
+	for _, s := range []string{"#zzz", "#ff00", "#ff00000", "", "#", "+f0000", "chartreuse"} {
+		_, err := ParseColor(s)
+		assert.Equal(t, ErrBadColor, err, "color: %s", s)
+	}
+}
@@ -0,0 +1,64 @@
+package thumbnail
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DigestPolicy is when Proxy sends a Digest header with the SHA-256 of
+// the image it returns, as in RFC 3230, so clients can verify it.
+type DigestPolicy int
+
+// Digest policies.
+const (
+	// NoDigest never sends a Digest header.
+	NoDigest DigestPolicy = iota
+	// WantDigest sends a Digest header when the request's Want-Digest
+	// header accepts sha-256.
+	WantDigest
+	// AlwaysDigest sends a Digest header with every image.
+	AlwaysDigest
+)
+
+// digest returns the Digest header value for blob.
+func digest(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wantsDigest returns true if a DigestPolicy calls for a Digest header
+// in response to a request with header h.
+func (d DigestPolicy) wantsDigest(h http.Header) bool {
+	switch d {
+	case AlwaysDigest:
+		return true
+	case WantDigest:
+		return acceptsSha256(h.Get("Want-Digest"))
+	}
+	return false
+}
+
+// acceptsSha256 returns true if a Want-Digest header value, such as
+// "sha-256;q=1, md5;q=0.5", lists sha-256 without a zero q value.
+func acceptsSha256(want string) bool {
+	for _, item := range strings.Split(want, ",") {
+		params := strings.Split(item, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "sha-256") {
+			continue
+		}
+
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+				if q, err := strconv.ParseFloat(kv[1], 64); err != nil || q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package thumbnail
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestAcceptsSha256(t *testing.T) {
+	for want, ok := range map[string]bool{
+		"":                        false,
+		"sha-256":                 true,
+		"SHA-256":                 true,
+		"md5":                     false,
+		"md5;q=0.3, sha-256;q=1":  true,
+		" sha-256 ; q=0.5 ":       true,
+		"sha-256;q=0":             false,
+		"sha-256;q=bogus":         false,
+		"sha-512, sha-256;q=0.1":  true,
+		"sha-2560":                false,
+		"md5;q=1,sha-256;foo=bar": true,
+	} {
+		assert.Equal(t, ok, acceptsSha256(want), want)
+	}
+}
+
+func TestDigestPolicy(t *testing.T) {
+	want := http.Header{"Want-Digest": {"sha-256"}}
+	assert.False(t, NoDigest.wantsDigest(want))
+	assert.False(t, WantDigest.wantsDigest(http.Header{}))
+	assert.True(t, WantDigest.wantsDigest(want))
+	assert.True(t, AlwaysDigest.wantsDigest(http.Header{}))
+
+	// The SHA-256 of "abc", from FIPS 180-2.
+	assert.Equal(t, "sha-256=ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=", digest([]byte("abc")))
+}
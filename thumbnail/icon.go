@@ -0,0 +1,104 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/die-net/fotomat/format"
+)
+
+// MaxIconSize is the largest width and height an ICO entry can have.
+const MaxIconSize = 256
+
+// DefaultIconSizes are the usual sizes of a favicon.
+var DefaultIconSizes = []int{16, 32, 48}
+
+// Icon scales a compressed image blob to each of sizes, such as
+// DefaultIconSizes, and packs the results into a single ICO file, such as
+// for a favicon.  Each is cropped to a square, or with Pad set, padded to
+// one, and stored as a PNG.  Sizes that would duplicate a smaller one,
+// since images aren't upscaled, are left out.  Other Options apply to each
+// size as they would for Thumbnail, except for Width, Height, Save,
+// KeepFormat, Video, PassThrough, and MinProcessDimension, since each
+// must be a newly encoded PNG.
+func Icon(blob []byte, sizes []int, o Options) ([]byte, error) {
+	if len(sizes) == 0 {
+		return nil, ErrBadOption
+	}
+	for _, size := range sizes {
+		if size < 1 || size > MaxIconSize {
+			return nil, ErrBadOption
+		}
+	}
+
+	if !o.Pad {
+		o.Crop = true
+	}
+	o.Save = format.SaveOptions{Format: format.Png, Lossless: true}
+	o.KeepFormat, o.Video, o.PassThrough, o.MinProcessDimension = false, NoVideo, false, 0
+
+	var images [][]byte
+	seen := make(map[int]bool)
+	for _, size := range sizes {
+		o.Width, o.Height = size, size
+		thumb, err := Thumbnail(blob, o)
+		if err != nil {
+			return nil, err
+		}
+
+		f, w, _, err := format.ProbeDimensions(thumb)
+		if err != nil {
+			return nil, err
+		}
+		if f != format.Png {
+			return nil, ErrUnsupportedConversion
+		}
+		if seen[w] {
+			continue
+		}
+		seen[w] = true
+
+		images = append(images, thumb)
+	}
+
+	return packIcon(images)
+}
+
+// packIcon returns an ICO file containing PNG images, described by an
+// ICONDIR header followed by an ICONDIRENTRY for each.
+func packIcon(images [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+
+	// Reserved, type 1 for icons, and the number of images.
+	header := make([]byte, 6)
+	le.PutUint16(header[2:4], 1)
+	le.PutUint16(header[4:6], uint16(len(images)))
+	buf.Write(header)
+
+	offset := 6 + 16*len(images)
+	for _, png := range images {
+		_, w, h, err := format.ProbeDimensions(png)
+		if err != nil {
+			return nil, err
+		}
+
+		// Width and height, where 0 means 256, no palette, reserved,
+		// 1 color plane, 32 bits per pixel, then the PNG's size and
+		// offset.
+		entry := make([]byte, 16)
+		entry[0], entry[1] = uint8(w), uint8(h)
+		le.PutUint16(entry[4:6], 1)
+		le.PutUint16(entry[6:8], 32)
+		le.PutUint32(entry[8:12], uint32(len(png)))
+		le.PutUint32(entry[12:16], uint32(offset))
+		buf.Write(entry)
+
+		offset += len(png)
+	}
+
+	for _, png := range images {
+		buf.Write(png)
+	}
+
+	return buf.Bytes(), nil
+}
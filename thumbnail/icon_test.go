@@ -0,0 +1,76 @@
+package thumbnail
+
+import (
+	"encoding/binary"
+	"github.com/die-net/fotomat/format"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIcon(t *testing.T) {
+	ico, err := Icon(image("watermelon.jpg"), DefaultIconSizes, Options{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []int{16, 32, 48}, iconSizes(t, ico))
+
+	// 256 is stored as 0, and images are never upscaled, so sizes that
+	// would duplicate a smaller one are left out.
+	ico, err = Icon(image("2px.png"), []int{2, 256}, Options{MinDimension: 1})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int{2}, iconSizes(t, ico))
+	}
+
+	// Originals are never passed through, even if they're tiny.
+	ico, err = Icon(image("watermelon.jpg"), []int{16}, Options{MinProcessDimension: 1000})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int{16}, iconSizes(t, ico))
+	}
+	ico, err = Icon(image("3000px.png"), []int{256}, Options{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int{256}, iconSizes(t, ico))
+		assert.Equal(t, byte(0), ico[6])
+	}
+
+	for _, sizes := range [][]int{nil, {0}, {16, 257}} {
+		_, err = Icon(image("watermelon.jpg"), sizes, Options{})
+		assert.Equal(t, ErrBadOption, err, "%v", sizes)
+	}
+
+	_, err = Icon(image("notimage.txt"), DefaultIconSizes, Options{})
+	assert.Equal(t, format.ErrUnknownFormat, err)
+}
+
+// iconSizes checks the ICO directory and PNG images of ico, and returns
+// the width of each image.
+func iconSizes(t *testing.T, ico []byte) []int {
+	le := binary.LittleEndian
+	if !assert.True(t, len(ico) >= 6) || !assert.Equal(t, uint16(1), le.Uint16(ico[2:4])) {
+		return nil
+	}
+
+	n := int(le.Uint16(ico[4:6]))
+	if !assert.True(t, len(ico) >= 6+16*n) {
+		return nil
+	}
+
+	var sizes []int
+	for i := 0; i < n; i++ {
+		entry := ico[6+16*i : 6+16*(i+1)]
+		size, offset := int(le.Uint32(entry[8:12])), int(le.Uint32(entry[12:16]))
+		if !assert.True(t, offset+size <= len(ico)) {
+			return nil
+		}
+
+		f, w, h, err := format.ProbeDimensions(ico[offset : offset+size])
+		if assert.Nil(t, err) {
+			assert.Equal(t, format.Png, f)
+			assert.Equal(t, w&0xff, int(entry[0]))
+			assert.Equal(t, h&0xff, int(entry[1]))
+			assert.Equal(t, w, h)
+		}
+		sizes = append(sizes, w)
+	}
+
+	return sizes
+}
@@ -1,9 +1,47 @@
 package thumbnail
 
 import (
+	"github.com/die-net/fotomat/format"
 	"github.com/die-net/fotomat/vips"
+	"sync"
+)
+
+var (
+	warmupOnce sync.Once
+	warmupErr  error
 )
 
 func init() {
 	vips.Initialize()
 }
+
+// Warmup makes the first real Thumbnail faster by thumbnailing a tiny
+// image in each format that can be saved, which loads the codecs and ICC
+// profiles VIPS otherwise initializes lazily.  It is safe to call more
+// than once or concurrently, but only does the work the first time.
+func Warmup() error {
+	warmupOnce.Do(func() {
+		warmupErr = warmup()
+	})
+	return warmupErr
+}
+
+func warmup() error {
+	for _, f := range []format.Format{format.Jpeg, format.Png, format.Webp} {
+		img, err := vips.NewImageFromMemory(make([]byte, 16*16*3), 16, 16, 3, vips.BandFormatUchar)
+		if err != nil {
+			return err
+		}
+		blob, err := format.Save(img, format.SaveOptions{Format: f})
+		img.Close()
+		if err != nil {
+			return err
+		}
+
+		if _, err := Thumbnail(blob, Options{Width: 8, Height: 8}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
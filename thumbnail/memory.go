@@ -0,0 +1,81 @@
+package thumbnail
+
+import (
+	"errors"
+	"github.com/die-net/fotomat/vips"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMemoryLimit is returned when processing an image allocates more than
+// Options.MaxMemory.
+var ErrMemoryLimit = errors.New("Image processing exceeded memory limit")
+
+// memoryPollInterval is how often a memoryWatchdog samples VIPS' memory.
+const memoryPollInterval = 5 * time.Millisecond
+
+// memoryWatchdog samples the memory VIPS has allocated beyond what it had
+// when the watchdog started, to notice an operation that allocates more
+// than its limit, even if that is freed again before the operation ends.
+// A nil memoryWatchdog never reports exceeding its limit.
+type memoryWatchdog struct {
+	base     int64
+	limit    int64
+	exceeded int32 // Accessed atomically.
+	stop     chan struct{}
+}
+
+// newMemoryWatchdog starts a memoryWatchdog for limit bytes, or returns
+// nil if limit is 0.
+func newMemoryWatchdog(limit int64) *memoryWatchdog {
+	if limit <= 0 {
+		return nil
+	}
+
+	w := &memoryWatchdog{base: vips.TrackedMem(), limit: limit, stop: make(chan struct{})}
+	go w.poll()
+	return w
+}
+
+func (w *memoryWatchdog) poll() {
+	ticker := time.NewTicker(memoryPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.sample()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *memoryWatchdog) sample() {
+	if vips.TrackedMem()-w.base > w.limit {
+		atomic.StoreInt32(&w.exceeded, 1)
+	}
+}
+
+// Check returns ErrMemoryLimit if the limit has been exceeded now or at
+// any sample since the watchdog started.
+func (w *memoryWatchdog) Check() error {
+	if w == nil {
+		return nil
+	}
+
+	w.sample()
+	if atomic.LoadInt32(&w.exceeded) != 0 {
+		return ErrMemoryLimit
+	}
+
+	return nil
+}
+
+// Stop stops sampling.  It must be called once the watchdog is no longer
+// needed.
+func (w *memoryWatchdog) Stop() {
+	if w != nil {
+		close(w.stop)
+	}
+}
@@ -0,0 +1,58 @@
+package thumbnail
+
+import (
+	"os"
+	"syscall"
+)
+
+// MapFile memory-maps filename read-only, returning its contents and a
+// function that unmaps them, which must be called once the contents are
+// no longer referenced.  This avoids copying large files into the Go heap.
+func MapFile(filename string) ([]byte, func() error, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Empty files can't be mapped, and have nothing to unmap.
+	size := fi.Size()
+	if size == 0 {
+		return []byte{}, func() error { return nil }, nil
+	}
+	if int64(int(size)) != size {
+		return nil, nil, syscall.EFBIG
+	}
+
+	blob, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return blob, func() error { return syscall.Munmap(blob) }, nil
+}
+
+// ProcessFile is like Process, but memory-maps the original image from
+// filename rather than reading it into memory, which reduces peak memory
+// use for large originals.  The mapping is released when processing
+// completes, so a Result that would refer to it, such as with
+// PassThrough, is copied first.
+func (p *Pool) ProcessFile(filename string, options Options, aborted <-chan bool) (Result, error) {
+	orig, unmap, err := MapFile(filename)
+	if err != nil {
+		return Result{}, err
+	}
+	defer unmap()
+
+	r, err := p.Process(orig, options, aborted)
+	if len(r.Blob) > 0 && len(orig) > 0 && &r.Blob[0] == &orig[0] {
+		r.Blob = append([]byte(nil), r.Blob...)
+	}
+
+	return r, err
+}
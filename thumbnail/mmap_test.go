@@ -0,0 +1,67 @@
+package thumbnail
+
+import (
+	"bytes"
+	"github.com/die-net/fotomat/format"
+	"github.com/stretchr/testify/assert"
+	goimage "image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fotomat-mmap")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// A 3000x2000 pattern, large enough to be worth mapping.
+	big := goimage.NewRGBA(goimage.Rect(0, 0, 3000, 2000))
+	for y := 0; y < 2000; y++ {
+		for x := 0; x < 3000; x++ {
+			big.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: 255})
+		}
+	}
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, png.Encode(&buf, big)) {
+		return
+	}
+	filename := filepath.Join(dir, "big.png")
+	if !assert.Nil(t, ioutil.WriteFile(filename, buf.Bytes(), 0644)) {
+		return
+	}
+
+	pool := NewPool(1, 1)
+	defer pool.Close()
+
+	// Mapping gives the same output as reading the whole file.
+	o := Options{Width: 300, Height: 300, Crop: true, Save: format.SaveOptions{Format: format.Png}}
+	want, err := pool.Thumbnail(buf.Bytes(), o, nil)
+	if assert.Nil(t, err) {
+		r, err := pool.ProcessFile(filename, o, nil)
+		if assert.Nil(t, err) {
+			assert.True(t, bytes.Equal(want, r.Blob))
+		}
+	}
+
+	// Results that would be the mapped original are copied, so outlive
+	// the mapping.
+	r, err := pool.ProcessFile(filename, Options{PassThrough: true, MaxBufferPixels: 6000000, Save: format.SaveOptions{KeepMetadata: true}}, nil)
+	if assert.Nil(t, err) {
+		assert.True(t, bytes.Equal(buf.Bytes(), r.Blob))
+	}
+
+	_, err = pool.ProcessFile(filepath.Join(dir, "missing.png"), o, nil)
+	assert.True(t, os.IsNotExist(err))
+
+	empty := filepath.Join(dir, "empty.png")
+	if assert.Nil(t, ioutil.WriteFile(empty, nil, 0644)) {
+		_, err = pool.ProcessFile(empty, o, nil)
+		assert.Equal(t, format.ErrUnknownFormat, err)
+	}
+}
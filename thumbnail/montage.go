@@ -0,0 +1,114 @@
+package thumbnail
+
+import (
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/vips"
+)
+
+// Montage arranges the first pages or frames of an image in a grid, as a
+// contact sheet for previewing animations or documents.  Each is scaled to
+// fit within a cell of Options' Width by Height, and centered on its
+// Background.
+type Montage struct {
+	// Columns and Rows are the most cells across and down.  There are
+	// only as many rows as needed for the image's pages.
+	Columns int
+	Rows    int
+	// Spacing is the number of pixels of Background between cells.
+	Spacing int
+}
+
+// size returns the width and height of a full Montage of w by h cells.
+func (mo Montage) size(w, h int) (int, int) {
+	return mo.Columns*(w+mo.Spacing) - mo.Spacing, mo.Rows*(h+mo.Spacing) - mo.Spacing
+}
+
+// pages returns the number of cells filled in a Montage of an image with
+// Metadata m.
+func (mo Montage) pages(m format.Metadata) int {
+	n := mo.Columns * mo.Rows
+	if m.Pages < n {
+		n = m.Pages
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// montage returns a Montage of the pages of blob with Metadata m, as
+// specified by Options o, which must already have been through Check.
+func montage(blob []byte, m format.Metadata, o Options) ([]byte, error) {
+	n := o.Montage.pages(m)
+
+	cells := make([]*vips.Image, 0, n)
+	defer func() {
+		for _, cell := range cells {
+			cell.Close()
+		}
+	}()
+
+	for page := 0; page < n; page++ {
+		cell, err := m.Format.LoadBytesPage(blob, page)
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, cell)
+
+		if err := montageCell(cell, m.Orientation, o); err != nil {
+			return nil, err
+		}
+	}
+
+	background := []float64{float64(o.Background.R), float64(o.Background.G), float64(o.Background.B)}
+	if cells[0].HasAlpha() {
+		background = append(background, cells[0].MaxAlpha())
+	}
+
+	sheet, err := vips.ArrayJoin(cells, o.Montage.Columns, o.Montage.Spacing, background)
+	if err != nil {
+		return nil, err
+	}
+	defer sheet.Close()
+
+	if o.Save.Format == format.Jpeg && sheet.HasAlpha() {
+		if err := flatten(sheet, o.Background); err != nil {
+			return nil, err
+		}
+	}
+
+	return format.Save(sheet, o.Save)
+}
+
+// montageCell scales a page of an image with Orientation orientation to
+// fit within and fill a Montage cell, as specified by Options o.
+func montageCell(cell *vips.Image, orientation format.Orientation, o Options) error {
+	if err := srgb(cell, o.CmykProfile, o.RgbProfile); err != nil {
+		return err
+	}
+
+	if err := orientation.Apply(cell); err != nil {
+		return err
+	}
+
+	iw, ih, _ := scaleAspect(cell.Xsize(), cell.Ysize(), o.Width, o.Height, true, o.Rounding)
+	if err := resize(cell, iw, ih, o.FastResize == ToggleOn, 0, false, false, !o.Premultiplied, resizeKernels{down: o.DownscaleKernel}); err != nil {
+		return err
+	}
+
+	if cell.ImageGetBandFormat() != vips.BandFormatUchar {
+		if err := cell.Cast(vips.BandFormatUchar); err != nil {
+			return err
+		}
+	}
+
+	// Pages share a loader, so all have the same bands as each other
+	// once in sRGB.
+	if cell.ImageGetBands() < 3 {
+		if err := cell.Colourspace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+
+	return pad(cell, o.Width, o.Height, o.Background)
+}
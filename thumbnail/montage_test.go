@@ -0,0 +1,39 @@
+package thumbnail
+
+import (
+	"github.com/die-net/fotomat/format"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMontage(t *testing.T) {
+	// Three 100x80 frames in 50x50 cells, two across with 4 pixels
+	// between, need two rows.
+	o := Options{Width: 50, Height: 50, Montage: Montage{Columns: 2, Rows: 3, Spacing: 4}, Save: format.SaveOptions{Format: format.Jpeg}}
+	thumb, err := Thumbnail(animatedGif(t, 3), o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 104, 104, false))
+	}
+
+	// At most Columns by Rows frames are used.
+	o.Montage = Montage{Columns: 3, Rows: 1}
+	thumb, err = Thumbnail(animatedGif(t, 5), o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 150, 50, false))
+	}
+
+	// A still image is a single cell.
+	o.Montage = Montage{Columns: 2, Rows: 2, Spacing: 10}
+	thumb, err = Thumbnail(image("watermelon.jpg"), o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 50, 50, false))
+	}
+
+	_, err = Thumbnail(image("watermelon.jpg"), Options{Width: 50, Height: 50, Montage: Montage{Columns: 2}})
+	assert.Equal(t, ErrBadOption, err)
+
+	_, err = Thumbnail(image("watermelon.jpg"), Options{Width: 5000, Height: 5000, Montage: Montage{Columns: 10, Rows: 10}})
+	assert.Equal(t, ErrTooBig, err)
+
+	assert.IsType(t, ConflictError{}, Options{Width: 50, Height: 50, Crop: true, Montage: Montage{Columns: 2, Rows: 2}}.Validate())
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/die-net/fotomat/format"
+	"math"
 	"time"
 )
 
@@ -15,40 +17,320 @@ var (
 	ErrTooBig = errors.New("Image is too wide or tall")
 	// ErrTooSmall is returned when an image is too small.
 	ErrTooSmall = errors.New("Image is too small")
+	// ErrBadAspectRatio is returned when an image is too elongated.
+	ErrBadAspectRatio = errors.New("Image aspect ratio is too extreme")
+	// ErrUnsupportedConversion is returned with Options.StrictFormat when
+	// the output format can't be the one requested or the original's.
+	ErrUnsupportedConversion = errors.New("Can't save image in requested format")
 )
 
+// PageError is returned when Options.Page is past the last page of an
+// image.
+type PageError struct {
+	Page  int
+	Pages int
+}
+
+func (e PageError) Error() string {
+	return fmt.Sprintf("Page %d requested, but image only has %d", e.Page, e.Pages)
+}
+
+// ConflictError is returned by Options.Validate when options contradict
+// each other, describing why.
+type ConflictError struct {
+	Reason string
+}
+
+func (e ConflictError) Error() string {
+	return "Conflicting options: " + e.Reason
+}
+
+// Rule sets the output size of originals larger than a threshold, so that
+// clients that don't know an original's size can still say, for example,
+// to scale originals wider than 2000 pixels down to 2000, and leave others
+// at their own size.
+type Rule struct {
+	// WiderThan and TallerThan select originals more than this many
+	// pixels wide or tall.  If both are 0, the Rule always matches.
+	WiderThan  int
+	TallerThan int
+	// Width and Height replace Options' Width and Height.
+	Width  int
+	Height int
+}
+
+// matches returns true if Rule r applies to an original with Metadata m.
+func (r Rule) matches(m format.Metadata) bool {
+	if r.WiderThan == 0 && r.TallerThan == 0 {
+		return true
+	}
+
+	return (r.WiderThan > 0 && m.Width > r.WiderThan) || (r.TallerThan > 0 && m.Height > r.TallerThan)
+}
+
 const (
 	minDimension = 2             // Avoid off-by-one divide-by-zero errors.
 	maxDimension = (1 << 15) - 2 // Avoid signed int16 overflows.
 )
 
+// Rounding specifies how a computed width or height is rounded to a whole
+// number of pixels.
+type Rounding int
+
+// Rounding modes. RoundUp never loses a partial row or column of pixels.
+const (
+	RoundUp Rounding = iota
+	RoundDown
+	RoundNearest
+)
+
+// divide returns n / d, rounded as specified.
+func (r Rounding) divide(n, d int) int {
+	switch r {
+	case RoundDown:
+		return n / d
+	case RoundNearest:
+		return (n + d/2) / d
+	default:
+		return (n + d - 1) / d
+	}
+}
+
+// Kernel is the interpolation kernel used to resize an image.
+type Kernel int
+
+// Kernels.  DefaultKernel is VIPS's default, which is Lanczos3.
+const (
+	DefaultKernel Kernel = iota
+	Nearest
+	Linear
+	Cubic
+	Lanczos2
+	Lanczos3
+)
+
+// OrientationPolicy specifies how an image's EXIF orientation is used.
+type OrientationPolicy int
+
+// Orientation policies.  GuessOrientation ignores an EXIF rotation by 90
+// or 270 degrees if the pixels already have the shape of the requested
+// Width and Height, such as a portrait image that has been rotated
+// upright without its orientation tag being updated.
+const (
+	TrustOrientation OrientationPolicy = iota
+	GuessOrientation
+)
+
 // Options specifies how a Thumbnail operation should modify an image.
+// However they are combined, operations are always applied in the same
+// order: Page is selected, ClippingPath is applied, Trim or Region is
+// extracted, the result is scaled to Width and Height and then cropped by
+// Crop, the Orientation is applied, it is padded by Pad, Watermark is
+// overlaid, and then it is saved as specified by Save.
 type Options struct {
 	// Width and Height are the optional maximum sizes of output image,
 	// in pixels.  If Crop is false, the original aspect ratio is
 	// preserved and the more restrictive of Width or Height are used.
 	Width  int
 	Height int
+	// Scale optionally sizes the output image relative to the original,
+	// such as 0.5 for half its width and height, and replaces Width and
+	// Height.  Unless Upscale is set, values over 1 act as 1.
+	Scale float64
+	// Upscale allows images smaller than Width by Height to be enlarged
+	// to fit it, or with Crop to fill it, rather than being left at
+	// their original size.
+	Upscale bool
+	// DownscaleKernel and UpscaleKernel optionally choose the Kernel
+	// used to shrink and to enlarge images, such as Lanczos3 to keep
+	// detail when shrinking, but Cubic to avoid ringing, or Nearest to
+	// keep pixel art sharp, when enlarging.  Both default to Lanczos3.
+	DownscaleKernel Kernel
+	UpscaleKernel   Kernel
+	// Rules optionally pick Width and Height by the original's size.  The
+	// first Rule that matches replaces them, and if none do, they're
+	// left as they are.
+	Rules []Rule
+	// MinDimension is the minimum width and height of an input image,
+	// in pixels, below which ErrTooSmall is returned.  If unset, images
+	// must be at least 2x2.  Set to 1 to accept 1x1 tracking pixels.
+	MinDimension int
+	// MaxDimension optionally caps the longest side of the output
+	// image, in pixels, independent of Width and Height.  The other side
+	// is rounded by Rounding, so a 398x536 image capped to 400 is 298x400
+	// with the default RoundUp, and 297x400 with RoundNearest.
+	MaxDimension int
+	// MaxMegapixels optionally caps the area of the output image, in
+	// millions of pixels, by scaling it down preserving its aspect
+	// ratio, such as 2 to limit storage costs whatever its shape.
+	MaxMegapixels float64
+	// Rounding specifies how the dimension not specified by Width or
+	// Height is rounded when preserving the aspect ratio.
+	Rounding Rounding
+	// KeepOrientationTag leaves the pixels as stored and keeps the EXIF
+	// orientation tag, rather than rotating them upright and setting the
+	// tag to TopLeft.  This requires Save.KeepMetadata, and viewers that
+	// ignore the tag will show the image sideways.
+	KeepOrientationTag bool
+	// OrientationPolicy specifies whether to always apply the EXIF
+	// orientation, or to ignore rotations that look wrong.
+	OrientationPolicy OrientationPolicy
+	// Region optionally selects a rectangle of the original image,
+	// which is clipped to its bounds and then scaled or cropped as if
+	// it were the whole image.
+	Region Rect
+	// Trim optionally removes borders of the original image as
+	// TrimMode says, such as the transparent padding around a logo with
+	// TrimAlpha, then scales or crops what's left as if it were the
+	// whole image.  It can't be combined with Region, Montage, or Video.
+	Trim TrimMode
 	// Crop enables crop mode, where exact supplied Width:Height aspect
 	// ratio is preserved and excess pixels are trimmed from the sides.
 	Crop bool
-	// Sharpen runs a mild sharpening pass on downsampled images.
-	Sharpen bool
-	// FastResize reduces output image quality in some cases in favor of speed.
-	FastResize bool
+	// Pad enables pad mode, where the image is scaled to fit within
+	// Width and Height, and then centered on a canvas of exactly that
+	// size filled with Background.
+	Pad bool
+	// Outside enables outside mode, where the image is scaled to fully
+	// cover Width and Height, like Crop, but nothing is trimmed, so the
+	// output may be wider or taller than requested.
+	Outside bool
+	// Background is the color of the canvas in Pad mode, and that
+	// transparency is blended with when saving as JPEG, black by
+	// default.
+	Background Color
+	// MaxCropFraction optionally combines Pad with Crop.  If cropping
+	// to fill Width and Height would trim no more than this fraction
+	// (0-1) of the image's width or height, it is cropped to fill.
+	// Otherwise that fraction is trimmed and the rest is padded.
+	MaxCropFraction float64
+	// ClippingPath makes the parts of a JPEG outside the clipping path
+	// saved in it by Photoshop transparent, such as to remove the
+	// background of a product photo.  The output is saved as PNG rather
+	// than JPEG to keep the transparency.  Images without a clipping
+	// path are unaffected.
+	ClippingPath bool
+	// Watermark is an optional compressed image overlaid on the bottom
+	// right corner of the output, after cropping or padding, blended by
+	// its transparency.  It's scaled down to fit if needed.  This
+	// requires VIPS 8.6 or later.
+	Watermark []byte
+	// Sharpen runs a mild sharpening pass on downsampled images if
+	// ToggleOn, or if PresetBest turns it on.
+	Sharpen Toggle
+	// SharpenBeforeResize sharpens the original image before it's
+	// downsampled, rather than the usual and cheaper sharpening of the
+	// result.
+	SharpenBeforeResize bool
+	// FastResize reduces output image quality in some cases in favor of
+	// speed if ToggleOn, or if PresetFast or PresetBalanced turns it on.
+	FastResize Toggle
+	// Preset optionally fills in the kernel, sharpening, encoder effort,
+	// and subsampling options that a Preset bundles, where they aren't
+	// set.
+	Preset Preset
 	// BlurSigma performs a gaussian blur with specified sigma.
 	BlurSigma float64
+	// Premultiplied means the color values of an image with alpha are
+	// already premultiplied by it, so resizing doesn't premultiply them
+	// again, and leaves them premultiplied.  Otherwise, transparent
+	// pixels would bleed into opaque ones as a dark fringe.
+	Premultiplied bool
+	// LinearProcessing resizes in linear light rather than
+	// gamma-encoded sRGB, which is slower but avoids darkening fine
+	// high-contrast detail.  Images with alpha are resized in sRGB.
+	LinearProcessing bool
+	// CmykProfile and RgbProfile optionally name ICC profile files used
+	// to convert CMYK images that have no usable embedded profile, from
+	// the CMYK profile they're assumed to be in to the RGB profile
+	// they're saved in.  By default these are U.S. Web Coated (SWOP) v2
+	// and sRGB.  Images with an embedded profile are always converted to
+	// sRGB.  Since no output format holds CMYK, failing to convert one
+	// is an error.
+	CmykProfile string
+	RgbProfile  string
+	// PassThrough returns the original image unchanged when no
+	// resizing, cropping, blurring, rotation, or format change would be
+	// done, rather than losing quality to re-encoding it.  Since the
+	// original keeps its metadata, this requires Save.KeepMetadata, and
+	// doesn't apply with Save.AllowWebp, MaxBytes, TargetSSIM,
+	// ScanScript, or CustomQuantTables, or with PreviewSize.
+	PassThrough bool
+	// MinProcessDimension returns the original image unchanged when
+	// both its width and height are smaller than this many pixels,
+	// since re-encoding tiny images can only lose quality.
+	MinProcessDimension int
+	// MaxAspectRatio optionally rejects images whose longer side is
+	// more than this many times their shorter side, such as 20 for
+	// 20:1, which are rarely useful as thumbnails.
+	MaxAspectRatio float64
 	// MaxBufferPixels specifies how large of an intermediate image
 	// buffer to allow, in pixels. RAM usage will be a few bytes per pixel.
+	// When several frames of an animation are decoded, such as for Video
+	// or Montage, their pixels are added together.
 	MaxBufferPixels int
+	// MaxMemory optionally limits how many bytes VIPS may allocate while
+	// processing the image, beyond what it had allocated beforehand, after
+	// which ErrMemoryLimit is returned.  This is sampled and checked
+	// between stages, so it stops the pipeline after, not during, the
+	// operation that exceeded it.  VIPS only tracks memory for the whole
+	// process, so this also counts images processed concurrently.
+	MaxMemory int64
 	// MaxQueueDuration limits the amount of time spent in a queue before processing starts.
 	MaxQueueDuration time.Duration
 	// MaxProcessingDuration limits the amount of time processing an
 	// image, after which it is assumed the operation has crashed and
 	// the server aborts, killing all outstanding requests.
 	MaxProcessingDuration time.Duration
+	// PreviewSize optionally also returns a tiny JPEG of the output
+	// image as Result.Preview, scaled to fit within this many pixels
+	// square, such as 20, to display while the full image loads.
+	PreviewSize int
+	// InputFormat optionally forces the original image to be loaded as
+	// this Format, rather than detecting it.  If the image isn't in
+	// that format, format.ErrUnknownFormat is returned.
+	InputFormat format.Format
+	// RepairHeader processes images whose headers are inconsistent but
+	// still decodable, such as a JPEG whose EXIF dimensions disagree with
+	// its frame header, at the size the decoder finds.  Otherwise, and
+	// always for headers that can't be decoded, format.ErrCorruptHeader
+	// is returned.
+	RepairHeader bool
+	// Page optionally selects which page or frame of a multi-page or
+	// animated image to use, counting from 0, such as of a GIF, WebP,
+	// HEIF, or, with format.LoadTiff, TIFF.  If the image has fewer
+	// pages, a PageError is returned.
+	Page int
+	// DPI optionally sets the pixel density of the output, in dots per
+	// inch, as saved in a JPEG's JFIF header or a PNG's pHYs chunk, such
+	// as for print workflows.
+	DPI float64
+	// KeepPrintSize scales the original's pixel density along with the
+	// image, so the output prints at the same physical size.  Otherwise
+	// the original's density is kept unchanged.  DPI overrides it.
+	KeepPrintSize bool
+	// Montage optionally arranges the first pages or frames of the image
+	// in a grid of Width by Height cells, rather than taking the first.
+	// It can't be combined with Crop, Pad, Region, Page, or Video.
+	Montage Montage
+	// Video optionally transcodes animated GIFs to a muted video in
+	// this VideoFormat, which is much smaller, to be played in a loop.
+	// Other images are unaffected.  This runs VideoEncoder, and can't be
+	// combined with Pad, Region, Page, or Watermark.
+	Video VideoFormat
+	// KeepFormat saves the image in the same Format as the original,
+	// such as GIF as GIF, rather than choosing one, if that Format can
+	// be saved.  It can't be combined with Save.Format.
+	KeepFormat bool
+	// StrictFormat returns ErrUnsupportedConversion, rather than saving
+	// in another format, if the image can't be saved in Save.Format or,
+	// if that's unset, the original's Format.
+	StrictFormat bool
 	// Save specifies the format.SaveOptions to use when compressing the modified image.
 	Save format.SaveOptions
+
+	// aborted is Request.Aborted, so long-running steps can stop early.
+	aborted <-chan bool
 }
 
 // Check verifies Options against Metadata and returns a modified
@@ -60,13 +342,57 @@ func (o Options) Check(m format.Metadata) (Options, error) {
 	}
 
 	// Security: Confirm that image sizes are sane.
-	if m.Width < minDimension || m.Height < minDimension {
+	minimum := o.MinDimension
+	if minimum < 0 {
+		return Options{}, ErrBadOption
+	}
+	if minimum == 0 {
+		minimum = minDimension
+	}
+	if m.Width < minimum || m.Height < minimum {
 		return Options{}, ErrTooSmall
 	}
+	if o.MaxAspectRatio < 0 {
+		return Options{}, ErrBadOption
+	}
+	if o.MaxAspectRatio > 0 && aspectRatio(m.Width, m.Height) > o.MaxAspectRatio {
+		return Options{}, ErrBadAspectRatio
+	}
 	if m.Width > maxDimension || m.Height > maxDimension {
 		return Options{}, ErrTooBig
 	}
 
+	if o.DPI < 0 || o.Video < NoVideo || o.Video > WebM {
+		return Options{}, ErrBadOption
+	}
+	if mo := o.Montage; mo.Columns < 0 || mo.Rows < 0 || mo.Spacing < 0 || (mo.Columns > 0) != (mo.Rows > 0) {
+		return Options{}, ErrBadOption
+	}
+
+	// The first matching Rule determines output width and height.
+	for _, r := range o.Rules {
+		if r.WiderThan < 0 || r.TallerThan < 0 || r.Width < 0 || r.Height < 0 {
+			return Options{}, ErrBadOption
+		}
+		if r.matches(m) {
+			o.Width, o.Height = r.Width, r.Height
+			break
+		}
+	}
+
+	// If set, Scale determines output width and height.
+	if o.Scale < 0 {
+		return Options{}, ErrBadOption
+	}
+	if o.Scale > 0 {
+		scale := o.Scale
+		if !o.Upscale {
+			scale = math.Min(scale, 1)
+		}
+		o.Width = int(float64(m.Width)*scale + 0.5)
+		o.Height = int(float64(m.Height)*scale + 0.5)
+	}
+
 	// If output width or height are not set, use original.
 	if o.Width == 0 {
 		o.Width = m.Width
@@ -74,6 +400,14 @@ func (o Options) Check(m format.Metadata) (Options, error) {
 	if o.Height == 0 {
 		o.Height = m.Height
 	}
+	// Outside is Crop to a box of the scaled image's own aspect ratio.
+	if o.Outside {
+		if o.Crop || o.Pad {
+			return Options{}, ErrBadOption
+		}
+		o.Width, o.Height, _ = scaleAspect(m.Width, m.Height, o.Width, o.Height, false, o.Rounding)
+		o.Outside, o.Crop = false, true
+	}
 	// Security: Verify requested width and height.
 	if o.Width < 1 || o.Height < 1 {
 		return Options{}, ErrTooSmall
@@ -81,29 +415,209 @@ func (o Options) Check(m format.Metadata) (Options, error) {
 	if o.Width > maxDimension || o.Height > maxDimension {
 		return Options{}, ErrTooBig
 	}
+	if mo := o.Montage; mo.Columns > 0 {
+		if mo.Columns > maxDimension || mo.Rows > maxDimension || mo.Spacing > maxDimension {
+			return Options{}, ErrTooBig
+		}
+		if w, h := mo.size(o.Width, o.Height); w > maxDimension || h > maxDimension {
+			return Options{}, ErrTooBig
+		}
+	}
 	// If requested crop width or height are larger than original, scale
 	// request down to fit within original dimensions.
-	if o.Crop && (o.Width > m.Width || o.Height > m.Height) {
-		o.Width, o.Height, _ = scaleAspect(o.Width, o.Height, m.Width, m.Height, true)
+	if o.Crop && !o.Upscale && (o.Width > m.Width || o.Height > m.Height) {
+		o.Width, o.Height, _ = scaleAspect(o.Width, o.Height, m.Width, m.Height, true, o.Rounding)
+	}
+
+	// If set, cap the longest side of the output to MaxDimension.  For
+	// crop, shrink the requested box while preserving its aspect ratio.
+	if o.MaxDimension < 0 || o.MaxMemory < 0 {
+		return Options{}, ErrBadOption
+	}
+	if o.MaxDimension > 0 && (o.Width > o.MaxDimension || o.Height > o.MaxDimension) {
+		if o.Crop {
+			o.Width, o.Height, _ = scaleAspect(o.Width, o.Height, o.MaxDimension, o.MaxDimension, true, o.Rounding)
+		} else {
+			if o.Width > o.MaxDimension {
+				o.Width = o.MaxDimension
+			}
+			if o.Height > o.MaxDimension {
+				o.Height = o.MaxDimension
+			}
+		}
+	}
+
+	// If set, cap the area of the output to MaxMegapixels.  Crop and Pad
+	// output the whole box, so shrink it preserving its aspect ratio.
+	// Otherwise, shrink the box to just within the cap on the image's
+	// own aspect ratio.
+	if o.MaxMegapixels < 0 {
+		return Options{}, ErrBadOption
+	}
+	if o.MaxMegapixels > 0 {
+		w, h := o.Width, o.Height
+		if !o.Crop && !o.Pad {
+			w, h, _ = scaleAspect(m.Width, m.Height, o.Width, o.Height, true, o.Rounding)
+			if !o.Upscale && (w > m.Width || h > m.Height) {
+				w, h = m.Width, m.Height
+			}
+		}
+		if maxPixels := o.MaxMegapixels * 1e6; float64(w)*float64(h) > maxPixels {
+			scale := math.Sqrt(maxPixels / (float64(w) * float64(h)))
+			o.Width, o.Height = int(float64(w)*scale), int(float64(h)*scale)
+			if o.Width < 1 || o.Height < 1 {
+				return Options{}, ErrTooSmall
+			}
+		}
+	}
+
+	// Pad and Crop are mutually exclusive, and the padded canvas is
+	// also an allocated buffer.
+	if o.Pad && o.Crop {
+		return Options{}, ErrBadOption
+	}
+	if o.MaxCropFraction < 0 || o.MaxCropFraction >= 1 {
+		return Options{}, ErrBadOption
+	}
+	if o.Pad && o.MaxBufferPixels > 0 && o.Width*o.Height > o.MaxBufferPixels {
+		return Options{}, ErrTooBig
 	}
 
 	// If set, limit allocated pixels to MaxBufferPixels.  Assume JPEG
-	// decoder can pre-scale to 1/8 original width and height.
+	// decoder can pre-scale to 1/8 original width and height.  Every
+	// frame decoded counts, so that many frames can't bypass the limit.
 	scale := 1
 	if m.Format == format.Jpeg {
 		scale = 8
 	}
-	if o.MaxBufferPixels > 0 && m.Width*m.Height > o.MaxBufferPixels*scale*scale {
+	if o.MaxBufferPixels > 0 && m.Width*m.Height*o.decodedPages(m) > o.MaxBufferPixels*scale*scale {
 		return Options{}, ErrTooBig
 	}
 
+	if o.MinProcessDimension < 0 || o.PreviewSize < 0 {
+		return Options{}, ErrBadOption
+	}
+
+	if o.Rounding < RoundUp || o.Rounding > RoundNearest {
+		return Options{}, ErrBadOption
+	}
+
+	if o.DownscaleKernel < DefaultKernel || o.DownscaleKernel > Lanczos3 || o.UpscaleKernel < DefaultKernel || o.UpscaleKernel > Lanczos3 {
+		return Options{}, ErrBadOption
+	}
+
+	if o.Trim < NoTrim || o.Trim > TrimAlpha {
+		return Options{}, ErrBadOption
+	}
+
+	if o.Preset < NoPreset || o.Preset > PresetBest {
+		return Options{}, ErrBadOption
+	}
+	o = o.Preset.apply(o)
+
+	// An enlarged image is also an allocated buffer, which for Crop is
+	// larger than the result.
+	if o.Upscale && o.MaxBufferPixels > 0 {
+		if iw, ih, _ := scaleAspect(m.Width, m.Height, o.Width, o.Height, !o.Crop, o.Rounding); iw*ih > o.MaxBufferPixels {
+			return Options{}, ErrTooBig
+		}
+	}
+
+	if o.OrientationPolicy < TrustOrientation || o.OrientationPolicy > GuessOrientation {
+		return Options{}, ErrBadOption
+	}
+
 	if o.BlurSigma < 0.0 || o.BlurSigma > 8.0 {
 		return Options{}, ErrBadOption
 	}
 
+	if err := o.checkPage(m); err != nil {
+		return Options{}, err
+	}
+
 	return o, nil
 }
 
+// Validate checks Options for combinations that contradict each other,
+// rather than silently ignoring some of them, and returns a ConflictError
+// describing the first one found.  Unlike Check, it doesn't need the
+// image, so it can be used to reject a request before doing any work.
+func (o Options) Validate() error {
+	switch {
+	case o.Crop && o.Pad:
+		return ConflictError{"Crop and Pad are mutually exclusive"}
+	case o.Outside && (o.Crop || o.Pad):
+		return ConflictError{"Outside can't be combined with Crop or Pad"}
+	case o.MaxCropFraction > 0 && !o.Pad:
+		return ConflictError{"MaxCropFraction requires Pad"}
+	case o.Scale > 0 && (o.Width > 0 || o.Height > 0):
+		return ConflictError{"Scale can't be combined with Width or Height"}
+	case o.Scale > 0 && len(o.Rules) > 0:
+		return ConflictError{"Scale can't be combined with Rules"}
+	case o.KeepOrientationTag && !o.Save.KeepMetadata:
+		return ConflictError{"KeepOrientationTag requires Save.KeepMetadata"}
+	case o.KeepOrientationTag && o.Watermark != nil:
+		return ConflictError{"Watermark can't be combined with KeepOrientationTag"}
+	case o.KeepFormat && o.Save.Format != format.Unknown:
+		return ConflictError{"KeepFormat can't be combined with Save.Format"}
+	case o.Montage.Columns > 0 && (o.Crop || o.Pad || o.Outside || o.Region != (Rect{}) || o.Page != 0 || o.Video != NoVideo):
+		return ConflictError{"Montage can't be combined with Crop, Pad, Outside, Region, Page, or Video"}
+	case o.Video != NoVideo && (o.Pad || o.Region != (Rect{}) || o.Page != 0 || o.Watermark != nil):
+		return ConflictError{"Video can't be combined with Pad, Region, Page, or Watermark"}
+	case o.Trim != NoTrim && (o.Region != (Rect{}) || o.Montage.Columns > 0 || o.Video != NoVideo):
+		return ConflictError{"Trim can't be combined with Region, Montage, or Video"}
+	}
+
+	s := o.Save
+	switch {
+	case s.Lossless && s.Format == format.Jpeg:
+		return ConflictError{"JPEG can't be saved lossless"}
+	case (s.QuantTable != 0 || len(s.CustomQuantTables) > 0 || s.RestartInterval != 0 || s.ScanScript != "") && s.Format != format.Unknown && s.Format != format.Jpeg:
+		return ConflictError{"QuantTable, CustomQuantTables, RestartInterval, and ScanScript only apply to JPEG"}
+	case len(s.CustomQuantTables) > 0 && (s.QuantTable != 0 || s.KeepMetadata || s.Metadata != format.StripMetadata):
+		return ConflictError{"CustomQuantTables can't be combined with QuantTable or kept metadata"}
+	case s.Colors != 0 && s.Format != format.Unknown && s.Format != format.Png:
+		return ConflictError{"Colors only applies to PNG"}
+	case s.Dither && s.Colors == 0:
+		return ConflictError{"Dither requires Colors"}
+	case (s.TileSize != 0 || s.TiffCompression != format.TiffJpeg) && s.Format != format.Unknown && s.Format != format.Tiff:
+		return ConflictError{"TileSize and TiffCompression only apply to TIFF"}
+	}
+
+	return nil
+}
+
+// decodedPages returns how many pages or frames of an image with Metadata
+// m are decoded for Options o: every frame of an animation transcoded to
+// video, one per cell of a Montage, and otherwise just one.
+func (o Options) decodedPages(m format.Metadata) int {
+	switch {
+	case o.Video != NoVideo && isAnimated(m):
+		return m.Pages
+	case o.Montage.Columns > 0:
+		return o.Montage.pages(m)
+	}
+	return 1
+}
+
+// checkPage verifies that Page is one of the pages in an image with
+// Metadata m.
+func (o Options) checkPage(m format.Metadata) error {
+	if o.Page < 0 {
+		return ErrBadOption
+	}
+
+	pages := m.Pages
+	if pages < 1 {
+		pages = 1
+	}
+	if o.Page >= pages {
+		return PageError{Page: o.Page, Pages: pages}
+	}
+
+	return nil
+}
+
 // ToJSON returns a compact JSON representation of Options.
 func (o Options) ToJSON() ([]byte, error) {
 	j, err := json.Marshal(o)
@@ -20,6 +20,51 @@ func TestOptionsMetadata(t *testing.T) {
 	assert.Equal(t, err, nil)
 }
 
+func TestOptionsConflicts(t *testing.T) {
+	assert.Nil(t, Options{Width: 100, Height: 100, Crop: true, Save: format.SaveOptions{Format: format.Jpeg, Quality: 80}}.Validate())
+	assert.Nil(t, Options{Pad: true, MaxCropFraction: 0.1, Save: format.SaveOptions{Lossless: true, Colors: 16, Dither: true}}.Validate())
+	assert.Nil(t, Options{Save: format.SaveOptions{Format: format.Tiff, TileSize: 512, TiffCompression: format.TiffLzw}}.Validate())
+
+	for _, o := range []Options{
+		{Crop: true, Pad: true},
+		{Outside: true, Crop: true},
+		{MaxCropFraction: 0.1},
+		{Scale: 0.5, Width: 100},
+		{Save: format.SaveOptions{Format: format.Jpeg, Lossless: true}},
+		{Save: format.SaveOptions{Format: format.Webp, RestartInterval: 4}},
+		{Save: format.SaveOptions{Format: format.Png, CustomQuantTables: make([][64]int, 1)}},
+		{Save: format.SaveOptions{KeepMetadata: true, CustomQuantTables: make([][64]int, 1)}},
+		{Save: format.SaveOptions{Format: format.Jpeg, Colors: 16}},
+		{Save: format.SaveOptions{Dither: true}},
+		{Save: format.SaveOptions{Format: format.Png, TileSize: 512}},
+		{Save: format.SaveOptions{Format: format.Jpeg, TiffCompression: format.TiffDeflate}},
+		{KeepFormat: true, Save: format.SaveOptions{Format: format.Png}},
+	} {
+		err := o.Validate()
+		if assert.IsType(t, ConflictError{}, err, "options: %+v", o) {
+			assert.NotEmpty(t, err.(ConflictError).Reason)
+		}
+	}
+}
+
+func TestOptionsRules(t *testing.T) {
+	m := format.Metadata{Width: 398, Height: 536, Format: format.Jpeg}
+
+	o, err := Options{Width: 200, Height: 200, Rules: []Rule{{WiderThan: 2000, Width: 2000, Height: 2000}}}.Check(m)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 200, o.Width)
+		assert.Equal(t, 200, o.Height)
+	}
+
+	o, err = Options{Rules: []Rule{{WiderThan: 300, Width: 100, Height: 100}}}.Check(m)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 100, o.Width)
+		assert.Equal(t, 100, o.Height)
+	}
+
+	assert.IsType(t, ConflictError{}, Options{Scale: 0.5, Rules: []Rule{{Width: 100}}}.Validate())
+}
+
 func TestOptionsValidation(t *testing.T) {
 	m := format.Metadata{Width: 640, Height: 480, Format: format.Jpeg}
 
@@ -29,6 +74,24 @@ func TestOptionsValidation(t *testing.T) {
 	_, err = Options{BlurSigma: -1}.Check(m)
 	assert.Equal(t, err, ErrBadOption)
 
+	_, err = Options{Rounding: RoundNearest + 1}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{MinProcessDimension: -1}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{MinDimension: -1}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{MaxAspectRatio: -1}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Pad: true, Crop: true}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Width: 4000, Height: 4000, Pad: true, MaxBufferPixels: 1000000}.Check(m)
+	assert.Equal(t, err, ErrTooBig)
+
 	_, err = Options{Width: -1}.Check(m)
 	assert.Equal(t, err, ErrTooSmall)
 
@@ -57,3 +120,71 @@ func TestOptionsCrop(t *testing.T) {
 	assert.Equal(t, r.Width, 400)
 	assert.Equal(t, r.Height, 800)
 }
+
+func TestOptionsMaxDimension(t *testing.T) {
+	m := format.Metadata{Width: 398, Height: 536, Format: format.Jpeg}
+
+	// Without a box, the longest side is capped.
+	r, err := Options{MaxDimension: 400}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 400)
+	assert.Equal(t, r.Height, 400)
+
+	// A box that is already smaller is left alone.
+	r, err = Options{Width: 200, Height: 300, MaxDimension: 400}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 200)
+	assert.Equal(t, r.Height, 300)
+
+	// When cropping, the box is shrunk preserving its aspect ratio.
+	r, err = Options{Width: 300, Height: 150, Crop: true, MaxDimension: 100}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 100)
+	assert.Equal(t, r.Height, 50)
+
+	_, err = Options{MaxDimension: -1}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+}
+
+func TestOptionsMaxMegapixels(t *testing.T) {
+	m := format.Metadata{Width: 398, Height: 536, Format: format.Jpeg}
+
+	// 213328 pixels scaled by sqrt(100000/213328) is 272.49x366.98.
+	r, err := Options{MaxMegapixels: 0.1}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 272)
+	assert.Equal(t, r.Height, 366)
+
+	// An image already within the cap is left alone, and never upscaled.
+	r, err = Options{Width: 1000, Height: 1000, MaxMegapixels: 1}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 1000)
+	assert.Equal(t, r.Height, 1000)
+
+	// The area is that of the output, not of the requested box.
+	r, err = Options{Width: 1000, Height: 200, MaxMegapixels: 0.1}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 1000)
+	assert.Equal(t, r.Height, 200)
+
+	// When cropping, the box is shrunk preserving its aspect ratio.
+	r, err = Options{Width: 300, Height: 150, Crop: true, MaxMegapixels: 0.02}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 200)
+	assert.Equal(t, r.Height, 100)
+
+	_, err = Options{MaxMegapixels: -1}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+}
+
+func TestOptionsMaxAspectRatio(t *testing.T) {
+	// Rejected for aspect ratio, even though it's only 544000 pixels.
+	_, err := Options{MaxAspectRatio: 20, MaxBufferPixels: 1000000}.Check(format.Metadata{Width: 34000, Height: 16, Format: format.Png})
+	assert.Equal(t, err, ErrBadAspectRatio)
+
+	_, err = Options{MaxAspectRatio: 20}.Check(format.Metadata{Width: 16, Height: 321, Format: format.Png})
+	assert.Equal(t, err, ErrBadAspectRatio)
+
+	_, err = Options{MaxAspectRatio: 20}.Check(format.Metadata{Width: 16, Height: 320, Format: format.Png})
+	assert.Nil(t, err)
+}
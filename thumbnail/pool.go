@@ -49,14 +49,24 @@ type Request struct {
 
 // Response sent to Request.ResponseCh when the Thumbnail operation is done.
 type Response struct {
-	Blob  []byte
-	Error error
+	Blob     []byte
+	Preview  string
+	Lossless bool
+	Timings  Timings
+	Error    error
 }
 
 // Thumbnail is a blocking wrapper that executes thumbnail.Thumbnail
 // requests in a pool of worker threads.  Work is skipped if aborted is
 // closed while the request is queued.
 func (p *Pool) Thumbnail(blob []byte, options Options, aborted <-chan bool) ([]byte, error) {
+	r, err := p.Process(blob, options, aborted)
+	return r.Blob, err
+}
+
+// Process is like Thumbnail, but returns a Result that also includes the
+// Timings of each stage, and any Preview.
+func (p *Pool) Process(blob []byte, options Options, aborted <-chan bool) (Result, error) {
 	rc := make(chan *Response)
 
 	r := &Request{Blob: blob, Options: options, Aborted: aborted, ResponseCh: rc}
@@ -65,7 +75,7 @@ func (p *Pool) Thumbnail(blob []byte, options Options, aborted <-chan bool) ([]b
 	s := <-rc
 	close(rc)
 
-	return s.Blob, s.Error
+	return Result{Blob: s.Blob, Preview: s.Preview, Lossless: s.Lossless, Timings: s.Timings}, s.Error
 }
 
 func (p *Pool) worker() {
@@ -81,7 +91,11 @@ func (p *Pool) worker() {
 		if hasAborted(q.Aborted) {
 			s.Error = ErrAborted
 		} else {
-			s.Blob, s.Error = Thumbnail(q.Blob, q.Options)
+			var r Result
+			o := q.Options
+			o.aborted = q.Aborted
+			r, s.Error = Process(q.Blob, o)
+			s.Blob, s.Preview, s.Lossless, s.Timings = r.Blob, r.Preview, r.Lossless, r.Timings
 		}
 
 		q.ResponseCh <- s
@@ -0,0 +1,77 @@
+package thumbnail
+
+import (
+	"github.com/die-net/fotomat/format"
+)
+
+// Preset is a named bundle of Options that trades speed for quality, so
+// callers can choose one rather than tuning each option.
+type Preset int
+
+// Presets.  Each sets the resize kernel, sharpening, encoder effort, and
+// JPEG chroma subsampling.
+const (
+	// NoPreset leaves Options as they are.
+	NoPreset Preset = iota
+	// PresetFast box-shrinks, resizes with Linear, compresses PNG with
+	// the least effort, and always subsamples JPEG chroma.
+	PresetFast
+	// PresetBalanced box-shrinks, then resizes with Lanczos3.
+	PresetBalanced
+	// PresetBest resizes with Lanczos3 alone, sharpens, compresses JPEG
+	// and PNG with the most effort, and keeps full JPEG chroma.
+	PresetBest
+)
+
+// Toggle is an on or off option that a Preset may turn on, unless it's
+// explicitly ToggleOff.
+type Toggle int
+
+// Toggle values.
+const (
+	// ToggleDefault is off, unless a Preset turns it on.
+	ToggleDefault Toggle = iota
+	// ToggleOn is on.
+	ToggleOn
+	// ToggleOff is off, even if a Preset would turn it on.
+	ToggleOff
+)
+
+// apply returns o with Preset p's options filled in, except those o
+// already sets, which take precedence.  Save.SmallJpeg can't be told
+// apart from unset when false, so PresetBest always turns it on.
+func (p Preset) apply(o Options) Options {
+	kernel, compression, subsampling := Lanczos3, format.DefaultCompression, format.DefaultSubsampling
+	fast, sharpen := ToggleDefault, ToggleDefault
+	switch p {
+	case PresetFast:
+		kernel, compression, subsampling = Linear, 1, format.Subsample420
+		fast = ToggleOn
+	case PresetBalanced:
+		fast = ToggleOn
+	case PresetBest:
+		compression, subsampling = 9, format.Subsample444
+		sharpen = ToggleOn
+		o.Save.SmallJpeg = true
+	default:
+		return o
+	}
+
+	if o.DownscaleKernel == DefaultKernel {
+		o.DownscaleKernel = kernel
+	}
+	if o.Save.Compression == 0 {
+		o.Save.Compression = compression
+	}
+	if o.Save.Subsampling == format.DefaultSubsampling {
+		o.Save.Subsampling = subsampling
+	}
+	if o.FastResize == ToggleDefault {
+		o.FastResize = fast
+	}
+	if o.Sharpen == ToggleDefault {
+		o.Sharpen = sharpen
+	}
+
+	return o
+}
@@ -1,12 +1,21 @@
 package thumbnail
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/die-net/fotomat/format"
+	"io"
 	"io/ioutil"
+	"log"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,8 +26,60 @@ const (
 	DefaultServer = "Fotomat"
 	// DefaultUserAgent is the default User-Agent header sent on upstream requests.
 	DefaultUserAgent = "Fotomat (http://fotomat.org)"
+
+	// immutableMaxAge is the max-age sent with Immutable responses.
+	immutableMaxAge = 365 * 24 * time.Hour
+
+	// maxProbeBytes is how much of an original image is downloaded
+	// while trying to probe its dimensions before giving up.
+	maxProbeBytes = 256 * 1024
 )
 
+// ErrSourceTooBig is returned when an original image is larger than
+// Proxy.MaxSourceBytes.
+var ErrSourceTooBig = errors.New("Original image is too many bytes")
+
+// errEmptyResult is returned if processing somehow succeeds without
+// producing an image, rather than responding with an empty one.
+var errEmptyResult = errors.New("Image processing produced no output")
+
+// CachePolicy describes the Cache-Control header sent with a response.
+type CachePolicy struct {
+	// MaxAge is how long a response may be cached by clients and CDNs.
+	MaxAge time.Duration
+	// StaleWhileRevalidate is how long after MaxAge a stale response
+	// may be served while it is revalidated in the background.
+	StaleWhileRevalidate time.Duration
+	// Immutable marks a response as never changing, such as for hashed
+	// URLs, allowing it to be cached for a year without revalidation.
+	Immutable bool
+	// NoStore forbids caching a response anywhere, and makes Proxy
+	// fetch the original image again rather than using SourceCache,
+	// such as to force a thumbnail to be regenerated.
+	NoStore bool
+}
+
+// String returns the Cache-Control header value for a CachePolicy.
+func (c CachePolicy) String() string {
+	if c.NoStore {
+		return "no-store"
+	}
+
+	maxAge := c.MaxAge
+	if c.Immutable {
+		maxAge = immutableMaxAge
+	}
+
+	s := "public, max-age=" + strconv.Itoa(int(maxAge/time.Second))
+	if c.StaleWhileRevalidate > 0 {
+		s += ", stale-while-revalidate=" + strconv.Itoa(int(c.StaleWhileRevalidate/time.Second))
+	}
+	if c.Immutable {
+		s += ", immutable"
+	}
+	return s
+}
+
 // Proxy represents an HTTP proxy that can optionally run its contents
 // through Thumbnail. Must be created with NewProxy.
 type Proxy struct {
@@ -27,8 +88,46 @@ type Proxy struct {
 	Accept    string
 	Server    string
 	UserAgent string
-	pool      *Pool
-	active    chan bool
+	// Header optionally holds additional headers, such as
+	// Authorization, sent on every upstream request.  These replace any
+	// of the same name that would otherwise be sent.
+	Header http.Header
+	// ForwardHeaders optionally lists the canonical names of request
+	// headers, such as Cookie, to copy to upstream requests.  Since the
+	// original may then differ per user, requests that have any of them
+	// bypass SourceCache.
+	ForwardHeaders []string
+	// CachePolicy optionally overrides the upstream Cache-Control
+	// header for a request that has been through Director.  Returning
+	// the zero CachePolicy keeps the upstream header.
+	CachePolicy func(*http.Request) CachePolicy
+	// Placeholder is an optional compressed image that is scaled and
+	// cropped to the requested size and returned with a 203 status
+	// when the original image can't be fetched or decoded.
+	Placeholder []byte
+	// Timings is optionally called with the stage Timings of each
+	// successfully thumbnailed image, such as to export as metrics.
+	Timings func(Timings)
+	// Log is optionally called with a LogEntry describing each request
+	// once it has been served, such as to write an access log.
+	Log func(LogEntry)
+	// SourceCache optionally caches original images, so that they
+	// aren't fetched from upstream again for each size requested.
+	SourceCache *SourceCache
+	// MaxSourceBytes optionally limits the size of original images.
+	// Larger ones are rejected with ErrSourceTooBig as soon as that's
+	// known, without downloading the rest.
+	MaxSourceBytes int64
+	// Digest is when to send a Digest header with the SHA-256 of the
+	// image returned.  Hashing costs CPU, so this defaults to NoDigest.
+	Digest DigestPolicy
+	// PassThroughUnsupported responds with the original image
+	// unchanged, rather than a 415, if it's in a known Format that
+	// can't be loaded, such as TIFF, or a format this build of VIPS
+	// lacks, so a CDN can still serve it.
+	PassThroughUnsupported bool
+	pool                   *Pool
+	active                 chan bool
 }
 
 // NewProxy creates a Proxy object, with a given Director, Pool, upper limit
@@ -55,12 +154,75 @@ func NewProxy(director func(*http.Request) (Options, int), pool *Pool, maxActive
 	return p
 }
 
+// Acquire waits for a turn to hold an original image in RAM, counted
+// against the same maxActive limit as the Proxy's own requests, so that
+// other handlers can share it.  It returns false if aborted first, and
+// otherwise Release must be called once the image is no longer needed.
+func (p *Proxy) Acquire(aborted <-chan bool) bool {
+	select {
+	case <-aborted:
+		return false
+	case <-p.active:
+		return true
+	}
+}
+
+// Release ends a turn started by Acquire.
+func (p *Proxy) Release() {
+	p.active <- true
+}
+
+// LogEntry describes a request served by Proxy.  Fields that don't apply,
+// such as the output of a request that failed, are left zero.
+type LogEntry struct {
+	// Source is the URL of the original image, or the request URL if
+	// Director rejected it.
+	Source string
+	// InputFormat and InputBytes describe the original image.
+	InputFormat format.Format
+	InputBytes  int
+	// OutputFormat, OutputBytes, Width, and Height describe the image
+	// returned.
+	OutputFormat format.Format
+	OutputBytes  int
+	Width        int
+	Height       int
+	// Duration is how long the request took to serve.
+	Duration time.Duration
+	// Status is the HTTP status returned.
+	Status int
+	// Error is the error code, such as "too_big", if the request failed
+	// or was answered with Placeholder.
+	Error string
+}
+
 // ServeHTTP serves an HTTP request for a given Proxy, using Director to
 // parse the request, fetching an image, calling pool.Thumbnail on it, and
 // returning the result.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, or *http.Request) {
 	aborted := w.(http.CloseNotifier).CloseNotify()
 
+	if p.Log == nil {
+		p.serve(w, or, aborted, &LogEntry{})
+		return
+	}
+
+	start := time.Now()
+	lw := &logWriter{ResponseWriter: w}
+	e := LogEntry{}
+	p.serve(lw, or, aborted, &e)
+
+	e.Source = or.URL.String()
+	e.Duration = time.Since(start)
+	e.Status = lw.status
+	if e.Error == "" {
+		e.Error = lw.code
+	}
+	p.Log(e)
+}
+
+// serve does the work of ServeHTTP, filling in entry as it goes.
+func (p *Proxy) serve(w http.ResponseWriter, or *http.Request, aborted <-chan bool, entry *LogEntry) {
 	w.Header().Set("Server", p.Server)
 
 	if or.Method != "GET" && or.Method != "HEAD" {
@@ -70,10 +232,20 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, or *http.Request) {
 
 	options, status := p.Director(or)
 	if status != 0 {
-		http.Error(w, http.StatusText(status), status)
+		WriteError(w, status, ErrorResponse{})
 		return
 	}
 
+	if err := options.Validate(); err != nil {
+		WriteError(w, http.StatusBadRequest, ErrorResponse{Code: "conflicting_options", Message: err.Error()})
+		return
+	}
+
+	var policy CachePolicy
+	if p.CachePolicy != nil {
+		policy = p.CachePolicy(or)
+	}
+
 	if options.MaxQueueDuration <= 0 {
 		options.MaxQueueDuration = time.Hour // "Forever" for an http request
 	}
@@ -91,14 +263,30 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, or *http.Request) {
 	case <-p.active:
 	}
 
-	orig, header, status, err := p.get(or.URL.String(), or.Header)
+	orig, header, status, err := p.fetch(sourceURL(or.URL), or.Header, policy.NoStore, options.MaxBufferPixels)
 	if err != nil || (status != http.StatusOK && status != http.StatusNotModified) {
 		p.active <- true // Release semaphore ASAP.
-		proxyError(w, err, status)
+		if err == ErrTooBig || err == ErrSourceTooBig {
+			// Rejected while downloading, rather than by upstream.
+			status, e := errorResponse(err, 0)
+			if err == ErrTooBig {
+				e.MaxPixels = options.MaxBufferPixels
+			}
+			WriteError(w, status, e)
+			return
+		}
+		entry.Error = errorCode(err, status)
+		if !p.servePlaceholder(w, options, aborted) {
+			proxyError(w, err, status)
+		}
 		return
 	}
 
 	copyHeaders(header, w.Header(), []string{"Age", "Cache-Control", "Date", "Etag", "Expires", "Last-Modified"})
+	if policy != (CachePolicy{}) {
+		w.Header().Set("Cache-Control", policy.String())
+		w.Header().Del("Expires")
+	}
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("X-XSS-Protection", "1; mode=block")
 
@@ -108,20 +296,173 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, or *http.Request) {
 		return
 	}
 
-	thumb, err := p.pool.Thumbnail(orig, options, aborted)
+	f, mismatch := format.DetectFormatDeclared(orig, header.Get("Content-Type"), or.URL.Path)
+	if mismatch && f != format.Unknown {
+		log.Printf("Proxy: %s is actually %s, not as declared", or.URL, f)
+	}
+	entry.InputFormat, entry.InputBytes = f, len(orig)
+
+	result, err := p.pool.Process(orig, options, aborted)
+	if err == format.ErrLoaderUnavailable && p.PassThroughUnsupported {
+		result, err = Result{Blob: orig}, nil
+	}
 	orig = nil       // Free up image memory ASAP.
 	p.active <- true // Release semaphore ASAP.
+	if err == nil && len(result.Blob) == 0 {
+		err = errEmptyResult
+	}
 
+	// Nothing has been written yet, so a failure gets a clean error
+	// response.  Don't let it be cached or revalidated as the original.
 	if err != nil {
-		proxyError(w, err, 0)
+		clearValidators(w.Header())
+		w.Header().Set("Cache-Control", "no-store")
+		entry.Error = errorCode(err, 0)
+		if (err != format.ErrUnknownFormat && err != format.ErrLoaderUnavailable && err != format.ErrCorruptHeader && err != ErrTooSmall && err != ErrBadAspectRatio) || !p.servePlaceholder(w, options, aborted) {
+			status, e := errorResponse(err, 0)
+			if err == ErrTooBig {
+				e.MaxPixels = options.MaxBufferPixels
+			}
+			WriteError(w, status, e)
+		}
 		return
 	}
 
+	if p.Timings != nil {
+		p.Timings(result.Timings)
+	}
+
+	entry.OutputFormat, entry.OutputBytes = format.DetectFormat(result.Blob), len(result.Blob)
+	if p.Log != nil {
+		if m, err := entry.OutputFormat.MetadataBytes(result.Blob); err == nil {
+			entry.Width, entry.Height = m.Width, m.Height
+		}
+	}
+
+	// ServeContent sets Content-Length and handles Range requests, such
+	// as for resuming downloads.  It only sniffs the Content-Type of
+	// some of our Formats, such as not TIFF.
+	if entry.OutputFormat != format.Unknown {
+		w.Header().Set("Content-Type", entry.OutputFormat.String())
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(or.URL, entry.OutputFormat))
+	if p.Digest == WantDigest {
+		w.Header().Add("Vary", "Want-Digest")
+	}
+	if p.Digest.wantsDigest(or.Header) {
+		w.Header().Set("Digest", digest(result.Blob))
+	}
+	http.ServeContent(w, or, "", time.Time{}, bytes.NewReader(result.Blob))
+}
+
+// logWriter is an http.ResponseWriter that records the status and any
+// error code of a response, for LogEntry.
+type logWriter struct {
+	http.ResponseWriter
+	status int
+	code   string
+}
+
+func (w *logWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// sourceURL returns the URL to fetch the original image from for a request
+// for source URL u, without the download query parameter, which only
+// changes our response, so it doesn't split SourceCache.
+func sourceURL(u *url.URL) string {
+	q := u.Query()
+	if _, ok := q["download"]; !ok {
+		return u.String()
+	}
+
+	q.Del("download")
+	s := *u
+	s.RawQuery = q.Encode()
+	return s.String()
+}
+
+// contentDisposition returns a Content-Disposition header value naming an
+// image fetched from source URL u after it, with the extension of the
+// Format f it was saved in.  A download=1 query parameter asks browsers to
+// save it rather than display it.
+func contentDisposition(u *url.URL, f format.Format) string {
+	disposition := "inline"
+	if u.Query().Get("download") == "1" {
+		disposition = "attachment"
+	}
+
+	name := path.Base(u.Path)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if name == "" || name == "." || name == "/" {
+		name = "image"
+	}
+
+	if v := mime.FormatMediaType(disposition, map[string]string{"filename": name + f.Extension()}); v != "" {
+		return v
+	}
+	return disposition
+}
+
+// servePlaceholder responds with Placeholder scaled and cropped to the size
+// requested in options.  Returns false without responding if there is no
+// Placeholder or it couldn't be thumbnailed.
+func (p *Proxy) servePlaceholder(w http.ResponseWriter, options Options, aborted <-chan bool) bool {
+	if p.Placeholder == nil {
+		return false
+	}
+
+	options.Crop = true
+	thumb, err := p.pool.Thumbnail(p.Placeholder, options, aborted)
+	if err != nil {
+		return false
+	}
+
+	// Don't let the placeholder be cached as if it were the original.
+	clearValidators(w.Header())
+	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Content-Length", strconv.Itoa(len(thumb)))
+	w.WriteHeader(http.StatusNonAuthoritativeInfo)
 	_, _ = w.Write(thumb)
+
+	return true
+}
+
+// fetch returns the original image at url from SourceCache if present, or
+// otherwise gets it from upstream, caching successful responses.  If
+// bypass is set, or header has any of ForwardHeaders, SourceCache is
+// neither read nor written.  Downloads are cut short as described in
+// readSource.
+func (p *Proxy) fetch(url string, header http.Header, bypass bool, maxBufferPixels int) ([]byte, http.Header, int, error) {
+	if bypass || hasAnyHeader(header, p.ForwardHeaders) {
+		return p.get(url, header, maxBufferPixels)
+	}
+
+	if p.SourceCache != nil {
+		if orig, h, ok := p.SourceCache.Get(url); ok {
+			return orig, h, http.StatusOK, nil
+		}
+	}
+
+	orig, h, status, err := p.get(url, header, maxBufferPixels)
+	if p.SourceCache != nil && err == nil && status == http.StatusOK {
+		p.SourceCache.Add(url, orig, h)
+	}
+
+	return orig, h, status, err
 }
 
-func (p *Proxy) get(url string, header http.Header) ([]byte, http.Header, int, error) {
+func (p *Proxy) get(url string, header http.Header, maxBufferPixels int) ([]byte, http.Header, int, error) {
 	r, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, nil, 0, err
@@ -131,18 +472,71 @@ func (p *Proxy) get(url string, header http.Header) ([]byte, http.Header, int, e
 	r.Header.Set("Accept", p.Accept)
 	r.Header.Set("User-Agent", p.UserAgent)
 	copyHeaders(header, r.Header, []string{"Cache-Control", "If-Modified-Since", "If-None-Match"})
+	copyHeaders(header, r.Header, p.ForwardHeaders)
+	for key, value := range p.Header {
+		r.Header[key] = value
+	}
 
 	resp, err := p.Client.Do(r)
 	if err != nil {
 		return nil, nil, 0, err
 	}
 
-	orig, err := ioutil.ReadAll(resp.Body)
+	// Only bother limiting images that we'd otherwise process.
+	var orig []byte
+	if resp.StatusCode == http.StatusOK {
+		if p.MaxSourceBytes > 0 && resp.ContentLength > p.MaxSourceBytes {
+			err = ErrSourceTooBig
+		} else {
+			orig, err = readSource(resp.Body, p.MaxSourceBytes, maxBufferPixels)
+		}
+	} else {
+		orig, err = ioutil.ReadAll(resp.Body)
+	}
 	_ = resp.Body.Close()
 
 	return orig, resp.Header, resp.StatusCode, err
 }
 
+// readSource reads an original image from r.  It returns ErrSourceTooBig
+// as soon as more than maxBytes (if positive) have arrived, and ErrTooBig
+// as soon as enough of the image's header has arrived for
+// format.ProbeDimensions to show that it's larger than maxBufferPixels
+// or the maximum dimension allow, rather than downloading all of it first.
+func readSource(r io.Reader, maxBytes int64, maxBufferPixels int) ([]byte, error) {
+	b := &bytes.Buffer{}
+	chunk := make([]byte, 32*1024)
+	probing := true
+	for {
+		n, err := r.Read(chunk)
+		b.Write(chunk[:n])
+
+		if maxBytes > 0 && int64(b.Len()) > maxBytes {
+			return nil, ErrSourceTooBig
+		}
+
+		if probing && n > 0 {
+			if f, w, h, perr := format.ProbeDimensions(b.Bytes()); perr == nil {
+				probing = false
+				m := format.Metadata{Format: f, Width: w, Height: h}
+				if _, cerr := (Options{MaxBufferPixels: maxBufferPixels}).Check(m); cerr == ErrTooBig {
+					return nil, ErrTooBig
+				}
+			} else if b.Len() >= maxProbeBytes {
+				// Not a format we can probe, so leave it to VIPS.
+				probing = false
+			}
+		}
+
+		if err == io.EOF {
+			return b.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
 // Close shuts down a Proxy.
 func (p *Proxy) Close() {
 	close(p.active)
@@ -150,6 +544,14 @@ func (p *Proxy) Close() {
 	*p = Proxy{}
 }
 
+// clearValidators removes the headers copied from upstream that describe
+// the original image, for a response that isn't derived from it.
+func clearValidators(h http.Header) {
+	for _, key := range []string{"Age", "Etag", "Expires", "Last-Modified"} {
+		h.Del(key)
+	}
+}
+
 func copyHeaders(src, dest http.Header, keys []string) {
 	for _, key := range keys {
 		if value, ok := src[key]; ok {
@@ -158,21 +560,114 @@ func copyHeaders(src, dest http.Header, keys []string) {
 	}
 }
 
+// hasAnyHeader returns true if h has a value for any of keys.
+func hasAnyHeader(h http.Header, keys []string) bool {
+	for _, key := range keys {
+		if _, ok := h[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func isNotModified(req, resp http.Header) bool {
 	etag := resp.Get("Etag")
 	match := req.Get("If-None-Match")
 	// TODO: Support the multi-valued form of If-None-Match.
-	if etag != "" && (match == etag || match == "*") {
-		return true
+	if match != "" {
+		// If-Modified-Since is ignored when If-None-Match is sent.
+		return etag != "" && (match == etag || match == "*")
+	}
+
+	// Origins that don't support conditional requests themselves may
+	// still send Last-Modified, so compare it to If-Modified-Since.
+	lastMod, err := http.ParseTime(resp.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	since, err := http.ParseTime(req.Get("If-Modified-Since"))
+	return err == nil && !lastMod.After(since)
+}
+
+// ErrorResponse is the JSON body of an error response.
+type ErrorResponse struct {
+	// Code is a stable, machine-readable name for the error, such as
+	// "too_big" or "not_found".
+	Code string `json:"error"`
+	// Message describes the error for people.
+	Message string `json:"message"`
+	// MaxPixels is the MaxBufferPixels limit, if any, for "too_big".
+	MaxPixels int `json:"max_pixels,omitempty"`
+}
+
+// WriteError responds with status and e as JSON.  If unset, e.Code and
+// e.Message are derived from status.
+func WriteError(w http.ResponseWriter, status int, e ErrorResponse) {
+	if e.Code == "" {
+		e.Code = statusCode(status)
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+
+	if lw, ok := w.(*logWriter); ok {
+		lw.code = e.Code
+	}
+
+	j, err := json.Marshal(e)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(j)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(j)
+}
+
+// ErrorCode returns the error code, such as "too_big", that a Proxy would
+// respond with for an error from processing an image.
+func ErrorCode(err error) string {
+	return errorCode(err, 0)
+}
+
+// errorCode returns the error code for an error from fetching or
+// processing an image, or for an upstream status.
+func errorCode(err error, status int) string {
+	status, e := errorResponse(err, status)
+	if e.Code == "" {
+		return statusCode(status)
 	}
+	return e.Code
+}
+
+// statusCode returns an error code for an HTTP status, such as "not_found".
+func statusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.Replace(strings.ToLower(text), " ", "_", -1)
+}
 
-	// TODO: String compare of time is sub-optimal.
-	lastMod := resp.Get("Last-Modified")
-	since := req.Get("If-Modified-Since")
-	return lastMod != "" && since == lastMod
+// WriteProcessError responds with the status and JSON error that a Proxy
+// would for an error from processing an image, such as 413 and "too_big"
+// for ErrTooBig.
+func WriteProcessError(w http.ResponseWriter, err error) {
+	proxyError(w, err, 0)
 }
 
 func proxyError(w http.ResponseWriter, err error, status int) {
+	status, e := errorResponse(err, status)
+	WriteError(w, status, e)
+}
+
+// errorResponse returns the HTTP status and ErrorResponse for an error
+// from fetching or processing an image, or for an upstream status.
+func errorResponse(err error, status int) (int, ErrorResponse) {
+	e := ErrorResponse{}
 	switch status {
 	case http.StatusBadRequest,
 		http.StatusUnauthorized,
@@ -184,14 +679,31 @@ func proxyError(w http.ResponseWriter, err error, status int) {
 		err = nil
 	case 0:
 		switch err {
-		case format.ErrUnknownFormat, ErrTooSmall:
-			status = http.StatusUnsupportedMediaType
+		case format.ErrUnknownFormat:
+			status, e.Code = http.StatusUnsupportedMediaType, "unknown_format"
+		case format.ErrLoaderUnavailable:
+			status, e.Code = http.StatusUnsupportedMediaType, "loader_unavailable"
+		case format.ErrCorruptHeader:
+			status, e.Code = http.StatusUnsupportedMediaType, "corrupt_header"
+		case ErrTooSmall:
+			// A valid image, but not one we'll process.
+			status, e.Code = http.StatusUnprocessableEntity, "too_small"
+		case ErrBadAspectRatio:
+			status, e.Code = http.StatusUnprocessableEntity, "bad_aspect_ratio"
 		case ErrTooBig:
-			status = http.StatusRequestEntityTooLarge
+			status, e.Code = http.StatusRequestEntityTooLarge, "too_big"
+		case ErrSourceTooBig:
+			status, e.Code = http.StatusRequestEntityTooLarge, "source_too_big"
+		case ErrUnsupportedConversion:
+			status, e.Code = http.StatusUnprocessableEntity, "unsupported_conversion"
+		case ErrMemoryLimit:
+			status, e.Code = http.StatusRequestEntityTooLarge, "memory_limit"
 		case ErrAborted:
-			status = 499 // Nginx error for "Client closed connection"
+			status, e.Code = 499, "aborted" // Nginx error for "Client closed connection"
 		default:
-			if isTimeout(err) {
+			if _, ok := err.(PageError); ok {
+				status, e.Code = http.StatusUnprocessableEntity, "bad_page"
+			} else if isTimeout(err) {
 				err = nil
 				status = http.StatusGatewayTimeout
 			} else {
@@ -200,14 +712,14 @@ func proxyError(w http.ResponseWriter, err error, status int) {
 		}
 	default:
 		err = fmt.Errorf("Proxy received %d %s", status, http.StatusText(status))
-		status = http.StatusBadGateway
+		status, e.Code = http.StatusBadGateway, "upstream_error"
 	}
 
-	if err == nil {
-		err = fmt.Errorf(http.StatusText(status))
+	if err != nil {
+		e.Message = err.Error()
 	}
 
-	http.Error(w, err.Error(), status)
+	return status, e
 }
 
 func isTimeout(err error) bool {
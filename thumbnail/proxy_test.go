@@ -1,13 +1,20 @@
 package thumbnail
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/die-net/fotomat/format"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -28,6 +35,493 @@ func TestProxySuccess(t *testing.T) {
 	assert.Nil(t, ps.isSize("watermelon.jpg", format.Webp, 200, 100))
 }
 
+func TestProxyCachePolicy(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	// Without a CachePolicy, the upstream header is passed through.
+	resp := ps.head("2px.png")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Cache-Control"))
+
+	for _, test := range []struct {
+		policy CachePolicy
+		want   string
+	}{
+		{CachePolicy{MaxAge: time.Hour, StaleWhileRevalidate: time.Minute}, "public, max-age=3600, stale-while-revalidate=60"},
+		{CachePolicy{Immutable: true}, "public, max-age=31536000, immutable"},
+		{CachePolicy{MaxAge: time.Hour, NoStore: true}, "no-store"},
+	} {
+		policy := test.policy
+		ps := newProxyServer(0, time.Minute, func(p *Proxy) {
+			p.CachePolicy = func(req *http.Request) CachePolicy { return policy }
+		})
+		resp := ps.head("2px.png")
+		assert.Equal(t, test.want, resp.Header.Get("Cache-Control"))
+		ps.close()
+	}
+}
+
+func TestProxyContentDisposition(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	// The filename has the extension of the format that was saved.
+	ps.options = Options{Width: 100, Height: 100, Save: format.SaveOptions{AllowWebp: true}}
+	resp := ps.head("watermelon.jpg")
+	disposition, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "inline", disposition)
+		assert.Equal(t, "watermelon.webp", params["filename"])
+	}
+
+	ps.options = Options{Width: 100, Height: 100, Save: format.SaveOptions{Format: format.Png}}
+	resp = ps.head("watermelon.jpg?download=1")
+	disposition, params, err = mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "attachment", disposition)
+		assert.Equal(t, "watermelon.png", params["filename"])
+	}
+}
+
+func TestProxyRange(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.options = Options{Width: 100, Height: 100}
+	full, status := ps.get("watermelon.jpg")
+	if !assert.Equal(t, http.StatusOK, status) || !assert.True(t, len(full) > 100) {
+		return
+	}
+
+	req, err := http.NewRequest("GET", ps.server.URL+"/watermelon.jpg", nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	req.Header.Set("Range", "bytes=0-99")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+		assert.Equal(t, "bytes 0-99/"+strconv.Itoa(len(full)), resp.Header.Get("Content-Range"))
+		assert.Equal(t, full[:100], body)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		f    format.Format
+		want string
+	}{
+		{"http://example.com/a/b/photo.jpeg", format.Jpeg, "inline; filename=photo.jpg"},
+		{"http://example.com/noext", format.Png, "inline; filename=noext.png"},
+		{"http://example.com/", format.Webp, "inline; filename=image.webp"},
+		{"http://example.com/my%20photo.png?download=1", format.Png, `attachment; filename="my photo.png"`},
+	} {
+		u, err := url.Parse(test.url)
+		if assert.Nil(t, err) {
+			assert.Equal(t, test.want, contentDisposition(u, test.f), test.url)
+		}
+	}
+}
+
+func TestSourceURL(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		want string
+	}{
+		{"http://example.com/photo.jpg", "http://example.com/photo.jpg"},
+		{"http://example.com/photo.jpg?download=1", "http://example.com/photo.jpg"},
+		{"http://example.com/photo.jpg?v=2&download=1", "http://example.com/photo.jpg?v=2"},
+		{"http://example.com/photo.jpg?v=2", "http://example.com/photo.jpg?v=2"},
+	} {
+		u, err := url.Parse(test.url)
+		if assert.Nil(t, err) {
+			assert.Equal(t, test.want, sourceURL(u), test.url)
+		}
+	}
+}
+
+func TestProxyIfModifiedSince(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	// An origin that sends Last-Modified, but ignores If-Modified-Since.
+	lastMod := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	blob := image("2px.png")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", lastMod.Format(http.TimeFormat))
+		_, _ = w.Write(blob)
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	ps.host = u.Host
+
+	for _, test := range []struct {
+		since  time.Time
+		status int
+	}{
+		{time.Time{}, http.StatusOK},
+		{lastMod.Add(-time.Hour), http.StatusOK},
+		{lastMod, http.StatusNotModified},
+		{lastMod.Add(time.Hour), http.StatusNotModified},
+	} {
+		req, err := http.NewRequest("GET", ps.server.URL+"/2px.png", nil)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		if !test.since.IsZero() {
+			req.Header.Set("If-Modified-Since", test.since.Format(http.TimeFormat))
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if assert.Nil(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, test.status, resp.StatusCode, test.since.String())
+			assert.Equal(t, lastMod.Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+		}
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since.
+	header := http.Header{}
+	header.Set("If-None-Match", `"abc"`)
+	header.Set("If-Modified-Since", lastMod.Format(http.TimeFormat))
+	assert.False(t, isNotModified(header, http.Header{"Last-Modified": {lastMod.Format(http.TimeFormat)}}))
+}
+
+func TestProxySourceCache(t *testing.T) {
+	// An origin that counts how many times it's fetched from.
+	fetches := int32(0)
+	blob := image("watermelon.jpg")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		_, _ = w.Write(blob)
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ps := newProxyServer(0, time.Minute, func(p *Proxy) {
+		p.SourceCache = NewSourceCache(1<<20, time.Minute)
+		p.ForwardHeaders = []string{"Cookie"}
+	})
+	defer ps.close()
+	ps.host = u.Host
+
+	ps.options = Options{Width: 100, Height: 100}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 75, 100))
+	ps.options = Options{Width: 50, Height: 50, Crop: true}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 50, 50))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// A different source is fetched.
+	assert.Nil(t, ps.isSize("watermelon.jpg?v=2", format.Jpeg, 50, 50))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	// As does a request with a forwarded header, which may be per-user.
+	req, err := http.NewRequest("GET", ps.server.URL+"/watermelon.jpg", nil)
+	if assert.Nil(t, err) {
+		req.Header.Set("Cookie", "session=1")
+		resp, err := http.DefaultClient.Do(req)
+		if assert.Nil(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 50, 50))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+
+	// A NoStore CachePolicy bypasses the cache.
+	nostore := newProxyServer(0, time.Minute, func(p *Proxy) {
+		p.SourceCache = NewSourceCache(1<<20, time.Minute)
+		p.CachePolicy = func(req *http.Request) CachePolicy {
+			return CachePolicy{NoStore: true}
+		}
+	})
+	defer nostore.close()
+	nostore.host = u.Host
+	nostore.options = ps.options
+	assert.Nil(t, nostore.isSize("watermelon.jpg", format.Jpeg, 50, 50))
+	assert.Nil(t, nostore.isSize("watermelon.jpg", format.Jpeg, 50, 50))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&fetches))
+}
+
+func TestProxyUpstreamHeaders(t *testing.T) {
+	ps := newProxyServer(0, time.Minute, func(p *Proxy) {
+		p.UserAgent = "TestAgent/1.0"
+		p.Header = http.Header{"Authorization": {"Bearer secret"}, "Accept": {"image/png"}}
+		p.ForwardHeaders = []string{"Cookie"}
+	})
+	defer ps.close()
+
+	// An origin that records the headers it receives.
+	received := make(chan http.Header, 1)
+	blob := image("2px.png")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		_, _ = w.Write(blob)
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	ps.host = u.Host
+
+	req, err := http.NewRequest("GET", ps.server.URL+"/2px.png", nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("Referer", "http://example.com/")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	h := <-received
+	assert.Equal(t, "TestAgent/1.0", h.Get("User-Agent"))
+	assert.Equal(t, "Bearer secret", h.Get("Authorization"))
+	assert.Equal(t, "image/png", h.Get("Accept"))
+	assert.Equal(t, "session=1", h.Get("Cookie"))
+	assert.Equal(t, "", h.Get("Referer"))
+}
+
+func TestProxyPlaceholder(t *testing.T) {
+	ps := newProxyServer(0, time.Minute, func(p *Proxy) {
+		p.Placeholder = image("flowers.png")
+	})
+	defer ps.close()
+
+	ps.options = Options{Width: 100, Height: 100, Save: format.SaveOptions{Format: format.Png}}
+
+	// A missing or undecodable original returns the placeholder at the requested size.
+	for _, filename := range []string{"notfound.txt", "notimage.txt", "bad.jpg"} {
+		body, status := ps.get(filename)
+		if assert.Equal(t, http.StatusNonAuthoritativeInfo, status, filename) {
+			assert.Nil(t, isSize(body, format.Png, 100, 100, false), filename)
+		}
+	}
+
+	// Other errors are still returned.
+	assert.Equal(t, ps.getStatus("34000px.png"), http.StatusRequestEntityTooLarge)
+
+	// And originals that can be decoded are unaffected.
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Png, 75, 100))
+}
+
+func TestProxyRejectEarly(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	// An origin that sends the start of an image, then stalls until
+	// the download is aborted.
+	var prefix []byte
+	aborted := make(chan bool, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		closed := w.(http.CloseNotifier).CloseNotify()
+		_, _ = w.Write(prefix)
+		w.(http.Flusher).Flush()
+		select {
+		case <-closed:
+			aborted <- true
+		case <-time.After(10 * time.Second):
+			aborted <- false
+		}
+	}))
+	defer origin.Close()
+
+	u, err := url.Parse(origin.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	ps.host = u.Host
+
+	code := func(ps *proxyServer, filename string) (int, string) {
+		body, status := ps.get(filename)
+		var e ErrorResponse
+		_ = json.Unmarshal(body, &e)
+		return status, e.Code
+	}
+
+	// Enough of a 34000px wide PNG to probe its dimensions.
+	prefix = image("34000px.png")[:33]
+	start := time.Now()
+	status, c := code(ps, "stall.png")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, "too_big", c)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.True(t, <-aborted)
+
+	// More bytes than MaxSourceBytes, without a Content-Length.
+	small := newProxyServer(0, time.Minute, func(p *Proxy) { p.MaxSourceBytes = 1000 })
+	defer small.close()
+	small.host = u.Host
+	prefix = image("watermelon.jpg")[:2000]
+	status, c = code(small, "stall.jpg")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, "source_too_big", c)
+	assert.True(t, <-aborted)
+
+	// And with a Content-Length, from the usual origin.
+	small.host = small.origin.Listener.Addr().String()
+	status, c = code(small, "watermelon.jpg")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, "source_too_big", c)
+
+	// Images within the limits are unaffected.
+	large := newProxyServer(0, time.Minute, func(p *Proxy) { p.MaxSourceBytes = 100000 })
+	defer large.close()
+	large.options = Options{Width: 100, Height: 100, Save: format.SaveOptions{Format: format.Jpeg}}
+	assert.Nil(t, large.isSize("watermelon.jpg", format.Jpeg, 75, 100))
+}
+
+func TestReadSource(t *testing.T) {
+	blob := image("watermelon.jpg")
+	b, err := readSource(bytes.NewReader(blob), 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, blob, b)
+
+	_, err = readSource(bytes.NewReader(blob), int64(len(blob)-1), 0)
+	assert.Equal(t, ErrSourceTooBig, err)
+
+	// Even allowing for JPEG shrink-on-load, 398x536 is over 1000 pixels.
+	_, err = readSource(bytes.NewReader(blob), 0, 1000)
+	assert.Equal(t, ErrTooBig, err)
+
+	_, err = readSource(bytes.NewReader(image("34000px.png")), 0, 0)
+	assert.Equal(t, ErrTooBig, err)
+
+	// Formats that can't be probed are read in full.
+	text := image("notimage.txt")
+	b, err = readSource(bytes.NewReader(text), 0, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, text, b)
+}
+
+func TestProxyDigest(t *testing.T) {
+	get := func(ps *proxyServer, want string) (string, []byte) {
+		req, err := http.NewRequest("GET", ps.server.URL+"/watermelon.jpg", nil)
+		if err != nil {
+			panic(err)
+		}
+		if want != "" {
+			req.Header.Set("Want-Digest", want)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			panic(err)
+		}
+		return resp.Header.Get("Digest"), body
+	}
+	sum := func(body []byte) string {
+		s := sha256.Sum256(body)
+		return "sha-256=" + base64.StdEncoding.EncodeToString(s[:])
+	}
+
+	server := func(digest DigestPolicy) *proxyServer {
+		ps := newProxyServer(0, time.Minute, func(p *Proxy) { p.Digest = digest })
+		ps.options = Options{Width: 100, Height: 100, Save: format.SaveOptions{Format: format.Png}}
+		return ps
+	}
+
+	// By default, no Digest is sent even if asked for.
+	ps := server(NoDigest)
+	defer ps.close()
+	d, _ := get(ps, "sha-256")
+	assert.Equal(t, "", d)
+
+	want := server(WantDigest)
+	defer want.close()
+	d, _ = get(want, "")
+	assert.Equal(t, "", d)
+	d, body := get(want, "md5;q=0.3, SHA-256;q=1")
+	assert.Equal(t, sum(body), d)
+	d, _ = get(want, "sha-256;q=0")
+	assert.Equal(t, "", d)
+
+	always := server(AlwaysDigest)
+	defer always.close()
+	d, body = get(always, "")
+	assert.Equal(t, sum(body), d)
+}
+
+func TestProxyLog(t *testing.T) {
+	entries := make(chan LogEntry, 1)
+	logTo := func(p *Proxy) { p.Log = func(e LogEntry) { entries <- e } }
+	ps := newProxyServer(0, time.Minute, logTo)
+	defer ps.close()
+
+	entry := func() LogEntry {
+		select {
+		case e := <-entries:
+			return e
+		case <-time.After(10 * time.Second):
+			return LogEntry{}
+		}
+	}
+
+	ps.options = Options{Width: 200, Height: 100, Crop: true, Save: format.SaveOptions{Format: format.Png}}
+	_, status := ps.get("watermelon.jpg")
+	assert.Equal(t, http.StatusOK, status)
+	e := entry()
+	assert.Equal(t, ps.origin.URL+"/watermelon.jpg", e.Source)
+	assert.Equal(t, format.Jpeg, e.InputFormat)
+	assert.Equal(t, len(image("watermelon.jpg")), e.InputBytes)
+	assert.Equal(t, format.Png, e.OutputFormat)
+	assert.True(t, e.OutputBytes > 0)
+	assert.Equal(t, 200, e.Width)
+	assert.Equal(t, 100, e.Height)
+	assert.True(t, e.Duration > 0)
+	assert.Equal(t, http.StatusOK, e.Status)
+	assert.Equal(t, "", e.Error)
+
+	// Errors are logged with their code.
+	ps.options = Options{}
+	assert.Equal(t, http.StatusRequestEntityTooLarge, ps.getStatus("34000px.png"))
+	e = entry()
+	assert.Equal(t, format.Png, e.InputFormat)
+	assert.Equal(t, 0, e.OutputBytes)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, e.Status)
+	assert.Equal(t, "too_big", e.Error)
+
+	assert.Equal(t, http.StatusNotFound, ps.getStatus("notfound.txt"))
+	e = entry()
+	assert.Equal(t, http.StatusNotFound, e.Status)
+	assert.Equal(t, "not_found", e.Error)
+
+	// Including those hidden by the placeholder.
+	placeholder := newProxyServer(0, time.Minute, logTo, func(p *Proxy) {
+		p.Placeholder = image("flowers.png")
+	})
+	defer placeholder.close()
+	placeholder.options = Options{Width: 100, Height: 100, Save: format.SaveOptions{Format: format.Png}}
+	assert.Equal(t, http.StatusNonAuthoritativeInfo, placeholder.getStatus("notimage.txt"))
+	e = entry()
+	assert.Equal(t, format.Unknown, e.InputFormat)
+	assert.Equal(t, http.StatusNonAuthoritativeInfo, e.Status)
+	assert.Equal(t, "unknown_format", e.Error)
+}
+
 func TestProxyErrors(t *testing.T) {
 	ps := newProxyServer(0, time.Minute)
 	defer ps.close()
@@ -41,12 +535,35 @@ func TestProxyErrors(t *testing.T) {
 	// Return StatusUnsupportedMediaType on a truncated image.
 	assert.Equal(t, ps.getStatus("bad.jpg"), http.StatusUnsupportedMediaType)
 
-	// Return StatusUnsupportedMediaType on a 1x1 pixel image.
-	assert.Equal(t, ps.getStatus("1px.png"), http.StatusUnsupportedMediaType)
+	// Or one with an inconsistent header.
+	assert.Equal(t, ps.getStatus("badheader.png"), http.StatusUnsupportedMediaType)
+
+	// Return StatusUnprocessableEntity on a 1x1 pixel image.
+	assert.Equal(t, ps.getStatus("1px.png"), http.StatusUnprocessableEntity)
 
 	// Return StatusRequestEntityTooLarge on a 34000px image.
 	assert.Equal(t, ps.getStatus("34000px.png"), http.StatusRequestEntityTooLarge)
 
+	// Return StatusUnprocessableEntity for a page past the last.
+	ps.options = Options{Width: 100, Height: 100, Page: 1}
+	body, status := ps.get("2px.png")
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	var e ErrorResponse
+	if assert.Nil(t, json.Unmarshal(body, &e)) {
+		assert.Equal(t, "bad_page", e.Code)
+	}
+
+	// Return StatusBadRequest with the reason for conflicting options.
+	ps.options = Options{Save: format.SaveOptions{Format: format.Jpeg, Lossless: true}}
+	body, status = ps.get("2px.png")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, string(body), "JPEG can't be saved lossless")
+	e = ErrorResponse{}
+	if assert.Nil(t, json.Unmarshal(body, &e)) {
+		assert.Equal(t, "conflicting_options", e.Code)
+	}
+	ps.options = Options{}
+
 	// Make sure director return status is working
 	ps.status = 403
 	assert.Equal(t, ps.getStatus("2px.png"), 403)
@@ -55,6 +572,35 @@ func TestProxyErrors(t *testing.T) {
 	assert.Nil(t, NewProxy(nil, nil, 0, nil))
 }
 
+func TestProxyEncodeError(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	// Decoding and resizing succeed, but saving fails.
+	ps.options = Options{Width: 100, Height: 100, Save: format.SaveOptions{TargetSSIM: 2}}
+	resp, err := http.Get(ps.server.URL + "/watermelon.jpg")
+	if !assert.Nil(t, err) {
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, format.Unknown, format.DetectFormat(body))
+	var e ErrorResponse
+	if assert.Nil(t, json.Unmarshal(body, &e)) {
+		assert.Equal(t, "internal_server_error", e.Code)
+		assert.Equal(t, format.ErrInvalidTargetSSIM.Error(), e.Message)
+	}
+
+	// Nor is the error cacheable as the original.
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "", resp.Header.Get("Last-Modified"))
+	assert.Equal(t, "", resp.Header.Get("Content-Disposition"))
+}
+
 func TestProxyTimeout(t *testing.T) {
 	ps := newProxyServer(time.Second, time.Nanosecond)
 	defer ps.close()
@@ -73,7 +619,35 @@ type proxyServer struct {
 	host    string
 }
 
-func newProxyServer(delay, timeout time.Duration) *proxyServer {
+func TestProxyPassThroughUnsupported(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+	ps.options = Options{Width: 100, Height: 100}
+
+	// TIFF is a known format that can't be loaded.
+	assert.Equal(t, http.StatusUnsupportedMediaType, ps.getStatus("2px.tif"))
+
+	ps = newProxyServer(0, time.Minute, func(p *Proxy) { p.PassThroughUnsupported = true })
+	defer ps.close()
+	ps.options = Options{Width: 100, Height: 100}
+	resp, err := http.Get(ps.server.URL + "/2px.tif")
+	if assert.Nil(t, err) {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "image/tiff", resp.Header.Get("Content-Type"))
+		assert.Equal(t, image("2px.tif"), body)
+	}
+
+	// Images still get processed, and unknown formats rejected.
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 75, 100))
+	assert.Equal(t, http.StatusUnsupportedMediaType, ps.getStatus("notimage.txt"))
+}
+
+// newProxyServer starts a proxy in front of a static origin, applying each
+// of configure to the Proxy before it serves any requests.
+func newProxyServer(delay, timeout time.Duration, configure ...func(p *Proxy)) *proxyServer {
 	// Static http server that serves our test images, with a delay.
 	fs := http.FileServer(http.Dir(imageDirectory))
 	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -94,6 +668,9 @@ func newProxyServer(delay, timeout time.Duration) *proxyServer {
 
 	// Proxy http server that fetches and thumbnails images from origin
 	ps.proxy = NewProxy(ps.director, NewPool(0, 1), 2, &http.Client{Timeout: timeout})
+	for _, c := range configure {
+		c(ps.proxy)
+	}
 	ps.server = httptest.NewServer(ps.proxy)
 
 	return ps
@@ -121,6 +698,16 @@ func (ps *proxyServer) get(filename string) ([]byte, int) {
 	return body, resp.StatusCode
 }
 
+func (ps *proxyServer) head(filename string) *http.Response {
+	resp, err := http.Head(ps.server.URL + "/" + filename)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+
+	return resp
+}
+
 func (ps *proxyServer) getStatus(filename string) int {
 	_, code := ps.get(filename)
 	return code
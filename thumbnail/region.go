@@ -0,0 +1,111 @@
+package thumbnail
+
+import (
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/vips"
+)
+
+// Rect is a rectangle of pixels within an image, relative to the image as
+// displayed, after any EXIF orientation is applied.
+type Rect struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+// clip returns r limited to the bounds of a width by height image, or
+// ErrBadOption if r is empty or doesn't overlap the image.
+func (r Rect) clip(width, height int) (Rect, error) {
+	if r.X < 0 || r.Y < 0 || r.Width < 1 || r.Height < 1 || r.X >= width || r.Y >= height {
+		return Rect{}, ErrBadOption
+	}
+
+	if r.X+r.Width > width {
+		r.Width = width - r.X
+	}
+	if r.Y+r.Height > height {
+		r.Height = height - r.Y
+	}
+
+	return r, nil
+}
+
+// Region crops the w by h pixel rectangle at x, y from a compressed image
+// blob, then scales and crops it to fill ow by oh pixels, never upscaling,
+// and returns a compressed image.  Other than Region, Width, Height, and
+// Crop, the Options specified in o are used.
+func Region(blob []byte, x, y, w, h, ow, oh int, o Options) ([]byte, error) {
+	o.Region = Rect{X: x, Y: y, Width: w, Height: h}
+	o.Width, o.Height, o.Crop = ow, oh, true
+	return Thumbnail(blob, o)
+}
+
+// extractRegion crops an image with Metadata m, which may have been shrunk
+// on load, to Rect r.
+func extractRegion(image *vips.Image, m format.Metadata, r Rect) error {
+	// Translate the region to physical coordinates in the possibly
+	// shrunk image.
+	pw, ph := m.Orientation.Dimensions(m.Width, m.Height)
+	x, y, w, h := m.Orientation.Crop(r.Width, r.Height, r.X, r.Y, m.Width, m.Height)
+	left, width := shrinkSpan(x, w, pw, image.Xsize())
+	top, height := shrinkSpan(y, h, ph, image.Ysize())
+
+	return image.ExtractArea(left, top, width, height)
+}
+
+// storedSize returns the size that image's pixels, as stored, are scaled
+// to for it to be displayed at iw by ih.  EXIF orientations 5-8 swap the
+// width and height, such as of a Region of a rotated JPEG, and scaling the
+// stored pixels keeps rounding the same for every orientation.
+func storedSize(image *vips.Image, iw, ih int) (int, int) {
+	return format.DetectOrientation(image).Dimensions(iw, ih)
+}
+
+// shrinkSpan scales the span of length n at offset off within a dimension
+// of size from to a dimension of size to, rounding outwards but staying
+// within bounds.
+func shrinkSpan(off, n, from, to int) (int, int) {
+	start := off * to / from
+	end := ((off+n)*to + from - 1) / from
+	if end > to {
+		end = to
+	}
+	if end <= start {
+		end = start + 1
+	}
+	return start, end - start
+}
+
+// CropBox returns the Rect of an image with Metadata m, as displayed, that
+// Thumbnail would keep for the Options in o, without loading any pixels,
+// such as for a UI to preview the crop.  The scaled image is cropped, so
+// the Rect is rounded to whole pixels of the original.  Without Crop or
+// Outside, the whole image or Region is kept.
+func CropBox(m format.Metadata, o Options) (Rect, error) {
+	box := Rect{Width: m.Width, Height: m.Height}
+	if o.Region != (Rect{}) {
+		var err error
+		if box, err = o.Region.clip(m.Width, m.Height); err != nil {
+			return Rect{}, err
+		}
+		m.Width, m.Height = box.Width, box.Height
+	}
+
+	o, err := o.Check(m)
+	if err != nil {
+		return Rect{}, err
+	}
+	if !o.Crop {
+		return box, nil
+	}
+
+	iw, ih, _ := scaleAspect(m.Width, m.Height, o.Width, o.Height, false, o.Rounding)
+	x, y := cropOffsets(iw, ih, o.Width, o.Height)
+	left, right := (x*m.Width+iw/2)/iw, ((x+o.Width)*m.Width+iw/2)/iw
+	top, bottom := (y*m.Height+ih/2)/ih, ((y+o.Height)*m.Height+ih/2)/ih
+	box.X, box.Width = box.X+left, right-left
+	box.Y, box.Height = box.Y+top, bottom-top
+
+	return box, nil
+}
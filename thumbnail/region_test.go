@@ -0,0 +1,146 @@
+package thumbnail
+
+import (
+	"bytes"
+	"github.com/die-net/fotomat/format"
+	"github.com/stretchr/testify/assert"
+	goimage "image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func TestRegion(t *testing.T) {
+	// A 2000x1500 white PNG with a 200x200 red square at 1000,600.
+	marker := goimage.NewRGBA(goimage.Rect(0, 0, 2000, 1500))
+	draw.Draw(marker, marker.Bounds(), goimage.NewUniform(color.White), goimage.ZP, draw.Src)
+	draw.Draw(marker, goimage.Rect(1000, 600, 1200, 800), goimage.NewUniform(color.RGBA{R: 255, A: 255}), goimage.ZP, draw.Src)
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, png.Encode(&buf, marker)) {
+		return
+	}
+	img := buf.Bytes()
+
+	// A 400x400 region around the marker, scaled to 100x100, has the
+	// marker in its center quarter.
+	thumb, err := Region(img, 900, 500, 400, 400, 100, 100, Options{Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 100, 100, false))
+
+		out, err := png.Decode(bytes.NewReader(thumb))
+		if assert.Nil(t, err) {
+			r, g, b, _ := out.At(50, 50).RGBA()
+			assert.True(t, r > 0xf000 && g < 0x1000 && b < 0x1000, "center should be red")
+			r, g, b, _ = out.At(10, 10).RGBA()
+			assert.True(t, r > 0xf000 && g > 0xf000 && b > 0xf000, "corner should be white")
+		}
+	}
+
+	// JPEG regions can be shrunk on load, and are cropped to fill.
+	thumb, err = Region(image("watermelon.jpg"), 100, 100, 200, 300, 50, 60, Options{})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 50, 60, false))
+	}
+
+	// Regions are clipped to the image.
+	thumb, err = Region(img, 1900, 1400, 200, 200, 50, 50, Options{Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 50, 50, false))
+	}
+
+	// And never scaled up.
+	thumb, err = Region(img, 0, 0, 100, 100, 200, 200, Options{Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 100, 100, false))
+	}
+
+	// Empty regions or those outside the image are rejected.
+	for _, r := range [][4]int{
+		{-1, 0, 100, 100},
+		{2000, 0, 100, 100},
+		{0, 1500, 100, 100},
+		{0, 0, 0, 100},
+		{0, 0, 100, 0},
+	} {
+		_, err = Region(img, r[0], r[1], r[2], r[3], 10, 10, Options{})
+		assert.Equal(t, err, ErrBadOption, "region: %v", r)
+	}
+}
+
+func TestRegionOrientation(t *testing.T) {
+	// orient6.jpg is stored 80x48, and displayed 48x80.
+	img := image("orient6.jpg")
+	o := Options{Save: format.SaveOptions{Format: format.Png}}
+	upright, err := Thumbnail(img, Options{Width: 48, Height: 80, Save: o.Save})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Regions are of the image as displayed, so match those of an
+	// upright copy, and are scaled to the requested shape.
+	for _, r := range [][4]int{{0, 0, 48, 40}, {8, 30, 40, 50}, {0, 0, 48, 80}} {
+		want, err := Region(upright, r[0], r[1], r[2], r[3], r[2]/2, r[3]/2, o)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		thumb, err := Region(img, r[0], r[1], r[2], r[3], r[2]/2, r[3]/2, o)
+		if assert.Nil(t, err) && assert.Nil(t, isSize(thumb, format.Png, r[2]/2, r[3]/2, false), "region: %v", r) {
+			assert.True(t, pngDifference(t, want, thumb) < 2, "region: %v", r)
+		}
+	}
+}
+
+func TestCropBox(t *testing.T) {
+	// A 200x800 PNG, redder to the right and greener further down.
+	gradient := goimage.NewRGBA(goimage.Rect(0, 0, 200, 800))
+	for y := 0; y < 800; y++ {
+		for x := 0; x < 200; x++ {
+			gradient.Set(x, y, color.RGBA{R: uint8(x * 255 / 199), G: uint8(y * 255 / 799), A: 255})
+		}
+	}
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, png.Encode(&buf, gradient)) {
+		return
+	}
+	img := buf.Bytes()
+
+	m, err := format.MetadataBytes(img)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Scaled to 100x400, the 100x100 crop starts a quarter of the way
+	// down what's cut off.
+	o := Options{Width: 100, Height: 100, Crop: true, Save: format.SaveOptions{Format: format.Png}}
+	box, err := CropBox(m, o)
+	if !assert.Nil(t, err) || !assert.Equal(t, Rect{X: 0, Y: 150, Width: 200, Height: 200}, box) {
+		return
+	}
+
+	// Rendering just the box gives the same image as the crop.
+	thumb, err := Thumbnail(img, o)
+	if !assert.Nil(t, err) {
+		return
+	}
+	boxed, err := Region(img, box.X, box.Y, box.Width, box.Height, 100, 100, Options{Save: o.Save})
+	if assert.Nil(t, err) {
+		assert.True(t, pngDifference(t, thumb, boxed) < 2)
+	}
+
+	// Outside crops the height too, and regions are offset.
+	box, err = CropBox(m, Options{Width: 100, Height: 100, Outside: true})
+	if assert.Nil(t, err) {
+		assert.Equal(t, Rect{X: 0, Y: 0, Width: 200, Height: 800}, box)
+	}
+	box, err = CropBox(m, Options{Width: 50, Height: 100, Crop: true, Region: Rect{X: 0, Y: 400, Width: 200, Height: 200}})
+	if assert.Nil(t, err) {
+		assert.Equal(t, Rect{X: 50, Y: 400, Width: 100, Height: 200}, box)
+	}
+
+	// Without cropping, the whole image is kept.
+	box, err = CropBox(m, Options{Width: 100, Height: 100})
+	if assert.Nil(t, err) {
+		assert.Equal(t, Rect{Width: 200, Height: 800}, box)
+	}
+}
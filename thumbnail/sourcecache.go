@@ -0,0 +1,139 @@
+package thumbnail
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SourceCache is an in-memory LRU cache of original images fetched by a
+// Proxy, keyed by URL, so that repeated requests for different sizes of the
+// same original don't each fetch it from upstream.  It's only in memory,
+// with no on-disk tier, so it's emptied on restart.  It is safe for
+// concurrent use.  Must be created with NewSourceCache.
+type SourceCache struct {
+	maxBytes int64
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List // Most recently used at the front.
+	entries map[string]*list.Element
+}
+
+type sourceEntry struct {
+	key     string
+	blob    []byte
+	header  http.Header
+	added   time.Time
+	expires time.Time
+}
+
+// NewSourceCache creates a SourceCache holding up to maxBytes of original
+// images, each for at most ttl (0=until evicted).
+func NewSourceCache(maxBytes int64, ttl time.Duration) *SourceCache {
+	if maxBytes <= 0 || ttl < 0 {
+		return nil
+	}
+
+	return &SourceCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached image and upstream response header for key, if
+// present and not expired.  As for any HTTP cache, the header's Age
+// includes how long it's been cached.
+func (c *SourceCache) Get(key string) ([]byte, http.Header, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+
+	entry := e.Value.(*sourceEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil, nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	return entry.blob, entry.aged(time.Now()), true
+}
+
+// Add caches an image and its upstream response header under key,
+// evicting the least recently used images to make room.  Images larger
+// than the whole cache aren't cached.
+func (c *SourceCache) Add(key string, blob []byte, header http.Header) {
+	size := int64(len(blob))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+
+	for c.bytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+
+	now := time.Now()
+	entry := &sourceEntry{key: key, blob: blob, header: header, added: now, expires: now.Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += size
+}
+
+// Remove removes the image cached under key, such as after it's updated
+// upstream, and returns false if it wasn't cached.
+func (c *SourceCache) Remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if ok {
+		c.remove(e)
+	}
+	return ok
+}
+
+// Len returns the number of images in the cache.
+func (c *SourceCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// aged returns a copy of the entry's header, with its Age increased by
+// how long it's been cached as of now.
+func (entry *sourceEntry) aged(now time.Time) http.Header {
+	h := make(http.Header, len(entry.header)+1)
+	for k, v := range entry.header {
+		h[k] = v
+	}
+
+	age, err := strconv.Atoi(entry.header.Get("Age"))
+	if err != nil || age < 0 {
+		age = 0
+	}
+	h.Set("Age", strconv.Itoa(age+int(now.Sub(entry.added)/time.Second)))
+
+	return h
+}
+
+func (c *SourceCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*sourceEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.blob))
+}
@@ -0,0 +1,77 @@
+package thumbnail
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSourceCache(t *testing.T) {
+	assert.Nil(t, NewSourceCache(0, time.Minute))
+	assert.Nil(t, NewSourceCache(10, -time.Minute))
+
+	c := NewSourceCache(10, 0)
+	header := http.Header{"Etag": {`"a"`}, "Age": {"5"}}
+	c.Add("a", []byte("aaaa"), header)
+	c.Add("b", []byte("bbbb"), nil)
+
+	blob, h, ok := c.Get("a")
+	if assert.True(t, ok) {
+		assert.Equal(t, []byte("aaaa"), blob)
+		assert.Equal(t, `"a"`, h.Get("Etag"))
+		assert.Equal(t, "5", h.Get("Age"))
+	}
+
+	// Age counts the time since it was cached, without changing what's
+	// cached.
+	c.entries["a"].Value.(*sourceEntry).added = time.Now().Add(-10 * time.Second)
+	_, h, ok = c.Get("a")
+	if assert.True(t, ok) {
+		assert.Equal(t, "15", h.Get("Age"))
+		assert.Equal(t, "5", header.Get("Age"))
+	}
+
+	// Adding c evicts b, which was used less recently than a.
+	c.Add("c", []byte("cccc"), nil)
+	assert.Equal(t, 2, c.Len())
+	_, _, ok = c.Get("b")
+	assert.False(t, ok)
+	_, _, ok = c.Get("a")
+	assert.True(t, ok)
+
+	// Replacing an entry doesn't count it twice.
+	c.Add("c", []byte("cc"), nil)
+	assert.Equal(t, 2, c.Len())
+
+	// Images larger than the whole cache are ignored.
+	c.Add("d", []byte("ddddddddddd"), nil)
+	_, _, ok = c.Get("d")
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.Len())
+
+	// Removed entries are gone, and their space is freed.
+	assert.True(t, c.Remove("a"))
+	assert.False(t, c.Remove("a"))
+	_, _, ok = c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Len())
+	c.Add("e", []byte("eeeeeeee"), nil)
+	assert.Equal(t, 2, c.Len())
+
+	// Entries cached without a header still get an Age.
+	c = NewSourceCache(10, 0)
+	c.Add("a", []byte("aaaa"), nil)
+	_, h, ok = c.Get("a")
+	if assert.True(t, ok) {
+		assert.Equal(t, "0", h.Get("Age"))
+	}
+
+	// Expired entries are removed.
+	c = NewSourceCache(10, time.Nanosecond)
+	c.Add("a", []byte("aaaa"), nil)
+	time.Sleep(time.Millisecond)
+	_, _, ok = c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+}
@@ -1,6 +1,7 @@
 package thumbnail
 
 import (
+	"encoding/base64"
 	"fmt"
 	"github.com/die-net/fotomat/format"
 	"github.com/die-net/fotomat/vips"
@@ -8,10 +9,49 @@ import (
 	"time"
 )
 
+// Timings records how long each stage of an operation took.  VIPS defers
+// most pixel work until an image is saved, so decoding and transforming
+// large images is often counted as part of Encode.
+type Timings struct {
+	// Load is the time spent reading the header and opening the image.
+	Load time.Duration
+	// Transform is the time spent setting up resizing, cropping, and
+	// other operations.
+	Transform time.Duration
+	// Encode is the time spent evaluating the image and compressing it.
+	Encode time.Duration
+}
+
+// Total returns the sum of all stages' Timings.
+func (t Timings) Total() time.Duration {
+	return t.Load + t.Transform + t.Encode
+}
+
+// Result is a compressed image and information about how it was made.
+type Result struct {
+	Blob []byte
+	// Preview is a base64-encoded tiny JPEG of the same image, if
+	// Options.PreviewSize was set.
+	Preview string
+	// Lossless is true if Blob is in a lossless encoding, such as PNG or
+	// lossless WebP, rather than JPEG or lossy WebP.
+	Lossless bool
+	Timings  Timings
+}
+
 // Thumbnail scales or crops a compressed image blob according to the
 // Options specified in o and returns a compressed image.
 // Should be called from a thread pool with runtime.LockOSThread() locked.
 func Thumbnail(blob []byte, o Options) ([]byte, error) {
+	r, err := Process(blob, o)
+	return r.Blob, err
+}
+
+// Process is like Thumbnail, but returns a Result that also includes the
+// Timings of each stage.
+func Process(blob []byte, o Options) (Result, error) {
+	start := time.Now()
+
 	if o.MaxProcessingDuration > 0 {
 		timer := time.AfterFunc(o.MaxProcessingDuration, func() {
 			panic(fmt.Sprintf("Thumbnail took longer than %v", o.MaxProcessingDuration))
@@ -22,14 +62,175 @@ func Thumbnail(blob []byte, o Options) ([]byte, error) {
 	// Free some thread-local caches. Safe to call unnecessarily.
 	defer vips.ThreadShutdown()
 
-	m, err := format.MetadataBytes(blob)
+	mem := newMemoryWatchdog(o.MaxMemory)
+	defer mem.Stop()
+
+	image, r, o, err := transform(blob, o, mem, start)
+	if err != nil || image == nil {
+		return r, err
+	}
+	defer image.Close()
+	transformed := time.Now()
+
+	// Buffer the thumbnail, so it can be read again for the preview.
+	if o.PreviewSize > 0 {
+		if err = image.Write(); err != nil {
+			return Result{}, err
+		}
+	}
+
+	if err = mem.Check(); err != nil {
+		return Result{}, err
+	}
+
+	r.Blob, err = format.Save(image, o.Save)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if err = mem.Check(); err != nil {
+		return Result{}, err
+	}
+	r.Lossless = format.IsLossless(r.Blob)
+
+	if o.PreviewSize > 0 {
+		if r.Preview, err = preview(image, o.PreviewSize); err != nil {
+			return Result{}, err
+		}
+	}
+	r.Timings.Encode = time.Since(transformed)
+
+	return r, nil
+}
+
+// ProcessImage is like Process, but rather than encoding the thumbnail,
+// returns it as an Image, for callers to run further VIPS operations on and
+// encode themselves.  The caller owns the Image, and must Close it.  Video,
+// Montage, PassThrough, MinProcessDimension, and PreviewSize are ignored,
+// since they don't produce an Image, and of Save, only a Format of JPEG
+// has an effect, flattening any transparency onto Background.  Should be
+// called from a thread pool with runtime.LockOSThread() locked.
+func ProcessImage(blob []byte, o Options) (*vips.Image, error) {
+	o.Video, o.Montage, o.PassThrough, o.MinProcessDimension = NoVideo, Montage{}, false, 0
+
+	mem := newMemoryWatchdog(o.MaxMemory)
+	defer mem.Stop()
+
+	image, _, _, err := transform(blob, o, mem, time.Now())
+	return image, err
+}
+
+// transform loads blob and transforms it as specified by Options o, up to
+// but not including encoding it, and returns the Image along with the
+// Options to encode it with and a Result holding the Timings so far.  If a
+// Result can be returned without encoding, such as with PassThrough, the
+// Image is nil and the Result has a Blob.  Memory use is checked with mem.
+func transform(blob []byte, o Options, mem *memoryWatchdog, start time.Time) (image *vips.Image, r Result, _ Options, err error) {
+	if err := format.CheckHeader(blob, o.RepairHeader); err != nil {
+		return nil, Result{}, Options{}, err
+	}
+
+	m, err := metadata(blob, o.InputFormat)
 	if err != nil {
-		return nil, err
+		return nil, Result{}, Options{}, err
+	}
+
+	// Later pages may differ from the first in size.
+	if o.Page != 0 {
+		if err := o.checkPage(m); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+		if m, err = m.Format.MetadataBytesPage(blob, o.Page); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	}
+
+	// Optionally make everything outside an embedded clipping path
+	// transparent.
+	var clipPath [][]format.Point
+	if o.ClippingPath && m.Format == format.Jpeg {
+		clipPath, _ = format.ClippingPath(blob)
+	}
+
+	// Optionally treat the pixels as already upright, if rotating them
+	// would turn them away from the requested shape.
+	ignoreOrientation := o.OrientationPolicy == GuessOrientation && misrotated(m, o.Width, o.Height)
+	if ignoreOrientation {
+		m.Width, m.Height = m.Orientation.Dimensions(m.Width, m.Height)
+		m.Orientation = format.TopLeft
+	}
+
+	// Optionally find the borders to trim in a full decode, and extract
+	// the rest as Region.
+	if o.Trim != NoTrim && o.Region == (Rect{}) {
+		if _, err := (Options{MaxBufferPixels: o.MaxBufferPixels}).Check(m); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+		if o.Region, err = trimRect(blob, m, o.Page, o.Trim); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	}
+
+	// If set, only process Region of the image, treating it as the
+	// original from here on.  The whole image still has to be within
+	// limits, since it's decoded.
+	full := m
+	if o.Region != (Rect{}) {
+		if _, err := (Options{MaxBufferPixels: o.MaxBufferPixels}).Check(m); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+		if o.Region, err = o.Region.clip(m.Width, m.Height); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+		m.Width, m.Height = o.Region.Width, o.Region.Height
+	}
+
+	// In Pad mode with MaxCropFraction, either crop to fill, or trim what
+	// we can and pad the rest.
+	if o.Pad && o.MaxCropFraction > 0 && o.Width > 0 && o.Height > 0 {
+		trim, cover := coverTrim(m.Width, m.Height, o.Width, o.Height, o.MaxCropFraction)
+		if cover {
+			o.Crop, o.Pad = true, false
+		} else {
+			if o.Region == (Rect{}) {
+				if _, err := (Options{MaxBufferPixels: o.MaxBufferPixels}).Check(m); err != nil {
+					return nil, Result{}, Options{}, err
+				}
+			}
+			trim.X += o.Region.X
+			trim.Y += o.Region.Y
+			o.Region = trim
+			m.Width, m.Height = trim.Width, trim.Height
+		}
 	}
 
 	o, err = o.Check(m)
 	if err != nil {
-		return nil, err
+		return nil, Result{}, Options{}, err
+	}
+
+	// Optionally transcode animations to video, rather than taking the
+	// first frame.
+	if o.Video != NoVideo && isAnimated(m) {
+		v, err := video(blob, m, o)
+		return nil, Result{Blob: v, Timings: Timings{Encode: time.Since(start)}}, o, err
+	}
+
+	if o.Montage.Columns > 0 {
+		blob, err := montage(blob, m, o)
+		return nil, Result{Blob: blob, Lossless: format.IsLossless(blob), Timings: Timings{Encode: time.Since(start)}}, o, err
+	}
+
+	// Optionally override the choice of output format.
+	if (o.KeepFormat || o.StrictFormat) && o.Save.Format == format.Unknown && m.Format.CanSave() {
+		o.Save.Format = m.Format
+	}
+	if o.StrictFormat && (!o.Save.Format.CanSave() || (clipPath != nil && o.Save.Format == format.Jpeg)) {
+		return nil, Result{}, Options{}, ErrUnsupportedConversion
+	}
+
+	if o.Region == (Rect{}) && o.Page == 0 && !ignoreOrientation && clipPath == nil && o.Watermark == nil && o.DPI == 0 && ((o.PassThrough && isNoop(m, o)) || isTiny(m, o)) {
+		return nil, Result{Blob: blob, Lossless: format.IsLossless(blob), Timings: Timings{Load: time.Since(start)}}, o, nil
 	}
 
 	// If source image is lossy, disable lossless.
@@ -37,61 +238,237 @@ func Thumbnail(blob []byte, o Options) ([]byte, error) {
 		o.Save.Lossless = false
 	}
 
+	// Keep the transparency from clipping.
+	if clipPath != nil && o.Save.Format == format.Jpeg {
+		o.Save.Format = format.Png
+	}
+
 	// Figure out size to scale image down to.  For crop, this is the
 	// intermediate size the original image would have to be scaled to
 	// be cropped to requested size.
-	iw, ih, trustWidth := scaleAspect(m.Width, m.Height, o.Width, o.Height, !o.Crop)
+	iw, ih, trustWidth := scaleAspect(m.Width, m.Height, o.Width, o.Height, !o.Crop, o.Rounding)
 
 	// Are we shrinking by more than 2.5%?
 	shrinking := iw < m.Width-m.Width/40 && ih < m.Height-m.Height/40
 
 	// Figure out the jpeg/webp shrink factor and load image.
 	// Jpeg shrink rounds up the number of pixels.
-	psf := preShrinkFactor(m.Width, m.Height, iw, ih, trustWidth, o.FastResize, m.Format == format.Jpeg)
-	image, err := load(blob, m.Format, psf)
+	psf := preShrinkFactor(m.Width, m.Height, iw, ih, trustWidth, o.FastResize == ToggleOn, m.Format == format.Jpeg)
+	image, err = load(blob, m.Format, psf, o.Page)
 	if err != nil {
-		return nil, err
+		return nil, Result{}, Options{}, err
 	}
-	defer image.Close()
+	defer func() {
+		if err != nil {
+			image.Close()
+		}
+	}()
 
-	if err = srgb(image); err != nil {
-		return nil, err
+	if ignoreOrientation {
+		format.RemoveOrientation(image)
 	}
 
-	if err = resize(image, iw, ih, o.FastResize, o.BlurSigma, o.Sharpen && shrinking); err != nil {
-		return nil, err
+	if err = srgb(image, o.CmykProfile, o.RgbProfile); err != nil {
+		return nil, Result{}, Options{}, err
+	}
+
+	// Clip before extracting a region, since the path is relative to
+	// the whole image.
+	if clipPath != nil {
+		if err = clip(image, clipPath); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	}
+
+	if o.Region != (Rect{}) {
+		if err = extractRegion(image, full, o.Region); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	}
+
+	loaded := time.Now()
+	r = Result{Timings: Timings{Load: loaded.Sub(start)}}
+
+	// Optionally resize in linear light, then convert back to the
+	// original gamma-encoded colourspace.
+	linear := o.LinearProcessing && !image.HasAlpha()
+	space := image.ImageGuessInterpretation()
+	if linear {
+		if err = image.Colourspace(vips.InterpretationScRGB); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	}
+
+	k := resizeKernels{down: o.DownscaleKernel, up: o.UpscaleKernel, upscale: o.Upscale}
+	if err = resize(image, iw, ih, o.FastResize == ToggleOn, o.BlurSigma, o.Sharpen == ToggleOn && shrinking, o.SharpenBeforeResize, !o.Premultiplied, k); err != nil {
+		return nil, Result{}, Options{}, err
+	}
+
+	if err = mem.Check(); err != nil {
+		return nil, Result{}, Options{}, err
+	}
+
+	if linear {
+		if err = image.Colourspace(space); err != nil {
+			return nil, Result{}, Options{}, err
+		}
 	}
 
 	// Make sure we generate images with 8 bits per channel.  Do this before the
 	// rotate to reduce the amount of data that needs to be copied.
 	if image.ImageGetBandFormat() != vips.BandFormatUchar {
 		if err = image.Cast(vips.BandFormatUchar); err != nil {
-			return nil, err
+			return nil, Result{}, Options{}, err
 		}
 	}
 
 	if o.Crop {
 		if err = crop(image, o.Width, o.Height); err != nil {
-			return nil, err
+			return nil, Result{}, Options{}, err
 		}
 	}
 
 	if image.HasAlpha() {
 		if min, err := minTransparency(image); err == nil && min >= 0.9 {
 			if err := image.Flatten(); err != nil {
-				return nil, err
+				return nil, Result{}, Options{}, err
 			}
 		}
 	}
 
-	if err := m.Orientation.Apply(image); err != nil {
-		return nil, err
+	// Optionally leave the pixels as stored, for the tag to rotate.
+	keepTag := o.KeepOrientationTag && o.Save.KeepMetadata
+	if !keepTag {
+		if err := m.Orientation.Apply(image); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	}
+
+	// Pad after rotating, so the image is centered as displayed.
+	if o.Pad {
+		width, height := o.Width, o.Height
+		if keepTag {
+			width, height = m.Orientation.Dimensions(width, height)
+		}
+		if err := pad(image, width, height, o.Background); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	}
+
+	if o.Watermark != nil {
+		if err := watermark(image, o.Watermark); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	}
+
+	// Optionally set the density.  Region and crop don't change the
+	// scale, so print size is kept by scaling with the resize.
+	if o.DPI > 0 {
+		if err := setDPI(image, o.DPI, o.DPI); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	} else if o.KeepPrintSize {
+		if err := setDPI(image, m.XDPI*float64(iw)/float64(m.Width), m.YDPI*float64(ih)/float64(m.Height)); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	}
+
+	// JPEG has no alpha channel, so blend transparency with Background
+	// rather than leaving it to VIPS.
+	if o.Save.Format == format.Jpeg && image.HasAlpha() {
+		if err := flatten(image, o.Background); err != nil {
+			return nil, Result{}, Options{}, err
+		}
+	}
+
+	transformed := time.Now()
+	r.Timings.Transform = transformed.Sub(loaded)
+
+	return image, r, o, nil
+}
+
+// metadata returns the Metadata of blob, loading it as f if set, or
+// detecting its format otherwise.
+func metadata(blob []byte, f format.Format) (format.Metadata, error) {
+	if f == format.Unknown {
+		return format.MetadataBytes(blob)
+	}
+
+	return f.MetadataBytes(blob)
+}
+
+// Validate checks that a compressed image blob is in a known format, has a
+// consistent header, and is within the size limits that Thumbnail would
+// enforce, and returns its Metadata.  Only the image header is decoded, so
+// this is much cheaper than Thumbnail for pre-flight checks.  If the image is readable but
+// outside the size limits, its Metadata is returned along with ErrTooBig
+// or ErrTooSmall, so callers can still describe it.
+func Validate(blob []byte, maxBufferPixels int) (format.Metadata, error) {
+	if err := format.CheckHeader(blob, false); err != nil {
+		return format.Metadata{}, err
+	}
+
+	m, err := format.MetadataBytes(blob)
+	if err != nil {
+		return format.Metadata{}, err
+	}
+
+	if _, err := (Options{MaxBufferPixels: maxBufferPixels}).Check(m); err != nil {
+		return m, err
 	}
 
-	return format.Save(image, o.Save)
+	return m, nil
+}
+
+// ThumbnailWidth scales a compressed image blob proportionally to the given
+// width, never upscaling.  Other than Width, Height, and Crop, the Options
+// specified in o are used.
+func ThumbnailWidth(blob []byte, width int, o Options) ([]byte, error) {
+	o.Width, o.Height, o.Crop = width, 0, false
+	return Thumbnail(blob, o)
+}
+
+// ThumbnailHeight scales a compressed image blob proportionally to the
+// given height, never upscaling.  Other than Width, Height, and Crop, the
+// Options specified in o are used.
+func ThumbnailHeight(blob []byte, height int, o Options) ([]byte, error) {
+	o.Width, o.Height, o.Crop = 0, height, false
+	return Thumbnail(blob, o)
+}
+
+// Transcode converts a compressed image blob to the format, quality, and
+// other SaveOptions specified in o.Save, keeping its original dimensions.
+// Orientation is still applied, but the Options that would resize, crop,
+// blur, or sharpen the image are ignored.
+func Transcode(blob []byte, o Options) ([]byte, error) {
+	o.Width, o.Height, o.Scale, o.MaxDimension, o.Crop, o.Region = 0, 0, 0, 0, false, Rect{}
+	o.BlurSigma, o.Sharpen = 0, ToggleOff
+	return Thumbnail(blob, o)
+}
+
+// isNoop returns true if Options o wouldn't change the pixels, format, or
+// metadata of an image with Metadata m, or ask for anything only
+// re-encoding it would do.
+func isNoop(m format.Metadata, o Options) bool {
+	return o.Width >= m.Width && o.Height >= m.Height && o.BlurSigma == 0.0 && !o.Pad &&
+		(!o.Upscale || (o.Width == m.Width && o.Height == m.Height)) &&
+		(m.Orientation == format.Undefined || m.Orientation == format.TopLeft) &&
+		(o.Save.Format == format.Unknown || o.Save.Format == m.Format) &&
+		o.Save.KeepMetadata && !o.Save.AllowWebp && o.Save.MaxBytes == 0 && o.Save.TargetSSIM == 0 &&
+		o.Save.ScanScript == "" && len(o.Save.CustomQuantTables) == 0 && o.PreviewSize == 0
 }
 
-func load(blob []byte, f format.Format, shrink int) (*vips.Image, error) {
+// isTiny returns true if an image with Metadata m is below Options o's
+// MinProcessDimension in both width and height.
+func isTiny(m format.Metadata, o Options) bool {
+	return m.Width < o.MinProcessDimension && m.Height < o.MinProcessDimension
+}
+
+func load(blob []byte, f format.Format, shrink int, page int) (*vips.Image, error) {
+	if page != 0 {
+		return f.LoadBytesPage(blob, page)
+	}
+
 	if shrink > 1 {
 		if f == format.Jpeg {
 			return vips.JpegloadBufferShrink(blob, shrink)
@@ -103,17 +480,38 @@ func load(blob []byte, f format.Format, shrink int) (*vips.Image, error) {
 	return f.LoadBytes(blob)
 }
 
-func srgb(image *vips.Image) error {
-	// Transform from embedded ICC profile if present or default profile
-	// if CMYK.  Ignore errors.
+// srgb converts an image to sRGB or grayscale.  CMYK images without an
+// embedded ICC profile are assumed to be in cmykProfile and converted to
+// rgbProfile, or the defaults if those are "".
+func srgb(image *vips.Image, cmykProfile, rgbProfile string) error {
+	// Transform from embedded ICC profile if present.  Ignore errors.
 	if image.ImageFieldExists(vips.MetaIccName) {
 		_ = image.IccTransform(sRgbFile, "", vips.IntentRelative)
-	} else if image.ImageGuessInterpretation() == vips.InterpretationCMYK {
-		_ = image.IccTransform(sRgbFile, cmykFile, vips.IntentRelative)
 	}
 
-	space := image.ImageGuessInterpretation()
-	if space != vips.InterpretationSRGB && space != vips.InterpretationBW {
+	// None of our output formats can hold CMYK, and converting it
+	// without a profile gives badly wrong colors, so if it's still CMYK,
+	// transform it from the assumed profile or fail.
+	if image.ImageGuessInterpretation() == vips.InterpretationCMYK {
+		if cmykProfile == "" {
+			cmykProfile = cmykFile
+		}
+		if rgbProfile == "" {
+			rgbProfile = sRgbFile
+		}
+		if err := image.IccTransform(rgbProfile, cmykProfile, vips.IntentRelative); err != nil {
+			return err
+		}
+	}
+
+	// Keep grayscale images, with or without alpha, as grayscale.
+	switch image.ImageGuessInterpretation() {
+	case vips.InterpretationSRGB, vips.InterpretationBW:
+	case vips.InterpretationGrey16:
+		if err := image.Colourspace(vips.InterpretationBW); err != nil {
+			return err
+		}
+	default:
 		if err := image.Colourspace(vips.InterpretationSRGB); err != nil {
 			return err
 		}
@@ -122,38 +520,68 @@ func srgb(image *vips.Image) error {
 	return nil
 }
 
-func resize(image *vips.Image, iw, ih int, fastResize bool, blurSigma float64, sharpen bool) error {
-	m := format.MetadataImage(image)
+// resizeKernels are the Kernels that resize uses, and whether it may
+// enlarge an image.
+type resizeKernels struct {
+	down, up Kernel
+	upscale  bool
+}
+
+// vipsKernels maps Kernel to the equivalent vips.Kernel.
+var vipsKernels = []vips.Kernel{
+	DefaultKernel: vips.KernelLanczos3,
+	Nearest:       vips.KernelNearest,
+	Linear:        vips.KernelLinear,
+	Cubic:         vips.KernelCubic,
+	Lanczos2:      vips.KernelLanczos2,
+	Lanczos3:      vips.KernelLanczos3,
+}
+
+func resize(image *vips.Image, iw, ih int, fastResize bool, blurSigma float64, sharpen, sharpenFirst, premultiply bool, k resizeKernels) error {
+	iw, ih = storedSize(image, iw, ih)
+	w, h := image.Xsize(), image.Ysize()
 
 	// Interpolation of RGB values with an alpha channel isn't safe
 	// unless the values are pre-multiplied. Undo this later.
 	// This also flattens fully transparent pixels to black.
-	premultiply := image.HasAlpha()
+	premultiply = premultiply && image.HasAlpha()
 	if premultiply {
 		if err := image.Premultiply(); err != nil {
 			return err
 		}
 	}
 
+	// Sharpening the original is slower, but keeps more of its detail.
+	if sharpen && sharpenFirst {
+		if err := image.MildSharpen(); err != nil {
+			return err
+		}
+	}
+
 	// A box filter will quickly get us within 2x of the final size, at some quality cost.
 	if fastResize {
 		// Shrink factors can be passed independently here, which
 		// may not be sane since Resize()'s blur and sharpening
 		// steps expect a normal aspect ratio.
-		wshrink := math.Floor(float64(m.Width) / float64(iw))
-		hshrink := math.Floor(float64(m.Height) / float64(ih))
+		wshrink := math.Floor(float64(w) / float64(iw))
+		hshrink := math.Floor(float64(h) / float64(ih))
 		if wshrink >= 2 || hshrink >= 2 {
 			// Shrink rounds down the number of pixels.
 			if err := image.Shrink(wshrink, hshrink); err != nil {
 				return err
 			}
-			m = format.MetadataImage(image)
+			w, h = image.Xsize(), image.Ysize()
 		}
 	}
 
 	// If necessary, do a high-quality resize to scale to final size.
-	if iw < m.Width || ih < m.Height {
-		if err := image.Resize(float64(iw)/float64(m.Width), float64(ih)/float64(m.Height)); err != nil {
+	enlarge := iw > w || ih > h
+	if iw < w || ih < h || (k.upscale && enlarge) {
+		kernel := k.down
+		if enlarge {
+			kernel = k.up
+		}
+		if err := image.ResizeKernel(float64(iw)/float64(w), float64(ih)/float64(h), vipsKernels[kernel]); err != nil {
 			return err
 		}
 	}
@@ -164,7 +592,7 @@ func resize(image *vips.Image, iw, ih int, fastResize bool, blurSigma float64, s
 		}
 	}
 
-	if sharpen {
+	if sharpen && !sharpenFirst {
 		if err := image.MildSharpen(); err != nil {
 			return err
 		}
@@ -180,6 +608,83 @@ func resize(image *vips.Image, iw, ih int, fastResize bool, blurSigma float64, s
 	return nil
 }
 
+// preview returns a base64-encoded low quality JPEG of image, scaled to
+// fit within size by size pixels.
+func preview(image *vips.Image, size int) (string, error) {
+	p, err := image.Copy()
+	if err != nil {
+		return "", err
+	}
+	defer p.Close()
+
+	w, h, _ := scaleAspect(p.Xsize(), p.Ysize(), size, size, true, RoundNearest)
+	if err := resize(p, w, h, true, 0, false, false, true, resizeKernels{}); err != nil {
+		return "", err
+	}
+
+	if p.ImageGetBandFormat() != vips.BandFormatUchar {
+		if err := p.Cast(vips.BandFormatUchar); err != nil {
+			return "", err
+		}
+	}
+
+	blob, err := format.Save(p, format.SaveOptions{Format: format.Jpeg, Quality: 40})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(blob), nil
+}
+
+// pad centers an image on a canvas of width by height pixels filled with
+// Color c.
+func pad(image *vips.Image, width, height int, c Color) error {
+	w, h := image.Xsize(), image.Ysize()
+	if w == width && h == height {
+		return nil
+	}
+
+	// The canvas color needs RGB bands.
+	if image.ImageGetBands() < 3 {
+		if err := image.Colourspace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+
+	background := []float64{float64(c.R), float64(c.G), float64(c.B)}
+	if image.HasAlpha() {
+		background = append(background, image.MaxAlpha())
+	}
+
+	return image.EmbedBackground((width-w)/2, (height-h)/2, width, height, background)
+}
+
+// setDPI sets the density of an image to xdpi by ydpi as displayed, which
+// is swapped if its orientation is still to be applied and rotates it by
+// 90 or 270 degrees.
+func setDPI(image *vips.Image, xdpi, ydpi float64) error {
+	if w, _ := format.DetectOrientation(image).Dimensions(1, 0); w == 0 {
+		xdpi, ydpi = ydpi, xdpi
+	}
+
+	return image.SetResolution(xdpi/format.MillimetresPerInch, ydpi/format.MillimetresPerInch)
+}
+
+// flatten removes the alpha channel of an image by blending it with Color
+// c.  Grayscale images stay grayscale if c is a shade of gray.
+func flatten(image *vips.Image, c Color) error {
+	background := []float64{float64(c.R), float64(c.G), float64(c.B)}
+	if image.ImageGetBands() < 3 {
+		if c.R == c.G && c.G == c.B {
+			background = background[:1]
+		} else if err := image.Colourspace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+
+	return image.FlattenBackground(background)
+}
+
 func crop(image *vips.Image, ow, oh int) error {
 	m := format.MetadataImage(image)
 
@@ -188,14 +693,20 @@ func crop(image *vips.Image, ow, oh int) error {
 		return nil
 	}
 
-	// Center horizontally
-	x := (m.Width - ow + 1) / 2
-	// Assume faces are higher up vertically
-	y := (m.Height - oh + 1) / 4
-
+	x, y := cropOffsets(m.Width, m.Height, ow, oh)
 	if x < 0 || y < 0 {
 		panic("Bad crop offsets!")
 	}
 
 	return image.ExtractArea(m.Orientation.Crop(ow, oh, x, y, m.Width, m.Height))
 }
+
+// cropOffsets returns where crop takes an ow by oh box from a w by h image.
+func cropOffsets(w, h, ow, oh int) (int, int) {
+	// Center horizontally
+	x := (w - ow + 1) / 2
+	// Assume faces are higher up vertically
+	y := (h - oh + 1) / 4
+
+	return x, y
+}
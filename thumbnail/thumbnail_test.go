@@ -1,14 +1,24 @@
 package thumbnail
 
 import (
+	"bytes"
+	"encoding/base64"
 	"fmt"
 	"github.com/die-net/fotomat/format"
 	"github.com/die-net/fotomat/vips"
 	"github.com/stretchr/testify/assert"
+	goimage "image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
+	"math"
 	"os"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -20,6 +30,16 @@ func TestMain(m *testing.M) {
 	os.Exit(r)
 }
 
+func TestWarmup(t *testing.T) {
+	assert.Nil(t, Warmup())
+	assert.Nil(t, Warmup())
+
+	thumb, err := Thumbnail(image("watermelon.jpg"), Options{Width: 100, Height: 100})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 75, 100, false))
+	}
+}
+
 func TestValidation(t *testing.T) {
 	// Return ErrUnknownFormat on a text file.
 	assert.Equal(t, tryNew("notimage.txt"), format.ErrUnknownFormat)
@@ -33,15 +53,42 @@ func TestValidation(t *testing.T) {
 	// Load a 2x2 pixel image.
 	assert.Nil(t, tryNew("2px.png"))
 
+	// Load a 1x1 pixel image if the minimum is lowered.
+	thumb, err := Thumbnail(image("1px.png"), Options{Width: 100, Height: 100, MinDimension: 1})
+	if assert.Nil(t, err) {
+		m, err := format.MetadataBytes(thumb)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []int{1, 1}, []int{m.Width, m.Height})
+		}
+	}
+
+	// Or refuse a 2x3 pixel image if it's raised.
+	_, err = Thumbnail(image("2px.png"), Options{MinDimension: 3})
+	assert.Equal(t, err, ErrTooSmall)
+
 	// Load a CMYK image.
 	assert.Nil(t, tryNew("cmyk.jpg"))
 
+	// Return ErrCorruptHeader on inconsistent headers.
+	assert.Equal(t, tryNew("badexif.jpg"), format.ErrCorruptHeader)
+	assert.Equal(t, tryNew("badheader.png"), format.ErrCorruptHeader)
+	_, err = Validate(image("badexif.jpg"), 0)
+	assert.Equal(t, err, format.ErrCorruptHeader)
+
+	// Unless they can be repaired, using the frame's size.
+	thumb, err = Thumbnail(image("badexif.jpg"), Options{Width: 200, Height: 200, RepairHeader: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 2, 3, false))
+	}
+	_, err = Thumbnail(image("badheader.png"), Options{Width: 200, Height: 200, RepairHeader: true})
+	assert.Equal(t, err, format.ErrCorruptHeader)
+
 	// Return ErrTooBig on a 34000x16 PNG image.
 	assert.Equal(t, tryNew("34000px.png"), ErrTooBig)
 
 	// Refuse to load a 213328 pixel JPEG image into 1000 pixel buffer.
 	// TODO: Add back MaxBufferPixels.
-	_, err := Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 300, MaxBufferPixels: 1000})
+	_, err = Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 300, MaxBufferPixels: 1000})
 	assert.Equal(t, err, ErrTooBig)
 
 	// Succeed in loading a 213328 pixel JPEG image into 10000 pixel buffer.
@@ -49,44 +96,873 @@ func TestValidation(t *testing.T) {
 	assert.Nil(t, err)
 }
 
-func tryNew(filename string) error {
-	_, err := Thumbnail(image(filename), Options{Width: 200, Height: 200})
-	return err
+func TestPreview(t *testing.T) {
+	r, err := Process(image("watermelon.jpg"), Options{Width: 200, Height: 200, PreviewSize: 20})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Nil(t, isSize(r.Blob, format.Jpeg, 149, 200, false))
+
+	preview, err := base64.StdEncoding.DecodeString(r.Preview)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(preview, format.Jpeg, 15, 20, false))
+	}
+
+	// No preview unless requested.
+	r, err = Process(image("watermelon.jpg"), Options{Width: 200, Height: 200})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "", r.Preview)
+	}
+}
+
+func TestRules(t *testing.T) {
+	// Scale originals wider than 2000 down to 2000 wide, and leave
+	// others at their own size, stripping metadata from both.
+	o := Options{Rules: []Rule{{WiderThan: 2000, Width: 2000, Height: maxDimension}}, Save: format.SaveOptions{Format: format.Jpeg}}
+
+	thumb, err := Thumbnail(image("watermelon.jpg"), o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 398, 536, false))
+	}
+
+	thumb, err = Thumbnail(image("3000px.png"), o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 2000, 1334, false))
+	}
+
+	// Rules are tried in order.
+	o.Rules = append([]Rule{{TallerThan: 500, Width: 100, Height: 100}}, o.Rules...)
+	thumb, err = Thumbnail(image("watermelon.jpg"), o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 75, 100, false))
+	}
+
+	_, err = Thumbnail(image("watermelon.jpg"), Options{Rules: []Rule{{WiderThan: -1}}})
+	assert.Equal(t, ErrBadOption, err)
+}
+
+func TestCmykProfile(t *testing.T) {
+	// Borrow the different RGB profile embedded in orient0.jpg.
+	img, err := format.Jpeg.LoadBytes(image("orient0.jpg"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	icc, ok := img.ImageGetBlob(vips.MetaIccName)
+	img.Close()
+	if !assert.True(t, ok) {
+		return
+	}
+	f, err := ioutil.TempFile("", "fotomat-rgb")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(icc)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	// cmyk.jpg has no embedded profile.
+	o := Options{Width: 200, Height: 200, Save: format.SaveOptions{Format: format.Png}}
+	def, err := Thumbnail(image("cmyk.jpg"), o)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Naming the default profiles changes nothing.
+	o.CmykProfile, o.RgbProfile = cmykFile, sRgbFile
+	same, err := Thumbnail(image("cmyk.jpg"), o)
+	if assert.Nil(t, err) {
+		assert.Equal(t, def, same)
+	}
+
+	// Another RGB profile does.
+	o.RgbProfile = f.Name()
+	other, err := Thumbnail(image("cmyk.jpg"), o)
+	if assert.Nil(t, err) {
+		assert.True(t, pngDifference(t, def, other) > 0)
+	}
+}
+
+func TestCmykToPng(t *testing.T) {
+	// A naive conversion of cmyk.jpg's own pixels to RGB, for comparison.
+	orig, err := jpeg.Decode(bytes.NewReader(image("cmyk.jpg")))
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, ok := orig.(*goimage.CMYK)
+	assert.True(t, ok)
+	want := averageRGB(orig)
+
+	// PNG can't hold CMYK, so the result must have been converted to RGB.
+	thumb, err := Thumbnail(image("cmyk.jpg"), Options{Save: format.SaveOptions{Format: format.Png}})
+	if !assert.Nil(t, err) {
+		return
+	}
+	img, err := png.Decode(bytes.NewReader(thumb))
+	if !assert.Nil(t, err) {
+		return
+	}
+	switch img.(type) {
+	case *goimage.RGBA, *goimage.NRGBA, *goimage.RGBA64, *goimage.NRGBA64:
+	default:
+		t.Errorf("CMYK to PNG gave %T, not RGB", img)
+	}
+
+	// The colors should be a similar warm brown, not CMYK values
+	// misread as RGB.
+	got := averageRGB(img)
+	assert.True(t, got[0] > got[2], "%v isn't warm", got)
+	for i := range got {
+		assert.InDelta(t, want[i], got[i], 48, "%v isn't close to %v", got, want)
+	}
+
+	// An unusable CMYK profile is an error, not a guess.
+	_, err = Thumbnail(image("cmyk.jpg"), Options{CmykProfile: "/nonexistent.icc", Save: format.SaveOptions{Format: format.Png}})
+	assert.NotNil(t, err)
+}
+
+// averageRGB returns the average 8-bit red, green, and blue of img.
+func averageRGB(img goimage.Image) [3]float64 {
+	var sum [3]float64
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			sum[0] += float64(c.R)
+			sum[1] += float64(c.G)
+			sum[2] += float64(c.B)
+		}
+	}
+	n := float64(b.Dx() * b.Dy())
+	return [3]float64{sum[0] / n, sum[1] / n, sum[2] / n}
+}
+
+func TestUpscale(t *testing.T) {
+	// Without Upscale, images are never enlarged.
+	o := Options{Width: 20, Height: 30, Save: format.SaveOptions{Format: format.Png}}
+	thumb, err := Thumbnail(image("2px.png"), o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 2, 3, false))
+	}
+
+	o.Upscale = true
+	o.UpscaleKernel = Nearest
+	nearest, err := Thumbnail(image("2px.png"), o)
+	if !assert.Nil(t, err) || !assert.Nil(t, isSize(nearest, format.Png, 20, 30, false)) {
+		return
+	}
+	o.UpscaleKernel = Cubic
+	smooth, err := Thumbnail(image("2px.png"), o)
+	if !assert.Nil(t, err) || !assert.Nil(t, isSize(smooth, format.Png, 20, 30, false)) {
+		return
+	}
+
+	// Nearest neighbour only repeats the original's colors, where a
+	// smooth kernel blends them at the edges between pixels.
+	orig, err := png.Decode(bytes.NewReader(image("2px.png")))
+	if !assert.Nil(t, err) {
+		return
+	}
+	colors := map[color.RGBA]bool{}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 2; x++ {
+			colors[color.RGBAModel.Convert(orig.At(x, y)).(color.RGBA)] = true
+		}
+	}
+	blended := func(blob []byte) int {
+		img, err := png.Decode(bytes.NewReader(blob))
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		n := 0
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if !colors[color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)] {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	assert.Equal(t, 0, blended(nearest))
+	assert.True(t, blended(smooth) > 0)
+	assert.True(t, pngDifference(t, nearest, smooth) > 1)
+
+	// Crop fills the requested size.
+	o.Crop = true
+	o.Width, o.Height = 40, 40
+	thumb, err = Thumbnail(image("2px.png"), o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 40, 40, false))
+	}
+
+	// Downscaling is unaffected by UpscaleKernel, but not DownscaleKernel.
+	o = Options{Width: 100, Height: 100, Save: format.SaveOptions{Format: format.Png}}
+	def, err := Thumbnail(image("watermelon.jpg"), o)
+	if !assert.Nil(t, err) {
+		return
+	}
+	o.Upscale, o.UpscaleKernel = true, Nearest
+	same, err := Thumbnail(image("watermelon.jpg"), o)
+	if assert.Nil(t, err) {
+		assert.Equal(t, def, same)
+	}
+	o.DownscaleKernel = Nearest
+	other, err := Thumbnail(image("watermelon.jpg"), o)
+	if assert.Nil(t, err) {
+		assert.True(t, pngDifference(t, def, other) > 0)
+	}
+
+	// Upscaling is limited by MaxBufferPixels too.
+	_, err = Thumbnail(image("2px.png"), Options{Width: 2000, Height: 3000, Upscale: true, MaxBufferPixels: 1000000})
+	assert.Equal(t, ErrTooBig, err)
+
+	_, err = Thumbnail(image("2px.png"), Options{Width: 20, Height: 30, UpscaleKernel: Lanczos3 + 1})
+	assert.Equal(t, ErrBadOption, err)
+}
+
+func TestPremultiply(t *testing.T) {
+	// Opaque red on the left, and transparent black on the right.
+	edge := goimage.NewNRGBA(goimage.Rect(0, 0, 101, 100))
+	draw.Draw(edge, goimage.Rect(0, 0, 50, 100), &goimage.Uniform{color.NRGBA{255, 0, 0, 255}}, goimage.ZP, draw.Src)
+	var buf bytes.Buffer
+	if !assert.Nil(t, png.Encode(&buf, edge)) {
+		return
+	}
+
+	// darkest returns the lowest red of any visible pixel.
+	darkest := func(o Options) uint8 {
+		thumb, err := Thumbnail(buf.Bytes(), o)
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		img, err := png.Decode(bytes.NewReader(thumb))
+		if !assert.Nil(t, err) {
+			return 0
+		}
+
+		min := uint8(255)
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA); c.A > 0 && c.R < min {
+					min = c.R
+				}
+			}
+		}
+		return min
+	}
+
+	o := Options{Width: 30, Height: 30, Save: format.SaveOptions{Format: format.Png}}
+	assert.True(t, darkest(o) >= 250, "dark fringe")
+
+	// Claiming the colors are already premultiplied leaves a fringe.
+	o.Premultiplied = true
+	assert.True(t, darkest(o) < 200, "no fringe")
+}
+
+func TestMemoryLimit(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	// A preview buffers the whole 149x200 thumbnail in memory, far more
+	// than 1KB.
+	_, err := Process(img, Options{Width: 200, Height: 200, PreviewSize: 20, MaxMemory: 1024})
+	assert.Equal(t, ErrMemoryLimit, err)
+
+	_, err = Process(img, Options{Width: 200, Height: 200, PreviewSize: 20, MaxMemory: 1 << 30})
+	assert.Nil(t, err)
+
+	_, err = Process(img, Options{Width: 200, Height: 200, MaxMemory: -1})
+	assert.Equal(t, ErrBadOption, err)
+}
+
+func TestProcessImage(t *testing.T) {
+	img, err := ProcessImage(image("watermelon.jpg"), Options{Width: 200, Height: 200, Crop: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer img.Close()
+	assert.Equal(t, 200, img.Xsize())
+	assert.Equal(t, 200, img.Ysize())
+
+	// Chain another operation, and encode it by hand.
+	assert.Nil(t, img.ExtractArea(0, 0, 100, 50))
+	blob, err := img.PngsaveBuffer(true, 6, false, 0, 0)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(blob, format.Png, 100, 50, false))
+	}
+
+	// Options that don't produce an Image are ignored.
+	fit, err := ProcessImage(image("watermelon.jpg"), Options{Width: 200, Height: 200, PassThrough: true})
+	if assert.Nil(t, err) {
+		assert.Equal(t, 149, fit.Xsize())
+		fit.Close()
+	}
+}
+
+func TestLossless(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	for _, save := range []format.SaveOptions{
+		{Format: format.Png},
+		{Format: format.Webp, Lossless: true},
+		{Format: format.Jpeg},
+		{Format: format.Webp},
+	} {
+		r, err := Process(img, Options{Width: 200, Height: 200, Save: save})
+		if assert.Nil(t, err) {
+			assert.Equal(t, save.Lossless || save.Format == format.Png, r.Lossless, "%+v", save)
+		}
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	thumb, err := Thumbnail(img, Options{Width: 200, Height: 200, Save: format.SaveOptions{Quality: 100, MaxBytes: 8192}})
+	if assert.Nil(t, err) {
+		assert.True(t, len(thumb) <= 8192, "%d bytes", len(thumb))
+		assert.Nil(t, isSize(thumb, format.Jpeg, 149, 200, false))
+	}
+
+	thumb, err = Thumbnail(img, Options{Width: 200, Height: 200, Save: format.SaveOptions{AllowWebp: true, Quality: 100, MaxBytes: 8192}})
+	if assert.Nil(t, err) {
+		assert.True(t, len(thumb) <= 8192, "%d bytes", len(thumb))
+		assert.Nil(t, isSize(thumb, format.Webp, 149, 200, false))
+	}
+
+	// Even the lowest quality doesn't fit in 100 bytes.
+	_, err = Thumbnail(img, Options{Width: 200, Height: 200, Save: format.SaveOptions{MaxBytes: 100}})
+	assert.Equal(t, format.ErrMaxBytes, err)
+
+	// A quality floor fails rather than going below it.
+	_, err = Thumbnail(img, Options{Width: 200, Height: 200, Save: format.SaveOptions{Quality: 100, MinQuality: 80, MaxBytes: 2048}})
+	assert.Equal(t, format.ErrMaxBytes, err)
+
+	_, err = Thumbnail(img, Options{Width: 200, Height: 200, Save: format.SaveOptions{MinQuality: 101, MaxBytes: 8192}})
+	assert.Equal(t, format.ErrInvalidMinQuality, err)
+
+	// Nor does a lossless PNG.
+	_, err = Thumbnail(img, Options{Width: 200, Height: 200, Save: format.SaveOptions{Format: format.Png, MaxBytes: 8192}})
+	assert.Equal(t, format.ErrMaxBytes, err)
+}
+
+func TestStrictFormat(t *testing.T) {
+	// The original's format is kept if possible, rather than becoming PNG.
+	thumb, err := Thumbnail(redGif(t), Options{Width: 50, Height: 50, StrictFormat: true})
+	if format.Gif.CanSave() {
+		if assert.Nil(t, err) {
+			assert.Nil(t, isSize(thumb, format.Gif, 50, 50, false))
+		}
+	} else {
+		assert.Equal(t, ErrUnsupportedConversion, err)
+	}
+
+	thumb, err = Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 200, StrictFormat: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 149, 200, false))
+	}
+
+	// A requested format is honored or fails.
+	thumb, err = Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 200, StrictFormat: true, Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 149, 200, false))
+	}
+
+	_, err = Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 200, StrictFormat: true, Save: format.SaveOptions{Format: format.Avif}})
+	assert.Equal(t, ErrUnsupportedConversion, err)
+}
+
+func TestInputFormat(t *testing.T) {
+	img := image("2px.png")
+
+	thumb, err := Thumbnail(img, Options{Width: 100, Height: 100, InputFormat: format.Png, Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 2, 3, false))
+	}
+
+	_, err = Thumbnail(img, Options{Width: 100, Height: 100, InputFormat: format.Jpeg})
+	assert.Equal(t, format.ErrUnknownFormat, err)
+
+	_, err = Thumbnail(img, Options{Width: 100, Height: 100, InputFormat: format.Webp})
+	assert.Equal(t, format.ErrUnknownFormat, err)
+}
+
+func TestPage(t *testing.T) {
+	// A two frame GIF: red, then blue.
+	anim := gif.GIF{}
+	for _, c := range []color.Color{color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}} {
+		frame := goimage.NewPaletted(goimage.Rect(0, 0, 20, 10), color.Palette{c})
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, gif.EncodeAll(&buf, &anim)) {
+		return
+	}
+	img := buf.Bytes()
+
+	m, err := format.MetadataBytes(img)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 2, m.Pages)
+	}
+
+	o := Options{Width: 100, Height: 100, Save: format.SaveOptions{Format: format.Png}}
+	thumb, err := Thumbnail(img, o)
+	if assert.Nil(t, err) {
+		assert.True(t, isRed(t, thumb, 5, 5, 0))
+	}
+
+	o.Page = 1
+	thumb, err = Thumbnail(img, o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 20, 10, false))
+		out, err := png.Decode(bytes.NewReader(thumb))
+		if assert.Nil(t, err) {
+			r, g, b, _ := out.At(5, 5).RGBA()
+			assert.True(t, r == 0 && g == 0 && b == 0xffff, "second frame should be blue")
+		}
+	}
+
+	o.Page = 2
+	_, err = Thumbnail(img, o)
+	assert.Equal(t, PageError{Page: 2, Pages: 2}, err)
+
+	o.Page = -1
+	_, err = Thumbnail(img, o)
+	assert.Equal(t, ErrBadOption, err)
+
+	// Still images only have one page.
+	_, err = Thumbnail(image("2px.png"), Options{Width: 100, Height: 100, Page: 1})
+	assert.Equal(t, PageError{Page: 1, Pages: 1}, err)
+
+	// A two page TIFF: red, then blue, once TIFF loading is enabled.
+	tiff := image("2page.tif")
+	o.Page = 0
+	_, err = Thumbnail(tiff, o)
+	assert.Equal(t, format.ErrLoaderUnavailable, err)
+
+	format.LoadTiff = true
+	defer func() { format.LoadTiff = false }()
+
+	m, err = format.MetadataBytes(tiff)
+	if assert.Nil(t, err) {
+		assert.Equal(t, format.Tiff, m.Format)
+		assert.Equal(t, 2, m.Pages)
+	}
+
+	thumb, err = Thumbnail(tiff, o)
+	if assert.Nil(t, err) {
+		assert.True(t, isRed(t, thumb, 5, 5, 0))
+	}
+
+	o.Page = 1
+	thumb, err = Thumbnail(tiff, o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 20, 10, false))
+		assert.False(t, isRed(t, thumb, 5, 5, 0), "second page should differ")
+	}
+
+	o.Page = 2
+	_, err = Thumbnail(tiff, o)
+	assert.Equal(t, PageError{Page: 2, Pages: 2}, err)
+}
+
+func TestKeepFormat(t *testing.T) {
+	img := redGif(t)
+
+	// Normally GIFs are converted.
+	thumb, err := Thumbnail(img, Options{Width: 50, Height: 50})
+	if assert.Nil(t, err) {
+		assert.Equal(t, format.Png, format.DetectFormat(thumb))
+	}
+
+	// But they can't be kept as GIF if VIPS can't save them.
+	if !format.Gif.CanSave() {
+		t.Skip("VIPS can't save GIF")
+	}
+
+	thumb, err = Thumbnail(img, Options{Width: 50, Height: 50, KeepFormat: true})
+	if assert.Nil(t, err) {
+		m, err := format.MetadataBytes(thumb)
+		if assert.Nil(t, err) {
+			assert.Equal(t, format.Gif, m.Format)
+			assert.Equal(t, []int{50, 50}, []int{m.Width, m.Height})
+		}
+	}
+
+	// Other formats are kept too, even when they'd otherwise be
+	// converted.
+	thumb, err = Thumbnail(image("watermelon.jpg"), Options{Width: 100, Height: 100, KeepFormat: true, Save: format.SaveOptions{AllowWebp: true}})
+	if assert.Nil(t, err) {
+		assert.Equal(t, format.Jpeg, format.DetectFormat(thumb))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	m, err := Validate(image("watermelon.jpg"), 0)
+	if assert.Nil(t, err) {
+		assert.Equal(t, format.Jpeg, m.Format)
+		assert.Equal(t, 398, m.Width)
+		assert.Equal(t, 536, m.Height)
+	}
+
+	_, err = Validate(image("notimage.txt"), 0)
+	assert.Equal(t, format.ErrUnknownFormat, err)
+
+	m, err = Validate(image("1px.png"), 0)
+	assert.Equal(t, ErrTooSmall, err)
+	assert.Equal(t, []int{1, 1}, []int{m.Width, m.Height})
+
+	// Metadata is still returned for images that are too big.
+	m, err = Validate(image("34000px.png"), 0)
+	assert.Equal(t, ErrTooBig, err)
+	assert.Equal(t, format.Png, m.Format)
+	assert.Equal(t, []int{34000, 16}, []int{m.Width, m.Height})
+
+	_, err = Validate(image("watermelon.jpg"), 1000)
+	assert.Equal(t, ErrTooBig, err)
+}
+
+func tryNew(filename string) error {
+	_, err := Thumbnail(image(filename), Options{Width: 200, Height: 200})
+	return err
+}
+
+func TestThumbnail(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	m, err := format.MetadataBytes(img)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, m.Width, 398)
+	assert.Equal(t, m.Height, 536)
+
+	// Verify scaling down to fit completely into box.
+	thumb, err := Thumbnail(img, Options{Width: 200, Height: 300})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 200, 270, false))
+	}
+
+	// Verify scaling down to have width fit.
+	thumb, err = Thumbnail(img, Options{Width: 200})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 200, 270, false))
+	}
+
+	// Verify scaling down to have height fit.
+	thumb, err = Thumbnail(img, Options{Height: 300})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 223, 300, false))
+	}
+
+	// Verify that we don't scale up.
+	thumb, err = Thumbnail(img, Options{Width: 2048, Height: 2048})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 398, 536, false))
+	}
+}
+
+func TestMaxAspectRatio(t *testing.T) {
+	_, err := Thumbnail(image("34000px.png"), Options{Width: 100, Height: 100, MaxAspectRatio: 20, MaxBufferPixels: 1000000})
+	assert.Equal(t, err, ErrBadAspectRatio)
+
+	thumb, err := Thumbnail(image("watermelon.jpg"), Options{Width: 100, Height: 100, MaxAspectRatio: 20})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 75, 100, false))
+	}
+}
+
+func TestThumbnailWidthHeight(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	// Verify scaling proportionally to a width.
+	thumb, err := ThumbnailWidth(img, 199, Options{})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 199, 268, false))
+	}
+
+	// Verify scaling proportionally to a height.
+	thumb, err = ThumbnailHeight(img, 268, Options{})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 199, 268, false))
+	}
+
+	// Verify that neither scales up.
+	thumb, err = ThumbnailWidth(img, 1000, Options{})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 398, 536, false))
+	}
+	thumb, err = ThumbnailHeight(img, 1000, Options{})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 398, 536, false))
+	}
+}
+
+func TestScale(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	// Scale replaces Width and Height.
+	thumb, err := Thumbnail(img, Options{Width: 10, Height: 10, Scale: 0.5})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 199, 268, false))
+	}
+
+	// Never scale up.
+	thumb, err = Thumbnail(img, Options{Scale: 2})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 398, 536, false))
+	}
+
+	// The pixel budget still applies.
+	_, err = Thumbnail(img, Options{Scale: 0.5, MaxBufferPixels: 1000})
+	assert.Equal(t, ErrTooBig, err)
+
+	_, err = Thumbnail(img, Options{Scale: -1})
+	assert.Equal(t, ErrBadOption, err)
+}
+
+func TestProcessTimings(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	start := time.Now()
+	r, err := Process(img, Options{Width: 200, Height: 200})
+	elapsed := time.Since(start)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Nil(t, isSize(r.Blob, format.Jpeg, 149, 200, false))
+	assert.True(t, r.Timings.Load > 0)
+	assert.True(t, r.Timings.Transform > 0)
+	assert.True(t, r.Timings.Encode > 0)
+
+	// Stages should account for most of the time taken.
+	assert.True(t, r.Timings.Total() <= elapsed)
+	assert.True(t, r.Timings.Total() >= elapsed/2)
+}
+
+func TestTranscode(t *testing.T) {
+	img := image("flowers.png")
+
+	thumb, err := Transcode(img, Options{Width: 100, Crop: true, Save: format.SaveOptions{Format: format.Jpeg, Quality: 90}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 256, 169, false))
+	}
+
+	thumb, err = Transcode(image("watermelon.jpg"), Options{Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 398, 536, false))
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	// Requesting the source dimensions returns the original bytes, if
+	// its metadata may be kept.
+	keep := format.SaveOptions{KeepMetadata: true}
+	thumb, err := Thumbnail(img, Options{Width: 398, Height: 536, PassThrough: true, Save: keep})
+	if assert.Nil(t, err) {
+		assert.Equal(t, img, thumb)
+	}
+
+	// As does requesting larger dimensions and the same format.
+	thumb, err = Thumbnail(img, Options{Width: 2048, Height: 2048, PassThrough: true, Save: format.SaveOptions{Format: format.Jpeg, KeepMetadata: true}})
+	if assert.Nil(t, err) {
+		assert.Equal(t, img, thumb)
+	}
+
+	// Without PassThrough, the image is re-encoded.
+	thumb, err = Thumbnail(img, Options{Width: 398, Height: 536})
+	if assert.Nil(t, err) {
+		assert.NotEqual(t, img, thumb)
+	}
+
+	// Resizing, blurring, format changes, stripping metadata, and
+	// anything only an encoder does all require re-encoding.
+	for _, o := range []Options{
+		{Width: 200, Height: 300, PassThrough: true, Save: keep},
+		{Width: 398, Height: 536, BlurSigma: 0.5, PassThrough: true, Save: keep},
+		{Width: 398, Height: 536, PassThrough: true, Save: format.SaveOptions{Format: format.Png, KeepMetadata: true}},
+		{Width: 398, Height: 536, PassThrough: true},
+		{Width: 398, Height: 536, PassThrough: true, Save: format.SaveOptions{KeepMetadata: true, AllowWebp: true}},
+		{Width: 398, Height: 536, PassThrough: true, Save: format.SaveOptions{KeepMetadata: true, MaxBytes: 1 << 20}},
+		{Width: 398, Height: 536, PassThrough: true, Save: format.SaveOptions{KeepMetadata: true, TargetSSIM: 0.99}},
+		{Width: 398, Height: 536, PassThrough: true, PreviewSize: 16, Save: keep},
+	} {
+		thumb, err = Thumbnail(img, o)
+		if assert.Nil(t, err) {
+			assert.NotEqual(t, img, thumb)
+		}
+	}
+
+	// Rotation requires re-encoding.
+	img = image("orient6.jpg")
+	thumb, err = Thumbnail(img, Options{Width: 48, Height: 80, PassThrough: true, Save: keep})
+	if assert.Nil(t, err) {
+		assert.NotEqual(t, img, thumb)
+		assert.Nil(t, isSize(thumb, format.Jpeg, 48, 80, false))
+	}
+}
+
+func TestMinProcessDimension(t *testing.T) {
+	// A 2x2 PNG.
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, png.Encode(&buf, goimage.NewGray(goimage.Rect(0, 0, 2, 2)))) {
+		return
+	}
+	img := buf.Bytes()
+
+	// Below the threshold, the original is returned, even if a
+	// different format is requested.
+	thumb, err := Thumbnail(img, Options{MinProcessDimension: 16, Save: format.SaveOptions{Format: format.Jpeg}})
+	if assert.Nil(t, err) {
+		assert.Equal(t, img, thumb)
+	}
+
+	// At or above it, the image is processed as usual.
+	thumb, err = Thumbnail(img, Options{MinProcessDimension: 2, Save: format.SaveOptions{Format: format.Jpeg}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 2, 2, false))
+	}
+
+	// Only tiny images are returned unchanged.
+	img = image("watermelon.jpg")
+	thumb, err = Thumbnail(img, Options{Width: 398, Height: 536, MinProcessDimension: 100})
+	if assert.Nil(t, err) {
+		assert.NotEqual(t, img, thumb)
+	}
+}
+
+func TestMaxDimension(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	// 398x536 capped to 400 on the longest side is 297.01x400, which
+	// RoundNearest rounds to 297.
+	thumb, err := Thumbnail(img, Options{MaxDimension: 400, Rounding: RoundNearest})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 297, 400, false))
+	}
+
+	// And the default RoundUp rounds to 298, never losing a partial
+	// column.
+	thumb, err = Thumbnail(img, Options{MaxDimension: 400})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 298, 400, false))
+	}
+
+	// Never upscale.
+	thumb, err = Thumbnail(img, Options{MaxDimension: 1000})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 398, 536, false))
+	}
+}
+
+func TestMaxMegapixels(t *testing.T) {
+	img := image("3000px.png")
+
+	// 3000x2000 is 6 megapixels, so it has to shrink to fit 0.1.
+	for _, o := range []Options{
+		{MaxMegapixels: 0.1},
+		{Width: 2000, Height: 2000, MaxMegapixels: 0.1},
+		{Width: 1000, Height: 1000, Crop: true, MaxMegapixels: 0.1},
+	} {
+		thumb, err := Thumbnail(img, o)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		m, err := format.MetadataBytes(thumb)
+		if assert.Nil(t, err) {
+			assert.True(t, m.Width*m.Height <= 100000, "%dx%d", m.Width, m.Height)
+			assert.True(t, m.Width*m.Height > 95000, "%dx%d", m.Width, m.Height)
+			if !o.Crop {
+				assert.InDelta(t, 1.5, float64(m.Width)/float64(m.Height), 0.01)
+			}
+		}
+	}
+}
+
+func TestRounding(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	// 398x536 scaled to 200 wide is 269.35 high; to 100 wide is 134.67 high.
+	for _, r := range []struct {
+		rounding Rounding
+		h200     int
+		h100     int
+	}{
+		{RoundUp, 270, 135},
+		{RoundDown, 269, 134},
+		{RoundNearest, 269, 135},
+	} {
+		thumb, err := ThumbnailWidth(img, 200, Options{Rounding: r.rounding})
+		if assert.Nil(t, err) {
+			assert.Nil(t, isSize(thumb, format.Jpeg, 200, r.h200, false), "rounding: %d", r.rounding)
+		}
+
+		thumb, err = ThumbnailWidth(img, 100, Options{Rounding: r.rounding})
+		if assert.Nil(t, err) {
+			assert.Nil(t, isSize(thumb, format.Jpeg, 100, r.h100, false), "rounding: %d", r.rounding)
+		}
+	}
 }
 
-func TestThumbnail(t *testing.T) {
-	img := image("watermelon.jpg")
+func TestLinearProcessing(t *testing.T) {
+	// A 64x64 black and white checkerboard of single pixels.
+	checker := goimage.NewGray(goimage.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if (x+y)%2 == 0 {
+				checker.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, png.Encode(&buf, checker)) {
+		return
+	}
 
-	m, err := format.MetadataBytes(img)
+	gamma, err := averageGray(buf.Bytes(), Options{Width: 16, Height: 16})
 	if !assert.Nil(t, err) {
 		return
 	}
-	assert.Equal(t, m.Width, 398)
-	assert.Equal(t, m.Height, 536)
-
-	// Verify scaling down to fit completely into box.
-	thumb, err := Thumbnail(img, Options{Width: 200, Height: 300})
-	if assert.Nil(t, err) {
-		assert.Nil(t, isSize(thumb, format.Jpeg, 200, 270, false))
+	linear, err := averageGray(buf.Bytes(), Options{Width: 16, Height: 16, LinearProcessing: true})
+	if !assert.Nil(t, err) {
+		return
 	}
 
-	// Verify scaling down to have width fit.
-	thumb, err = Thumbnail(img, Options{Width: 200})
-	if assert.Nil(t, err) {
-		assert.Nil(t, isSize(thumb, format.Jpeg, 200, 270, false))
+	// Half of the light, averaged in gamma space, is 50% grey or ~128.
+	// In linear light, it should be ~188 once gamma-encoded again.
+	assert.InDelta(t, gamma, 128, 8)
+	assert.InDelta(t, linear, 188, 8)
+}
+
+// averageGray thumbnails a blob to PNG and returns its average grey level.
+func averageGray(blob []byte, o Options) (float64, error) {
+	o.Save.Format = format.Png
+	thumb, err := Thumbnail(blob, o)
+	if err != nil {
+		return 0, err
 	}
 
-	// Verify scaling down to have height fit.
-	thumb, err = Thumbnail(img, Options{Height: 300})
-	if assert.Nil(t, err) {
-		assert.Nil(t, isSize(thumb, format.Jpeg, 223, 300, false))
+	img, err := png.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		return 0, err
 	}
 
-	// Verify that we don't scale up.
-	thumb, err = Thumbnail(img, Options{Width: 2048, Height: 2048})
-	if assert.Nil(t, err) {
-		assert.Nil(t, isSize(thumb, format.Jpeg, 398, 536, false))
+	b := img.Bounds()
+	sum := 0.0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			sum += float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+		}
 	}
+
+	return sum / float64(b.Dx()*b.Dy()), nil
 }
 
 func TestCrop(t *testing.T) {
@@ -116,6 +992,85 @@ func TestCrop(t *testing.T) {
 	}
 }
 
+func TestOutside(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	// Scale to cover the box, without cropping the width.
+	thumb, err := Thumbnail(img, Options{Width: 200, Height: 300, Outside: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 223, 300, false))
+	}
+
+	// Never scale up.
+	thumb, err = Thumbnail(img, Options{Width: 2000, Height: 1500, Outside: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 398, 536, false))
+	}
+
+	_, err = Thumbnail(img, Options{Width: 200, Height: 300, Outside: true, Crop: true})
+	assert.Equal(t, ErrBadOption, err)
+}
+
+func TestPad(t *testing.T) {
+	red, err := ParseColor("#ff0000")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// 398x536 scales to 75x100, centered with 12 and 13 pixel bars.
+	thumb, err := Thumbnail(image("watermelon.jpg"), Options{Width: 100, Height: 100, Pad: true, Background: red, Save: format.SaveOptions{Format: format.Png}})
+	if !assert.Nil(t, err) || !assert.Nil(t, isSize(thumb, format.Png, 100, 100, false)) {
+		return
+	}
+
+	img, err := png.Decode(bytes.NewReader(thumb))
+	if assert.Nil(t, err) {
+		for _, x := range []int{0, 11, 88, 99} {
+			r, g, b, _ := img.At(x, 50).RGBA()
+			assert.Equal(t, []uint32{0xffff, 0, 0}, []uint32{r, g, b}, "x: %d", x)
+		}
+		r, g, b, _ := img.At(50, 50).RGBA()
+		assert.NotEqual(t, []uint32{0xffff, 0, 0}, []uint32{r, g, b})
+	}
+}
+
+func TestMaxCropFraction(t *testing.T) {
+	red := Color{R: 255}
+	img := image("watermelon.jpg")
+
+	// Cropping 398x536 to fill 100x100 trims 25.7% of the height, so is
+	// allowed with 30%, and there is no padding.
+	thumb, err := Thumbnail(img, Options{Width: 100, Height: 100, Pad: true, Background: red, MaxCropFraction: 0.3, Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) && assert.Nil(t, isSize(thumb, format.Png, 100, 100, false)) {
+		assert.False(t, isRed(t, thumb, 0, 50, 0))
+		assert.False(t, isRed(t, thumb, 99, 50, 0))
+	}
+
+	// With 10%, it's trimmed to 398x483, scaled to 83x100, and padded.
+	thumb, err = Thumbnail(img, Options{Width: 100, Height: 100, Pad: true, Background: red, MaxCropFraction: 0.1, Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) && assert.Nil(t, isSize(thumb, format.Png, 100, 100, false)) {
+		assert.True(t, isRed(t, thumb, 0, 50, 0))
+		assert.True(t, isRed(t, thumb, 7, 50, 0))
+		assert.False(t, isRed(t, thumb, 50, 50, 0))
+		assert.True(t, isRed(t, thumb, 99, 50, 0))
+	}
+
+	_, err = Thumbnail(img, Options{Width: 100, Height: 100, Pad: true, MaxCropFraction: 1})
+	assert.Equal(t, err, ErrBadOption)
+}
+
+// isRed returns true if the pixel at x, y of a PNG is red, with each
+// channel within tolerance (0-0xffff) of pure red.
+func isRed(t *testing.T, blob []byte, x, y int, tolerance uint32) bool {
+	img, err := png.Decode(bytes.NewReader(blob))
+	if !assert.Nil(t, err) {
+		return false
+	}
+
+	r, g, b, _ := img.At(x, y).RGBA()
+	return r >= 0xffff-tolerance && g <= tolerance && b <= tolerance
+}
+
 func TestBlurSharpen(t *testing.T) {
 	img := image("watermelon.jpg")
 
@@ -128,13 +1083,92 @@ func TestBlurSharpen(t *testing.T) {
 		assert.True(t, len(thumb) < l) // Blurry photos will be smaller
 	}
 
-	thumb, err = Thumbnail(img, Options{Width: 300, Height: 400, Sharpen: true})
+	thumb, err = Thumbnail(img, Options{Width: 300, Height: 400, Sharpen: ToggleOn})
 	assert.Nil(t, err)
 	if assert.Nil(t, err) {
 		assert.True(t, len(thumb) > l) // Sharpened photos will be larger
 	}
 }
 
+func TestSharpenBeforeResize(t *testing.T) {
+	img := image("flowers.png")
+	o := Options{Width: 100, Height: 100, Sharpen: ToggleOn, Save: format.SaveOptions{Format: format.Png}}
+
+	after, err := Thumbnail(img, o)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	o.SharpenBeforeResize = true
+	before, err := Thumbnail(img, o)
+	if assert.Nil(t, err) {
+		assert.NotEqual(t, after, before)
+	}
+
+	// Without Sharpen, the order doesn't matter.
+	o.Sharpen = ToggleDefault
+	unsharp, err := Thumbnail(img, o)
+	if assert.Nil(t, err) {
+		o.SharpenBeforeResize = false
+		plain, err := Thumbnail(img, o)
+		if assert.Nil(t, err) {
+			assert.Equal(t, plain, unsharp)
+		}
+	}
+}
+
+func TestPreset(t *testing.T) {
+	img := image("flowers.png")
+	o := Options{Width: 200, Height: 200, Save: format.SaveOptions{Format: format.Png}}
+
+	o.Preset = PresetFast
+	fast, err := Thumbnail(img, o)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	o.Preset = PresetBest
+	best, err := Thumbnail(img, o)
+	if assert.Nil(t, err) {
+		assert.True(t, len(fast) > len(best), "fast %d, best %d", len(fast), len(best))
+	}
+
+	// Options that are set override the preset.
+	m, err := format.MetadataBytes(img)
+	if !assert.Nil(t, err) {
+		return
+	}
+	checked, err := Options{Preset: PresetFast, DownscaleKernel: Cubic}.Check(m)
+	if assert.Nil(t, err) {
+		assert.Equal(t, Cubic, checked.DownscaleKernel)
+		assert.Equal(t, 1, checked.Save.Compression)
+		assert.Equal(t, ToggleOn, checked.FastResize)
+		assert.Equal(t, format.Subsample420, checked.Save.Subsampling)
+	}
+	checked, err = Options{Preset: PresetBest, Save: format.SaveOptions{Compression: 3}}.Check(m)
+	if assert.Nil(t, err) {
+		assert.Equal(t, Lanczos3, checked.DownscaleKernel)
+		assert.Equal(t, 3, checked.Save.Compression)
+		assert.Equal(t, ToggleOn, checked.Sharpen)
+		assert.Equal(t, format.Subsample444, checked.Save.Subsampling)
+		assert.True(t, checked.Save.SmallJpeg)
+	}
+
+	// Including turning off what the preset would turn on.
+	checked, err = Options{Preset: PresetBest, Sharpen: ToggleOff, Save: format.SaveOptions{Subsampling: format.Subsample420}}.Check(m)
+	if assert.Nil(t, err) {
+		assert.Equal(t, ToggleOff, checked.Sharpen)
+		assert.Equal(t, format.Subsample420, checked.Save.Subsampling)
+	}
+	checked, err = Options{Preset: PresetFast, FastResize: ToggleOff}.Check(m)
+	if assert.Nil(t, err) {
+		assert.Equal(t, ToggleOff, checked.FastResize)
+	}
+
+	_, err = Options{Preset: PresetBest + 1}.Check(m)
+	assert.Equal(t, ErrBadOption, err)
+}
+
 func TestAlpha(t *testing.T) {
 	img := image("noalpha.png")
 	assert.Nil(t, isSize(img, format.Png, 100, 50, true))
@@ -155,6 +1189,47 @@ func TestAlpha(t *testing.T) {
 	}
 }
 
+func TestGrayAlpha(t *testing.T) {
+	// 100x100 light gray, with the right half fully transparent.
+	img := image("grayalpha.png")
+	assert.Nil(t, isSize(img, format.Png, 100, 100, true))
+
+	// PNG stays grayscale with alpha (IHDR color type 4).
+	thumb, err := Thumbnail(img, Options{Width: 50, Height: 50})
+	if assert.Nil(t, err) && assert.Nil(t, isSize(thumb, format.Png, 50, 50, true)) {
+		assert.Equal(t, byte(4), thumb[25])
+
+		out, err := png.Decode(bytes.NewReader(thumb))
+		if assert.Nil(t, err) {
+			_, _, _, a := out.At(10, 25).RGBA()
+			assert.Equal(t, uint32(0xffff), a)
+			_, _, _, a = out.At(40, 25).RGBA()
+			assert.Equal(t, uint32(0), a)
+		}
+	}
+
+	// JPEG is flattened onto the background.
+	for _, bg := range []Color{{255, 255, 255}, {255, 0, 0}} {
+		thumb, err = Thumbnail(img, Options{Width: 50, Height: 50, Background: bg, Save: format.SaveOptions{Format: format.Jpeg}})
+		if !assert.Nil(t, err) || !assert.Nil(t, isSize(thumb, format.Jpeg, 50, 50, false)) {
+			continue
+		}
+
+		out, err := jpeg.Decode(bytes.NewReader(thumb))
+		if assert.Nil(t, err) {
+			for _, p := range []struct {
+				x int
+				c Color
+			}{{10, Color{200, 200, 200}}, {40, bg}} {
+				r, g, b, _ := out.At(p.x, 25).RGBA()
+				assert.InDelta(t, float64(p.c.R), float64(r>>8), 8, "x: %d", p.x)
+				assert.InDelta(t, float64(p.c.G), float64(g>>8), 8, "x: %d", p.x)
+				assert.InDelta(t, float64(p.c.B), float64(b>>8), 8, "x: %d", p.x)
+			}
+		}
+	}
+}
+
 func TestRotation(t *testing.T) {
 	for i := 0; i <= 8; i++ {
 		// Verify that New() correctly translates dimensions.
@@ -173,8 +1248,239 @@ func TestRotation(t *testing.T) {
 			assert.Nil(t, isSize(thumb, format.Jpeg, 24, 40, false))
 		}
 
-		// TODO: Figure out how to test crop.
+		// Verify that cropping takes the same region of the F, whose
+		// top bar and stem are black, for every orientation.
+		thumb, err = Thumbnail(img, Options{Width: 40, Height: 40, Crop: true, Save: format.SaveOptions{Format: format.Png}})
+		if assert.Nil(t, err) && assert.Nil(t, isSize(thumb, format.Png, 40, 40, false)) {
+			assert.True(t, isGray(t, thumb, 5, 5, 0, 0x4000), "orientation %d: top left should be black", i)
+			assert.True(t, isGray(t, thumb, 35, 30, 0xc000, 0xffff), "orientation %d: right should be white", i)
+		}
+	}
+}
+
+func TestDPI(t *testing.T) {
+	// Set an explicit density.
+	img, err := Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 400, DPI: 300})
+	if !assert.Nil(t, err) || !assert.Nil(t, isSize(img, format.Jpeg, 200, 270, false)) {
+		return
+	}
+	assert.Equal(t, []int{1, 300, 300}, jfifDensity(img))
+
+	m, err := format.MetadataBytes(img)
+	if assert.Nil(t, err) {
+		assert.InDelta(t, 300, m.XDPI, 0.01)
+		assert.InDelta(t, 300, m.YDPI, 0.01)
+	}
+
+	// Halving the width doubles the density when keeping print size,
+	// and keeps it otherwise.
+	thumb, err := Thumbnail(img, Options{Width: 100, Height: 400, KeepPrintSize: true})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int{1, 150, 150}, jfifDensity(thumb))
+	}
+	thumb, err = Thumbnail(img, Options{Width: 100, Height: 400})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int{1, 300, 300}, jfifDensity(thumb))
+	}
+
+	// DPI wins over KeepPrintSize.
+	thumb, err = Thumbnail(img, Options{Width: 100, Height: 400, KeepPrintSize: true, DPI: 72})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int{1, 72, 72}, jfifDensity(thumb))
+	}
+
+	_, err = Thumbnail(img, Options{Width: 100, Height: 400, DPI: -1})
+	assert.Equal(t, ErrBadOption, err)
+}
+
+// jfifDensity returns the units and horizontal and vertical density from
+// the JFIF APP0 segment at the start of a JPEG, or nil if there isn't one.
+func jfifDensity(blob []byte) []int {
+	if len(blob) < 18 || blob[2] != 0xff || blob[3] != 0xe0 || string(blob[6:11]) != "JFIF\x00" {
+		return nil
+	}
+	return []int{int(blob[13]), int(blob[14])<<8 | int(blob[15]), int(blob[16])<<8 | int(blob[17])}
+}
+
+func TestCropOrientation(t *testing.T) {
+	// A 60x100 image as displayed, white with a red top left quadrant.
+	displayed := goimage.NewRGBA(goimage.Rect(0, 0, 60, 100))
+	draw.Draw(displayed, displayed.Bounds(), goimage.NewUniform(color.White), goimage.ZP, draw.Src)
+	draw.Draw(displayed, goimage.Rect(0, 0, 30, 50), goimage.NewUniform(color.RGBA{R: 255, A: 255}), goimage.ZP, draw.Src)
+
+	var want []byte
+	for o := format.TopLeft; o <= format.LeftBottom; o++ {
+		img := orientedJpeg(t, displayed, o)
+		if img == nil {
+			continue
+		}
+
+		// Scaled to 60x100, cropping to 60x60 starts 10 rows down,
+		// leaving 40 rows of the quadrant.
+		thumb, err := Thumbnail(img, Options{Width: 60, Height: 60, Crop: true, Save: format.SaveOptions{Format: format.Png}})
+		if !assert.Nil(t, err, "orientation %d", o) || !assert.Nil(t, isSize(thumb, format.Png, 60, 60, false), "orientation %d", o) {
+			continue
+		}
+		for _, p := range []struct {
+			x, y int
+			red  bool
+		}{{5, 5, true}, {25, 35, true}, {35, 5, false}, {5, 45, false}, {55, 55, false}} {
+			assert.Equal(t, p.red, isRed(t, thumb, p.x, p.y, 0x3fff), "orientation %d: %d,%d", o, p.x, p.y)
+		}
+
+		// Every orientation crops exactly the same region.
+		if want == nil {
+			want = thumb
+		} else {
+			assert.True(t, pngDifference(t, want, thumb) < 2, "orientation %d", o)
+		}
+	}
+}
+
+// orientedJpeg returns a JPEG of the displayed image stored with pixels
+// laid out for EXIF Orientation o, so that applying o displays it.
+func orientedJpeg(t *testing.T, displayed goimage.Image, o format.Orientation) []byte {
+	b := displayed.Bounds()
+	pw, ph := o.Dimensions(b.Dx(), b.Dy())
+	stored := goimage.NewRGBA(goimage.Rect(0, 0, pw, ph))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			sx, sy, _, _ := o.Crop(1, 1, x, y, b.Dx(), b.Dy())
+			stored.Set(sx, sy, displayed.At(x, y))
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, jpeg.Encode(&buf, stored, &jpeg.Options{Quality: 95})) {
+		return nil
+	}
+
+	// Insert an APP1 segment after SOI with a big-endian TIFF header and
+	// an IFD0 holding only the Orientation tag.
+	exif := []byte("Exif\x00\x00MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	exif[6+8+2+8+1] = byte(o)
+	app1 := append([]byte{0xff, 0xe1, 0, byte(len(exif) + 2)}, exif...)
+
+	blob := buf.Bytes()
+	return append(append(append([]byte{}, blob[:2]...), app1...), blob[2:]...)
+}
+
+// isGray returns true if the red, green, and blue values of the pixel at
+// x, y of a PNG are all between min and max.
+func isGray(t *testing.T, blob []byte, x, y int, min, max uint32) bool {
+	img, err := png.Decode(bytes.NewReader(blob))
+	if !assert.Nil(t, err) {
+		return false
+	}
+
+	r, g, b, _ := img.At(x, y).RGBA()
+	for _, v := range []uint32{r, g, b} {
+		if v < min || v > max {
+			return false
+		}
+	}
+	return true
+}
+
+func TestKeepOrientationTag(t *testing.T) {
+	img := image("orient6.jpg")
+
+	// By default, the metadata is stripped.
+	thumb, err := Thumbnail(img, Options{Width: 40, Height: 40})
+	if assert.Nil(t, err) {
+		m, err := format.MetadataBytes(thumb)
+		if assert.Nil(t, err) {
+			assert.Equal(t, format.Undefined, m.Orientation)
+		}
+	}
+
+	// Kept metadata has the pixels rotated upright and the tag reset.
+	thumb, err = Thumbnail(img, Options{Width: 40, Height: 40, Save: format.SaveOptions{KeepMetadata: true}})
+	if assert.Nil(t, err) {
+		m, err := format.MetadataBytes(thumb)
+		if assert.Nil(t, err) {
+			assert.Equal(t, format.TopLeft, m.Orientation)
+		}
+		_, w, h, err := format.ProbeDimensions(thumb)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []int{24, 40}, []int{w, h})
+		}
+	}
+
+	// Or the pixels left as stored, with the original tag.
+	o := Options{Width: 40, Height: 40, KeepOrientationTag: true, Save: format.SaveOptions{KeepMetadata: true}}
+	thumb, err = Thumbnail(img, o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 24, 40, false))
+		m, err := format.MetadataBytes(thumb)
+		if assert.Nil(t, err) {
+			assert.Equal(t, format.RightTop, m.Orientation)
+		}
+		_, w, h, err := format.ProbeDimensions(thumb)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []int{40, 24}, []int{w, h})
+		}
+	}
+
+	o.Save.KeepMetadata = false
+	assert.IsType(t, ConflictError{}, o.Validate())
+}
+
+func TestOrientationPolicy(t *testing.T) {
+	// orient1.jpg, already upright, but tagged as needing a 90 degree
+	// rotation.
+	img := image("prerotated6.jpg")
+
+	// Trusting EXIF turns it sideways.
+	thumb, err := Thumbnail(img, Options{Width: 24, Height: 40})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 24, 15, false))
+	}
+
+	// Guessing sees that it's already the requested shape.
+	o := Options{Width: 24, Height: 40, OrientationPolicy: GuessOrientation, Save: format.SaveOptions{Format: format.Png}}
+	thumb, err = Thumbnail(img, o)
+	if assert.Nil(t, err) && assert.Nil(t, isSize(thumb, format.Png, 24, 40, false)) {
+		// And matches the correctly tagged original.
+		want, err := Thumbnail(image("orient1.jpg"), o)
+		if assert.Nil(t, err) {
+			assert.True(t, pngDifference(t, want, thumb) < 4)
+		}
+	}
+
+	// Rotations to the requested shape are still applied.
+	thumb, err = Thumbnail(image("orient6.jpg"), Options{Width: 24, Height: 40, OrientationPolicy: GuessOrientation})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 24, 40, false))
+	}
+
+	_, err = Thumbnail(img, Options{OrientationPolicy: GuessOrientation + 1})
+	assert.Equal(t, ErrBadOption, err)
+}
+
+// pngDifference returns the mean absolute difference per channel, from 0
+// to 255, between two PNGs of the same size.
+func pngDifference(t *testing.T, a, b []byte) float64 {
+	ia, err := png.Decode(bytes.NewReader(a))
+	if !assert.Nil(t, err) {
+		return 255
+	}
+	ib, err := png.Decode(bytes.NewReader(b))
+	if !assert.Nil(t, err) || !assert.Equal(t, ia.Bounds(), ib.Bounds()) {
+		return 255
+	}
+
+	sum, n := 0.0, 0
+	r := ia.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			ar, ag, ab, _ := ia.At(x, y).RGBA()
+			br, bg, bb, _ := ib.At(x, y).RGBA()
+			sum += math.Abs(float64(ar)-float64(br)) + math.Abs(float64(ag)-float64(bg)) + math.Abs(float64(ab)-float64(bb))
+			n += 3
+		}
 	}
+	return sum / float64(n) / 257
 }
 
 func TestConversion(t *testing.T) {
@@ -209,6 +1515,45 @@ func TestConversion(t *testing.T) {
 	}
 }
 
+func TestWebpInput(t *testing.T) {
+	for _, filename := range []string{"lossy.webp", "lossless.webp"} {
+		img := image(filename)
+
+		m, err := format.MetadataBytes(img)
+		if assert.Nil(t, err, filename) {
+			assert.Equal(t, format.Webp, m.Format, filename)
+			assert.Equal(t, format.Undefined, m.Orientation, filename)
+			assert.True(t, m.HasAlpha, filename)
+		}
+
+		// Alpha should survive scaling and conversion to PNG.
+		thumb, err := Thumbnail(img, Options{Width: 50, Height: 50, Save: format.SaveOptions{Format: format.Png}})
+		if assert.Nil(t, err, filename) {
+			assert.Nil(t, isSize(thumb, format.Png, 50, 25, true), filename)
+		}
+	}
+}
+
+func TestAvifInput(t *testing.T) {
+	img := image("somealpha.avif")
+	assert.Equal(t, format.Avif, format.DetectFormat(img))
+
+	m, err := format.MetadataBytes(img)
+	if err == format.ErrLoaderUnavailable {
+		t.Skip("Can't load AVIF:", err)
+	}
+	if assert.Nil(t, err) {
+		assert.Equal(t, format.Avif, m.Format)
+		assert.True(t, m.HasAlpha)
+	}
+
+	// Alpha should survive scaling and conversion to PNG.
+	thumb, err := Thumbnail(img, Options{Width: 50, Height: 50, Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 50, 25, true))
+	}
+}
+
 func TestScalingJpeg(t *testing.T) {
 	testScalingFormat(t, format.Jpeg)
 }
@@ -230,7 +1575,7 @@ func testScalingFormat(t *testing.T, f format.Format) {
 	// Try scaling to some difficult sizes and make sure we get the expected size back.
 	// We have different code paths for different image formats, so we try for each.
 	for _, size := range []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 31, 32, 33, 63, 64, 65, 127, 128, 129, 255, 256} {
-		thumb, err := Thumbnail(blob, Options{Width: size, Height: size, FastResize: true, Save: format.SaveOptions{Format: f}})
+		thumb, err := Thumbnail(blob, Options{Width: size, Height: size, FastResize: ToggleOn, Save: format.SaveOptions{Format: f}})
 		if assert.Nil(t, err) {
 			h := (169*size + 255) / 256
 			if h < 1 {
@@ -272,6 +1617,7 @@ func TestOptionsJson(t *testing.T) {
 	assert.Error(t, err)
 }
 
+// Smaller JPEG thumbnails shrink more on load.
 func BenchmarkThumbnailJpeg_16(b *testing.B) {
 	benchThumbnail(b, format.Jpeg, Options{Width: 16, Height: 16})
 }
@@ -385,6 +1731,7 @@ func benchThumbnail(b *testing.B, f format.Format, o Options) {
 	blob, err := flowersFormat(f)
 	assert.Nil(b, err)
 
+	b.ReportAllocs()
 	b.ResetTimer()
 
 	b.RunParallel(func(pb *testing.PB) {
@@ -395,6 +1742,19 @@ func benchThumbnail(b *testing.B, f format.Format, o Options) {
 	})
 }
 
+// PresetFast should be faster than PresetBest for the same image and size.
+func BenchmarkPresetFast(b *testing.B) {
+	benchThumbnail(b, format.Jpeg, Options{Width: 256, Height: 256, Preset: PresetFast})
+}
+
+func BenchmarkPresetBest(b *testing.B) {
+	benchThumbnail(b, format.Jpeg, Options{Width: 256, Height: 256, Preset: PresetBest})
+}
+
+func BenchmarkCrop(b *testing.B) {
+	benchThumbnail(b, format.Jpeg, Options{Width: 192, Height: 96, Crop: true})
+}
+
 func flowersFormat(f format.Format) ([]byte, error) {
 	return Thumbnail(image("flowers.png"), Options{Save: format.SaveOptions{Format: f}})
 }
@@ -424,3 +1784,13 @@ func image(filename string) []byte {
 
 	return bytes
 }
+
+// redGif returns a 100x100 solid red GIF.
+func redGif(t *testing.T) []byte {
+	frame := goimage.NewPaletted(goimage.Rect(0, 0, 100, 100), color.Palette{color.RGBA{R: 255, A: 255}})
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, frame, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
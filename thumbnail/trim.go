@@ -0,0 +1,69 @@
+package thumbnail
+
+import (
+	"github.com/die-net/fotomat/format"
+)
+
+// TrimMode is how Options.Trim finds the borders to remove from an image.
+type TrimMode int
+
+// Trim modes.
+const (
+	// NoTrim keeps the whole image.
+	NoTrim TrimMode = iota
+	// TrimBackground removes borders of the same solid color as the
+	// top-left pixel.
+	TrimBackground
+	// TrimAlpha removes fully transparent borders, such as the padding
+	// around sprites and logos.  Images without alpha are kept whole.
+	TrimAlpha
+)
+
+// trimThreshold is how far from the background color, out of 255, a pixel
+// can be and still be trimmed by TrimBackground.
+const trimThreshold = 10
+
+// trimRect returns the Rect of page of an image with Metadata m, as
+// displayed, that's left after trimming its borders as mode says, or an
+// empty Rect if there's nothing to trim or nothing would be left.
+func trimRect(blob []byte, m format.Metadata, page int, mode TrimMode) (Rect, error) {
+	image, err := load(blob, m.Format, 1, page)
+	if err != nil {
+		return Rect{}, err
+	}
+	defer image.Close()
+
+	if err := m.Orientation.Apply(image); err != nil {
+		return Rect{}, err
+	}
+
+	var background []float64
+	threshold := float64(trimThreshold)
+	if mode == TrimAlpha {
+		if !image.HasAlpha() {
+			return Rect{}, nil
+		}
+		if err := image.ExtractBand(image.ImageGetBands()-1, 1); err != nil {
+			return Rect{}, err
+		}
+		background, threshold = []float64{0}, 0
+	} else {
+		if background, err = image.Getpoint(0, 0); err != nil {
+			return Rect{}, err
+		}
+		// Alpha is flattened against the background before comparing.
+		if image.HasAlpha() {
+			background = background[:len(background)-1]
+		}
+	}
+
+	left, top, width, height, err := image.FindTrim(threshold, background)
+	if err != nil {
+		return Rect{}, err
+	}
+	if width <= 0 || height <= 0 || (width == image.Xsize() && height == image.Ysize()) {
+		return Rect{}, nil
+	}
+
+	return Rect{X: left, Y: top, Width: width, Height: height}, nil
+}
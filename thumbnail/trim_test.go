@@ -0,0 +1,65 @@
+package thumbnail
+
+import (
+	"github.com/die-net/fotomat/format"
+	"github.com/stretchr/testify/assert"
+	goimage "image"
+	"image/color"
+	"testing"
+)
+
+func TestTrim(t *testing.T) {
+	red := fill{goimage.Rect(100, 50, 160, 90), color.RGBA{R: 255, A: 255}}
+	options := Options{Width: 1000, Height: 1000, Save: format.SaveOptions{Format: format.Png}}
+
+	// A 60x40 red rectangle on a 400x300 transparent canvas is trimmed
+	// to the rectangle, which is opaque, so flattened.
+	sprite := pngBlob(t, 400, 300, color.Transparent, red)
+	o := options
+	o.Trim = TrimAlpha
+	thumb, err := Thumbnail(sprite, o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 60, 40, false))
+	}
+
+	// Then scaled as if it were the whole image.
+	o.Width, o.Height = 30, 30
+	thumb, err = Thumbnail(sprite, o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 30, 20, false))
+	}
+
+	// Nothing is trimmed from an image that's entirely transparent, or
+	// from one without alpha.
+	o = options
+	o.Trim = TrimAlpha
+	thumb, err = Thumbnail(pngBlob(t, 40, 30, color.Transparent), o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 40, 30, true))
+	}
+	thumb, err = Thumbnail(image("2px.png"), o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 2, 3, false))
+	}
+
+	// The same rectangle on a white background is trimmed by color.
+	logo := pngBlob(t, 400, 300, color.White, red)
+	o.Trim = TrimBackground
+	thumb, err = Thumbnail(logo, o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 60, 40, false))
+	}
+
+	// But not by alpha.
+	o.Trim = TrimAlpha
+	thumb, err = Thumbnail(logo, o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 400, 300, false))
+	}
+
+	o.Trim = TrimAlpha + 1
+	_, err = Thumbnail(logo, o)
+	assert.Equal(t, ErrBadOption, err)
+
+	assert.IsType(t, ConflictError{}, Options{Trim: TrimAlpha, Region: Rect{Width: 10, Height: 10}}.Validate())
+}
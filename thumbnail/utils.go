@@ -1,12 +1,14 @@
 package thumbnail
 
 import (
+	"github.com/die-net/fotomat/format"
 	"github.com/die-net/fotomat/vips"
 )
 
 // Scale original (width, height) to result (width, height), maintaining aspect ratio.
 // If within=true, fit completely within result, leaving empty space if necessary.
-func scaleAspect(ow, oh, rw, rh int, within bool) (int, int, bool) {
+// The computed dimension is rounded to whole pixels as specified by rounding.
+func scaleAspect(ow, oh, rw, rh int, within bool, rounding Rounding) (int, int, bool) {
 	// Scale aspect ratio using integer math, avoiding floating point
 	// errors.
 
@@ -15,9 +17,9 @@ func scaleAspect(ow, oh, rw, rh int, within bool) (int, int, bool) {
 
 	trustWidth := false
 	if within == (wp < hp) {
-		rw = (wp + oh - 1) / oh
+		rw = rounding.divide(wp, oh)
 	} else {
-		rh = (hp + ow - 1) / ow
+		rh = rounding.divide(hp, ow)
 		trustWidth = true
 	}
 
@@ -31,6 +33,57 @@ func scaleAspect(ow, oh, rw, rh int, within bool) (int, int, bool) {
 	return rw, rh, trustWidth
 }
 
+// coverTrim returns true if cropping a w by h image to fill ow by oh would
+// trim no more than maxCrop of its width or height.  Otherwise, it returns
+// the Rect of the image left after trimming maxCrop from the sides, or
+// mostly from the bottom, like crop.
+func coverTrim(w, h, ow, oh int, maxCrop float64) (Rect, bool) {
+	r := Rect{Width: w, Height: h}
+
+	wp := w * oh
+	hp := h * ow
+	switch {
+	case wp > hp:
+		// Wider than requested.
+		if 1-float64(hp)/float64(wp) <= maxCrop {
+			return Rect{}, true
+		}
+		r.Width = w - int(float64(w)*maxCrop)
+		r.X = (w - r.Width + 1) / 2
+	case wp < hp:
+		// Taller than requested.
+		if 1-float64(wp)/float64(hp) <= maxCrop {
+			return Rect{}, true
+		}
+		r.Height = h - int(float64(h)*maxCrop)
+		r.Y = (h - r.Height + 1) / 4
+	default:
+		return Rect{}, true
+	}
+
+	return r, false
+}
+
+// misrotated returns true if Metadata m's orientation rotates the image by
+// 90 or 270 degrees, but its pixels as stored already have the same shape
+// as the requested width and height.
+func misrotated(m format.Metadata, width, height int) bool {
+	pw, ph := m.Orientation.Dimensions(m.Width, m.Height)
+	if pw == m.Width || width <= 0 || height <= 0 || width == height {
+		return false
+	}
+
+	return (pw > ph) == (width > height)
+}
+
+// aspectRatio returns the ratio of the longer to the shorter of width and height.
+func aspectRatio(width, height int) float64 {
+	if width < height {
+		width, height = height, width
+	}
+	return float64(width) / float64(height)
+}
+
 func preShrinkFactor(mw, mh, iw, ih int, trustWidth, fastResize, jpeg bool) int {
 	// JPEG shrink on VIPS >= 8.6.4 and WebP shrink both round down the
 	// number of pixels.  Round our shrink factor down by a pixel to
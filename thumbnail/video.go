@@ -0,0 +1,122 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/die-net/fotomat/format"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ErrNoVideoEncoder is returned when Options.Video is set, but VideoEncoder
+// can't be found.
+var ErrNoVideoEncoder = errors.New("Video encoder not available")
+
+// VideoEncoder is the ffmpeg binary used to transcode animated GIFs to
+// video, looked up in $PATH if it has no directory.
+var VideoEncoder = "ffmpeg"
+
+// VideoTimeout is how long VideoEncoder may run when
+// Options.MaxProcessingDuration is unset.  Otherwise, it's killed in time
+// to return an error before MaxProcessingDuration is reached.
+var VideoTimeout = time.Minute
+
+// VideoFormat is a container and codec that animated GIFs can be
+// transcoded to.
+type VideoFormat int
+
+// Video formats.
+const (
+	// NoVideo leaves animated GIFs as images.
+	NoVideo VideoFormat = iota
+	// MP4 is H.264 in an MP4 container.
+	MP4
+	// WebM is VP9 in a WebM container.
+	WebM
+)
+
+var videoFormatInfo = []struct {
+	mime string
+	args []string
+}{
+	{mime: "", args: nil},
+	// MP4 can only be streamed to a pipe fragmented, and H.264 needs
+	// 4:2:0 chroma for browsers to play it.
+	{mime: "video/mp4", args: []string{"-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "frag_keyframe+empty_moov", "-f", "mp4"}},
+	{mime: "video/webm", args: []string{"-c:v", "libvpx-vp9", "-pix_fmt", "yuv420p", "-b:v", "0", "-crf", "36", "-f", "webm"}},
+}
+
+// String returns the mime type of a VideoFormat.
+func (v VideoFormat) String() string {
+	return videoFormatInfo[v].mime
+}
+
+// isAnimated returns true if an image with Metadata m would be transcoded
+// to video.
+func isAnimated(m format.Metadata) bool {
+	return m.Format == format.Gif && m.Pages > 1
+}
+
+// video transcodes an animated GIF blob with Metadata m to a muted video
+// in the VideoFormat and size specified by Options o, which must already
+// have been through Check.  Crop is supported, but not Pad.  The encoder
+// is killed if it runs too long, or if the request is aborted.
+func video(blob []byte, m format.Metadata, o Options) ([]byte, error) {
+	encoder, err := exec.LookPath(VideoEncoder)
+	if err != nil {
+		return nil, ErrNoVideoEncoder
+	}
+
+	// Scale, never upscaling, then crop to Crop's box, and to even
+	// dimensions for 4:2:0 chroma.
+	iw, ih, _ := scaleAspect(m.Width, m.Height, o.Width, o.Height, !o.Crop, o.Rounding)
+	ow, oh, x, y := iw, ih, 0, 0
+	if o.Crop {
+		ow, oh = o.Width, o.Height
+		x, y = cropOffsets(iw, ih, ow, oh)
+	} else if iw > m.Width || ih > m.Height {
+		iw, ih, ow, oh = m.Width, m.Height, m.Width, m.Height
+	}
+	ow, oh = ow&^1, oh&^1
+	if ow < 2 || oh < 2 {
+		return nil, ErrTooSmall
+	}
+	filter := fmt.Sprintf("scale=%d:%d,crop=%d:%d:%d:%d", iw, ih, ow, oh, x, y)
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-f", "gif", "-i", "pipe:0", "-an", "-vf", filter}
+	args = append(args, videoFormatInfo[o.Video].args...)
+
+	timeout := VideoTimeout
+	if o.MaxProcessingDuration > 0 {
+		timeout = o.MaxProcessingDuration * 9 / 10
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Request.Aborted may only deliver a single value, so remember it.
+	aborted := make(chan bool)
+	go func() {
+		select {
+		case <-o.aborted:
+			close(aborted)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	cmd := exec.CommandContext(ctx, encoder, append(args, "pipe:1")...)
+	cmd.Stdin = bytes.NewReader(blob)
+	out, stderr := bytes.Buffer{}, bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+
+	if err := cmd.Run(); err != nil {
+		if hasAborted(aborted) {
+			return nil, ErrAborted
+		}
+		return nil, fmt.Errorf("%s: %v: %s", VideoEncoder, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,114 @@
+package thumbnail
+
+import (
+	"bytes"
+	"github.com/die-net/fotomat/format"
+	"github.com/stretchr/testify/assert"
+	goimage "image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"os/exec"
+	"testing"
+)
+
+func TestVideo(t *testing.T) {
+	if _, err := exec.LookPath(VideoEncoder); err != nil {
+		t.Skip("No video encoder:", err)
+	}
+
+	animation := animatedGif(t, 3)
+	m, err := format.MetadataBytes(animation)
+	if !assert.Nil(t, err) || !assert.True(t, isAnimated(m)) {
+		return
+	}
+
+	// MP4 starts with an ftyp box, and WebM with an EBML header.
+	result, err := Process(animation, Options{Width: 64, Height: 64, Video: MP4})
+	if assert.Nil(t, err) && assert.True(t, len(result.Blob) > 8) {
+		assert.Equal(t, "ftyp", string(result.Blob[4:8]))
+	}
+
+	result, err = Process(animation, Options{Width: 64, Height: 48, Crop: true, Video: WebM})
+	if assert.Nil(t, err) && assert.True(t, len(result.Blob) > 4) {
+		assert.Equal(t, []byte{0x1A, 0x45, 0xDF, 0xA3}, result.Blob[:4])
+	}
+
+	// A still GIF remains an image.
+	result, err = Process(animatedGif(t, 1), Options{Width: 64, Height: 64, Video: MP4})
+	if assert.Nil(t, err) {
+		m, err := format.MetadataBytes(result.Blob)
+		assert.Nil(t, err)
+		assert.NotEqual(t, format.Unknown, m.Format)
+	}
+
+	// An aborted request kills the encoder.
+	aborted := make(chan bool)
+	close(aborted)
+	_, err = Process(animation, Options{Width: 64, Height: 64, Video: MP4, aborted: aborted})
+	assert.Equal(t, ErrAborted, err)
+}
+
+func TestVideoOptions(t *testing.T) {
+	_, err := Options{Width: 64, Height: 64, Video: VideoFormat(10)}.Check(format.Metadata{Width: 100, Height: 100})
+	assert.Equal(t, ErrBadOption, err)
+
+	assert.IsType(t, ConflictError{}, Options{Width: 64, Height: 64, Pad: true, Video: MP4}.Validate())
+	assert.IsType(t, ConflictError{}, Options{Width: 64, Height: 64, Region: Rect{Width: 10, Height: 10}, Video: WebM}.Validate())
+	assert.Nil(t, Options{Width: 64, Height: 64, Crop: true, Video: WebM}.Validate())
+}
+
+func TestAnimationPixels(t *testing.T) {
+	// 50 frames of 1000x1000 is far more than 6.5M pixels, though each
+	// frame alone isn't.
+	m := format.Metadata{Format: format.Gif, Width: 1000, Height: 1000, Pages: 50}
+	o := Options{Width: 100, Height: 100, MaxBufferPixels: 6500000}
+	_, err := o.Check(m)
+	assert.Nil(t, err)
+	o.Video = MP4
+	_, err = o.Check(m)
+	assert.Equal(t, ErrTooBig, err)
+	m.Pages = 5
+	_, err = o.Check(m)
+	assert.Nil(t, err)
+
+	// Each 100x80 frame fits in 10000 pixels, but 3 frames don't.
+	animation := animatedGif(t, 3)
+	o = Options{Width: 64, Height: 64, MaxBufferPixels: 10000}
+	_, err = Process(animation, o)
+	assert.Nil(t, err)
+
+	o.Video = WebM
+	_, err = Process(animation, o)
+	assert.Equal(t, ErrTooBig, err)
+
+	o.Video, o.Montage = NoVideo, Montage{Columns: 2, Rows: 2}
+	_, err = Process(animation, o)
+	assert.Equal(t, ErrTooBig, err)
+
+	// A single cell Montage only decodes one frame.
+	o.Montage = Montage{Columns: 1, Rows: 1}
+	_, err = Process(animation, o)
+	assert.Nil(t, err)
+}
+
+// animatedGif returns a 100x80 GIF of solid frames, each a
+// different color.
+func animatedGif(t *testing.T, frames int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := goimage.NewPaletted(goimage.Rect(0, 0, 100, 80), palette.Plan9)
+		c := frame.Palette.Index(color.RGBA{uint8(255 * i / frames), 0, 255, 255})
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(c)
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,39 @@
+package thumbnail
+
+import (
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/vips"
+)
+
+// watermark overlays the compressed image blob in the bottom right corner
+// of image, scaling it down to fit if needed.
+func watermark(image *vips.Image, blob []byte) error {
+	m, err := format.MetadataBytes(blob)
+	if err != nil {
+		return err
+	}
+
+	mark, err := m.Format.LoadBytes(blob)
+	if err != nil {
+		return err
+	}
+	defer mark.Close()
+
+	if err := srgb(mark, "", ""); err != nil {
+		return err
+	}
+
+	if err := m.Orientation.Apply(mark); err != nil {
+		return err
+	}
+
+	w, h := image.Xsize(), image.Ysize()
+	if mw, mh := mark.Xsize(), mark.Ysize(); mw > w || mh > h {
+		iw, ih, _ := scaleAspect(mw, mh, w, h, true, RoundDown)
+		if err := resize(mark, iw, ih, false, 0, false, false, true, resizeKernels{}); err != nil {
+			return err
+		}
+	}
+
+	return image.CompositeOver(mark, w-mark.Xsize(), h-mark.Ysize())
+}
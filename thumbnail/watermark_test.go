@@ -0,0 +1,102 @@
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/die-net/fotomat/format"
+	"github.com/die-net/fotomat/vips"
+	"github.com/stretchr/testify/assert"
+	goimage "image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func TestWatermark(t *testing.T) {
+	var major, minor int
+	if _, _ = fmt.Sscanf(vips.Version(), "%d.%d", &major, &minor); major == 8 && minor < 6 {
+		t.Skip("VIPS doesn't support compositing")
+	}
+
+	// A 2000x1500 white original and a 20x20 blue watermark.
+	img := pngBlob(t, 2000, 1500, color.White)
+	mark := pngBlob(t, 20, 20, color.RGBA{B: 255, A: 255})
+	if img == nil || mark == nil {
+		return
+	}
+
+	// Extract a 2:1 region, pad it to a red square, and watermark it.
+	red := Color{R: 255}
+	thumb, err := Thumbnail(img, Options{
+		Region:     Rect{X: 0, Y: 0, Width: 1000, Height: 500},
+		Width:      200,
+		Height:     200,
+		Pad:        true,
+		Background: red,
+		Watermark:  mark,
+		Save:       format.SaveOptions{Format: format.Png},
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, isSize(thumb, format.Png, 200, 200, false))
+
+	out, err := png.Decode(bytes.NewReader(thumb))
+	if !assert.Nil(t, err) {
+		return
+	}
+	for _, p := range []struct {
+		x, y    int
+		r, g, b uint32
+	}{
+		{100, 100, 0xffff, 0xffff, 0xffff}, // Region.
+		{100, 190, 0xffff, 0, 0},           // Padding.
+		{190, 190, 0, 0, 0xffff},           // Watermark.
+	} {
+		r, g, b, _ := out.At(p.x, p.y).RGBA()
+		assert.Equal(t, []uint32{p.r, p.g, p.b}, []uint32{r, g, b}, "pixel: %d,%d", p.x, p.y)
+	}
+
+	// Watermarks larger than the output are scaled down to fit.
+	thumb, err = Thumbnail(mark, Options{Width: 10, Height: 10, Watermark: img, Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.True(t, isColor(t, thumb, 5, 5, 0xffff, 0xffff, 0xffff))
+	}
+
+	_, err = Thumbnail(img, Options{Width: 100, Height: 100, Watermark: []byte("not an image")})
+	assert.Equal(t, format.ErrUnknownFormat, err)
+}
+
+// fill is a rectangle of a pngBlob drawn in another color.
+type fill struct {
+	r goimage.Rectangle
+	c color.Color
+}
+
+// pngBlob returns a width by height PNG filled with c, then with each of
+// fills.
+func pngBlob(t *testing.T, width, height int, c color.Color, fills ...fill) []byte {
+	img := goimage.NewRGBA(goimage.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), goimage.NewUniform(c), goimage.ZP, draw.Src)
+	for _, f := range fills {
+		draw.Draw(img, f.r, goimage.NewUniform(f.c), goimage.ZP, draw.Src)
+	}
+	buf := bytes.Buffer{}
+	if !assert.Nil(t, png.Encode(&buf, img)) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// isColor returns true if the pixel at x, y of a PNG has the given 16-bit
+// red, green, and blue values.
+func isColor(t *testing.T, blob []byte, x, y int, r, g, b uint32) bool {
+	img, err := png.Decode(bytes.NewReader(blob))
+	if !assert.Nil(t, err) {
+		return false
+	}
+
+	pr, pg, pb, _ := img.At(x, y).RGBA()
+	return pr == r && pg == g && pb == b
+}
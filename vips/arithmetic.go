@@ -6,9 +6,52 @@ package vips
 */
 import "C"
 
+import (
+	"runtime"
+	"unsafe"
+)
+
 // Min finds the single smallest value in all bands of the input image.
 func (in *Image) Min() (float64, error) {
 	var out C.double
 	err := vipsError(C.cgo_vips_min(in.vi, &out))
+	runtime.KeepAlive(in)
+	return float64(out), err
+}
+
+// Getpoint returns the value of each band of the pixel at x, y.
+func (in *Image) Getpoint(x, y int) ([]float64, error) {
+	values := make([]float64, in.ImageGetBands())
+	var n C.int
+	err := vipsError(C.cgo_vips_getpoint(in.vi, (*C.double)(unsafe.Pointer(&values[0])), C.int(len(values)), &n, C.int(x), C.int(y)))
+	runtime.KeepAlive(in)
+	if err != nil {
+		return nil, err
+	}
+	if int(n) < len(values) {
+		values = values[:n]
+	}
+	return values, nil
+}
+
+// FindTrim returns the bounding box of the pixels in the input image that
+// differ from background, which has a value for each band or one for all,
+// by more than threshold, after a median filter removes noise.  Any alpha
+// is flattened against background first.  The box is empty if all pixels
+// match.  Requires VIPS 8.6 or later.
+func (in *Image) FindTrim(threshold float64, background []float64) (left, top, width, height int, err error) {
+	var l, t, w, h C.int
+	err = vipsError(C.cgo_vips_find_trim(in.vi, &l, &t, &w, &h, C.double(threshold), (*C.double)(unsafe.Pointer(&background[0])), C.int(len(background))))
+	runtime.KeepAlive(in)
+	return int(l), int(t), int(w), int(h), err
+}
+
+// Ssim returns the mean structural similarity (SSIM) of the luminance of
+// in and ref, which must be the same size.  1.0 means they're identical.
+func (in *Image) Ssim(ref *Image) (float64, error) {
+	var out C.double
+	err := vipsError(C.cgo_vips_ssim(in.vi, ref.vi, &out))
+	runtime.KeepAlive(in)
+	runtime.KeepAlive(ref)
 	return float64(out), err
 }
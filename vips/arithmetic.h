@@ -6,3 +6,101 @@ int
 cgo_vips_min(VipsImage *in, double *out) {
     return vips_min(in, out, NULL);
 }
+
+// cgo_vips_getpoint copies the value of up to max bands of the pixel at
+// x, y to out, and sets n to the number of bands.
+int
+cgo_vips_getpoint(VipsImage *in, double *out, int max, int *n, int x, int y) {
+    double *vector = NULL;
+
+    if (vips_getpoint(in, &vector, n, x, y, NULL)) {
+        return -1;
+    }
+    for (int i = 0; i < *n && i < max; i++) {
+        out[i] = vector[i];
+    }
+    g_free(vector);
+
+    return 0;
+}
+
+int
+cgo_vips_find_trim(VipsImage *in, int *left, int *top, int *width, int *height, double threshold, double *background, int n) {
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6)
+    VipsArrayDouble *bg = vips_array_double_new(background, n);
+    int e = vips_find_trim(in, left, top, width, height, "threshold", threshold, "background", bg, NULL);
+    vips_area_unref(VIPS_AREA(bg));
+    return e;
+#else
+    // Finding trim was added in VIPS 8.6.
+    vips_error("find_trim", "not supported by this version of libvips");
+    return -1;
+#endif
+}
+
+// cgo_vips_ssim computes the mean structural similarity of the luminance
+// of a and b, using the usual 11x11 Gaussian window with sigma 1.5.
+int
+cgo_vips_ssim(VipsImage *a, VipsImage *b, double *out) {
+    // C1 = (0.01 * 255)^2, C2 = (0.03 * 255)^2.
+    const double c1 = 6.5025;
+    const double c2 = 58.5225;
+    const double sigma = 1.5;
+
+    VipsImage *t[21] = { NULL };
+    int ret = -1;
+
+    if (!vips_colourspace(a, &t[0], VIPS_INTERPRETATION_B_W, NULL) &&
+        !vips_extract_band(t[0], &t[1], 0, NULL) &&
+        !vips_cast(t[1], &t[2], VIPS_FORMAT_FLOAT, NULL) &&
+        !vips_colourspace(b, &t[3], VIPS_INTERPRETATION_B_W, NULL) &&
+        !vips_extract_band(t[3], &t[4], 0, NULL) &&
+        !vips_cast(t[4], &t[5], VIPS_FORMAT_FLOAT, NULL) &&
+        // Local means, and their squares and product.
+        !vips_gaussblur(t[2], &t[6], sigma, NULL) &&
+        !vips_gaussblur(t[5], &t[7], sigma, NULL) &&
+        !vips_multiply(t[6], t[6], &t[8], NULL) &&
+        !vips_multiply(t[7], t[7], &t[9], NULL) &&
+        !vips_multiply(t[6], t[7], &t[10], NULL) &&
+        // Local variances and covariance.
+        !vips_multiply(t[2], t[2], &t[11], NULL) &&
+        !vips_multiply(t[5], t[5], &t[12], NULL) &&
+        !vips_multiply(t[2], t[5], &t[13], NULL) &&
+        !vips_gaussblur(t[11], &t[14], sigma, NULL) &&
+        !vips_gaussblur(t[12], &t[15], sigma, NULL) &&
+        !vips_gaussblur(t[13], &t[16], sigma, NULL) &&
+        !vips_add(t[14], t[15], &t[17], NULL) &&
+        !vips_subtract(t[16], t[10], &t[18], NULL)) {
+
+        // numerator = (2 * mu_ab + C1) * (2 * sigma_ab + C2)
+        // denominator = (mu_aa + mu_bb + C1) * (sigma_aa + sigma_bb + C2)
+        // where sigma_aa + sigma_bb = blur(a*a) + blur(b*b) - mu_aa - mu_bb.
+        VipsImage *u[8] = { NULL };
+        if (!vips_linear1(t[10], &u[0], 2.0, c1, NULL) &&
+            !vips_linear1(t[18], &u[1], 2.0, c2, NULL) &&
+            !vips_multiply(u[0], u[1], &u[2], NULL) &&
+            !vips_add(t[8], t[9], &t[19], NULL) &&
+            !vips_linear1(t[19], &u[3], 1.0, c1, NULL) &&
+            !vips_subtract(t[17], t[19], &t[20], NULL) &&
+            !vips_linear1(t[20], &u[4], 1.0, c2, NULL) &&
+            !vips_multiply(u[3], u[4], &u[5], NULL) &&
+            !vips_divide(u[2], u[5], &u[6], NULL) &&
+            !vips_avg(u[6], out, NULL)) {
+            ret = 0;
+        }
+
+        for (int i = 0; i < 8; i++) {
+            if (u[i]) {
+                g_object_unref(u[i]);
+            }
+        }
+    }
+
+    for (int i = 0; i < 21; i++) {
+        if (t[i]) {
+            g_object_unref(t[i]);
+        }
+    }
+
+    return ret;
+}
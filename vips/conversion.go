@@ -6,6 +6,11 @@ package vips
 */
 import "C"
 
+import (
+	"runtime"
+	"unsafe"
+)
+
 // Extend specifies how to extend edges of an image
 type Extend int
 
@@ -39,6 +44,25 @@ const (
 	DirectionVertical   Direction = C.VIPS_DIRECTION_VERTICAL   // top-bottom
 )
 
+// Bandjoin2 appends the bands of other to in.  The images must be the
+// same size.
+func (in *Image) Bandjoin2(other *Image) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_bandjoin2(in.vi, other.vi, &out)
+	runtime.KeepAlive(other)
+	return in.imageError(out, e)
+}
+
+// CompositeOver draws overlay over in, with its top left corner at x, y,
+// blending by overlay's alpha if present.  in keeps its size, bands, and
+// BandFormat.  This requires VIPS 8.6 or later.
+func (in *Image) CompositeOver(overlay *Image, x, y int) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_composite_over(in.vi, overlay.vi, &out, C.int(x), C.int(y))
+	runtime.KeepAlive(overlay)
+	return in.imageError(out, e)
+}
+
 // Cast converts in to BandFormat. Floats are truncated (not rounded). Out of range values are clipped.
 func (in *Image) Cast(format BandFormat) error {
 	var out *C.struct__VipsImage
@@ -53,6 +77,14 @@ func (in *Image) Copy() (*Image, error) {
 	return imageFromVi(out), err
 }
 
+// SetResolution sets the horizontal and vertical resolution of an image,
+// in pixels per millimetre, which some formats save as their density.
+func (in *Image) SetResolution(xres, yres float64) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_copy_resolution(in.vi, &out, C.double(xres), C.double(yres))
+	return in.imageError(out, e)
+}
+
 // Embed in within an image of size width by height at position x, y.
 // Extend controls what appears in the new pixels.
 func (in *Image) Embed(left, top, width, height int, extend Extend) error {
@@ -61,6 +93,38 @@ func (in *Image) Embed(left, top, width, height int, extend Extend) error {
 	return in.imageError(out, e)
 }
 
+// ArrayJoin returns a new Image of images laid out in a grid across images
+// wide, with shim pixels between them, filling any gaps with background,
+// which has a value for each band.
+func ArrayJoin(images []*Image, across, shim int, background []float64) (*Image, error) {
+	if len(images) == 0 {
+		return nil, ErrImageOp
+	}
+
+	in := make([]*C.struct__VipsImage, len(images))
+	for i, image := range images {
+		in[i] = image.vi
+	}
+
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_arrayjoin(&in[0], &out, C.int(len(in)), C.int(across), C.int(shim), (*C.double)(unsafe.Pointer(&background[0])), C.int(len(background)))
+	runtime.KeepAlive(images)
+	if err := vipsError(e); err != nil {
+		return nil, err
+	}
+
+	return imageFromVi(out), nil
+}
+
+// EmbedBackground embeds in within an image of size width by height at
+// position x, y, filling the new pixels with background, which has a value
+// for each band.
+func (in *Image) EmbedBackground(left, top, width, height int, background []float64) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_embed_background(in.vi, &out, C.int(left), C.int(top), C.int(width), C.int(height), (*C.double)(unsafe.Pointer(&background[0])), C.int(len(background)))
+	return in.imageError(out, e)
+}
+
 // ExtractArea extract an area from an image. The area must fit within in.
 func (in *Image) ExtractArea(left, top, width, height int) error {
 	var out *C.struct__VipsImage
@@ -83,6 +147,14 @@ func (in *Image) Flatten() error {
 	return in.imageError(out, e)
 }
 
+// FlattenBackground is like Flatten, but blends with background, which has
+// a value for each band other than alpha.
+func (in *Image) FlattenBackground(background []float64) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_flatten_background(in.vi, &out, (*C.double)(unsafe.Pointer(&background[0])), C.int(len(background)))
+	return in.imageError(out, e)
+}
+
 // Flip an image left-right or up-down.
 func (in *Image) Flip(direction Direction) error {
 	var out *C.struct__VipsImage
@@ -92,7 +164,9 @@ func (in *Image) Flip(direction Direction) error {
 
 // MaxAlpha returns the maximum value for an alpha channel in current BandFormat of image.
 func (in *Image) MaxAlpha() float64 {
-	return float64(C.cgo_max_alpha(in.vi))
+	m := float64(C.cgo_max_alpha(in.vi))
+	runtime.KeepAlive(in)
+	return m
 }
 
 // Premultiply any alpha channel. The final band is taken to be the alpha.
@@ -2,21 +2,89 @@
 #include <vips/vips.h>
 #include <vips/vips7compat.h>
 
+int
+cgo_vips_bandjoin2(VipsImage *in1, VipsImage *in2, VipsImage **out) {
+    return vips_bandjoin2(in1, in2, out, NULL);
+}
+
 int
 cgo_vips_cast(VipsImage *in, VipsImage **out, VipsBandFormat format) {
     return vips_cast(in, out, format, NULL);
 }
 
+int
+cgo_vips_composite_over(VipsImage *base, VipsImage *overlay, VipsImage **out, int x, int y) {
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6)
+    VipsImage *t[4] = {NULL, NULL, NULL, NULL};
+    int e, i;
+
+    // Give opaque overlays an alpha band, so that the transparent canvas
+    // they're embedded in doesn't cover base.
+    if (vips_image_hasalpha(overlay)) {
+        e = vips_copy(overlay, &t[0], NULL);
+    } else {
+        e = vips_bandjoin_const1(overlay, &t[0], 255, NULL);
+    }
+    if (!e) {
+        e = vips_embed(t[0], &t[1], x, y, base->Xsize, base->Ysize, "extend", VIPS_EXTEND_BLACK, NULL);
+    }
+    if (!e) {
+        e = vips_composite2(base, t[1], &t[2], VIPS_BLEND_MODE_OVER, NULL);
+    }
+    // Don't add an alpha band to opaque images.
+    if (!e && !vips_image_hasalpha(base)) {
+        e = vips_extract_band(t[2], &t[3], 0, "n", t[2]->Bands - 1, NULL);
+    } else if (!e) {
+        e = vips_copy(t[2], &t[3], NULL);
+    }
+    if (!e) {
+        e = vips_cast(t[3], out, base->BandFmt, NULL);
+    }
+
+    for (i = 0; i < 4; i++) {
+        if (t[i]) {
+            g_object_unref(t[i]);
+        }
+    }
+    return e;
+#else
+    // Compositing was added in VIPS 8.6.
+    vips_error("composite2", "not supported by this version of libvips");
+    return -1;
+#endif
+}
+
 int
 cgo_vips_copy(VipsImage *in, VipsImage **out) {
     return vips_copy(in, out, NULL);
 }
 
+int
+cgo_vips_copy_resolution(VipsImage *in, VipsImage **out, double xres, double yres) {
+    return vips_copy(in, out, "xres", xres, "yres", yres, NULL);
+}
+
 int
 cgo_vips_embed(VipsImage *in, VipsImage **out, int left, int top, int width, int height, int extend) {
     return vips_embed(in, out, left, top, width, height, "extend", extend, NULL);
 }
 
+int
+cgo_vips_arrayjoin(VipsImage **in, VipsImage **out, int n, int across, int shim, double *background, int bands) {
+    VipsArrayDouble *bg = vips_array_double_new(background, bands);
+    int e = vips_arrayjoin(in, out, n, "across", across, "shim", shim, "background", bg, NULL);
+    vips_area_unref(VIPS_AREA(bg));
+    return e;
+}
+
+int
+cgo_vips_embed_background(VipsImage *in, VipsImage **out, int left, int top, int width, int height, double *background, int n) {
+    VipsArrayDouble *bg = vips_array_double_new(background, n);
+    int e = vips_embed(in, out, left, top, width, height, "extend", VIPS_EXTEND_BACKGROUND, "background", bg, NULL);
+    vips_area_unref(VIPS_AREA(bg));
+    return e;
+}
+
 int
 cgo_vips_extract_area(VipsImage *in, VipsImage **out, int left, int top, int width, int height) {
     return vips_extract_area(in, out, left, top, width, height, NULL);
@@ -45,6 +113,14 @@ cgo_vips_flatten(VipsImage *in, VipsImage **out) {
     return vips_flatten(in, out, "max_alpha", cgo_max_alpha(in), NULL);
 }
 
+int
+cgo_vips_flatten_background(VipsImage *in, VipsImage **out, double *background, int n) {
+    VipsArrayDouble *bg = vips_array_double_new(background, n);
+    int e = vips_flatten(in, out, "max_alpha", cgo_max_alpha(in), "background", bg, NULL);
+    vips_area_unref(VIPS_AREA(bg));
+    return e;
+}
+
 int
 cgo_vips_flip(VipsImage *in, VipsImage **out, VipsDirection direction) {
     return vips_flip(in, out, direction, NULL);
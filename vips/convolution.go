@@ -6,6 +6,10 @@ package vips
 */
 import "C"
 
+import (
+	"runtime"
+)
+
 // Gaussblur creates a circularly symmetric Gaussian mask of radius sigma
 // and performs a separable (two-pass) convolution of in with it.
 func (in *Image) Gaussblur(sigma float64) error {
@@ -21,6 +25,7 @@ func (in *Image) Gaussblur(sigma float64) error {
 func (in *Image) PhotoMetric(threshold float64) (int, error) {
 	var out C.int
 	err := vipsError(C.cgo_photo_metric(in.vi, C.double(threshold), &out))
+	runtime.KeepAlive(in)
 	return int(out), err
 }
 
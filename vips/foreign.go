@@ -7,6 +7,7 @@ package vips
 import "C"
 
 import (
+	"runtime"
 	"unsafe"
 )
 
@@ -26,6 +27,53 @@ func GifloadBuffer(buf []byte) (*Image, error) {
 	return loadError(out, e)
 }
 
+// GifloadBufferPage reads page (frame) number page, counting from 0, of a
+// GIF byte slice into an Image.  Requires VIPS 8.5 for pages other than 0.
+func GifloadBufferPage(buf []byte, page int) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_gifload_buffer_page(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, C.int(page))
+	return loadError(out, e)
+}
+
+// GifsaveBuffer returns an Image as a GIF byte slice, reducing it to a
+// palette of at most 256 colors.  Requires VIPS 8.12 or later built with
+// cgif.
+func (in *Image) GifsaveBuffer(strip bool) ([]byte, error) {
+	var ptr unsafe.Pointer
+	length := C.size_t(0)
+
+	e := C.cgo_vips_gifsave_buffer(in.vi, &ptr, &length, C.int(btoi(strip)))
+	runtime.KeepAlive(in)
+
+	return saveError(ptr, length, e)
+}
+
+// Heifload reads a HEIF or AVIF file into an Image.  Requires VIPS 8.8 or
+// later built with libheif.
+func Heifload(filename string) (*Image, error) {
+	var out *C.struct__VipsImage
+	cf := C.CString(filename)
+	e := C.cgo_vips_heifload(cf, &out)
+	C.free(unsafe.Pointer(cf))
+	return loadError(out, e)
+}
+
+// HeifloadBuffer reads a HEIF or AVIF byte slice into an Image.  Requires
+// VIPS 8.8 or later built with libheif.
+func HeifloadBuffer(buf []byte) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_heifload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out)
+	return loadError(out, e)
+}
+
+// HeifloadBufferPage reads image number page, counting from 0, of a HEIF
+// or AVIF byte slice into an Image.  Requires VIPS 8.8 or later.
+func HeifloadBufferPage(buf []byte, page int) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_heifload_buffer_page(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, C.int(page))
+	return loadError(out, e)
+}
+
 // Jpegload reads and returns a JPEG file as an Image.
 func Jpegload(filename string) (*Image, error) {
 	var out *C.struct__VipsImage
@@ -63,15 +111,39 @@ func JpegloadBufferShrink(buf []byte, shrink int) (*Image, error) {
 	return loadError(out, e)
 }
 
+// Subsample is whether JpegsaveBuffer subsamples chroma, as VIPS 8.10's
+// VipsForeignSubsample, which older VIPS lacks.
+type Subsample int
+
+// Various Subsample values understood by VIPS.
+const (
+	// SubsampleAuto subsamples chroma, except at Q >= 90 with VIPS 8.10
+	// or later.
+	SubsampleAuto Subsample = 0
+	// SubsampleOn always halves chroma resolution (4:2:0).
+	SubsampleOn Subsample = 1
+	// SubsampleOff keeps full chroma resolution (4:4:4).
+	SubsampleOff Subsample = 2
+)
+
 // JpegsaveBuffer write a VIPS image to a byte slice as JPEG.
 // Strip removes all metadata from an image.
 // OptimizeCoding computes and uses optimal Huffman coding tables and attaches them.
 // Interlace write an interlaced (progressive) JPEG.
-func (in *Image) JpegsaveBuffer(strip bool, q int, optimizeCoding, interlace bool) ([]byte, error) {
+// QuantTable selects a preset quantization table, which requires VIPS 8.8
+// and mozjpeg for values other than 0.
+// RestartInterval adds a restart marker every that many MCUs, which
+// requires VIPS 8.15 for values other than 0.
+// Trellis enables mozjpeg's trellis quantization, overshoot deringing, and
+// progressive scan optimization, which are ignored by other libjpegs.
+// Subsample selects chroma subsampling.  Before VIPS 8.10, SubsampleOn is
+// the same as SubsampleAuto.
+func (in *Image) JpegsaveBuffer(strip bool, q int, optimizeCoding, interlace bool, quantTable, restartInterval int, trellis bool, subsample Subsample) ([]byte, error) {
 	var ptr unsafe.Pointer
 	length := C.size_t(0)
 
-	e := C.cgo_vips_jpegsave_buffer(in.vi, &ptr, &length, C.int(btoi(strip)), C.int(q), C.int(btoi(optimizeCoding)), C.int(btoi(interlace)))
+	e := C.cgo_vips_jpegsave_buffer(in.vi, &ptr, &length, C.int(btoi(strip)), C.int(q), C.int(btoi(optimizeCoding)), C.int(btoi(interlace)), C.int(quantTable), C.int(restartInterval), C.int(btoi(trellis)), C.int(subsample))
+	runtime.KeepAlive(in)
 
 	return saveError(ptr, length, e)
 }
@@ -96,11 +168,68 @@ func PngloadBuffer(buf []byte) (*Image, error) {
 // Strip removes all metadata from an image.
 // Compression supplies the gzip level of effort to use (1 - 9).
 // Interlace writes the image with ADAM7 interlacing, which is up to 7x slower.
-func (in *Image) PngsaveBuffer(strip bool, compression int, interlace bool) ([]byte, error) {
+// Colors quantizes the image to a palette of at most this many colors (2 -
+// 256), or 0 to save it in truecolor.  This requires VIPS 8.7 or later built
+// with libimagequant.
+// Dither is the amount of Floyd-Steinberg dithering used when quantizing
+// (0 - 1).
+func (in *Image) PngsaveBuffer(strip bool, compression int, interlace bool, colors int, dither float64) ([]byte, error) {
 	var ptr unsafe.Pointer
 	length := C.size_t(0)
 
-	e := C.cgo_vips_pngsave_buffer(in.vi, &ptr, &length, C.int(btoi(strip)), C.int(compression), C.int(btoi(interlace)))
+	e := C.cgo_vips_pngsave_buffer(in.vi, &ptr, &length, C.int(btoi(strip)), C.int(compression), C.int(btoi(interlace)), C.int(colors), C.double(dither))
+	runtime.KeepAlive(in)
+
+	return saveError(ptr, length, e)
+}
+
+// TiffCompression is how TiffsaveBuffer compresses an image.
+type TiffCompression int
+
+// Various TiffCompression values understood by VIPS.
+const (
+	TiffCompressionNone    TiffCompression = C.VIPS_FOREIGN_TIFF_COMPRESSION_NONE
+	TiffCompressionJpeg    TiffCompression = C.VIPS_FOREIGN_TIFF_COMPRESSION_JPEG
+	TiffCompressionDeflate TiffCompression = C.VIPS_FOREIGN_TIFF_COMPRESSION_DEFLATE
+	TiffCompressionLzw     TiffCompression = C.VIPS_FOREIGN_TIFF_COMPRESSION_LZW
+)
+
+// Tiffload reads the first page of a TIFF file into an Image.
+func Tiffload(filename string) (*Image, error) {
+	var out *C.struct__VipsImage
+	cf := C.CString(filename)
+	e := C.cgo_vips_tiffload(cf, &out)
+	C.free(unsafe.Pointer(cf))
+	return loadError(out, e)
+}
+
+// TiffloadBuffer reads the first page of a TIFF byte slice into an Image.
+func TiffloadBuffer(buf []byte) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_tiffload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out)
+	return loadError(out, e)
+}
+
+// TiffloadBufferPage reads page number page, counting from 0, of a TIFF
+// byte slice into an Image.
+func TiffloadBufferPage(buf []byte, page int) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_tiffload_buffer_page(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, C.int(page))
+	return loadError(out, e)
+}
+
+// TiffsaveBuffer returns an Image compressed as a tiled, pyramidal TIFF,
+// such as for deep zoom viewers, as a byte slice.  Each level of the
+// pyramid is half the size of the one before, down to a single tile.
+// Tiles are tileSize pixels square, which must be a multiple of 16.  q is
+// the quality when compression is TiffCompressionJpeg.  This requires VIPS
+// 8.5 or later.
+func (in *Image) TiffsaveBuffer(strip bool, q, tileSize int, compression TiffCompression) ([]byte, error) {
+	var ptr unsafe.Pointer
+	length := C.size_t(0)
+
+	e := C.cgo_vips_tiffsave_buffer(in.vi, &ptr, &length, C.int(btoi(strip)), C.int(q), C.int(tileSize), C.VipsForeignTiffCompression(compression))
+	runtime.KeepAlive(in)
 
 	return saveError(ptr, length, e)
 }
@@ -141,14 +270,25 @@ func WebploadBufferShrink(buf []byte, shrink int) (*Image, error) {
 	return loadError(out, e)
 }
 
+// WebploadBufferPage reads frame number page, counting from 0, of an
+// animated WebP byte slice into an Image.  Requires VIPS 8.8 for pages
+// other than 0.
+func WebploadBufferPage(buf []byte, page int) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_webpload_buffer_page(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, C.int(page))
+	return loadError(out, e)
+}
+
 // WebpsaveBuffer writes an Image to a WebP byte slice.
+// Strip removes all metadata from an image.
 // Q specifies the compression factor for RGB channels between 0 and 100.
 // Lossless encodes the image without any loss, at a large file size.
-func (in *Image) WebpsaveBuffer(q int, lossless bool) ([]byte, error) {
+func (in *Image) WebpsaveBuffer(strip bool, q int, lossless bool) ([]byte, error) {
 	var ptr unsafe.Pointer
 	length := C.size_t(0)
 
-	e := C.cgo_vips_webpsave_buffer(in.vi, &ptr, &length, C.int(q), C.int(btoi(lossless)))
+	e := C.cgo_vips_webpsave_buffer(in.vi, &ptr, &length, C.int(btoi(strip)), C.int(q), C.int(btoi(lossless)))
+	runtime.KeepAlive(in)
 
 	return saveError(ptr, length, e)
 }
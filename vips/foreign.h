@@ -12,6 +12,64 @@ cgo_vips_gifload_buffer(void *buf, size_t len, VipsImage **out) {
     return vips_gifload_buffer(buf, len, out, NULL);
 }
 
+int
+cgo_vips_gifload_buffer_page(void *buf, size_t len, VipsImage **out, int page) {
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 5)
+    return vips_gifload_buffer(buf, len, out, "page", page, NULL);
+#else
+    // Loading pages other than the first was added in VIPS 8.5.
+    if (page != 0) {
+        vips_error("gifload_buffer", "page not supported by this version of libvips");
+        return -1;
+    }
+    return vips_gifload_buffer(buf, len, out, NULL);
+#endif
+}
+
+int
+cgo_vips_gifsave_buffer(VipsImage *in, void **buf, size_t *len, int strip) {
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 12)
+    return vips_gifsave_buffer(in, buf, len, "strip", strip, NULL);
+#else
+    // GIF saving was added in VIPS 8.12.
+    vips_error("gifsave_buffer", "not supported by this version of libvips");
+    return -1;
+#endif
+}
+
+// HEIF and AVIF loading were added in VIPS 8.8.
+#define CGO_VIPS_HAS_HEIFLOAD (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
+
+int
+cgo_vips_heifload(const char *filename, VipsImage **out) {
+#if CGO_VIPS_HAS_HEIFLOAD
+    return vips_heifload(filename, out, NULL);
+#else
+    vips_error("heifload", "not supported by this version of libvips");
+    return -1;
+#endif
+}
+
+int
+cgo_vips_heifload_buffer(void *buf, size_t len, VipsImage **out) {
+#if CGO_VIPS_HAS_HEIFLOAD
+    return vips_heifload_buffer(buf, len, out, NULL);
+#else
+    vips_error("heifload_buffer", "not supported by this version of libvips");
+    return -1;
+#endif
+}
+
+int
+cgo_vips_heifload_buffer_page(void *buf, size_t len, VipsImage **out, int page) {
+#if CGO_VIPS_HAS_HEIFLOAD
+    return vips_heifload_buffer(buf, len, out, "page", page, NULL);
+#else
+    vips_error("heifload_buffer", "not supported by this version of libvips");
+    return -1;
+#endif
+}
+
 int
 cgo_vips_jpegload(const char *filename, VipsImage **out, int shrink) {
     return vips_jpegload(filename, out, "access", VIPS_ACCESS_SEQUENTIAL, "shrink", shrink, NULL);
@@ -22,9 +80,38 @@ cgo_vips_jpegload_buffer(void *buf, size_t len, VipsImage **out, int shrink) {
     return vips_jpegload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "shrink", shrink, NULL);
 }
 
+// Chroma subsampling was made selectable in VIPS 8.10, which also stopped
+// subsampling by default at Q >= 90.  Before then, it could only be disabled.
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 10)
+#define CGO_VIPS_SUBSAMPLE(mode) "subsample_mode", (mode)
+#else
+#define CGO_VIPS_SUBSAMPLE(mode) "no_subsample", (mode) == 2
+#endif
+
 int
-cgo_vips_jpegsave_buffer(VipsImage *in, void **buf, size_t *len, int strip, int q, int optimize_coding, int interlace) {
-    return vips_jpegsave_buffer(in, buf, len, "strip", strip, "Q", q, "optimize_coding", optimize_coding, "interlace", interlace, NULL);
+cgo_vips_jpegsave_buffer(VipsImage *in, void **buf, size_t *len, int strip, int q, int optimize_coding, int interlace, int quant_table, int restart_interval, int trellis, int subsample) {
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 15)
+    return vips_jpegsave_buffer(in, buf, len, "strip", strip, "Q", q, "optimize_coding", optimize_coding, "interlace", interlace, "quant_table", quant_table, "restart_interval", restart_interval,
+                                "trellis_quant", trellis, "overshoot_deringing", trellis, "optimize_scans", trellis && interlace, CGO_VIPS_SUBSAMPLE(subsample), NULL);
+#else
+    // Restart markers were added in VIPS 8.15.
+    if (restart_interval != 0) {
+        vips_error("jpegsave_buffer", "restart_interval not supported by this version of libvips");
+        return -1;
+    }
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8)
+    return vips_jpegsave_buffer(in, buf, len, "strip", strip, "Q", q, "optimize_coding", optimize_coding, "interlace", interlace, "quant_table", quant_table,
+                                "trellis_quant", trellis, "overshoot_deringing", trellis, "optimize_scans", trellis && interlace, CGO_VIPS_SUBSAMPLE(subsample), NULL);
+#else
+    // Quantization table presets were added in VIPS 8.8.
+    if (quant_table != 0) {
+        vips_error("jpegsave_buffer", "quant_table not supported by this version of libvips");
+        return -1;
+    }
+    return vips_jpegsave_buffer(in, buf, len, "strip", strip, "Q", q, "optimize_coding", optimize_coding, "interlace", interlace,
+                                "trellis_quant", trellis, "overshoot_deringing", trellis, "optimize_scans", trellis && interlace, CGO_VIPS_SUBSAMPLE(subsample), NULL);
+#endif
+#endif
 }
 
 int
@@ -38,8 +125,45 @@ cgo_vips_pngload_buffer(void *buf, size_t len, VipsImage **out) {
 }
 
 int
-cgo_vips_pngsave_buffer(VipsImage *in, void **buf, size_t *len, int strip, int compression, int interlace) {
-    return vips_pngsave_buffer(in, buf, len, "strip", strip, "compression", compression, "interlace", interlace, NULL);
+cgo_vips_pngsave_buffer(VipsImage *in, void **buf, size_t *len, int strip, int compression, int interlace, int colours, double dither) {
+    if (colours == 0) {
+        return vips_pngsave_buffer(in, buf, len, "strip", strip, "compression", compression, "interlace", interlace, NULL);
+    }
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7)
+    return vips_pngsave_buffer(in, buf, len, "strip", strip, "compression", compression, "interlace", interlace,
+                               "palette", TRUE, "colours", colours, "dither", dither, NULL);
+#else
+    // Palette quantization was added in VIPS 8.7.
+    vips_error("pngsave_buffer", "palette not supported by this version of libvips");
+    return -1;
+#endif
+}
+
+int
+cgo_vips_tiffload(const char *filename, VipsImage **out) {
+    return vips_tiffload(filename, out, NULL);
+}
+
+int
+cgo_vips_tiffload_buffer(void *buf, size_t len, VipsImage **out) {
+    return vips_tiffload_buffer(buf, len, out, NULL);
+}
+
+int
+cgo_vips_tiffload_buffer_page(void *buf, size_t len, VipsImage **out, int page) {
+    return vips_tiffload_buffer(buf, len, out, "page", page, NULL);
+}
+
+int
+cgo_vips_tiffsave_buffer(VipsImage *in, void **buf, size_t *len, int strip, int q, int tile_size, VipsForeignTiffCompression compression) {
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 5)
+    return vips_tiffsave_buffer(in, buf, len, "strip", strip, "Q", q, "compression", compression,
+                                "tile", TRUE, "tile_width", tile_size, "tile_height", tile_size, "pyramid", TRUE, NULL);
+#else
+    // TIFF saving to a buffer was added in VIPS 8.5.
+    vips_error("tiffsave_buffer", "not supported by this version of libvips");
+    return -1;
+#endif
 }
 
 int
@@ -53,6 +177,25 @@ cgo_vips_webpload_buffer(void *buf, size_t len, VipsImage **out, int shrink) {
 }
 
 int
-cgo_vips_webpsave_buffer(VipsImage *in, void **buf, size_t *len, int q, int lossless) {
+cgo_vips_webpload_buffer_page(void *buf, size_t len, VipsImage **out, int page) {
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8)
+    return vips_webpload_buffer(buf, len, out, "page", page, NULL);
+#else
+    // Animated WebP loading was added in VIPS 8.8.
+    if (page != 0) {
+        vips_error("webpload_buffer", "page not supported by this version of libvips");
+        return -1;
+    }
+    return vips_webpload_buffer(buf, len, out, NULL);
+#endif
+}
+
+int
+cgo_vips_webpsave_buffer(VipsImage *in, void **buf, size_t *len, int strip, int q, int lossless) {
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6)
+    return vips_webpsave_buffer(in, buf, len, "strip", strip, "Q", q, "lossless", lossless, NULL);
+#else
+    // WebP metadata was added in VIPS 8.6, so there's nothing to strip.
     return vips_webpsave_buffer(in, buf, len, "Q", q, "lossless", lossless, NULL);
+#endif
 }
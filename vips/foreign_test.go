@@ -0,0 +1,62 @@
+package vips
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestJpegloadBufferShrink(t *testing.T) {
+	buf, err := ioutil.ReadFile(testdataPath + "watermelon.jpg")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	for _, shrink := range []int{1, 2, 4, 8} {
+		img, err := JpegloadBufferShrink(buf, shrink)
+		if assert.Nil(t, err, "shrink: %d", shrink) {
+			assert.Equal(t, (398+shrink-1)/shrink, img.Xsize(), "shrink: %d", shrink)
+			assert.Equal(t, (536+shrink-1)/shrink, img.Ysize(), "shrink: %d", shrink)
+			img.Close()
+		}
+	}
+}
+
+func BenchmarkJpegloadBuffer(b *testing.B) {
+	benchJpegloadBufferShrink(b, 1)
+}
+
+func BenchmarkJpegloadBufferShrink_2(b *testing.B) {
+	benchJpegloadBufferShrink(b, 2)
+}
+
+func BenchmarkJpegloadBufferShrink_4(b *testing.B) {
+	benchJpegloadBufferShrink(b, 4)
+}
+
+func BenchmarkJpegloadBufferShrink_8(b *testing.B) {
+	benchJpegloadBufferShrink(b, 8)
+}
+
+// benchJpegloadBufferShrink decodes watermelon.jpg, shrinking on load.
+// Loading is lazy, so Write forces the decode.
+func benchJpegloadBufferShrink(b *testing.B, shrink int) {
+	buf, err := ioutil.ReadFile(testdataPath + "watermelon.jpg")
+	if !assert.Nil(b, err) {
+		return
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			img, err := JpegloadBufferShrink(buf, shrink)
+			if !assert.Nil(b, err) {
+				continue
+			}
+			assert.Nil(b, img.Write())
+			img.Close()
+		}
+	})
+}
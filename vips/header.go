@@ -7,13 +7,20 @@ package vips
 import "C"
 
 import (
+	"runtime"
 	"unsafe"
 )
 
-// Potential values for ImageGetAsString.
+// Potential values for ImageGetAsString, ImageGetInt, ImageSetInt, and
+// ImageGetBlob.
 const (
 	ExifOrientation = "exif-ifd0-Orientation"
+	MetaExifName    = "exif-data"
 	MetaIccName     = "icc-profile-data"
+	MetaIptcName    = "ipct-data" // Sic, as VIPS names it.
+	MetaNPages      = "n-pages"
+	MetaOrientation = "orientation"
+	MetaXmpName     = "xmp-data"
 )
 
 // BandFormat is the format used for each band element.  Each corresponds to
@@ -40,6 +47,7 @@ func (in *Image) ImageFieldExists(field string) bool {
 	cf := C.CString(field)
 	e := C.vips_image_get_typeof(in.vi, cf)
 	C.free(unsafe.Pointer(cf))
+	runtime.KeepAlive(in)
 
 	return e != 0
 }
@@ -53,25 +61,102 @@ func (in *Image) ImageGetAsString(field string) (string, bool) {
 	C.free(unsafe.Pointer(cf))
 
 	s := C.GoString(out)
+	runtime.KeepAlive(in)
 	// TODO: Leak? Crash if I follow docs and: C.g_free(C.gpointer(out))
 
 	return s, e == 0
 }
 
+// ImageGetInt returns the contents of Image's integer metadata field along
+// with a bool which will be true on success.
+func (in *Image) ImageGetInt(field string) (int, bool) {
+	var out C.int
+	cf := C.CString(field)
+	e := C.cgo_vips_image_get_int(in.vi, cf, &out)
+	C.free(unsafe.Pointer(cf))
+	runtime.KeepAlive(in)
+
+	return int(out), e == 0
+}
+
+// ImageSetInt sets Image's integer metadata field to value.
+func (in *Image) ImageSetInt(field string, value int) {
+	cf := C.CString(field)
+	C.vips_image_set_int(in.vi, cf, C.int(value))
+	C.free(unsafe.Pointer(cf))
+	runtime.KeepAlive(in)
+}
+
+// ImageGetBlob returns a copy of the contents of Image's binary metadata
+// field along with a bool which will be true on success.
+func (in *Image) ImageGetBlob(field string) ([]byte, bool) {
+	var data unsafe.Pointer
+	length := C.size_t(0)
+	cf := C.CString(field)
+	e := C.cgo_vips_image_get_blob(in.vi, cf, &data, &length)
+	C.free(unsafe.Pointer(cf))
+
+	if e != 0 {
+		return nil, false
+	}
+
+	blob := C.GoBytes(data, C.int(length))
+	runtime.KeepAlive(in)
+
+	return blob, true
+}
+
+// ImageSetBlob sets Image's binary metadata field to a copy of data.
+// Requires VIPS 8.7 or later.
+func (in *Image) ImageSetBlob(field string, data []byte) error {
+	if len(data) == 0 {
+		return ErrImageOp
+	}
+
+	cf := C.CString(field)
+	e := C.cgo_vips_image_set_blob(in.vi, cf, unsafe.Pointer(&data[0]), C.size_t(len(data)))
+	C.free(unsafe.Pointer(cf))
+	runtime.KeepAlive(in)
+
+	return vipsError(e)
+}
+
 // ImageGetBands returns the number of bands (channels) in the image.
 func (in *Image) ImageGetBands() int {
-	return int(C.vips_image_get_bands(in.vi))
+	b := int(C.vips_image_get_bands(in.vi))
+	runtime.KeepAlive(in)
+	return b
 }
 
 // ImageGetBandFormat returns the BandFormat of each band element.
 func (in *Image) ImageGetBandFormat() BandFormat {
-	return BandFormat(C.vips_image_get_format(in.vi))
+	f := BandFormat(C.vips_image_get_format(in.vi))
+	runtime.KeepAlive(in)
+	return f
+}
+
+// ImageGetXres returns the horizontal resolution of the image in pixels
+// per millimetre.
+func (in *Image) ImageGetXres() float64 {
+	r := float64(C.vips_image_get_xres(in.vi))
+	runtime.KeepAlive(in)
+	return r
+}
+
+// ImageGetYres returns the vertical resolution of the image in pixels per
+// millimetre.
+func (in *Image) ImageGetYres() float64 {
+	r := float64(C.vips_image_get_yres(in.vi))
+	runtime.KeepAlive(in)
+	return r
 }
 
 // ImageGuessInterpretation returns the Interpretation for an image,
 // guessing a sane value if the set value looks crazy.
 func (in *Image) ImageGuessInterpretation() Interpretation {
-	return Interpretation(C.vips_image_guess_interpretation(in.vi))
+	i := Interpretation(C.vips_image_guess_interpretation(in.vi))
+	runtime.KeepAlive(in)
+	return i
 }
 
 // HasAlpha returns true if the image's last band is an alpha channel.
@@ -79,7 +164,7 @@ func (in *Image) HasAlpha() bool {
 	b := in.ImageGetBands()
 	i := in.ImageGuessInterpretation()
 
-	alpha := (b == 2 && i == InterpretationBW) ||
+	alpha := (b == 2 && (i == InterpretationBW || i == InterpretationGrey16)) ||
 		(b == 4 && i != InterpretationCMYK) ||
 		(b == 5 && i == InterpretationCMYK)
 	return alpha
@@ -91,6 +176,7 @@ func (in *Image) ImageRemove(field string) bool {
 	cf := C.CString(field)
 	ok := C.vips_image_remove(in.vi, cf)
 	C.free(unsafe.Pointer(cf))
+	runtime.KeepAlive(in)
 
 	return ok != 0
 }
@@ -9,3 +9,31 @@ cgo_vips_image_get_as_string(const VipsImage *image, const char *field, const ch
     }
     return -1;
 }
+
+int
+cgo_vips_image_get_int(const VipsImage *image, const char *field, int *out) {
+    if (vips_image_get_typeof(image, field) != 0 && !vips_image_get_int(image, field, out)) {
+        return 0;
+    }
+    return -1;
+}
+
+int
+cgo_vips_image_get_blob(const VipsImage *image, const char *field, void **data, size_t *length) {
+    if (vips_image_get_typeof(image, field) != 0 && !vips_image_get_blob(image, field, (const void **) data, length)) {
+        return 0;
+    }
+    return -1;
+}
+
+int
+cgo_vips_image_set_blob(VipsImage *image, const char *field, void *data, size_t length) {
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7)
+    vips_image_set_blob_copy(image, field, data, length);
+    return 0;
+#else
+    // Copying blobs into metadata was added in VIPS 8.7.
+    vips_error("image_set_blob", "setting blobs not supported by this version of libvips");
+    return -1;
+#endif
+}
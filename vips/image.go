@@ -8,6 +8,16 @@ package vips
 */
 import "C"
 
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// leakedImages counts Images that were garbage collected without Close.
+var leakedImages int64
+
 // Image can represent an image on disc, a memory buffer, or a partially
 // evaluated image in memory, represented as its source data and chain of
 // operations to be performed on that image later.
@@ -20,7 +30,33 @@ func imageFromVi(vi *C.struct__VipsImage) *Image {
 		return nil
 	}
 
-	return &Image{vi: vi}
+	in := &Image{vi: vi}
+	runtime.SetFinalizer(in, (*Image).finalize)
+	return in
+}
+
+// finalize frees an Image that was garbage collected without being closed.
+// Until then, its possibly large buffers were held outside of the Go heap,
+// so log a warning to help find the missing Close.
+func (in *Image) finalize() {
+	atomic.AddInt64(&leakedImages, 1)
+	log.Printf("vips: %dx%d Image was garbage collected without Close", in.Xsize(), in.Ysize())
+	in.Close()
+}
+
+// NewImageFromMemory returns an Image holding a copy of data, which is
+// width by height pixels of bands elements each in BandFormat format.
+func NewImageFromMemory(data []byte, width, height, bands int, format BandFormat) (*Image, error) {
+	if len(data) == 0 {
+		return nil, ErrImageOp
+	}
+
+	vi := C.vips_image_new_from_memory_copy(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(width), C.int(height), C.int(bands), C.VipsBandFormat(format))
+	if vi == nil {
+		return nil, vipsError(-1)
+	}
+
+	return imageFromVi(vi), nil
 }
 
 // Xsize returns the width of the image in pixels.
@@ -41,10 +77,45 @@ func (in *Image) Write() error {
 	return in.imageError(out, e)
 }
 
-// Close frees the memory associated with an Image.
+// WriteToMemory applies all queued operations to the image and returns its
+// pixels, row by row, with the bands of each pixel interleaved.
+func (in *Image) WriteToMemory() ([]byte, error) {
+	var size C.size_t
+	data := C.vips_image_write_to_memory(in.vi, &size)
+	runtime.KeepAlive(in)
+	if data == nil {
+		return nil, vipsError(-1)
+	}
+	defer C.g_free(C.gpointer(data))
+
+	return C.GoBytes(data, C.int(size)), nil
+}
+
+// Close frees the memory associated with an Image.  It is safe to call
+// Close more than once; subsequent calls do nothing.
 func (in *Image) Close() {
+	if in == nil || in.vi == nil {
+		return
+	}
+
 	C.g_object_unref(C.gpointer(in.vi))
 	*in = Image{}
+	runtime.SetFinalizer(in, nil)
+}
+
+// Replace frees the image that in holds, if any, and moves from's into it,
+// leaving from closed.  This lets in be reused for many images in a row,
+// with only in ever needing a finalizer.
+func (in *Image) Replace(from *Image) {
+	if in.vi == nil {
+		runtime.SetFinalizer(in, (*Image).finalize)
+	} else {
+		C.g_object_unref(C.gpointer(in.vi))
+	}
+	in.vi = from.vi
+
+	*from = Image{}
+	runtime.SetFinalizer(from, nil)
 }
 
 // imageError adapts image modification semantics from being the VIPS-style
@@ -0,0 +1,59 @@
+package vips
+
+import (
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testdataPath = "../testdata/"
+
+func TestCloseTwice(t *testing.T) {
+	img, err := Pngload(testdataPath + "2px.png")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, img.Xsize(), 2)
+
+	assert.NotPanics(t, img.Close)
+	assert.Nil(t, img.vi)
+
+	// The second Close does nothing.
+	assert.NotPanics(t, img.Close)
+	assert.Nil(t, img.vi)
+
+	var nilImage *Image
+	assert.NotPanics(t, nilImage.Close)
+}
+
+func TestFinalizer(t *testing.T) {
+	before := atomic.LoadInt64(&leakedImages)
+
+	// Forget to Close an Image.
+	func() {
+		img, err := Pngload(testdataPath + "2px.png")
+		if assert.Nil(t, err) {
+			assert.Equal(t, img.Xsize(), 2)
+		}
+	}()
+
+	// Finalizers run in their own goroutine after a GC.
+	for i := 0; i < 100 && atomic.LoadInt64(&leakedImages) == before; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, atomic.LoadInt64(&leakedImages), before+1)
+
+	// Closed Images aren't finalized.
+	img, err := Pngload(testdataPath + "2px.png")
+	if assert.Nil(t, err) {
+		img.Close()
+	}
+	img = nil
+	runtime.GC()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, atomic.LoadInt64(&leakedImages), before+1)
+}
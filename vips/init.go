@@ -10,10 +10,16 @@ package vips
 import "C"
 
 import (
+	"errors"
 	"os"
 	"runtime"
+	"strconv"
+	"unsafe"
 )
 
+// ErrNotDirectory is returned by SetTempDir if the path isn't a directory.
+var ErrNotDirectory = errors.New("Not a directory")
+
 // Initialize starts up the world of VIPS. You should call this on program
 // startup before using any other VIPS operations.
 func Initialize() {
@@ -32,6 +38,57 @@ func Initialize() {
 	C.vips_cache_set_max(0)
 }
 
+// SetTempDir sets the directory VIPS uses for temporary files, such as
+// large intermediate images that are spilled to disk rather than held in
+// memory.  The default is $TMPDIR, or /tmp if that isn't set.  VIPS has no
+// setting of its own for this, so it sets TMPDIR in the C environment only:
+// Go's os.Getenv and os.TempDir, and child processes such as ffmpeg, don't
+// see it, but other C libraries in this process do.  Changing the
+// environment isn't safe while VIPS may be reading it, so this must be
+// called before any images are processed.
+func SetTempDir(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return ErrNotDirectory
+	}
+
+	return setenvC("TMPDIR", path)
+}
+
+// SetDiscThreshold sets the size in bytes above which decompressed images
+// are spilled to a temporary file instead of held in memory.  VIPS reads
+// this once, so it must be called before the first image is loaded.  The
+// default is 100MB, and 0 means to never use disk.
+func SetDiscThreshold(bytes int64) error {
+	return os.Setenv("VIPS_DISC_THRESHOLD", strconv.FormatInt(bytes, 10))
+}
+
+// setenvC sets key to value in the C environment, which Go keeps a
+// separate copy of.
+func setenvC(key, value string) error {
+	ck := C.CString(key)
+	cv := C.CString(value)
+	r, err := C.setenv(ck, cv, 1)
+	C.free(unsafe.Pointer(cv))
+	C.free(unsafe.Pointer(ck))
+
+	if r != 0 {
+		return err
+	}
+	return nil
+}
+
+// getenvC returns the value of key in the C environment, or "" if unset.
+func getenvC(key string) string {
+	ck := C.CString(key)
+	defer C.free(unsafe.Pointer(ck))
+
+	return C.GoString(C.getenv(ck))
+}
+
 // LeakSet turns leak checking on or off.  You should call this very early
 // in your program.
 func LeakSet(enable bool) {
@@ -52,3 +109,27 @@ func ThreadShutdown() {
 func Shutdown() {
 	C.vips_shutdown()
 }
+
+// Version returns the version of the VIPS library in use, such as "8.6.5".
+func Version() string {
+	return C.GoString(C.vips_version_string())
+}
+
+// TrackedMem returns the number of bytes VIPS currently has allocated for
+// pixel buffers, across all threads.
+func TrackedMem() int64 {
+	return int64(C.vips_tracked_get_mem())
+}
+
+// OperationExists returns true if the VIPS library in use provides an
+// operation with the given nickname, such as "webpload_buffer".  Which
+// operations exist depends on how VIPS was built.
+func OperationExists(nickname string) bool {
+	cb := C.CString("VipsOperation")
+	cn := C.CString(nickname)
+	t := C.vips_type_find(cb, cn)
+	C.free(unsafe.Pointer(cn))
+	C.free(unsafe.Pointer(cb))
+
+	return t != 0
+}
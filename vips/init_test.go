@@ -0,0 +1,49 @@
+package vips
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	Initialize()
+	LeakSet(true)
+	r := m.Run()
+	ThreadShutdown()
+	Shutdown()
+	os.Exit(r)
+}
+
+func TestSetTempDir(t *testing.T) {
+	// Go's environment isn't changed, so its TempDir is what VIPS used.
+	defer SetTempDir(os.TempDir())
+
+	dir, err := ioutil.TempDir("", "vipstemp")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.Remove(dir)
+
+	assert.Nil(t, SetTempDir(dir))
+	assert.Equal(t, dir, getenvC("TMPDIR"))
+	assert.NotEqual(t, dir, os.Getenv("TMPDIR"))
+
+	f, err := ioutil.TempFile(dir, "file")
+	if assert.Nil(t, err) {
+		_ = f.Close()
+		defer os.Remove(f.Name())
+		assert.Equal(t, ErrNotDirectory, SetTempDir(f.Name()))
+	}
+
+	assert.NotNil(t, SetTempDir(dir+"/missing"))
+	assert.Equal(t, dir, getenvC("TMPDIR"))
+}
+
+func TestSetDiscThreshold(t *testing.T) {
+	defer os.Setenv("VIPS_DISC_THRESHOLD", os.Getenv("VIPS_DISC_THRESHOLD"))
+
+	assert.Nil(t, SetDiscThreshold(1<<30))
+	assert.Equal(t, os.Getenv("VIPS_DISC_THRESHOLD"), "1073741824")
+}
@@ -57,6 +57,27 @@ func (in *Image) Resize(xscale, yscale float64) error {
 	return in.imageError(out, e)
 }
 
+// Kernel is the interpolation kernel used by ResizeKernel.
+type Kernel int
+
+// Various Kernel values understood by VIPS.
+const (
+	KernelNearest  Kernel = C.VIPS_KERNEL_NEAREST  // nearest neighbour
+	KernelLinear   Kernel = C.VIPS_KERNEL_LINEAR   // linear interpolation
+	KernelCubic    Kernel = C.VIPS_KERNEL_CUBIC    // cubic interpolation
+	KernelLanczos2 Kernel = C.VIPS_KERNEL_LANCZOS2 // two-lobe Lanczos
+	KernelLanczos3 Kernel = C.VIPS_KERNEL_LANCZOS3 // three-lobe Lanczos, Resize's default
+)
+
+// ResizeKernel is Resize, but with a given Kernel.  When upsizing, this
+// chooses the interpolator: nearest for KernelNearest, bilinear for
+// KernelLinear, and otherwise bicubic.
+func (in *Image) ResizeKernel(xscale, yscale float64, kernel Kernel) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_resize_kernel(in.vi, &out, C.double(xscale), C.double(yscale), C.VipsKernel(kernel))
+	return in.imageError(out, e)
+}
+
 // Shrink in by a pair of factors with a simple box filter.  You will get
 // aliasing for non-integer shrinks.  In this case, shrink with this
 // function to the nearest integer size above the target shrink, then
@@ -13,6 +13,11 @@ cgo_vips_resize(VipsImage *in, VipsImage **out, double xscale, double yscale) {
     return vips_resize(in, out, xscale, "vscale", yscale, "centre", TRUE, NULL);
 }
 
+int
+cgo_vips_resize_kernel(VipsImage *in, VipsImage **out, double xscale, double yscale, VipsKernel kernel) {
+    return vips_resize(in, out, xscale, "vscale", yscale, "centre", TRUE, "kernel", kernel, NULL);
+}
+
 int
 cgo_vips_shrink(VipsImage *in, VipsImage **out, double xshrink, double yshrink) {
     return vips_shrink(in, out, xshrink, yshrink, NULL);